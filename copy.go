@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// copyImage implements the "copy" subcommand, which copies an
+// existing built image to other LXD remotes without rebuilding it.
+func copyImage(args []string) error {
+	fs := flag.NewFlagSet("copy", flag.ExitOnError)
+	from := fs.String("from", "", "LXD remote to copy the image from (default: the default remote)")
+	public := fs.Bool("public", false, "Mark the copied images as public")
+	limitRate := fs.String("limit-rate", "", "Bandwidth limit, per second (e.g. 10MiB), for the copies, which are then relayed through this host")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s copy [-from remote] [-public] [-limit-rate rate] <alias> <remote>...\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var targets []string
+	for _, target := range fs.Args()[1:] {
+		targets = append(targets, strings.TrimSuffix(target, ":"))
+	}
+	ctx := context.Background()
+	if *limitRate != "" {
+		rate, err := imagebuilder.ParseSize(*limitRate)
+		if err != nil {
+			return err
+		}
+		ctx = imagebuilder.WithRateLimit(ctx, rate)
+	}
+	return imagebuilder.CopyImage(
+		ctx, fs.Arg(0),
+		strings.TrimSuffix(*from, ":"), targets, *public,
+	)
+}
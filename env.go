@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the names of the environment variables
+// that flags, of builds and subcommands alike, may be set with.
+const envPrefix = "JLIB_"
+
+// flagEnvVar returns the name of the environment variable that
+// sets the named flag, e.g. JLIB_KEEP_SERIALS for -keep-serials.
+func flagEnvVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets the flags in fs that were not specified on
+// the command line from their environment variables (see flagEnvVar),
+// if set. If names are given, only those flags are considered. Flags
+// that may be repeated take a single value from the environment.
+func setFlagsFromEnv(fs *flag.FlagSet, names ...string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || len(names) > 0 && !contains(names, f.Name) {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvVar(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid $%s: %v", flagEnvVar(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	defer os.Unsetenv("JLIB_TOKEN_FILE")
+	defer os.Unsetenv("JLIB_LISTEN")
+	os.Setenv("JLIB_TOKEN_FILE", "/etc/image-builder/token")
+	os.Setenv("JLIB_LISTEN", "0.0.0.0:8080")
+
+	// As for a subcommand's flags.
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", "localhost:8080", "")
+	tokenFile := fs.String("token-file", "", "")
+	if err := fs.Parse([]string{"-listen", "localhost:9090"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *tokenFile != "/etc/image-builder/token" {
+		t.Errorf("got -token-file %q, expected it from $JLIB_TOKEN_FILE", *tokenFile)
+	}
+	if *listen != "localhost:9090" {
+		t.Errorf("got -listen %q, expected the command line to override $JLIB_LISTEN", *listen)
+	}
+}
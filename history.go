@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// showHistory implements the "history" subcommand, which lists the
+// builds recorded in the history file, most recent first.
+func showHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	historyFile := fs.String("history-file", imagebuilder.DefaultHistoryFile(), "File builds are recorded in")
+	alias := fs.String("alias", "", "Only list builds of this alias")
+	n := fs.Int("n", 20, "Number of builds to list, or 0 for all")
+	jsonOutput := fs.Bool("json", false, "Print the records as JSON lines, including the build options")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s history [-alias alias] [-n count] [-json]\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	records, err := imagebuilder.ReadHistory(*historyFile)
+	if err != nil {
+		return err
+	}
+	var selected []imagebuilder.HistoryRecord
+	for i := len(records) - 1; i >= 0 && (*n <= 0 || len(selected) < *n); i-- {
+		if *alias == "" || records[i].Alias == *alias {
+			selected = append(selected, records[i])
+		}
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		for _, rec := range selected {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tSTATUS\tDURATION\tALIAS\tSERIAL\tFINGERPRINT")
+	for _, rec := range selected {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.12s\n",
+			rec.Started.Local().Format(time.RFC3339),
+			rec.Status,
+			rec.Duration.Round(time.Second),
+			rec.Alias,
+			orDash(rec.Serial),
+			orDash(rec.Fingerprint),
+		)
+	}
+	return tw.Flush()
+}
+
+// pruneHistory implements the "prune" subcommand, which removes old
+// builds from the history file.
+func pruneHistory(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	historyFile := fs.String("history-file", imagebuilder.DefaultHistoryFile(), "File builds are recorded in")
+	keep := fs.Int("keep", 0, "Number of the most recent builds of each alias to keep")
+	olderThan := fs.Duration("older-than", 0, "Remove builds started longer ago than this (e.g. 720h)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s prune [-keep count] [-older-than duration]\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *keep <= 0 && *olderThan <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var before time.Time
+	if *olderThan > 0 {
+		before = time.Now().Add(-*olderThan)
+	}
+	removed, err := imagebuilder.PruneHistory(*historyFile, *keep, before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d build(s) from %s\n", removed, *historyFile)
+	return nil
+}
+
+// printBuild describes the recorded build.
+func printBuild(w io.Writer, rec *imagebuilder.HistoryRecord) {
+	for _, field := range [][2]string{
+		{"Alias", rec.Alias},
+		{"Serial", rec.Serial},
+		{"Remote", rec.Remote},
+		{"Fingerprint", rec.Fingerprint},
+		{"Spec hash", rec.SpecHash},
+		{"Tool version", rec.ToolVersion},
+	} {
+		fmt.Fprintf(w, "%s:\t%s\n", field[0], orDash(field[1]))
+	}
+	printBuildSummary(w, "", rec)
+}
+
+// printBuildSummary describes the outcome of the recorded build,
+// with each line indented by indent.
+func printBuildSummary(w io.Writer, indent string, rec *imagebuilder.HistoryRecord) {
+	for _, field := range [][2]string{
+		{"Status", rec.Status},
+		{"Error", rec.Error},
+		{"Started", rec.Started.Local().Format(time.RFC3339)},
+		{"Duration", rec.Duration.Round(time.Second).String()},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(w, "%s%s:\t%s\n", indent, field[0], field[1])
+		}
+	}
+	for i, artifact := range rec.Artifacts {
+		label := ""
+		if i == 0 {
+			label = "Artifacts:"
+		}
+		fmt.Fprintf(w, "%s%s\t%s\n", indent, label, artifact)
+	}
+}
+
+// printSpec prints the recorded options of the build.
+func printSpec(rec *imagebuilder.HistoryRecord) error {
+	if len(rec.Spec) == 0 {
+		return fmt.Errorf("no options recorded for the build of %s", rec.Fingerprint)
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, rec.Spec, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(buf.String())
+	return nil
+}
+
+// isFingerprint reports whether s looks like an image fingerprint,
+// or an abbreviation of one, rather than an alias.
+func isFingerprint(s string) bool {
+	if len(s) < 12 || len(s) > 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
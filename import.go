@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// importTarball implements the "import" subcommand, which adds the
+// templates to an existing image tarball and imports it,
+// without building in a container.
+func importTarball(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	remote := fs.String("remote", "", "lxc remote to import the image into (default: the default remote)")
+	var properties, templateTriggers stringsFlag
+	fs.Var(&properties, "property", "Property (user.key=value) to import the image with; may be repeated")
+	templateSet := fs.String("template-set", imagebuilder.TemplateSetNoCloudClassic, "Set of templates to add: nocloud-classic, lxd-datasource or static-network")
+	fs.Var(&templateTriggers, "template-trigger", "Events on which LXD renders a template, as name=event,... (e.g. network-config=create,copy,start); may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import [-remote remote] [-property user.key=value]... <tarball> <alias>\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := imagebuilder.ImportOptions{
+		Tarball:     fs.Arg(0),
+		Alias:       fs.Arg(1),
+		Remote:      strings.TrimSuffix(*remote, ":"),
+		TemplateSet: *templateSet,
+	}
+	var err error
+	if opts.Properties, err = parseProperties(properties); err != nil {
+		return err
+	}
+	if opts.TemplateTriggers, err = parseTemplateTriggers(templateTriggers); err != nil {
+		return err
+	}
+	_, err = imagebuilder.ImportTarball(context.Background(), opts)
+	return err
+}
+
+// retemplateImage implements the "retemplate" subcommand, which
+// updates the templates of an image already in an LXD
+// image store, or of all images built by the builder, without
+// rebuilding them.
+func retemplateImage(args []string) error {
+	fs := flag.NewFlagSet("retemplate", flag.ExitOnError)
+	all := fs.Bool("all", false, "Update every image built by "+imagebuilder.BuilderName+" in the remote")
+	remote := fs.String("remote", "", "lxc remote holding the images, with -all (default: the default remote)")
+	var properties, templateTriggers stringsFlag
+	fs.Var(&properties, "property", "Property (user.key=value) to add to the image; may be repeated")
+	templateSet := fs.String("template-set", imagebuilder.TemplateSetNoCloudClassic, "Set of templates to add: nocloud-classic, lxd-datasource or static-network")
+	fs.Var(&templateTriggers, "template-trigger", "Events on which LXD renders a template, as name=event,... (e.g. network-config=create,copy,start); may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s retemplate [-property user.key=value]... [remote:]alias\n", imagebuilder.BuilderName)
+		fmt.Fprintf(fs.Output(), "       %s retemplate -all [-remote remote] [-property user.key=value]...\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if *all && fs.NArg() != 0 || !*all && (fs.NArg() != 1 || *remote != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := imagebuilder.RetemplateOptions{
+		Remote:      strings.TrimSuffix(*remote, ":"),
+		TemplateSet: *templateSet,
+	}
+	if !*all {
+		opts.Alias = fs.Arg(0)
+		if i := strings.IndexByte(opts.Alias, ':'); i >= 0 {
+			opts.Remote, opts.Alias = opts.Alias[:i], opts.Alias[i+1:]
+		}
+	}
+	var err error
+	if opts.Properties, err = parseProperties(properties); err != nil {
+		return err
+	}
+	if opts.TemplateTriggers, err = parseTemplateTriggers(templateTriggers); err != nil {
+		return err
+	}
+	if *all {
+		_, err = imagebuilder.RetemplateBuiltImages(context.Background(), opts)
+		return err
+	}
+	_, err = imagebuilder.RetemplateImage(context.Background(), opts)
+	return err
+}
+
+// parseProperties parses -property flags of the
+// form key=value.
+func parseProperties(kvs []string) (map[string]string, error) {
+	var properties map[string]string
+	for _, kv := range kvs {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid -property %q, expected key=value", kv)
+		}
+		if properties == nil {
+			properties = make(map[string]string)
+		}
+		properties[kv[:i]] = kv[i+1:]
+	}
+	return properties, nil
+}
+
+// parseTemplateTriggers parses -template-trigger flags
+// of the form name=event,...
+func parseTemplateTriggers(kvs []string) (map[string][]string, error) {
+	var triggers map[string][]string
+	for _, kv := range kvs {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid -template-trigger %q, expected name=event,...", kv)
+		}
+		if triggers == nil {
+			triggers = make(map[string][]string)
+		}
+		triggers[kv[:i]] = strings.Split(kv[i+1:], ",")
+	}
+	return triggers, nil
+}
@@ -1,404 +1,542 @@
 package main
 
 import (
-	"archive/tar"
-	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
-	"time"
+	"syscall"
+	"text/tabwriter"
 
-	"gopkg.in/yaml.v2"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/tracing"
 )
 
-var image string
-var keep bool
-var alias string
-
-const (
-	cloudInitMetaTemplate = `#cloud-config
-instance-id: {{ container.name }}
-local-hostname: {{ container.name }}
-{{ config_get("user.meta-data", "") }}`
-
-	cloudInitNetworkTemplate = `{% if config_get("user.network-config", "") == "" %}version: 1
-config:
-    - type: physical
-      name: eth0
-      subnets:
-          - type: {% if config_get("user.network_mode", "") == "link-local" %}manual{% else %}dhcp{% endif %}
-            control: auto{% else %}{{ config_get("user.network-config", "") }}{% endif %}`
-
-	cloudInitUserTemplate = `{{ config_get("user.user-data", properties.default) }}`
-
-	cloudInitVendorTemplate = `{{ config_get("user.vendor-data", properties.default) }}`
-)
-
-var cloudInitTemplates = map[string]template{
-	"/var/lib/cloud/seed/nocloud-net/meta-data": template{
-		Template: "cloud-init-meta.tpl",
-		When:     []string{"create", "copy"},
-		content:  cloudInitMetaTemplate,
-	},
-	"/var/lib/cloud/seed/nocloud-net/network-config": template{
-		Template: "cloud-init-network.tpl",
-		When:     []string{"create", "copy"},
-		content:  cloudInitNetworkTemplate,
-	},
-	"/var/lib/cloud/seed/nocloud-net/user-data": template{
-		Properties: map[string]string{
-			"default": "#cloud-config\n{}",
-		},
-		Template: "cloud-init-user.tpl",
-		When:     []string{"create", "copy"},
-		content:  cloudInitUserTemplate,
-	},
-	"/var/lib/cloud/seed/nocloud-net/vendor-data": template{
-		Properties: map[string]string{
-			"default": "#cloud-config\n{}",
-		},
-		Template: "cloud-init-vendor.tpl",
-		When:     []string{"create", "copy"},
-		content:  cloudInitVendorTemplate,
-	},
-}
-
-type template struct {
-	Properties map[string]string `yaml:"properties,omitempty"`
-	Template   string            `yaml:"template"`
-	When       []string          `yaml:"when,omitempty"`
-
-	// content is the contents of the template file to create
-	// in the image metadata.
-	content string `yaml:"-"`
-}
-
 func Main() error {
-	flag.StringVar(&image, "image", "images:centos/7", "Base CentOS image")
-	flag.StringVar(&alias, "alias", "juju/centos7/amd64", "Alias for new image")
-	flag.BoolVar(&keep, "keep", false, "Keep the build directory")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "list":
+			return listImages(os.Args[2:])
+		case "serve":
+			return serve(os.Args[2:])
+		case "serve-images":
+			return serveImages(os.Args[2:])
+		case "copy":
+			return copyImage(os.Args[2:])
+		case "import":
+			return importTarball(os.Args[2:])
+		case "retemplate":
+			return retemplateImage(os.Args[2:])
+		case "describe":
+			return describeImage(os.Args[2:])
+		case "history":
+			return showHistory(os.Args[2:])
+		case "prune":
+			return pruneHistory(os.Args[2:])
+		case "rebuild":
+			return rebuildImage(os.Args[2:])
+		case "schema":
+			return printSchema(os.Args[2:])
+		}
+	}
+
+	var opts imagebuilder.Options
+	var profiles, buildPackages, imageFallbacks, jujuConfig, pushRemotes, repoFiles, buildArgs, buildSecrets, redact, testScenarios stringsFlag
+	var devices, containerConfig, properties, recommended, templateTriggers, dns stringsFlag
+	var nesting, controller, keepOnFailure, keepAlways bool
+	var configFile, userConfigFile, eventsFile, manifestFile, otlpEndpoint, idShift, maxSize, limitRate string
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv(tracing.EnvEndpoint), "OTLP/HTTP collector to export build traces to (e.g. http://localhost:4318)")
+	flag.StringVar(&eventsFile, "events-json", "", "File to write build events to, as JSON lines (\"-\" for stdout)")
+	flag.StringVar(&configFile, "config", "", "Build configuration file (YAML)")
+	flag.StringVar(&userConfigFile, "user-config", defaultUserConfig(), "Configuration file of personal defaults, in the -config format, applied before -config (empty to disable)")
+	flag.StringVar(&opts.Image, "image", imagebuilder.DefaultImage, "Base CentOS image")
+	flag.Var(&imageFallbacks, "image-fallback", "Image to build from if -image is not found, e.g. a mirror (mirror:centos/7) or a pinned fingerprint; may be repeated, and is tried in order")
+	flag.StringVar(&opts.Base, "base", "", "Alias of an image built by this program to build from instead of -image")
+	flag.BoolVar(&opts.VM, "vm", false, "Build a virtual machine image, from -base-qcow2 or a -base built with -vm")
+	flag.StringVar(&opts.BaseQCOW2, "base-qcow2", "", "qcow2 cloud image (e.g. a CentOS or Rocky Linux GenericCloud image) to build a -vm image from instead of -image; it is imported as an LXD VM image")
+	flag.BoolVar(&opts.SkipUnchanged, "skip-unchanged", false, "Skip the build if the image was built from the same base image with the same inputs")
+	flag.BoolVar(&opts.SerialOnChange, "serial-on-change", false, "Only publish a new serial if the build changes the packages or inputs of the image it replaces; otherwise keep that image")
+	flag.BoolVar(&opts.Cache, "cache", false, "Cache the build container in LXD snapshots after each provisioning step, and resume later builds from the deepest unchanged step")
+	flag.StringVar(&opts.Alias, "alias", imagebuilder.DefaultAlias, "Alias for new image")
+	flag.BoolVar(&keepOnFailure, "keep-on-failure", false, "Keep the build directory, container and logs if the build fails")
+	flag.BoolVar(&keepAlways, "keep-always", false, "Keep the build directory, container and logs whether or not the build fails")
+	flag.BoolVar(&keepAlways, "keep", false, "Deprecated: use -keep-always")
+	flag.StringVar(&opts.Remote, "remote", "", "lxc remote on which to build and publish the image (default: the lxc default remote)")
+	flag.StringVar(&opts.JujuModel, "juju-model", "", "Juju model ([controller:]model) to make the image available to")
+	flag.StringVar(&opts.JujuRemote, "juju-remote", "", "lxc remote for the Juju model's LXD cloud (default: detect from the cloud endpoint)")
+	flag.StringVar(&opts.SigningKey, "signing-key", "", "GPG key to sign the SHA256SUMS file in the simplestreams tree with")
+	flag.BoolVar(&opts.Cosign, "cosign", false, "Sign the image tarball with cosign (keylessly, unless -cosign-key is specified)")
+	flag.StringVar(&opts.CosignKey, "cosign-key", "", "Key to sign the image tarball with cosign, as accepted by cosign sign-blob --key")
+	flag.BoolVar(&opts.Provenance, "provenance", false, "Generate a SLSA provenance document for the image, signed with -cosign/-cosign-key and -signing-key if specified")
+	flag.StringVar(&opts.BuilderID, "builder-id", "", "Builder identity to record in provenance documents (default: derived from the hostname)")
+	flag.BoolVar(&opts.Reproducible, "reproducible", false, "Write the image tarball reproducibly, clamping timestamps to $SOURCE_DATE_EPOCH")
+	flag.Int64Var(&opts.TarballFormat.GzipModTime, "gzip-mtime", 0, "Modification time to record in the image tarball's gzip header, in seconds since the epoch (default: none)")
+	flag.StringVar(&opts.TarballFormat.GzipOS, "gzip-os", "", "OS to record in the image tarball's gzip header: unix, fat, ntfs, unknown or 0-255 (default: unknown)")
+	flag.StringVar(&opts.TarballFormat.TarFormat, "tar-format", "", "Format to write every tar header of the image tarball in: ustar, pax or gnu (default: the most compact that represents each entry)")
+	flag.StringVar(&idShift, "id-shift", "", "Amount to subtract from the uids and gids of rootfs entries, for images built on hosts with shifted ids, or \"auto\" to detect it from the rootfs owner")
+	flag.BoolVar(&opts.StrictIDs, "strict-ids", false, "Fail the build if rootfs entries are owned by ids above 65535, which do not unpack in unprivileged containers")
+	flag.StringVar(&opts.Upload, "upload", "", "S3 URL (s3://bucket/prefix) to upload the image and simplestreams metadata to; credentials are taken from $AWS_*")
+	flag.Var(&pushRemotes, "push-remote", "lxc remote to copy the built image to; may be repeated")
+	flag.BoolVar(&opts.PushPublic, "push-public", false, "Mark images copied to -push-remote remotes as public")
+	flag.Var(&jujuConfig, "juju-config", "Model config (key=value) to set on the Juju model; may be repeated")
+	flag.BoolVar(&opts.JujuTest, "juju-test", false, "Test the image by starting a Juju machine with it (bootstraps a temporary controller unless -juju-model is specified)")
+	flag.Var(&testScenarios, "test-scenario", testScenarioUsage())
+	flag.Var(&profiles, "profile", profileUsage())
+	flag.Var(&buildPackages, "build-package", "Package to install for the provisioning steps and remove, with the dependencies installed for it, before publishing; may be repeated")
+	flag.BoolVar(&nesting, "nesting", false, "Prepare the image for nested containers (same as -profile nesting)")
+	flag.BoolVar(&controller, "controller", false, "Build a Juju controller image variant, published with the alias suffixed by /controller")
+	flag.StringVar(&opts.ImageServer, "image-server", "", "Simplestreams image server URL to take the base image from (e.g. an internal mirror); -image must then be unqualified")
+	flag.StringVar(&opts.ImageServerCA, "image-server-ca", "", "PEM certificate to trust for -image-server: that of its private CA, or its own")
+	flag.StringVar(&opts.ImageServerAuthFile, "image-server-auth-file", "", "File containing user:password to authenticate to -image-server with, using HTTP basic authentication")
+	flag.BoolVar(&opts.AllowOSMismatch, "allow-os-mismatch", false, "Allow a base image whose distribution, release or architecture does not match the alias (e.g. a Rocky Linux image under juju/centos9/amd64)")
+	flag.StringVar(&opts.BaseFingerprint, "base-fingerprint", "", "Expected fingerprint of the base image (or a prefix of at least 12 characters)")
+	flag.StringVar(&opts.BaseKeyring, "base-keyring", "", "GPG keyring to verify the base image against its remote's signed simplestreams metadata")
+	flag.BoolVar(&opts.Offline, "offline", false, "Build without internet access, installing packages only from -local-repo and -repo-file repositories")
+	flag.BoolVar(&opts.NoHostNetwork, "no-host-network", false, "Build on a host without internet access, having the LXD server download base images from simplestreams remotes")
+	flag.BoolVar(&opts.NoContainerNetwork, "no-container-network", false, "Build in a container without network access: do not wait for connectivity, and install packages only from -local-repo and -repo-file repositories")
+	flag.StringVar(&opts.NetworkWait.Family, "wait-family", "", "Address family the build container must have a global address of before provisioning: inet (the default), inet6 or any")
+	flag.StringVar(&opts.NetworkWait.Interface, "wait-interface", "", "Interface of the build container that must have an address before provisioning (default: any but lo)")
+	flag.IntVar(&opts.NetworkWait.MinInterfaces, "wait-min-interfaces", 0, "Number of build container interfaces that must have an address before provisioning (default: 1)")
+	flag.StringVar(&opts.NetworkWait.DNSHost, "wait-dns-host", "", "Host name that must resolve in the build container before provisioning, e.g. mirrorlist.centos.org")
+	flag.StringVar(&opts.LocalRepo, "local-repo", "", "Host directory holding a yum repository to mount into the build container for -offline builds")
+	flag.Var(&dns, "dns", "Nameserver (IP address) for the build container to use instead of those its network configures; may be repeated, up to three times")
+	flag.StringVar(&opts.NIC.Device, "nic-device", "", "Profile NIC of the build container whose addresses -nic-mac, -nic-ipv4 and -nic-ipv6 pin (default: eth0)")
+	flag.StringVar(&opts.NIC.MAC, "nic-mac", "", "MAC address to give the build container's NIC")
+	flag.StringVar(&opts.NIC.IPv4, "nic-ipv4", "", "IPv4 address to assign the build container's NIC (on an LXD managed bridge)")
+	flag.StringVar(&opts.NIC.IPv6, "nic-ipv6", "", "IPv6 address to assign the build container's NIC (on an LXD managed bridge)")
+	flag.Var(&repoFiles, "repo-file", "Host yum .repo file to install in the build container for -offline builds; may be repeated")
+	flag.StringVar(&opts.UserData, "user-data", "", "cloud-init user-data file to apply to the build container at launch; requires a base image with cloud-init")
+	flag.Var(&devices, "device", "Device (name,type=...,key=value...) to add to the build container, and remove before publishing; may be repeated")
+	flag.Var(&containerConfig, "container-config", "LXD config (key=value) to set on the build container, e.g. security.nesting=true; may be repeated")
+	flag.Var(&containerConfig, "launch-config", "Alias for -container-config")
+	flag.BoolVar(&opts.Privileged, "privileged", false, "Run the build container privileged, for provisioning steps that need it (the published image does not require it)")
+	flag.StringVar(&opts.ImageFormat, "image-format", imagebuilder.ImageFormatUnified, "Format of the published image: unified (a single tarball) or split (separate metadata and rootfs tarballs, written directly from an export of the build container; faster for large images, but not with -output or -upload)")
+	flag.StringVar(&maxSize, "max-size", "", "Maximum size of the published image (e.g. 2GiB); larger images fail the build before they are imported")
+	flag.BoolVar(&opts.SkipSpaceCheck, "skip-space-check", false, "Do not check that the build directory has space for the build (about 3x the base image) before launching the build container")
+	flag.StringVar(&limitRate, "limit-rate", "", "Bandwidth limit, per second (e.g. 10MiB), for image exports, imports and copies to and from LXD servers over the network, and uploads")
+	flag.StringVar(&opts.SELinux, "selinux", imagebuilder.SELinuxAuto, "SELinux labelling of the image's files: auto (label with restorecon, or relabel at first boot if that is not possible), relabel (always also relabel at first boot) or off")
+	flag.StringVar(&opts.Description, "description", "", "Description of the published image; may refer to variables as {{name}}, e.g. {{release}}, {{date}} or {{base_fingerprint}}")
+	flag.StringVar(&opts.TemplateSet, "template-set", imagebuilder.TemplateSetNoCloudClassic, "Set of templates to add to the image: nocloud-classic, lxd-datasource (needs cloud-init 21.3+), static-network, or one defined in template-sets in the config file")
+	flag.BoolVar(&opts.BakeSeed, "bake-seed", false, "Also bake a static cloud-init NoCloud seed into the rootfs, for clones of the image made outside LXD (e.g. by copying its rootfs); see the README for the trade-offs")
+	flag.StringVar(&opts.SeedInstanceID, "seed-instance-id", "", "What the -bake-seed instance-id is derived from: serial (the image's alias and serial, changing with every build) or alias (the alias alone, the same for every build) (default: serial)")
+	flag.StringVar(&opts.SeedUserData, "seed-user-data", "", "cloud-init user-data file to bake into the -bake-seed seed (default: an empty #cloud-config); do not include secrets, as every clone gets it")
+	flag.StringVar(&opts.SeedNetworkConfig, "seed-network-config", "", "cloud-init network config file to bake into the -bake-seed seed (default: DHCP on eth0)")
+	flag.Var(&templateTriggers, "template-trigger", "Events on which LXD renders a template, as name=event,... (e.g. network-config=create,copy,start); may be repeated")
+	flag.Var(&properties, "property", "Property (user.key=value) to publish the image with; the value may refer to variables, as for -description; may be repeated")
+	flag.Var(&recommended, "recommend", "Instance config (key=value) recommended for launching the image, e.g. security.nesting=true, recorded in its properties; may be repeated")
+	flag.Var(&buildArgs, "build-arg", "Build argument (KEY=VALUE) to set in the environment of provisioning steps; may be repeated")
+	flag.Var(&buildSecrets, "build-secret", "Secret build argument (KEY=file:PATH or KEY=env:NAME), checked not to be left in the image; may be repeated")
+	flag.Var(&redact, "redact", "Regular expression matching sensitive text (e.g. a token) to mask in logs, events and build artifacts; may be repeated")
+	flag.IntVar(&opts.StepRetries, "step-retries", 0, "Number of times to retry a failed provisioning step, restoring the container to a snapshot taken before the step")
+	flag.StringVar(&opts.Serial, "serial", "", "Build serial (default: YYYYMMDD.N, incrementing N for each build of the alias that day)")
+	flag.IntVar(&opts.KeepSerials, "keep-serials", imagebuilder.DefaultKeepSerials, "Number of builds of the alias to keep, or 0 to keep all")
+	flag.IntVar(&opts.KeepDays, "keep-days", 0, "Number of days to keep builds of the alias for, or 0 to keep them regardless of age")
+	flag.IntVar(&opts.Rollback, "rollback", 0, "Number of previous builds of the alias to keep, whatever the retention policy, as <alias>/previous, <alias>/previous-2 and so on")
+	flag.StringVar(&opts.ScanCommand, "scan-command", "", "Program to scan the image's installed packages for vulnerabilities before publishing")
+	flag.StringVar(&opts.ScanFailSeverity, "scan-fail-severity", "", "Fail the build if the scan finds vulnerabilities of this severity or higher (low, medium, high, critical)")
+	flag.StringVar(&opts.CaptureLogs, "capture-logs", imagebuilder.CaptureLogsOnFailure, "When to capture the build container's journal and cloud-init/yum logs: failure, always or never")
+	flag.StringVar(&opts.LogsDir, "logs-dir", "", "Directory to write captured container logs to (default: a temporary directory)")
+	flag.StringVar(&opts.DiagnosticsDir, "diagnostics-dir", os.TempDir(), "Directory to write a diagnostics bundle to if the build fails, or empty to disable")
+	flag.StringVar(&opts.HistoryFile, "history-file", imagebuilder.DefaultHistoryFile(), "File to record builds in, for the history, describe and prune subcommands, or empty to disable")
+	flag.StringVar(&opts.OutputDir, "output", "", "Directory in which to write the image and simplestreams metadata")
+	flag.StringVar(&manifestFile, "manifest", "", "File to write the build manifest to, for the rebuild subcommand")
 	flag.Parse()
 
-	tmpdir, err := ioutil.TempDir("", "juju-lxd-centos")
-	if err != nil {
+	// Flags may also be set in the environment, overriding the config
+	// files but not the command line; the config files themselves must
+	// be known before they are read.
+	if err := setFlagsFromEnv(flag.CommandLine, "config", "user-config"); err != nil {
 		return err
 	}
-	if keep {
-		log.Println("Build directory:", tmpdir)
-	} else {
-		defer os.RemoveAll(tmpdir)
+	var configs []*imagebuilder.Config
+	if userConfigFile != "" {
+		switch config, err := imagebuilder.ReadConfig(userConfigFile); {
+		case err == nil:
+			configs = append(configs, config)
+		case !os.IsNotExist(err) || userConfigFile != defaultUserConfig():
+			return err
+		}
 	}
-
-	// Start a build container.
-	var deleted bool
-	containerName := fmt.Sprintf("juju-lxd-centos-%v", time.Now().Unix())
-	if err := lxc("launch", image, containerName); err != nil {
-		return err
+	if configFile != "" {
+		config, err := imagebuilder.ReadConfig(configFile)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, config)
 	}
-	if keep {
-		log.Println("Build container:", containerName)
-	} else {
-		defer func() {
-			if deleted {
-				return
-			}
-			err := lxc("delete", "--force", containerName)
-			if err != nil {
-				log.Println("Deleting build container", err)
+	if len(configs) > 0 {
+		for _, config := range configs {
+			if err := config.Apply(&opts); err != nil {
+				return err
 			}
-		}()
-	}
-
-	// Update the build container by running commands inside it,
-	// and then publish the container as an image.
-	if err := waitContainerNetwork(containerName); err != nil {
-		return err
-	}
-	if err := updateContainer(containerName); err != nil {
-		return err
+		}
+		// Parse the command line again, so that flags
+		// specified explicitly override the config files.
+		profiles, buildPackages, imageFallbacks, jujuConfig, pushRemotes, repoFiles, buildArgs, buildSecrets, redact, testScenarios = nil, nil, nil, nil, nil, nil, nil, nil, nil, nil
+		devices, containerConfig, properties, recommended, templateTriggers, dns = nil, nil, nil, nil, nil, nil
+		flag.CommandLine.Parse(os.Args[1:])
 	}
-	if err := lxc("stop", containerName); err != nil {
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
 		return err
 	}
-	if err := lxc("publish", "--alias="+alias, containerName); err != nil {
-		return err
+	switch {
+	case keepAlways:
+		opts.Keep = imagebuilder.KeepAlways
+	case keepOnFailure:
+		opts.Keep = imagebuilder.KeepOnFailure
 	}
-	if err := lxc("delete", containerName); err != nil {
-		return err
+	if idShift != "" {
+		shift, err := imagebuilder.ParseIDShift(idShift)
+		if err != nil {
+			return err
+		}
+		opts.IDShift = shift
 	}
-	deleted = true
-
-	// Export the image and add the cloud-init templates.
-	if err := updateImageTemplates(alias, tmpdir); err != nil {
-		return err
+	if maxSize != "" {
+		size, err := imagebuilder.ParseSize(maxSize)
+		if err != nil {
+			return err
+		}
+		opts.MaxSize = size
 	}
-
-	return nil
-}
-
-func waitContainerNetwork(container string) error {
-	log.Println("Waiting for network connectivity")
-
-	now := time.Now()
-	interval := time.Second
-	deadline := now.Add(time.Minute)
-	for !now.After(deadline) {
-		status, err := getContainerStatus(container)
+	if limitRate != "" {
+		rate, err := imagebuilder.ParseSize(limitRate)
 		if err != nil {
 			return err
 		}
-		if status.State.Status == "Running" {
-			for name, network := range status.State.Networks {
-				if name == "lo" || network.State != "up" || len(network.Addresses) == 0 {
-					continue
-				}
-				for _, addr := range network.Addresses {
-					if addr.Scope == "global" && addr.Family == "inet" {
-						return nil
-					}
-				}
-			}
+		opts.RateLimit = rate
+	}
+	if nesting {
+		profiles = append(profiles, "nesting")
+	}
+	if controller {
+		profiles = append(profiles, "juju-agent", "controller")
+		opts.Alias += "/controller"
+	}
+	opts.Profiles = append(opts.Profiles, profiles...)
+	opts.BuildPackages = append(opts.BuildPackages, buildPackages...)
+	opts.ImageFallbacks = append(opts.ImageFallbacks, imageFallbacks...)
+	opts.JujuConfig = append(opts.JujuConfig, jujuConfig...)
+	opts.RepoFiles = append(opts.RepoFiles, repoFiles...)
+	opts.BuildArgs = append(opts.BuildArgs, buildArgs...)
+	opts.BuildSecrets = append(opts.BuildSecrets, buildSecrets...)
+	opts.Redact = append(opts.Redact, redact...)
+	opts.TestScenarios = append(opts.TestScenarios, testScenarios...)
+	opts.PushRemotes = append(opts.PushRemotes, pushRemotes...)
+	if len(dns) > 0 {
+		opts.DNS = dns
+	}
+	for _, device := range devices {
+		name, config, err := imagebuilder.ParseDevice(device)
+		if err != nil {
+			return err
+		}
+		if opts.Devices == nil {
+			opts.Devices = make(map[string]map[string]string)
 		}
-		time.Sleep(interval)
-		now = now.Add(interval)
+		opts.Devices[name] = config
+	}
+	for _, kv := range containerConfig {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid -container-config %q, expected key=value", kv)
+		}
+		if opts.ContainerConfig == nil {
+			opts.ContainerConfig = make(map[string]string)
+		}
+		opts.ContainerConfig[kv[:i]] = kv[i+1:]
+	}
+	for _, kv := range properties {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid -property %q, expected key=value", kv)
+		}
+		if opts.Properties == nil {
+			opts.Properties = make(map[string]string)
+		}
+		opts.Properties[kv[:i]] = kv[i+1:]
+	}
+	for _, kv := range recommended {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid -recommend %q, expected key=value", kv)
+		}
+		if opts.RecommendedConfig == nil {
+			opts.RecommendedConfig = make(map[string]string)
+		}
+		opts.RecommendedConfig[kv[:i]] = kv[i+1:]
+	}
+	for _, kv := range templateTriggers {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid -template-trigger %q, expected name=event,...", kv)
+		}
+		if opts.TemplateTriggers == nil {
+			opts.TemplateTriggers = make(map[string][]string)
+		}
+		opts.TemplateTriggers[kv[:i]] = strings.Split(kv[i+1:], ",")
 	}
-	return errors.New("timed out waiting for network connectivity")
-}
-
-type containerStatus struct {
-	State struct {
-		Status   string `json:"status"`
-		Networks map[string]struct {
-			Addresses []struct {
-				Family string `json:"family"`
-				Scope  string `json:"scope"`
-			} `json:"addresses"`
-			State string `json:"state"`
-		} `json:"network"`
-	} `json:"state"`
-}
-
-func getContainerStatus(container string) (*containerStatus, error) {
-	var buf bytes.Buffer
-	cmd := exec.Command("lxc", "list", "--format=json", container)
-	cmd.Stdout = &buf
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return nil, err
-	}
-	var statuses []containerStatus
-	if err := json.Unmarshal(buf.Bytes(), &statuses); err != nil {
-		return nil, err
-	}
-	return &statuses[0], nil
-}
 
-func updateContainer(container string) error {
-	commands := []string{
-		"yum install -y openssh-server redhat-lsb-core cloud-init",
-		// Disable the set_hostname/update_hostname modules, or SELinux sadness ensues.
-		"sed -i -E 's/.*(set|update)_hostname.*/#\\0/' /etc/cloud/cloud.cfg",
-		// Clean out yum cache from previous installs.
-		"yum clean all",
-		// Remove SSH host keys so we don't end up with all instances having the same.
-		"/bin/rm -f /etc/ssh/*key*",
-	}
-	for _, command := range commands {
-		if err := lxc("exec", container, "--", "/bin/sh", "-c", command); err != nil {
-			return err
+	if eventsFile != "" {
+		w := os.Stdout
+		if eventsFile != "-" {
+			f, err := os.Create(eventsFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		opts.OnEvent = func(e imagebuilder.Event) {
+			if err := enc.Encode(e); err != nil {
+				log.Println("Writing event:", err)
+			}
 		}
 	}
-	return nil
-}
 
-func updateImageTemplates(alias, tmpdir string) error {
-	if err := lxc("image", "export", alias, tmpdir); err != nil {
-		return err
+	var tracer *tracing.Tracer
+	if otlpEndpoint != "" {
+		tracer = tracing.New(otlpEndpoint, map[string]string{"build.alias": opts.Alias})
+		opts.OnEvent = chainEvents(opts.OnEvent, tracer.OnEvent)
 	}
+	finish := superviseBuild(&opts)
 
-	// Images can have one of two formats: a single tarball with
-	// both rootfs and metadata in it, or separate rootfs and
-	// metadata tarballs.
-	//
-	// We currently assume that the centos/7 image uses a single
-	// tarball only.
-	f, err := os.Open(tmpdir)
+	b, err := imagebuilder.New(opts)
 	if err != nil {
+		finish(err)
 		return err
 	}
-	defer f.Close()
-	names, err := f.Readdirnames(-1)
+	// Cancel the build cleanly on SIGINT/SIGTERM, so that the build
+	// container and intermediate images are removed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := b.Build(ctx)
+	finish(err)
+	if tracer != nil {
+		if err := tracer.Export(context.Background(), err); err != nil {
+			log.Println("Exporting trace:", err)
+		} else {
+			log.Println("Exported trace", tracer.TraceID())
+		}
+	}
 	if err != nil {
 		return err
 	}
-	if len(names) != 1 {
-		return fmt.Errorf(
-			"expected a single tarball, found %v (%s)",
-			len(names), names,
-		)
-	}
-
-	// Decompress the tarball, so we can update its contents. We do it
-	// like this rather than extracting the whole tarball with "tar xf"
-	// to avoid having to run as root, since the tarball contains root-
-	// owned special files.
-	tarballName := names[0]
-	fingerprint := tarballName[:strings.IndexRune(tarballName, '.')]
-	switch ext := path.Ext(tarballName); ext {
-	case ".gz":
-		if err := run("gunzip", filepath.Join(tmpdir, tarballName)); err != nil {
+	if manifestFile != "" {
+		if err := writeManifest(manifestFile, result); err != nil {
 			return err
 		}
-		tarballName = strings.TrimSuffix(tarballName, ext)
-	default:
-		fmt.Println(path.Ext(tarballName))
-		return fmt.Errorf("Unhandled compression type in tarball: %s", tarballName)
-	}
-
-	// Extract metadata.yaml, and update it with the cloud-init
-	// template references. Also write the templates to disk in
-	// the temp dir, and then update the tarball.
-	var metadataBuf bytes.Buffer
-	tarCmd := exec.Command("tar", "xOf", tarballName, "metadata.yaml")
-	tarCmd.Stdin = os.Stdin
-	tarCmd.Stdout = &metadataBuf
-	tarCmd.Stderr = os.Stderr
-	tarCmd.Dir = tmpdir
-	if err := tarCmd.Run(); err != nil {
-		return err
-	}
-	metadata := make(map[string]interface{})
-	if err := yaml.Unmarshal(metadataBuf.Bytes(), &metadata); err != nil {
-		return err
 	}
+	log.Printf("Built %s (serial %s, fingerprint %.12s)", result.Alias, result.Serial, result.Fingerprint)
+	return nil
+}
 
-	// Update the metadata with the cloud-init template references,
-	// writing it and the template to disk in the temp dir, so we
-	// can update the tarball.
-	templates := metadata["templates"].(map[interface{}]interface{})
-	for name, template := range cloudInitTemplates {
-		templates[name] = template
-	}
-	metadataOut, err := yaml.Marshal(metadata)
-	if err != nil {
-		return err
+// chainEvents returns an event callback that calls
+// each of the non-nil callbacks in turn.
+func chainEvents(fs ...func(imagebuilder.Event)) func(imagebuilder.Event) {
+	return func(e imagebuilder.Event) {
+		for _, f := range fs {
+			if f != nil {
+				f(e)
+			}
+		}
 	}
+}
 
-	log.Println("Updating metadata/templates in tarball")
-	outTarballName := filepath.Join(tmpdir, "output.tar.gz")
-	if err := createFinalTarball(
-		outTarballName,
-		filepath.Join(tmpdir, tarballName),
-		metadataOut,
-		gzip.DefaultCompression,
-	); err != nil {
-		return err
+// profileUsage returns the usage text for the -profile flag.
+func profileUsage() string {
+	usage := "Provisioning profile to apply; may be repeated. One of:"
+	for _, name := range imagebuilder.ProfileNames() {
+		usage += fmt.Sprintf("\n  %s: %s", name, imagebuilder.ProfileDescription(name))
 	}
+	return usage
+}
 
-	// Import the image tarball over the top of the alias, and finally
-	// remove the intermediate image.
-	if err := lxc("image", "import", "--alias="+alias, outTarballName); err != nil {
-		return err
+// testScenarioUsage returns the usage text for the -test-scenario flag.
+func testScenarioUsage() string {
+	usage := "Scenario to test the image with before it is output or copied, or \"all\"; may be repeated. One of:"
+	for _, name := range imagebuilder.TestScenarioNames() {
+		usage += fmt.Sprintf("\n  %s: %s", name, imagebuilder.TestScenarioDescription(name))
 	}
-	if err := lxc("image", "delete", fingerprint); err != nil {
-		return err
-	}
-	return nil
+	return usage
 }
 
-func createFinalTarball(
-	outpath, inpath string,
-	metadata []byte,
-	compressionLevel int,
-) error {
-	fin, err := os.Open(inpath)
+// listImages implements the "list" subcommand, which displays the
+// images produced by this tool along with their recorded properties.
+func listImages(args []string) error {
+	var remote string
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s list [remote]", imagebuilder.BuilderName)
+	} else if len(args) == 1 {
+		remote = strings.TrimSuffix(args[0], ":")
+	}
+	images, err := imagebuilder.ListBuiltImages(context.Background(), remote)
 	if err != nil {
 		return err
 	}
-	defer fin.Close()
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].UploadedAt > images[j].UploadedAt
+	})
 
-	fout, err := os.Create(outpath)
-	if err != nil {
-		return err
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tFINGERPRINT\tCLOUD-INIT\tJUJU TESTED\tUPLOADED")
+	for _, image := range images {
+		var aliases []string
+		for _, a := range image.Aliases {
+			aliases = append(aliases, a.Name)
+		}
+		fmt.Fprintf(tw, "%s\t%.12s\t%s\t%s\t%s\n",
+			strings.Join(aliases, ","),
+			image.Fingerprint,
+			orDash(image.Properties[imagebuilder.PropertyCloudInitVersion]),
+			orDash(image.Properties[imagebuilder.PropertyJujuVersionTested]),
+			image.UploadedAt,
+		)
 	}
-	defer fout.Close()
+	return tw.Flush()
+}
 
-	gzout, err := gzip.NewWriterLevel(fout, compressionLevel)
-	if err != nil {
+// describeImage implements the "describe" subcommand, which displays
+// the build properties recorded on an image produced by this tool,
+// tracing it back to the inputs it was built from, and the build
+// recorded in the history file. Builds of images that no longer exist
+// can be described by fingerprint.
+func describeImage(args []string) error {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	historyFile := fs.String("history-file", imagebuilder.DefaultHistoryFile(), "File builds are recorded in")
+	spec := fs.Bool("spec", false, "Print only the recorded options of the build that produced the image, as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s describe [-spec] [remote:]alias|fingerprint\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
 		return err
 	}
-
-	in := tar.NewReader(fin)
-	out := tar.NewWriter(gzout)
-	for {
-		h, err := in.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	image, err := imagebuilder.DescribeImage(context.Background(), fs.Arg(0))
+	if err != nil {
+		if !isFingerprint(fs.Arg(0)) || *historyFile == "" {
 			return err
 		}
-		if h.Name == "metadata.yaml" {
-			// Ignore metadata.yaml, we'll write a new one below.
-			continue
-		}
-		if err := out.WriteHeader(h); err != nil {
+		// The image may have been deleted since it was built.
+		rec, findErr := imagebuilder.FindBuild(*historyFile, fs.Arg(0))
+		if findErr != nil {
 			return err
 		}
-		if _, err := io.Copy(out, in); err != nil {
-			return err
+		if *spec {
+			return printSpec(rec)
 		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		printBuild(tw, rec)
+		return tw.Flush()
 	}
-
-	writeFile := func(name string, content []byte) error {
-		h := &tar.Header{
-			Name:     name,
-			Mode:     0644,
-			Size:     int64(len(content)),
-			Typeflag: tar.TypeReg,
+	var rec *imagebuilder.HistoryRecord
+	if *historyFile != "" {
+		rec, _ = imagebuilder.FindBuild(*historyFile, image.Fingerprint)
+	}
+	if *spec {
+		if rec == nil {
+			return fmt.Errorf("no build of image %s recorded in %s", image.Fingerprint, *historyFile)
 		}
-		if err := out.WriteHeader(h); err != nil {
-			return err
+		return printSpec(rec)
+	}
+	var aliases []string
+	for _, a := range image.Aliases {
+		aliases = append(aliases, a.Name)
+	}
+	props := image.Properties
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, field := range [][2]string{
+		{"Aliases", strings.Join(aliases, ",")},
+		{"Fingerprint", image.Fingerprint},
+		{"Serial", props[imagebuilder.PropertySerial]},
+		{"Built", props[imagebuilder.PropertyTimestamp]},
+		{"Tool version", props[imagebuilder.PropertyToolVersion]},
+		{"Spec hash", props[imagebuilder.PropertySpecHash]},
+		{"Inputs", props[imagebuilder.PropertyInputs]},
+		{"Base image", props[imagebuilder.PropertyBaseImage]},
+		{"Base fingerprint", props[imagebuilder.PropertyBaseFingerprint]},
+		{"Cloud-init", props[imagebuilder.PropertyCloudInitVersion]},
+		{"Juju tested", props[imagebuilder.PropertyJujuVersionTested]},
+		{"Uploaded", image.UploadedAt},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", field[0], orDash(field[1]))
+	}
+	if recommended := imagebuilder.RecommendedConfig(props); len(recommended) > 0 {
+		fmt.Fprintf(tw, "Recommended config:\n")
+		keys := make([]string, 0, len(recommended))
+		for key := range recommended {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(tw, "  %s:\t%s\n", key, recommended[key])
 		}
-		_, err = out.Write(content)
-		return err
 	}
-	if err := writeFile("metadata.yaml", metadata); err != nil {
-		return err
+	if rec != nil {
+		fmt.Fprintf(tw, "Build:\n")
+		printBuildSummary(tw, "  ", rec)
 	}
-	for _, t := range cloudInitTemplates {
-		if err := writeFile(path.Join("templates", t.Template), []byte(t.content)); err != nil {
-			return err
-		}
+	return tw.Flush()
+}
+
+// printSchema prints the JSON Schema for build specs
+// or manifests.
+func printSchema(args []string) error {
+	name := "spec"
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s schema [spec|manifest]", imagebuilder.BuilderName)
+	} else if len(args) == 1 {
+		name = args[0]
 	}
-	if err := out.Close(); err != nil {
+	schema, err := imagebuilder.Schema(name)
+	if err != nil {
 		return err
 	}
-	if err := gzout.Close(); err != nil {
-		return err
+	fmt.Print(schema)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// defaultUserConfig returns the path to the configuration file of
+// personal defaults, which need not exist, or "" if the user has no
+// configuration directory.
+func defaultUserConfig() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
 	}
-	return fout.Close()
+	return filepath.Join(dir, "juju-lxd-image-builder", "config.yaml")
 }
 
-func lxc(args ...string) error {
-	return run("lxc", args...)
+// stringsFlag is a flag.Value that may be specified multiple
+// times, accumulating each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
 }
 
-func run(arg0 string, args ...string) error {
-	log.Println("Running command:", arg0, strings.Join(args, " "))
-	cmd := exec.Command(arg0, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
 }
 
 func main() {
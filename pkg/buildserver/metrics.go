@@ -0,0 +1,152 @@
+package buildserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// durationBuckets holds the upper bounds, in seconds, of the
+// build duration histogram buckets.
+var durationBuckets = []float64{60, 120, 300, 600, 900, 1200, 1800, 2700, 3600, 7200}
+
+// metrics records build metrics, and writes them in the
+// Prometheus text exposition format.
+type metrics struct {
+	mu sync.Mutex
+
+	// builds counts finished builds, by final state.
+	builds map[State]int
+
+	// failures counts failed builds, by the phase
+	// that was running when the build failed.
+	failures map[string]int
+
+	// durations holds the cumulative bucket counts for the
+	// duration of successful builds, with one more element
+	// than durationBuckets for the +Inf bucket.
+	durations     []int
+	durationSum   float64
+	durationCount int
+
+	// sizes holds the size of the most recently
+	// built image, by alias.
+	sizes map[string]int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		builds:    make(map[State]int),
+		failures:  make(map[string]int),
+		durations: make([]int, len(durationBuckets)+1),
+		sizes:     make(map[string]int64),
+	}
+}
+
+// buildFinished records the outcome of a build.
+func (m *metrics) buildFinished(status Status, result *imagebuilder.Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.builds[status.State]++
+	switch status.State {
+	case StateFailed:
+		m.failures[status.Phase]++
+	case StateSucceeded:
+		d := result.Finished.Sub(result.Started).Seconds()
+		for i, le := range durationBuckets {
+			if d <= le {
+				m.durations[i]++
+			}
+		}
+		m.durations[len(durationBuckets)]++
+		m.durationSum += d
+		m.durationCount++
+		m.sizes[result.Alias] = result.Size
+	}
+}
+
+// write writes the metrics to w, along with gauges
+// for the given numbers of queued and running builds.
+func (m *metrics) write(w io.Writer, queued, running int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP imagebuilder_builds Number of builds currently queued or running.")
+	fmt.Fprintln(w, "# TYPE imagebuilder_builds gauge")
+	fmt.Fprintf(w, "imagebuilder_builds{state=%s} %d\n", labelValue(string(StateQueued)), queued)
+	fmt.Fprintf(w, "imagebuilder_builds{state=%s} %d\n", labelValue(string(StateRunning)), running)
+
+	fmt.Fprintln(w, "# HELP imagebuilder_builds_total Number of finished builds, by final state.")
+	fmt.Fprintln(w, "# TYPE imagebuilder_builds_total counter")
+	for _, state := range []State{StateSucceeded, StateFailed, StateCancelled} {
+		fmt.Fprintf(w, "imagebuilder_builds_total{state=%s} %d\n", labelValue(string(state)), m.builds[state])
+	}
+
+	fmt.Fprintln(w, "# HELP imagebuilder_build_failures_total Number of failed builds, by the phase that failed.")
+	fmt.Fprintln(w, "# TYPE imagebuilder_build_failures_total counter")
+	for _, phase := range sortedKeys(m.failures) {
+		fmt.Fprintf(w, "imagebuilder_build_failures_total{phase=%s} %d\n", labelValue(phase), m.failures[phase])
+	}
+
+	fmt.Fprintln(w, "# HELP imagebuilder_build_duration_seconds Duration of successful builds.")
+	fmt.Fprintln(w, "# TYPE imagebuilder_build_duration_seconds histogram")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(w, "imagebuilder_build_duration_seconds_bucket{le=\"%g\"} %d\n", le, m.durations[i])
+	}
+	fmt.Fprintf(w, "imagebuilder_build_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durations[len(durationBuckets)])
+	fmt.Fprintf(w, "imagebuilder_build_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "imagebuilder_build_duration_seconds_count %d\n", m.durationCount)
+
+	fmt.Fprintln(w, "# HELP imagebuilder_image_size_bytes Size of the most recently built image, by alias.")
+	fmt.Fprintln(w, "# TYPE imagebuilder_image_size_bytes gauge")
+	aliases := make([]string, 0, len(m.sizes))
+	for alias := range m.sizes {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		fmt.Fprintf(w, "imagebuilder_image_size_bytes{alias=%s} %d\n", labelValue(alias), m.sizes[alias])
+	}
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	var queued, running int
+	s.mu.Lock()
+	for _, b := range s.builds {
+		b.mu.Lock()
+		switch b.status.State {
+		case StateQueued:
+			queued++
+		case StateRunning:
+			running++
+		}
+		b.mu.Unlock()
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, queued, running)
+}
+
+// labelValue returns s quoted as a Prometheus label value.
+func labelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
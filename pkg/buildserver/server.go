@@ -0,0 +1,593 @@
+// Package buildserver provides an HTTP API for running image builds
+// in a long-running service.
+//
+// The API is as follows, with all responses in JSON:
+//
+//	POST /builds                 submit a build spec (YAML or JSON Config)
+//	GET  /builds                 list builds
+//	GET  /builds/{id}            query a build's status
+//	GET  /builds/{id}/log        stream a build's events, as JSON lines
+//	GET  /builds/{id}/manifest   fetch the manifest of a successful build
+//	POST /builds/{id}/cancel     cancel a build
+//	GET  /metrics                Prometheus metrics
+//
+// The log is streamed until the build completes, unless the query
+// parameter "follow=false" is specified.
+//
+// Every request must present the server's Token as a bearer token
+// ("Authorization: Bearer <token>"). Specs that set fields giving
+// access to the host (see imagebuilder.Config.HostFields) are refused
+// unless the server's AllowHostFields allows them.
+//
+// Builds are queued, and run with limited concurrency per LXD remote
+// as configured by Limits. Queued builds may be cancelled. Finished
+// builds are forgotten once they expire, or to make room for others.
+package buildserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/systemd"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/tracing"
+)
+
+// State is the state of a build.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Status describes the status of a build.
+type Status struct {
+	ID       string     `json:"id"`
+	State    State      `json:"state"`
+	Alias    string     `json:"alias"`
+	Remote   string     `json:"remote"`
+	Phase    string     `json:"phase,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Limits configures the number of builds the server
+// runs concurrently.
+type Limits struct {
+	// Concurrency is the maximum number of builds to run at once
+	// on each LXD remote, unless overridden in Remotes. If zero,
+	// builds are run one at a time.
+	Concurrency int
+
+	// Remotes holds the maximum number of builds to run at
+	// once on specific LXD remotes, keyed by remote name.
+	Remotes map[string]int
+
+	// Pending is the maximum number of builds to queue or run at
+	// once, across all remotes; further builds are refused until
+	// some finish. If zero, DefaultPending is used.
+	Pending int
+
+	// Finished is the maximum number of finished builds to remember,
+	// the oldest being forgotten first. If zero, DefaultFinished is
+	// used.
+	Finished int
+
+	// Expiry is how long finished builds are remembered for.
+	// If zero, DefaultExpiry is used.
+	Expiry time.Duration
+}
+
+const (
+	// DefaultPending is the default value of Limits.Pending.
+	DefaultPending = 100
+
+	// DefaultFinished is the default value of Limits.Finished.
+	DefaultFinished = 100
+
+	// DefaultExpiry is the default value of Limits.Expiry.
+	DefaultExpiry = 24 * time.Hour
+)
+
+// maxRequestSize is the maximum size of a submitted build spec.
+const maxRequestSize = 1 << 20
+
+// Server is an http.Handler that runs image builds.
+type Server struct {
+	// OTLPEndpoint, if non-empty, is the OTLP/HTTP collector
+	// to export a trace of each build to.
+	OTLPEndpoint string
+
+	// Journal, if true, writes the progress of each build to the
+	// systemd journal, if the server's output is connected to it,
+	// tagged with the build's ID (see systemd.Journal).
+	Journal bool
+
+	// Token is the bearer token that clients must present. If it
+	// is empty, all requests are refused.
+	Token string
+
+	// AllowHostFields holds the keys of the fields giving access to
+	// the host that specs may set, as reported by
+	// imagebuilder.Config.HostFields, e.g. "output" or
+	// "provisioner:file". Specs setting any others are refused.
+	AllowHostFields []string
+
+	// SpecDir is the directory that relative host paths in specs
+	// are interpreted relative to. AllowHostFields is ignored if
+	// SpecDir is empty, so that they are never interpreted relative
+	// to the server's working directory.
+	SpecDir string
+
+	ctx     context.Context
+	limits  Limits
+	metrics *metrics
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	builds map[string]*build
+	slots  map[string]chan struct{}
+}
+
+// New returns a new Server. Builds are run in the context of ctx;
+// cancelling it cancels all queued and running builds.
+func New(ctx context.Context, limits Limits) *Server {
+	return &Server{
+		ctx:     ctx,
+		limits:  limits,
+		metrics: newMetrics(),
+		builds:  make(map[string]*build),
+		slots:   make(map[string]chan struct{}),
+	}
+}
+
+// remoteSlots returns the semaphore limiting the number of
+// concurrent builds on the named remote.
+func (s *Server) remoteSlots(remote string) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slots, ok := s.slots[remote]
+	if !ok {
+		n, ok := s.limits.Remotes[remote]
+		if !ok {
+			n = s.limits.Concurrency
+		}
+		if n <= 0 {
+			n = 1
+		}
+		slots = make(chan struct{}, n)
+		s.slots[remote] = slots
+	}
+	return slots
+}
+
+// Wait waits for all builds to complete. This should be called
+// after cancelling the server's context, to allow builds to clean
+// up before the process exits.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+type build struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	status  Status
+	events  []imagebuilder.Event
+	result  *imagebuilder.Result
+	changed chan struct{}
+}
+
+// update calls f with the build's mutex held, and then
+// notifies any waiters that the build has changed.
+func (b *build) update(f func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f()
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// finished returns the time at which the build finished.
+func (b *build) finished() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return *b.status.Finished
+}
+
+func (b *build) done() bool {
+	return b.status.State != StateQueued && b.status.State != StateRunning
+}
+
+// ServeHTTP is part of the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="builds"`)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "metrics" {
+		s.serveMetrics(w, r)
+		return
+	}
+	if parts[0] != "builds" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listBuilds(w, r)
+		case http.MethodPost:
+			s.submitBuild(w, r)
+		default:
+			methodNotAllowed(w)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	b, ok := s.builds[parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("build %q not found", parts[1]))
+		return
+	}
+	var op string
+	if len(parts) == 3 {
+		op = parts[2]
+	}
+	switch {
+	case op == "" && r.Method == http.MethodGet:
+		b.mu.Lock()
+		status := b.status
+		b.mu.Unlock()
+		writeJSON(w, http.StatusOK, status)
+	case op == "log" && r.Method == http.MethodGet:
+		streamLog(w, r, b)
+	case op == "manifest" && r.Method == http.MethodGet:
+		b.mu.Lock()
+		result, status := b.result, b.status
+		b.mu.Unlock()
+		if result == nil {
+			writeError(w, http.StatusConflict, fmt.Errorf("build is %s", status.State))
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	case op == "cancel" && r.Method == http.MethodPost:
+		b.cancel()
+		w.WriteHeader(http.StatusAccepted)
+	case op == "" || op == "log" || op == "manifest" || op == "cancel":
+		methodNotAllowed(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized reports whether the request presents the server's token.
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if s.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// checkSpec checks that the spec sets no fields giving access
+// to the host other than those the server allows.
+func (s *Server) checkSpec(spec *imagebuilder.Config) error {
+	allowed := make(map[string]bool)
+	if s.SpecDir != "" {
+		for _, key := range s.AllowHostFields {
+			allowed[key] = true
+		}
+	}
+	var refused []string
+	for _, key := range spec.HostFields() {
+		if !allowed[key] {
+			refused = append(refused, key)
+		}
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("build spec sets fields not allowed by the server: %s", strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// addBuild records a new build, first forgetting the finished
+// builds that have expired or that there is no room for. It fails
+// if there are already the maximum number of pending builds.
+func (s *Server) addBuild(b *build) error {
+	pendingLimit, finishedLimit, expiry := s.limits.Pending, s.limits.Finished, s.limits.Expiry
+	if pendingLimit <= 0 {
+		pendingLimit = DefaultPending
+	}
+	if finishedLimit <= 0 {
+		finishedLimit = DefaultFinished
+	}
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending int
+	var finished []*build
+	for id, other := range s.builds {
+		other.mu.Lock()
+		status := other.status
+		other.mu.Unlock()
+		switch {
+		case status.Finished == nil:
+			pending++
+		case time.Since(*status.Finished) > expiry:
+			delete(s.builds, id)
+		default:
+			finished = append(finished, other)
+		}
+	}
+	if pending >= pendingLimit {
+		return fmt.Errorf("too many pending builds (%d)", pending)
+	}
+	if n := len(finished) - finishedLimit; n > 0 {
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].finished().Before(finished[j].finished())
+		})
+		for _, old := range finished[:n] {
+			delete(s.builds, old.status.ID)
+		}
+	}
+	s.builds[b.status.ID] = b
+	return nil
+}
+
+func (s *Server) listBuilds(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.builds))
+	for _, b := range s.builds {
+		b.mu.Lock()
+		statuses = append(statuses, b.status)
+		b.mu.Unlock()
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Created.Before(statuses[j].Created)
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) submitBuild(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	spec, err := imagebuilder.ParseConfig(data, s.SpecDir)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parsing build spec: %v", err))
+		return
+	}
+	if err := s.checkSpec(spec); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	opts := imagebuilder.Options{KeepSerials: imagebuilder.DefaultKeepSerials}
+	if err := spec.Apply(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	b := &build{
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		status: Status{
+			ID:      id,
+			State:   StateQueued,
+			Alias:   opts.Alias,
+			Remote:  opts.Remote,
+			Created: time.Now(),
+		},
+	}
+	if b.status.Alias == "" {
+		b.status.Alias = imagebuilder.DefaultAlias
+	}
+	if b.status.Remote == "" {
+		b.status.Remote = "local"
+	}
+	opts.OnEvent = func(e imagebuilder.Event) {
+		b.update(func() {
+			b.events = append(b.events, e)
+			if e.Type == imagebuilder.EventPhaseStarted {
+				b.status.Phase = e.Phase
+			}
+		})
+	}
+	var tracer *tracing.Tracer
+	if s.OTLPEndpoint != "" {
+		tracer = tracing.New(s.OTLPEndpoint, map[string]string{
+			"build.id":    id,
+			"build.alias": b.status.Alias,
+		})
+		onEvent := opts.OnEvent
+		opts.OnEvent = func(e imagebuilder.Event) {
+			onEvent(e)
+			tracer.OnEvent(e)
+		}
+	}
+	var journal *systemd.Journal
+	if s.Journal {
+		if journal, err = systemd.NewJournal(map[string]string{
+			systemd.FieldBuildID: id,
+			systemd.FieldAlias:   b.status.Alias,
+		}); err != nil {
+			log.Printf("Writing build %s to the journal: %v", id, err)
+		}
+		if journal != nil {
+			onEvent := opts.OnEvent
+			opts.OnEvent = func(e imagebuilder.Event) {
+				onEvent(e)
+				journal.OnEvent(e)
+			}
+		}
+	}
+	builder, err := imagebuilder.New(opts)
+	if err != nil {
+		cancel()
+		if journal != nil {
+			journal.Finish(err)
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := s.addBuild(b); err != nil {
+		cancel()
+		if journal != nil {
+			journal.Finish(err)
+		}
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	slots := s.remoteSlots(b.status.Remote)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+
+		// Wait for a free slot on the remote.
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			if journal != nil {
+				journal.Finish(ctx.Err())
+			}
+			b.update(func() {
+				now := time.Now()
+				b.status.State = StateCancelled
+				b.status.Finished = &now
+				s.metrics.buildFinished(b.status, nil)
+			})
+			return
+		}
+		b.update(func() {
+			now := time.Now()
+			b.status.State = StateRunning
+			b.status.Started = &now
+		})
+
+		result, err := builder.Build(ctx)
+		if tracer != nil {
+			if err := tracer.Export(context.Background(), err); err != nil {
+				log.Printf("Exporting trace of build %s: %v", id, err)
+			}
+		}
+		if journal != nil {
+			journal.Finish(err)
+		}
+		b.update(func() {
+			now := time.Now()
+			b.status.Finished = &now
+			switch {
+			case err == nil:
+				b.status.State = StateSucceeded
+				b.result = result
+			case ctx.Err() != nil:
+				b.status.State = StateCancelled
+				b.status.Error = err.Error()
+			default:
+				b.status.State = StateFailed
+				b.status.Error = err.Error()
+			}
+			s.metrics.buildFinished(b.status, result)
+		})
+	}()
+
+	b.mu.Lock()
+	status := b.status
+	b.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// streamLog writes the build's events to w as JSON lines,
+// following new events until the build completes or the
+// client goes away.
+func streamLog(w http.ResponseWriter, r *http.Request, b *build) {
+	follow := r.URL.Query().Get("follow") != "false"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var next int
+	for {
+		b.mu.Lock()
+		events := b.events[next:]
+		next = len(b.events)
+		done := b.done()
+		changed := b.changed
+		b.mu.Unlock()
+
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done || !follow {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func newID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+}
@@ -0,0 +1,178 @@
+package buildserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+func newTestServer() *Server {
+	s := New(context.Background(), Limits{})
+	s.Token = "sekrit"
+	return s
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := newTestServer()
+	for _, auth := range []string{"", "Bearer wrong", "sekrit", "Basic c2Vrcml0"} {
+		req := httptest.NewRequest(http.MethodGet, "/builds", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d, expected %d", auth, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// With no token, every request is refused.
+	s.Token = ""
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got status %d, expected %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	s := newTestServer()
+	req := httptest.NewRequest(http.MethodGet, "/builds", nil)
+	req.Header.Set("Authorization", "Bearer sekrit")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
+
+func TestCheckSpecRefusesHostFields(t *testing.T) {
+	for _, test := range []struct {
+		spec  imagebuilder.Config
+		field string
+	}{
+		{imagebuilder.Config{ScanCommand: "/bin/sh"}, "scan-command"},
+		{imagebuilder.Config{OutputDir: "/etc"}, "output"},
+		{imagebuilder.Config{HistoryFile: "../history"}, "history-file"},
+		{imagebuilder.Config{LogsDir: "logs"}, "logs-dir"},
+		{imagebuilder.Config{DiagnosticsDir: "/tmp"}, "diagnostics-dir"},
+		{imagebuilder.Config{Privileged: true}, "privileged"},
+		{imagebuilder.Config{
+			ImageFiles: []imagebuilder.ImageFileConfig{{Source: "/etc/shadow", Destination: "/root/shadow"}},
+		}, "image-files"},
+		{imagebuilder.Config{
+			Provisioners: []imagebuilder.ProvisionerConfig{{Type: "exec", Command: "rm", Args: []string{"-rf", "/"}}},
+		}, "provisioner:exec"},
+		{imagebuilder.Config{
+			Provisioners: []imagebuilder.ProvisionerConfig{{Type: "file", Source: "/etc/shadow", Destination: "/tmp/shadow"}},
+		}, "provisioner:file"},
+		{imagebuilder.Config{
+			Devices: map[string]map[string]string{"root": {"type": "disk", "source": "/", "path": "/host"}},
+		}, "devices"},
+		{imagebuilder.Config{
+			ContainerConfig: map[string]string{"raw.lxc": "lxc.apparmor.profile=unconfined"},
+		}, "container-config:raw.lxc"},
+		{imagebuilder.Config{
+			LaunchConfig: map[string]string{"linux.kernel_modules": "ip_vs"},
+		}, "container-config:linux.kernel_modules"},
+		{imagebuilder.Config{
+			Devices: map[string]map[string]string{"eth1": {"type": "nic", "nictype": "physical", "parent": "eno1"}},
+		}, "devices:nic"},
+		{imagebuilder.Config{BuildSecrets: []string{"TOKEN=env:HOME"}}, "build-secrets"},
+		{imagebuilder.Config{Remote: "production"}, "remote"},
+		{imagebuilder.Config{PushRemotes: []string{"production"}}, "push-remotes"},
+		{imagebuilder.Config{PushPublic: true}, "push-public"},
+		{imagebuilder.Config{JujuRemote: "production"}, "juju-remote"},
+		{imagebuilder.Config{JujuTest: true}, "juju-test"},
+		{imagebuilder.Config{ImageServer: "https://images.internal:8443"}, "image-server"},
+		{imagebuilder.Config{Notifications: []imagebuilder.Notification{
+			{Type: imagebuilder.NotifySlack, Webhook: "http://169.254.169.254/latest/meta-data"},
+		}}, "notifications:slack"},
+		{imagebuilder.Config{Notifications: []imagebuilder.Notification{
+			{Type: imagebuilder.NotifySMTP, Server: "10.0.0.1:25", From: "a@example.com", To: []string{"b@example.com"}},
+		}}, "notifications:smtp"},
+		{imagebuilder.Config{Notifications: []imagebuilder.Notification{
+			{Type: imagebuilder.NotifyMatrix, Homeserver: "http://localhost:6167", Room: "!a:b", AccessToken: "t"},
+		}}, "notifications:matrix"},
+	} {
+		s := newTestServer()
+		err := s.checkSpec(&test.spec)
+		if err == nil || !strings.HasSuffix(err.Error(), ": "+test.field) {
+			t.Errorf("%s: got error %v", test.field, err)
+		}
+	}
+}
+
+func TestCheckSpecAllowHostFields(t *testing.T) {
+	spec := &imagebuilder.Config{
+		OutputDir:       "/srv/specs/images",
+		Devices:         map[string]map[string]string{"cache": {"type": "none"}},
+		ContainerConfig: map[string]string{"limits.memory": "4GiB"},
+		Provisioners: []imagebuilder.ProvisionerConfig{
+			{Type: "shell", Commands: []string{"true"}},
+			{Type: "file", Source: "/srv/specs/files/motd", Destination: "/etc/motd"},
+		},
+	}
+	if fields := strings.Join(spec.HostFields(), ","); fields != "output,provisioner:file" {
+		t.Fatalf("got host fields %q", fields)
+	}
+
+	s := newTestServer()
+	s.AllowHostFields = []string{"output", "provisioner:file"}
+	if err := s.checkSpec(spec); err == nil {
+		t.Errorf("host fields allowed without a spec directory")
+	}
+	s.SpecDir = "/srv/specs"
+	if err := s.checkSpec(spec); err != nil {
+		t.Errorf("allowed host fields refused: %v", err)
+	}
+	s.AllowHostFields = []string{"output"}
+	if err := s.checkSpec(spec); err == nil || !strings.Contains(err.Error(), "provisioner:file") {
+		t.Errorf("got error %v, expected provisioner:file to be refused", err)
+	}
+}
+
+func TestAddBuildLimits(t *testing.T) {
+	s := New(context.Background(), Limits{Pending: 2, Finished: 2, Expiry: time.Hour})
+	newBuild := func(id string, finished time.Duration) *build {
+		b := &build{status: Status{ID: id}, changed: make(chan struct{})}
+		if finished != 0 {
+			t := time.Now().Add(-finished)
+			b.status.State = StateSucceeded
+			b.status.Finished = &t
+		}
+		return b
+	}
+	for _, b := range []*build{
+		newBuild("expired", 2*time.Hour),
+		newBuild("old", 30*time.Minute),
+		newBuild("older", 40*time.Minute),
+		newBuild("new", time.Minute),
+		newBuild("pending1", 0),
+	} {
+		s.builds[b.status.ID] = b
+	}
+	if err := s.addBuild(newBuild("pending2", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"expired", "older"} {
+		if _, ok := s.builds[id]; ok {
+			t.Errorf("build %q not forgotten", id)
+		}
+	}
+	for _, id := range []string{"old", "new", "pending1", "pending2"} {
+		if _, ok := s.builds[id]; !ok {
+			t.Errorf("build %q forgotten", id)
+		}
+	}
+	if err := s.addBuild(newBuild("pending3", 0)); err == nil {
+		t.Errorf("expected too many pending builds")
+	}
+}
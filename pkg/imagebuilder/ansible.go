@@ -0,0 +1,54 @@
+package imagebuilder
+
+import (
+	"context"
+)
+
+// ansibleConnection is the Ansible connection plugin used to run
+// playbooks against the build container, via the "lxc" client.
+const ansibleConnection = "community.general.lxd"
+
+// AnsibleProvisioner is a Provisioner that runs an Ansible playbook
+// on the host against the container, with the lxd connection plugin
+// from the community.general collection, so existing roles can be
+// reused. The container is the only host in the inventory, so
+// playbooks should target "all". Modules are run with the python
+// interpreter in the container, as for any other host.
+//
+// Build arguments are set in ansible-playbook's environment, and
+// may be read in the playbook with the "env" lookup.
+type AnsibleProvisioner struct {
+	// Playbook is the path of the playbook on the host.
+	Playbook string
+
+	// RolesPath, if non-empty, is the colon-separated list of
+	// directories on the host in which to look for roles, as for
+	// ANSIBLE_ROLES_PATH.
+	RolesPath string
+
+	// Args holds additional arguments to pass to ansible-playbook,
+	// e.g. "--extra-vars" or "--tags".
+	Args []string
+}
+
+// Run is part of the Provisioner interface.
+func (p AnsibleProvisioner) Run(ctx context.Context, container string) error {
+	remote, name := splitImage(container)
+	// The trailing comma makes the inventory a list
+	// of hosts, rather than the path of a file.
+	args := []string{"--inventory", name + ",", "--connection", ansibleConnection}
+	if remote != "" {
+		args = append(args, "--extra-vars", "ansible_lxd_remote="+remote)
+	}
+	args = append(args, p.Args...)
+	args = append(args, p.Playbook)
+
+	env := []string{"ANSIBLE_NOCOLOR=1"}
+	if p.RolesPath != "" {
+		env = append(env, "ANSIBLE_ROLES_PATH="+p.RolesPath)
+	}
+	if a := contextBuildArgs(ctx); a != nil {
+		env = append(env, a.env...)
+	}
+	return runEnv(ctx, env, "ansible-playbook", args...)
+}
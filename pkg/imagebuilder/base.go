@@ -0,0 +1,194 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitImage splits an image reference of the form
+// "[remote:]alias-or-fingerprint" into its parts.
+func splitImage(image string) (remote, name string) {
+	if i := strings.IndexRune(image, ':'); i != -1 {
+		return image[:i], image[i+1:]
+	}
+	return "", image
+}
+
+// findBaseImage returns the first of the base image and its fallbacks
+// (see Options.ImageFallbacks) that is found, as specified, and as
+// the reference to launch the build container from, failing with
+// ErrBaseImageNotFound if none is. The returned function must be
+// called once the image is no longer needed. auth applies to
+// opts.ImageServer.
+func findBaseImage(ctx context.Context, opts Options, auth *imageServerAuth) (string, string, func(), error) {
+	candidates := append([]string{opts.Image}, opts.ImageFallbacks...)
+	for i, name := range candidates {
+		opts.Image = name
+		image, cleanup, err := resolveBaseImage(ctx, opts, auth)
+		if err != nil && (i == len(candidates)-1 || !errors.Is(err, ErrBaseImageNotFound)) {
+			return "", "", nil, err
+		}
+		if err == nil && imageExists(ctx, image) {
+			if i > 0 {
+				logf(ctx, "Warning: base image %s not found; using fallback %s", candidates[0], name)
+			}
+			return name, image, cleanup, nil
+		}
+		if err == nil {
+			cleanup()
+		}
+		if i < len(candidates)-1 {
+			logf(ctx, "Base image %s not found; trying %s", name, candidates[i+1])
+		}
+	}
+	if len(opts.ImageFallbacks) > 0 {
+		return "", "", nil, fmt.Errorf(
+			"%w: tried %s", ErrBaseImageNotFound, strings.Join(candidates, ", "),
+		)
+	}
+	return "", "", nil, fmt.Errorf(
+		"%w: %s (public image servers drop old releases; specify another "+
+			"image, or fallbacks such as a mirror or a pinned fingerprint with -image-fallback)",
+		ErrBaseImageNotFound, opts.Image,
+	)
+}
+
+// resolveBaseImage returns the reference to launch the build container
+// from for the base image, opts.Image, along with a function to call
+// once it is no longer needed: images are downloaded by the LXD server
+// for builds without host network access, and looked up on the image
+// server through a temporary remote if one is specified.
+func resolveBaseImage(ctx context.Context, opts Options, auth *imageServerAuth) (string, func(), error) {
+	if opts.NoHostNetwork && opts.Base == "" {
+		return serverBaseImage(ctx, opts, auth)
+	}
+	if opts.ImageServer != "" {
+		remote, cleanup, err := imageServerRemote(ctx, opts.ImageServer, auth)
+		if err != nil {
+			return "", nil, err
+		}
+		return qualify(remote, opts.Image), cleanup, nil
+	}
+	return opts.Image, func() {}, nil
+}
+
+// verifyBaseFingerprint checks that the base image's fingerprint
+// matches the expected fingerprint, which may be abbreviated to a
+// prefix of at least 12 characters.
+func verifyBaseFingerprint(image, fingerprint, expected string) error {
+	expected = strings.ToLower(expected)
+	if len(expected) < 12 || !strings.HasPrefix(fingerprint, expected) {
+		return fmt.Errorf(
+			"%w: %s has fingerprint %s, expected %s",
+			ErrBaseImageUnverified, image, fingerprint, expected,
+		)
+	}
+	return nil
+}
+
+// verifyBaseSignature checks that the base image's fingerprint is
+// listed in the simplestreams metadata of the image's remote, and
+// that the metadata is signed by a key in the given GPG keyring.
+// The remote must be a simplestreams image server, such as the
+// default "images:" remote. If auth is non-nil, the metadata is
+// fetched trusting its CA certificate and with its credentials.
+func verifyBaseSignature(ctx context.Context, image, fingerprint, keyring string, auth *imageServerAuth) error {
+	remote, _ := splitImage(image)
+	if remote == "" {
+		return fmt.Errorf("%w: %s is not on a simplestreams remote", ErrBaseImageUnverified, image)
+	}
+	remotes, err := listRemotes(ctx)
+	if err != nil {
+		return err
+	}
+	addr := remotes[remote].Addr
+	if !remotes[remote].imageServer() {
+		return fmt.Errorf("%w: remote %q is not a simplestreams server", ErrBaseImageUnverified, remote)
+	}
+
+	signed, err := ioutil.TempFile("", "juju-lxd-centos-images-*.sjson")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(signed.Name())
+	defer signed.Close()
+	url := strings.TrimSuffix(addr, "/") + "/streams/v1/images.sjson"
+	logf(ctx, "Verifying %s against %s", image, redactCredentials(url))
+	resp, err := auth.get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	if _, err := io.Copy(signed, resp.Body); err != nil {
+		return fmt.Errorf("fetching %s: %v", url, err)
+	}
+	if err := signed.Close(); err != nil {
+		return err
+	}
+
+	// gpgv looks for keyrings named without a directory in
+	// the GnuPG home directory, so make the path absolute.
+	if keyring, err = filepath.Abs(keyring); err != nil {
+		return err
+	}
+	verified := signed.Name() + ".json"
+	defer os.Remove(verified)
+	if err := run(ctx, "gpgv", "--keyring", keyring, "--output", verified, signed.Name()); err != nil {
+		return fmt.Errorf("%w: verifying signature of %s: %v", ErrBaseImageUnverified, url, err)
+	}
+	data, err := ioutil.ReadFile(verified)
+	if err != nil {
+		return err
+	}
+	if !streamsContainFingerprint(data, fingerprint) {
+		return fmt.Errorf(
+			"%w: %s (fingerprint %s) is not listed in the signed metadata at %s",
+			ErrBaseImageUnverified, image, fingerprint, url,
+		)
+	}
+	return nil
+}
+
+// streamsContainFingerprint reports whether the simplestreams product
+// metadata lists an image with the given fingerprint. LXD fingerprints
+// are the SHA-256 hash of unified image tarballs, and of the metadata
+// and rootfs concatenated for split images, which simplestreams
+// records in the "combined_*sha256" fields of the metadata item.
+func streamsContainFingerprint(data []byte, fingerprint string) bool {
+	var products struct {
+		Products map[string]struct {
+			Versions map[string]struct {
+				Items map[string]map[string]interface{} `json:"items"`
+			} `json:"versions"`
+		} `json:"products"`
+	}
+	if err := json.Unmarshal(data, &products); err != nil {
+		return false
+	}
+	for _, product := range products.Products {
+		for _, version := range product.Versions {
+			for _, item := range version.Items {
+				for key, value := range item {
+					if key != "sha256" && !(strings.HasPrefix(key, "combined_") && strings.HasSuffix(key, "sha256")) {
+						continue
+					}
+					if value == fingerprint {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// buildArgsPath is where the build arguments are written in the build
+// container, as a shell script assigning them. /run is a tmpfs, so
+// the file is never written to the container's root filesystem, nor
+// captured in snapshots or the published image.
+const buildArgsPath = "/run/juju-lxd-centos/build-args"
+
+// loadBuildArgsShell returns the shell commands to prepend to
+// commands to export the build arguments in the file to them.
+func loadBuildArgsShell(path string) string {
+	return "set -a; . " + path + "; set +a; "
+}
+
+var buildArgNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// buildArgs holds the build arguments and secrets (see
+// Options.BuildArgs and Options.BuildSecrets) made available
+// to provisioning steps.
+type buildArgs struct {
+	// env holds the arguments and secrets as key=value.
+	env []string
+
+	// secrets holds the names of the secrets.
+	secrets []string
+}
+
+// loadBuildArgs parses the build arguments, and reads the build
+// secrets from their sources. If there are neither, it returns nil.
+func loadBuildArgs(args, secrets []string) (*buildArgs, error) {
+	if len(args) == 0 && len(secrets) == 0 {
+		return nil, nil
+	}
+	a := &buildArgs{}
+	seen := make(map[string]bool)
+	add := func(name, value string) error {
+		if !buildArgNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid build argument name %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("build argument %q specified more than once", name)
+		}
+		seen[name] = true
+		a.env = append(a.env, name+"="+value)
+		return nil
+	}
+	for _, arg := range args {
+		i := strings.IndexRune(arg, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid build argument %q, expected KEY=VALUE", arg)
+		}
+		if err := add(arg[:i], arg[i+1:]); err != nil {
+			return nil, err
+		}
+	}
+	for _, secret := range secrets {
+		i := strings.IndexRune(secret, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid build secret %q, expected KEY=file:PATH or KEY=env:NAME", secret)
+		}
+		name, source := secret[:i], secret[i+1:]
+		var value string
+		switch {
+		case strings.HasPrefix(source, "file:"):
+			data, err := ioutil.ReadFile(strings.TrimPrefix(source, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("reading build secret %s: %v", name, err)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		case strings.HasPrefix(source, "env:"):
+			value = os.Getenv(strings.TrimPrefix(source, "env:"))
+		default:
+			return nil, fmt.Errorf("invalid build secret %q, expected KEY=file:PATH or KEY=env:NAME", secret)
+		}
+		if value == "" {
+			// An empty secret would match every file
+			// when checking that secrets were scrubbed.
+			return nil, fmt.Errorf("build secret %s is empty", name)
+		}
+		if err := add(name, value); err != nil {
+			return nil, err
+		}
+		a.secrets = append(a.secrets, name)
+	}
+	return a, nil
+}
+
+// secretValues returns the values of the build secrets.
+func (a *buildArgs) secretValues() []string {
+	if a == nil {
+		return nil
+	}
+	var values []string
+	for _, kv := range a.env {
+		i := strings.IndexRune(kv, '=')
+		for _, name := range a.secrets {
+			if kv[:i] == name {
+				values = append(values, kv[i+1:])
+			}
+		}
+	}
+	return values
+}
+
+// buildArgNames returns the sorted names of the build
+// arguments (key=value), to record in place of their values.
+func buildArgNames(args []string) []string {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		if i := strings.IndexRune(arg, '='); i != -1 {
+			arg = arg[:i]
+		}
+		names = append(names, arg)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// push writes the build arguments to the container, via a
+// temporary file in tmpdir, readable only by the owner.
+func (a *buildArgs) push(ctx context.Context, container, tmpdir string) error {
+	var script strings.Builder
+	for _, kv := range a.env {
+		i := strings.IndexRune(kv, '=')
+		fmt.Fprintf(&script, "%s=%s\n", kv[:i], shellQuote(kv[i+1:]))
+	}
+	f, err := ioutil.TempFile(tmpdir, "build-args")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	push := FileProvisioner{
+		Source:      f.Name(),
+		Destination: buildArgsPath,
+		Mode:        0600,
+	}
+	return push.Run(ctx, container)
+}
+
+// remove removes the build arguments from the container,
+// along with any copies made for other users.
+func (a *buildArgs) remove(ctx context.Context, container string) error {
+	return lxc(ctx, "exec", container, "--", "/bin/sh", "-c", "rm -f "+buildArgsPath+" "+buildArgsPath+".*")
+}
+
+// shellQuote quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+type buildArgsKey struct{}
+
+// withBuildArgs returns a context that causes provisioners
+// to make the build arguments available to their commands.
+func withBuildArgs(ctx context.Context, a *buildArgs) context.Context {
+	if a == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, buildArgsKey{}, a)
+}
+
+// contextBuildArgs returns the context's build arguments,
+// or nil if there are none.
+func contextBuildArgs(ctx context.Context) *buildArgs {
+	a, _ := ctx.Value(buildArgsKey{}).(*buildArgs)
+	return a
+}
+
+// scrubBuildArgs is a Provisioner that removes traces of the build
+// arguments from the container: shell history is removed, logs in
+// /var/log that contain secrets are truncated, and the build fails
+// if secrets are found in any other files.
+type scrubBuildArgs struct{}
+
+// Run is part of the Provisioner interface.
+func (scrubBuildArgs) Run(ctx context.Context, container string) error {
+	if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c",
+		"rm -f /root/.bash_history /home/*/.bash_history",
+	); err != nil {
+		return err
+	}
+	a := contextBuildArgs(ctx)
+	if a == nil || len(a.secrets) == 0 {
+		return nil
+	}
+	// Refer to the secrets by variable name,
+	// so their values are never in the command.
+	var patterns []string
+	for _, name := range a.secrets {
+		patterns = append(patterns, fmt.Sprintf(`-e "$%s"`, name))
+	}
+	grep := "-type f -exec grep -lsF " + strings.Join(patterns, " ") + " {} +"
+	if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c", loadBuildArgsShell(buildArgsPath)+
+		"find /var/log -xdev "+grep+` | while IFS= read -r f; do : > "$f"; done`,
+	); err != nil {
+		return err
+	}
+	// The root filesystem only: -xdev skips /proc,
+	// /sys, /dev and /run, which hold the secrets.
+	out, err := runOutput(ctx, "lxc", "exec", container, "--", "/bin/sh", "-c", loadBuildArgsShell(buildArgsPath)+
+		"find / -xdev "+grep+" || true",
+	)
+	if err != nil {
+		return err
+	}
+	if files := strings.Fields(string(out)); len(files) > 0 {
+		return fmt.Errorf("build secrets found in image files: %s", strings.Join(files, ", "))
+	}
+	return nil
+}
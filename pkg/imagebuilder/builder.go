@@ -0,0 +1,1928 @@
+// Package imagebuilder builds Juju-compatible CentOS LXD images.
+//
+// A build launches a container from a base image, provisions it,
+// publishes it as an image, and then rewrites the image to include
+// cloud-init templates so that Juju can configure instances
+// launched from it.
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/ratelimit"
+)
+
+const (
+	// DefaultImage is the default base image to build from.
+	DefaultImage = "images:centos/7"
+
+	// DefaultAlias is the default alias to publish the image under.
+	DefaultAlias = "juju/centos7/amd64"
+
+	// DefaultKeepSerials is the default number of builds
+	// of an alias to keep.
+	DefaultKeepSerials = 3
+)
+
+const (
+	// KeepOnFailure keeps the build directory, container and
+	// logs only if the build fails.
+	KeepOnFailure = "failure"
+
+	// KeepAlways keeps the build directory, container and
+	// logs whether or not the build fails.
+	KeepAlways = "always"
+)
+
+// Options holds the options for a build.
+type Options struct {
+	// Image is the base image to build from. If empty,
+	// DefaultImage is used.
+	Image string
+
+	// ImageFallbacks holds images to build from, in order, if Image
+	// is not found, as public image servers drop old releases: e.g. a
+	// mirror ("mirror:centos/7"), the image pinned by fingerprint, or
+	// an alternative release ("images:centos/7/cloud"). They are looked
+	// up as Image is; the image used is recorded in Result.BaseImage,
+	// and BaseFingerprint and BaseKeyring apply to it.
+	ImageFallbacks []string
+
+	// Base, if non-empty, is the alias of an image built by this
+	// package to build from instead of Image, for layered builds
+	// (e.g. hardened base, then Juju-ready, then team-specific).
+	// The image must be in the build remote's image store.
+	Base string
+
+	// VM, if true, builds a virtual machine image: the build instance
+	// is launched with "lxc launch --vm", and published as a VM image.
+	// The base image must be a VM image: BaseQCOW2, or Base, if it was
+	// built with VM. VM images are published as their metadata tarball
+	// and qcow2 root disk, which files cannot be added to; they cannot
+	// be written reproducibly, nor to a simplestreams tree, nor tested
+	// with TestScenarios or JujuTest, which launch containers.
+	VM bool
+
+	// BaseQCOW2, if non-empty, is the path of a qcow2 cloud image to
+	// build from instead of Image, such as a CentOS or Rocky Linux
+	// GenericCloud image, for VM builds. It is imported into the build
+	// remote's image store as a VM image, with generated metadata, and
+	// deleted once the build VM is launched, unless it was there
+	// already. Cloud images have no LXD agent, so the build VM is given
+	// LXD's agent and cloud-init drives, and cloud-init vendor-data
+	// that installs the agent; the agent is kept in the image, and
+	// cloud-init reset, as for UserData.
+	BaseQCOW2 string
+
+	// SkipUnchanged, if true, skips the build if the image with
+	// the alias was built from the same base image (by fingerprint)
+	// with the same inputs: profiles, provisioners and the files
+	// they copy, and offline repositories. Running the builds of
+	// a layered pipeline in order with SkipUnchanged rebuilds only
+	// the layers affected by a change.
+	SkipUnchanged bool
+
+	// SerialOnChange, if true, only publishes a new serial of the
+	// alias if the build changes the image it would replace: its
+	// packages, or the build's inputs. Otherwise the new image is
+	// discarded once provisioned, and the build reported as skipped.
+	// Unlike SkipUnchanged, this catches builds that reproduce the
+	// image from a new base image, or from package repositories
+	// with no updates.
+	SerialOnChange bool
+
+	// Cache, if true, caches the build container's state after each
+	// provisioning step in LXD snapshots, keyed by the base image and
+	// the contents of the steps up to and including it. Subsequent
+	// builds of the alias restore the deepest unchanged step, and run
+	// only the steps after it. The snapshots are kept on the build
+	// remote, in a stopped container named "juju-lxd-centos-cache-*".
+	Cache bool
+
+	// Alias is the alias to publish the image under. If empty,
+	// DefaultAlias is used.
+	Alias string
+
+	// Remote is the lxc remote on which to run the build and
+	// publish the image. If empty, the default remote is used.
+	Remote string
+
+	// Keep controls when the build directory and container are
+	// kept rather than removed when the build completes: never if
+	// empty, KeepOnFailure or KeepAlways.
+	Keep string
+
+	// Profiles holds the names of the optional provisioning
+	// profiles to apply. See ProfileNames.
+	Profiles []string
+
+	// Provisioners holds additional provisioning steps to run,
+	// in order, after the profiles have been applied.
+	Provisioners []Provisioner
+
+	// Hooks holds shell commands to run in the build container
+	// at well-defined points of provisioning, keyed by hook point:
+	// HookPrePackages, HookPostPackages, HookPreCleanup or
+	// HookPrePublish. The commands of each hook point run in order,
+	// as a single step.
+	Hooks map[string][]string
+
+	// BuildPackages holds the names of packages, such as compilers
+	// and debuginfo packages, to install before the profiles and
+	// provisioners run, and to remove, with the dependencies
+	// installed for them alone, once they have. Packages already
+	// installed in the base image are left alone; packages that
+	// provisioners install depending on build packages are removed
+	// with them.
+	BuildPackages []string
+
+	// ImageServer, if non-empty, is the URL of a simplestreams image
+	// server to take the base image from, such as an internal mirror
+	// of the "images:" remote. Image must then be unqualified (e.g.
+	// "centos/9"). If no lxc remote has the server's address, one is
+	// added for the duration of the build.
+	ImageServer string
+
+	// ImageServerCA, if non-empty, is the path of a PEM certificate
+	// to trust for ImageServer's HTTPS certificate: that of the
+	// private CA that issued it, or the server's own. The system
+	// trust store is not used for the server, nor modified.
+	ImageServerCA string
+
+	// ImageServerAuthFile, if non-empty, is the path of a file
+	// holding the credentials for ImageServer, as user:password,
+	// sent with HTTP basic authentication (as "serve-images
+	// -basic-auth-file" requires). The password is masked in
+	// logs and events.
+	//
+	// With ImageServerCA or ImageServerAuthFile, a temporary remote
+	// is always added for ImageServer, rather than using an
+	// existing remote with its address.
+	ImageServerAuthFile string
+
+	// BaseFingerprint, if non-empty, is the expected fingerprint of
+	// the base image, or a prefix of it of at least 12 characters.
+	// The build fails with ErrBaseImageUnverified if the base image
+	// has a different fingerprint.
+	BaseFingerprint string
+
+	// AllowOSMismatch, if true, allows building from a base image
+	// whose distribution, release or architecture, as read from
+	// /etc/os-release and "uname -m" in the build container, does
+	// not match the alias, e.g. a Rocky Linux image published as
+	// "juju/centos9/amd64". Otherwise, if the alias has the form
+	// "juju/<id><release>/<arch>[/<variant>]", the build fails
+	// with ErrOSMismatch before provisioning starts.
+	AllowOSMismatch bool
+
+	// BaseKeyring, if non-empty, is a GPG keyring to verify the base
+	// image with. The base image must be on a simplestreams remote,
+	// and listed in its signed metadata (streams/v1/images.sjson),
+	// or the build fails with ErrBaseImageUnverified.
+	BaseKeyring string
+
+	// Offline, if true, builds without access to the internet.
+	// Packages are installed only from LocalRepo and the
+	// repositories in RepoFiles, which replace the base image's
+	// repositories for the duration of the build, and New fails
+	// with ErrNeedsNetwork if other options would require the
+	// internet, such as a base image on the "images:" remote.
+	Offline bool
+
+	// NoHostNetwork, if true, builds on a host without access to the
+	// internet, whose LXD server (or its proxy) has access. Base
+	// images on simplestreams remotes, or on ImageServer, are
+	// downloaded by the LXD server rather than through the lxc
+	// client, and New fails with ErrNeedsNetwork if other options
+	// would require the host to access the internet, such as
+	// BaseKeyring or Upload.
+	NoHostNetwork bool
+
+	// NoContainerNetwork, if true, builds in a container without
+	// network connectivity, or without access to the internet. The
+	// build does not wait for the container to acquire connectivity,
+	// and packages are installed only from LocalRepo, which must be
+	// specified, and the repositories in RepoFiles, as for offline
+	// builds. Unlike Offline, other options are not restricted, as
+	// the host may still access the internet.
+	NoContainerNetwork bool
+
+	// NetworkWait holds the criteria for the build container's network
+	// to be ready, which the build waits for after launching it (and
+	// after restoring it to retry a step), unless it has no network.
+	NetworkWait NetworkWait
+
+	// DNS holds the addresses of up to three nameservers for the build
+	// container to use instead of those its network configures, e.g.
+	// where the LXD bridge hands out nameservers that cannot resolve
+	// the package mirrors. They are set before waiting for the network,
+	// for the duration of the build only: the published image uses the
+	// nameservers it is given when launched.
+	DNS []string
+
+	// NIC pins the MAC and IP addresses of the build container's
+	// network device, e.g. where firewall rules or repository ACLs
+	// permit traffic by source address. The device's config is
+	// overridden before the container first starts.
+	NIC NIC
+
+	// LocalRepo is a directory on the host holding a yum
+	// repository, which is mounted into the build container
+	// for offline builds, and builds without container network.
+	// The build then does not wait for the container to acquire
+	// network connectivity.
+	LocalRepo string
+
+	// RepoFiles holds the paths of yum .repo files on the host,
+	// e.g. for internal mirrors, to install in the build
+	// container for offline builds, and builds without
+	// container network.
+	RepoFiles []string
+
+	// UserData, if non-empty, is the path of a cloud-init user-data
+	// file to apply to the build container at launch, by setting its
+	// user.user-data config key. The build waits for cloud-init to
+	// finish before running the provisioners, and resets cloud-init
+	// afterwards, so that instances of the image run it again with
+	// their own user-data. The base image must have cloud-init
+	// installed, e.g. images:centos/7/cloud.
+	UserData string
+
+	// Devices holds additional devices to add to the build container
+	// at launch, keyed by name, each described by its LXD device
+	// config including "type"; e.g. a disk device sharing a host
+	// directory as an artifact cache. The devices are removed from
+	// the container before it is published.
+	Devices map[string]map[string]string
+
+	// ContainerConfig holds LXD config to set on the build container
+	// at launch, e.g. "security.nesting": "true". The keys are unset
+	// before the container is published.
+	ContainerConfig map[string]string
+
+	// Privileged, if true, runs the build container privileged
+	// (security.privileged), for provisioning steps that do not work
+	// in unprivileged containers. As with ContainerConfig, the key
+	// is unset before the container is published, and the image
+	// records no instance config, so instances of the image need
+	// not be privileged.
+	Privileged bool
+
+	// SELinux is the SELinux labelling mode: SELinuxAuto (the
+	// default, if empty), SELinuxRelabel or SELinuxOff.
+	SELinux string
+
+	// Description, if non-empty, is the description to publish the
+	// image with, replacing the base image's. It may refer to the
+	// variables in TemplateVariables, e.g. "CentOS {{release}} for
+	// Juju, built {{date}}".
+	Description string
+
+	// Properties holds additional user.* properties to publish the
+	// image with. Their values may refer to variables, as for
+	// Description.
+	Properties map[string]string
+
+	// RecommendedConfig holds the instance config recommended for
+	// launching the image, e.g. "limits.memory": "2GiB", or
+	// "security.nesting": "true" for images that run containers. It
+	// is recorded in the image properties, prefixed with
+	// PropertyRecommendedPrefix, and shown by "describe"; it is not
+	// applied to instances of the image.
+	RecommendedConfig map[string]string
+
+	// ImageFormat is the format of the published image:
+	// ImageFormatUnified (the default, if empty), a single tarball
+	// holding the metadata and rootfs, or ImageFormatSplit, separate
+	// metadata and rootfs tarballs. Split images are written directly
+	// from an export of the build container, rather than publishing
+	// it and rewriting the exported image, which saves several minutes
+	// for large images. They cannot be written to a simplestreams tree
+	// (OutputDir or Upload).
+	ImageFormat string
+
+	// MaxSize, if positive, is the maximum size of the published
+	// image (see Result.Size), in bytes. Larger images fail the
+	// build with ErrTooLarge before they are imported.
+	MaxSize int64
+
+	// SkipSpaceCheck, if true, skips checking that the build
+	// directory has space for the build before launching the
+	// build container. The space needed is estimated from the
+	// size of the base image: about three times as much, or
+	// four times for split images.
+	SkipSpaceCheck bool
+
+	// TemplateSet is the name of the set of templates to add to the
+	// image, for LXD to render into its instances: one of TemplateSets,
+	// or the built-in TemplateSetNoCloudClassic (the default, if
+	// empty), TemplateSetLXDDatasource or TemplateSetStaticNetwork.
+	TemplateSet string
+
+	// TemplateSets holds additional template sets, keyed by name.
+	// They may not redefine the built-in sets.
+	TemplateSets map[string]TemplateSet
+
+	// TemplateTriggers overrides the events on which LXD renders the
+	// templates, keyed by the base name of the file rendered, e.g.
+	// "meta-data", "network-config", "user-data" or "vendor-data" for
+	// the default template set. The events are "create", "copy" and
+	// "start"; by default, the built-in templates are rendered on
+	// create and copy only.
+	TemplateTriggers map[string][]string
+
+	// ImageFiles holds files on the host to add to the image's
+	// rootfs as the image tarball is written, after provisioning,
+	// replacing any files at the same paths. They are added as is,
+	// so may hold binary content, such as pre-generated seed images
+	// or compiled policy files, with the mode and ownership given,
+	// e.g. 0440 for sudoers drop-ins. Directories may be listed too.
+	ImageFiles []ImageFile
+
+	// BakeSeed, if true, also bakes a static cloud-init NoCloud seed
+	// into the image's rootfs, in /var/lib/cloud/seed/nocloud-net,
+	// for instances of the image created without LXD, e.g. by copying
+	// its rootfs. The templates of the default template set render
+	// the same files, so instances that LXD creates or copies get
+	// their own seed as usual. The seed holds the image's instance-id
+	// (see SeedInstanceID), SeedUserData and SeedNetworkConfig.
+	BakeSeed bool
+
+	// SeedInstanceID controls the instance-id of the baked seed:
+	// SeedInstanceIDSerial (the default, if empty) or
+	// SeedInstanceIDAlias.
+	SeedInstanceID string
+
+	// SeedUserData, if non-empty, is the path of the cloud-init
+	// user-data to bake into the seed. Otherwise it is empty
+	// cloud-config.
+	SeedUserData string
+
+	// SeedNetworkConfig, if non-empty, is the path of the network
+	// config to bake into the seed. Otherwise eth0 is configured
+	// with DHCP, as the default templates do.
+	SeedNetworkConfig string
+
+	// BuildArgs holds build arguments (KEY=VALUE) to make available
+	// to provisioning steps as environment variables. Their values
+	// are not recorded in diagnostics bundles or provenance
+	// documents, and are never written to the container's root
+	// filesystem, though steps may of course write them there.
+	BuildArgs []string
+
+	// BuildSecrets holds build arguments whose values are secret, as
+	// KEY=file:PATH (read from a file on the host) or KEY=env:NAME
+	// (read from an environment variable on the host). As well as
+	// being handled as BuildArgs are, the build fails if a secret's
+	// value is found in the image's files once every provisioning
+	// step and hook has run, after removing shell history and
+	// truncating logs that contain it.
+	BuildSecrets []string
+
+	// Redact holds regular expressions matching sensitive text, such
+	// as tokens and passwords, to mask in the build's logs, events,
+	// provenance document and diagnostics bundle, as are the values
+	// of BuildSecrets. Steps whose commands or output are secret
+	// altogether can be marked sensitive (see SensitiveProvisioner).
+	Redact []string
+
+	// StepRetries is the number of times to retry a failed
+	// provisioning step, e.g. because of a flaky repository mirror.
+	// Before each retry, the build container is restored to a
+	// snapshot taken before the step, so earlier work is not lost.
+	StepRetries int
+
+	// Serial is the build serial. If empty, a serial of the form
+	// YYYYMMDD.N is assigned, incrementing N for each build of
+	// the alias on the same day.
+	Serial string
+
+	// KeepSerials is the number of builds of the alias to keep,
+	// in the local image store, on the push remotes, and in the
+	// simplestreams tree. If zero, builds are not limited by number.
+	KeepSerials int
+
+	// KeepDays is the number of days to keep builds of the alias
+	// for, going by the date in their serials, in the same places
+	// as KeepSerials. If zero, builds are not limited by age. The
+	// newest build is always kept.
+	KeepDays int
+
+	// Rollback is the number of builds before the newest to keep,
+	// whatever the retention policy, and to alias in the local image
+	// store and on the push remotes as "<alias>/previous",
+	// "<alias>/previous-2" and so on, so that a bad build can be
+	// rolled back by launching, or re-aliasing, the previous one.
+	Rollback int
+
+	// ScanCommand, if non-empty, is a program to run on the host
+	// to scan the provisioned container for vulnerabilities before
+	// it is published. The program is passed the path to a file
+	// listing the installed packages, one per line as
+	// "name<TAB>epoch:version-release.arch", and must write a JSON
+	// array of Vulnerability objects to stdout.
+	ScanCommand string
+
+	// ScanFailSeverity, if non-empty, causes the build to fail if
+	// the scan finds vulnerabilities of this severity or higher:
+	// "low", "medium", "high" or "critical". Otherwise, found
+	// vulnerabilities are only reported.
+	ScanFailSeverity string
+
+	// CaptureLogs controls when the build container's journal and
+	// cloud-init and yum logs are captured: CaptureLogsOnFailure
+	// (the default), CaptureLogsAlways or CaptureLogsNever.
+	CaptureLogs string
+
+	// LogsDir is the directory to write captured logs to. If
+	// empty, they are written to the build directory if it is
+	// kept, and otherwise to a new temporary directory.
+	LogsDir string
+
+	// DiagnosticsDir, if non-empty, is the directory in which to
+	// write a diagnostics bundle if the build fails. The bundle is
+	// a tarball holding the build's events, options and partial
+	// result, details of the LXD server, and any captured logs.
+	DiagnosticsDir string
+
+	// OutputDir, if non-empty, is the directory in which to write
+	// the image and simplestreams metadata.
+	OutputDir string
+
+	// SigningKey, if non-empty, identifies a GPG key to sign the
+	// SHA256SUMS file written to the simplestreams tree with.
+	SigningKey string
+
+	// Cosign, if true, signs the image tarball with cosign, keylessly
+	// unless CosignKey is specified, and publishes the signature in
+	// a Sigstore bundle alongside the image in the simplestreams tree.
+	Cosign bool
+
+	// CosignKey, if non-empty, is the key to sign the image tarball
+	// with, as accepted by "cosign sign-blob --key". It implies Cosign.
+	CosignKey string
+
+	// Provenance, if true, generates a SLSA provenance document for
+	// the image, recording it in the build result and publishing it
+	// alongside the image in the simplestreams tree. The document is
+	// signed with cosign if Cosign is set, and with SigningKey if
+	// specified.
+	Provenance bool
+
+	// BuilderID is the builder identity recorded in provenance
+	// documents. If empty, a URI identifying this host is used.
+	BuilderID string
+
+	// Reproducible, if true, writes the image tarball reproducibly,
+	// so that builds with identical inputs (including the serial)
+	// produce byte-identical images with identical fingerprints.
+	// Timestamps are clamped to SourceDate, entries are sorted by
+	// name, and owner names are dropped.
+	Reproducible bool
+
+	// SourceDate is the time to clamp timestamps to in reproducible
+	// builds. If zero, it is taken from $SOURCE_DATE_EPOCH.
+	SourceDate time.Time
+
+	// TarballFormat controls the gzip header fields and tar header
+	// format of the image tarballs, whether or not the build is
+	// reproducible, e.g. to match the artifacts of an earlier Go
+	// version that downstream caches were keyed on.
+	TarballFormat TarballFormat
+
+	// IDShift, if positive, is subtracted from the uids and gids of
+	// the rootfs entries when the image tarball is rewritten, for
+	// images published on hosts where the build container's ids are
+	// not unshifted in the published rootfs. If IDShiftAuto, the
+	// shift is the owner of the rootfs directory.
+	IDShift int
+
+	// StrictIDs, if true, fails the build if any rootfs entry is
+	// owned by an id outside the range LXD maps into unprivileged
+	// containers by default (0-65535), after any shift. Otherwise
+	// such entries are reported with a warning.
+	StrictIDs bool
+
+	// Upload, if non-empty, is an S3 URL ("s3://bucket/prefix") to
+	// upload the image and simplestreams metadata to. Credentials
+	// and the endpoint are taken from the standard AWS environment
+	// variables. The simplestreams tree is written to OutputDir if
+	// specified, and otherwise to a temporary directory, seeded
+	// with the metadata already in the bucket.
+	Upload string
+
+	// RateLimit, if positive, limits the image transfers to and from
+	// LXD servers over the network (image exports, imports and copies
+	// to PushRemotes or the Juju model's remote) and uploads (Upload)
+	// to this many bytes per second, altogether. Copies between
+	// remotes are then relayed through the host, rather than made
+	// between the servers directly.
+	RateLimit int64
+
+	// PushRemotes holds the names of lxc remotes to copy the
+	// image to once it has been built, with the alias and serial
+	// alias. On each remote, the aliases are moved from any
+	// existing images to the new one.
+	PushRemotes []string
+
+	// PushPublic, if true, marks the images copied to
+	// PushRemotes as public.
+	PushPublic bool
+
+	// JujuModel, if non-empty, is the Juju model ([controller:]model)
+	// to make the image available to.
+	JujuModel string
+
+	// JujuRemote, if non-empty, is the lxc remote for the Juju model's
+	// LXD cloud. If empty, it is detected from the cloud's endpoint.
+	JujuRemote string
+
+	// JujuConfig holds model config (key=value) to set on the
+	// Juju model.
+	JujuConfig []string
+
+	// JujuTest, if true, tests the image by starting a Juju machine
+	// with it. If JujuModel is empty, a temporary controller is
+	// bootstrapped for the test, which requires the build to
+	// run on the local remote.
+	JujuTest bool
+
+	// TestScenarios holds the names of the scenarios to test the
+	// image with once its templates are added, before it is output,
+	// signed or copied anywhere, or TestScenarioAll for all of them
+	// (see TestScenarioNames). Each scenario starts an instance of the
+	// image on Remote with a different configuration exercising its
+	// cloud-init templates, such as custom user-data or link-local
+	// networking, and checks that it comes up as configured. Every
+	// scenario is run; the build fails if any does.
+	TestScenarios []string
+
+	// HistoryFile, if non-empty, is the file to record the build
+	// in, as a line of JSON describing the HistoryRecord, whether
+	// or not it succeeds. See DefaultHistoryFile.
+	HistoryFile string
+
+	// Notifications holds where to send a summary of the build
+	// when it finishes, e.g. for unattended nightly builds.
+	Notifications []Notification
+
+	// OnEvent, if non-nil, is called for each event that occurs
+	// during the build. Calls are serialised, and should not block.
+	OnEvent func(Event)
+
+	// Runner, if non-nil, runs the external commands (lxc, juju)
+	// used by the build. If nil, they are run as subprocesses.
+	Runner Runner
+}
+
+// Result holds the result of a successful build. Its JSON encoding,
+// the build manifest, is described by ManifestSchema.
+type Result struct {
+	// SchemaVersion is the manifest format version,
+	// SchemaVersion.
+	SchemaVersion string `json:"schema-version"`
+
+	// Alias is the alias the image was published under.
+	Alias string `json:"alias"`
+
+	// Serial is the build serial.
+	Serial string `json:"serial"`
+
+	// Fingerprint is the fingerprint of the published image.
+	Fingerprint string `json:"fingerprint"`
+
+	// Size is the size of the published image tarball, or of the
+	// metadata and rootfs tarballs of split images, or of the
+	// metadata tarball and qcow2 root disk of VM images, in bytes.
+	Size int64 `json:"size"`
+
+	// UnpackedSize is the total size of the regular files in the
+	// image's rootfs, or the size of the root disk of VM images,
+	// in bytes.
+	UnpackedSize int64 `json:"unpacked-size"`
+
+	// BaseImage is the base image the build started from.
+	BaseImage string `json:"base-image"`
+
+	// BaseImageServer is the image server the base image
+	// was taken from, if Options.ImageServer was specified.
+	BaseImageServer string `json:"base-image-server,omitempty"`
+
+	// BaseFingerprint is the fingerprint of the base image.
+	BaseFingerprint string `json:"base-fingerprint,omitempty"`
+
+	// OS describes the distribution of the base image.
+	OS *OSRelease `json:"os,omitempty"`
+
+	// Skipped is true if the build was skipped because the
+	// image was unchanged (see Options.SkipUnchanged and
+	// Options.SerialOnChange), in which case the result
+	// describes the existing image.
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Spec holds the options the image was built with, encoded as
+	// in diagnostics bundles, with sensitive steps and text masked,
+	// so that the build can be repeated (see OptionsForRebuild).
+	Spec json.RawMessage `json:"spec,omitempty"`
+
+	// Provenance holds the SLSA provenance document for the
+	// image, if Options.Provenance was specified.
+	Provenance json.RawMessage `json:"provenance,omitempty"`
+
+	// Properties holds the properties recorded on the image.
+	Properties map[string]string `json:"properties,omitempty"`
+
+	// Vulnerabilities holds the vulnerabilities found by the
+	// scan, if Options.ScanCommand was specified.
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+
+	// Pushed holds the names of the remotes the image
+	// was copied to (see Options.PushRemotes).
+	Pushed []string `json:"pushed,omitempty"`
+
+	// Uploaded holds the S3 URLs of the objects uploaded
+	// (see Options.Upload).
+	Uploaded []string `json:"uploaded,omitempty"`
+
+	// Logs holds the paths of the logs captured from the
+	// build container (see Options.CaptureLogs).
+	Logs []string `json:"logs,omitempty"`
+
+	// Previous describes the image the alias referred to before
+	// the build, and the packages that changed since, if the alias
+	// referred to an image built by this package.
+	Previous *Previous `json:"previous,omitempty"`
+
+	// Changelog describes what changed since the previous image,
+	// if the alias referred to an image built by this package.
+	Changelog *ChangelogEntry `json:"changelog,omitempty"`
+
+	// TestLogs holds the paths of the console and cloud-init logs
+	// captured from the instances the image was tested with (see
+	// Options.TestScenarios and Options.JujuTest).
+	TestLogs []string `json:"test-logs,omitempty"`
+
+	// TestScenarios holds the outcome of each test scenario
+	// (see Options.TestScenarios). Failed scenarios are only
+	// recorded in the partial result of diagnostics bundles.
+	TestScenarios []ScenarioResult `json:"test-scenarios,omitempty"`
+
+	// Started and Finished record when the build
+	// started and finished.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// Builder builds images.
+type Builder struct {
+	opts      Options
+	steps     []step
+	userData  string
+	buildArgs *buildArgs
+	uploader  *uploader
+
+	// limiter limits the build's transfers, if
+	// Options.RateLimit is specified.
+	limiter *ratelimit.Limiter
+
+	// imageServerAuth holds the CA certificate and credentials
+	// for Options.ImageServer, if any.
+	imageServerAuth *imageServerAuth
+
+	// redactor masks the sensitive text of Options.Redact and
+	// Options.BuildSecrets, and the secrets of
+	// Options.Notifications, if any.
+	redactor *redactor
+
+	// testScenarios holds the names of the scenarios of
+	// Options.TestScenarios, with TestScenarioAll expanded.
+	testScenarios []string
+
+	// templates holds the templates of Options.TemplateSet,
+	// keyed by the file each renders.
+	templates map[string]template
+
+	// seed holds the seed to bake into the rootfs, if
+	// Options.BakeSeed is specified.
+	seed *rootfsSeed
+
+	// notifiers holds the notifier for each of
+	// Options.Notifications.
+	notifiers []notifier
+}
+
+// New returns a new Builder with the given options.
+func New(opts Options) (*Builder, error) {
+	if opts.Image == "" {
+		opts.Image = DefaultImage
+	}
+	if opts.Alias == "" {
+		opts.Alias = DefaultAlias
+	}
+	if opts.Base != "" {
+		if opts.ImageServer != "" {
+			return nil, fmt.Errorf("base image and image server cannot both be specified")
+		}
+		if opts.Base == opts.Alias {
+			return nil, fmt.Errorf("image %q cannot be its own base", opts.Alias)
+		}
+		opts.Image = qualify(opts.Remote, opts.Base)
+	}
+	if opts.Base != "" && len(opts.ImageFallbacks) > 0 {
+		return nil, fmt.Errorf("base image and image fallbacks cannot both be specified")
+	}
+	if opts.BaseQCOW2 != "" {
+		if err := checkQCOW2Options(opts); err != nil {
+			return nil, err
+		}
+		// The base image is imported from the qcow2
+		// image when the build starts.
+		opts.Image = ""
+	}
+	if opts.VM {
+		if err := checkVMOptions(opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ImageServer != "" {
+		for _, image := range append([]string{opts.Image}, opts.ImageFallbacks...) {
+			if remote, _ := splitImage(image); remote != "" {
+				return nil, fmt.Errorf("image %q must not specify a remote when an image server is specified", image)
+			}
+		}
+	}
+	if opts.ImageServer == "" && (opts.ImageServerCA != "" || opts.ImageServerAuthFile != "") {
+		return nil, fmt.Errorf("image server CA and credentials require an image server")
+	}
+	imageServerAuth, err := loadImageServerAuth(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.NoContainerNetwork && opts.LocalRepo == "" {
+		return nil, fmt.Errorf("builds without container network require a local repository")
+	}
+	if opts.NoHostNetwork {
+		if err := checkNoHostNetwork(opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Offline {
+		if err := checkOffline(opts); err != nil {
+			return nil, err
+		}
+	} else if !opts.NoContainerNetwork && (opts.LocalRepo != "" || len(opts.RepoFiles) > 0) {
+		return nil, fmt.Errorf("local repository or repo files specified for an online build")
+	}
+	if opts.Reproducible && opts.SourceDate.IsZero() {
+		sourceDate, err := sourceDateEpoch()
+		if err != nil {
+			return nil, err
+		}
+		opts.SourceDate = sourceDate
+	}
+	if err := opts.TarballFormat.check(); err != nil {
+		return nil, err
+	}
+	if opts.IDShift < 0 && opts.IDShift != IDShiftAuto {
+		return nil, fmt.Errorf("invalid ID shift %d", opts.IDShift)
+	}
+	if opts.StepRetries < 0 {
+		return nil, fmt.Errorf("invalid step retries %d", opts.StepRetries)
+	}
+	if opts.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid maximum size %d", opts.MaxSize)
+	}
+	if opts.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit %d", opts.RateLimit)
+	}
+	limiter := ratelimit.NewLimiter(opts.RateLimit)
+	if err := opts.NetworkWait.check(); err != nil {
+		return nil, err
+	}
+	if err := opts.NIC.check(opts.Devices); err != nil {
+		return nil, err
+	}
+	if len(opts.DNS) > 0 {
+		if opts.NoContainerNetwork {
+			return nil, fmt.Errorf("nameservers specified for a build without container network")
+		}
+		if err := checkDNS(opts.DNS); err != nil {
+			return nil, err
+		}
+	}
+	if opts.KeepSerials < 0 || opts.KeepDays < 0 {
+		return nil, fmt.Errorf("invalid retention policy: negative keep-serials or keep-days")
+	}
+	if opts.Rollback < 0 {
+		return nil, fmt.Errorf("invalid rollback depth %d", opts.Rollback)
+	}
+	for _, remote := range opts.PushRemotes {
+		if remote == "" || sameRemote(remote, opts.Remote) {
+			return nil, fmt.Errorf("invalid push remote %q", remote)
+		}
+	}
+	if opts.JujuTest && opts.JujuModel == "" && !sameRemote(opts.Remote, "local") {
+		return nil, fmt.Errorf("testing with a temporary controller requires a local build")
+	}
+	switch opts.Keep {
+	case "", KeepOnFailure, KeepAlways:
+	default:
+		return nil, fmt.Errorf("invalid keep mode %q", opts.Keep)
+	}
+	switch opts.CaptureLogs {
+	case "", CaptureLogsOnFailure, CaptureLogsAlways, CaptureLogsNever:
+	default:
+		return nil, fmt.Errorf("invalid log capture mode %q", opts.CaptureLogs)
+	}
+	if opts.ScanFailSeverity != "" && severityRank(opts.ScanFailSeverity) <= 0 {
+		return nil, fmt.Errorf("invalid scan severity %q", opts.ScanFailSeverity)
+	}
+	if opts.ScanFailSeverity != "" && opts.ScanCommand == "" {
+		return nil, fmt.Errorf("scan severity specified without a scan command")
+	}
+	testScenarios, err := testScenarioNames(opts.TestScenarios)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := profileSteps(opts.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	opts.RecommendedConfig = profileRecommendedConfig(opts.Profiles, opts.RecommendedConfig)
+	var removeBuildPackages step
+	if len(opts.BuildPackages) > 0 {
+		var install step
+		install, removeBuildPackages = buildPackageSteps(opts.BuildPackages)
+		steps = append([]step{install}, steps...)
+	}
+	for i, p := range opts.Provisioners {
+		if p, ok := p.(ParallelProvisioner); ok {
+			if err := p.validate(); err != nil {
+				return nil, fmt.Errorf("provisioner %d: %v", i, err)
+			}
+		}
+		steps = append(steps, step{
+			name:        fmt.Sprintf("provisioner %d (%s)", i, provisionerType(p)),
+			provisioner: p,
+		})
+	}
+	if removeBuildPackages.provisioner != nil {
+		steps = append(steps, removeBuildPackages)
+	}
+	var userData string
+	if opts.UserData != "" {
+		var err error
+		if userData, err = readUserData(opts.UserData); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Base != "" || opts.UserData != "" || opts.BaseQCOW2 != "" {
+		steps = append(steps, step{"reset cloud-init", resetCloudInitProvisioner})
+	}
+	buildArgs, err := loadBuildArgs(opts.BuildArgs, opts.BuildSecrets)
+	if err != nil {
+		return nil, err
+	}
+	secrets := buildArgs.secretValues()
+	var notifiers []notifier
+	for _, n := range opts.Notifications {
+		notifier, values, err := newNotifier(n)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+		secrets = append(secrets, values...)
+	}
+	redactor, err := newRedactor(opts.Redact, secrets)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := resolveTemplates(opts.TemplateSet, opts.TemplateSets, opts.TemplateTriggers)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := loadRootfsSeed(opts)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.SELinux {
+	case "", SELinuxAuto, SELinuxRelabel:
+		targets := templateTargets(templates)
+		if seed != nil {
+			targets = seed.labelTargets(targets)
+		}
+		steps = append(steps, step{"label SELinux contexts", selinuxLabels{
+			relabel: opts.SELinux == SELinuxRelabel,
+			targets: targets,
+		}})
+	case SELinuxOff:
+	default:
+		return nil, fmt.Errorf("invalid SELinux mode %q", opts.SELinux)
+	}
+	for name, device := range opts.Devices {
+		if err := checkDevice(name, device); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkContainerConfig(opts.ContainerConfig); err != nil {
+		return nil, err
+	}
+	if opts.Privileged {
+		if v, ok := opts.ContainerConfig["security.privileged"]; ok && v != "true" {
+			return nil, fmt.Errorf("privileged build conflicts with container config security.privileged=%s", v)
+		}
+		config := map[string]string{"security.privileged": "true"}
+		for key, value := range opts.ContainerConfig {
+			config[key] = value
+		}
+		opts.ContainerConfig = config
+	}
+	switch opts.ImageFormat {
+	case "", ImageFormatUnified:
+	case ImageFormatSplit:
+		if opts.OutputDir != "" || opts.Upload != "" {
+			return nil, fmt.Errorf("split images cannot be written to a simplestreams tree")
+		}
+	default:
+		return nil, fmt.Errorf("invalid image format %q", opts.ImageFormat)
+	}
+	if err := checkImageFiles(opts.ImageFiles); err != nil {
+		return nil, err
+	}
+	if err := checkHooks(opts.Hooks); err != nil {
+		return nil, err
+	}
+	if err := checkPropertyTemplates(opts.Description, opts.Properties); err != nil {
+		return nil, err
+	}
+	if err := checkRecommendedConfig(opts.RecommendedConfig); err != nil {
+		return nil, err
+	}
+	if len(opts.Devices) > 0 || len(opts.ContainerConfig) > 0 {
+		steps = append(steps, step{"detach devices", detachDevices{
+			devices: sortedDeviceNames(opts.Devices),
+			config:  sortedKeys(opts.ContainerConfig),
+		}})
+	}
+	if opts.SigningKey != "" && opts.OutputDir == "" && opts.Upload == "" {
+		return nil, fmt.Errorf("signing key specified without an output directory or upload target")
+	}
+	if (opts.Cosign || opts.CosignKey != "") && opts.OutputDir == "" && opts.Upload == "" {
+		return nil, fmt.Errorf("cosign signing requires an output directory or upload target")
+	}
+	var uploader *uploader
+	if opts.Upload != "" {
+		if uploader, err = newUploader(opts.Upload, limiter); err != nil {
+			return nil, err
+		}
+	}
+	var offline *offlineRepo
+	if opts.Offline || opts.NoContainerNetwork {
+		offline = &offlineRepo{dir: opts.LocalRepo, repoFiles: opts.RepoFiles}
+	}
+	return &Builder{
+		opts:            opts,
+		steps:           buildSteps(steps, offline, opts.Hooks, buildArgs != nil),
+		userData:        userData,
+		buildArgs:       buildArgs,
+		uploader:        uploader,
+		limiter:         limiter,
+		imageServerAuth: imageServerAuth,
+		redactor:        redactor,
+		testScenarios:   testScenarios,
+		notifiers:       notifiers,
+		templates:       templates,
+		seed:            seed,
+	}, nil
+}
+
+// Build builds and publishes the image. If ctx is cancelled, the
+// build stops at the next opportunity, and the build container and
+// any intermediate image are removed.
+//
+// Failures may be distinguished with errors.Is and errors.As,
+// using ErrBaseImageNotFound, ErrBaseImageUnverified,
+// ErrNetworkTimeout, ErrImportFailed, ErrOSMismatch, ErrTooLarge,
+// ErrInsufficientSpace, *ProvisionError (which matches
+// ErrProvisionFailed) and *ScanError (which matches ErrVulnerable).
+func (b *Builder) Build(ctx context.Context) (_ *Result, err error) {
+	onEvent := b.opts.OnEvent
+	var diag *diagnostics
+	if b.opts.DiagnosticsDir != "" {
+		diag = &diagnostics{}
+		onEvent = func(e Event) {
+			diag.record(e)
+			if b.opts.OnEvent != nil {
+				b.opts.OnEvent(e)
+			}
+		}
+	}
+	var artifacts []string
+	if b.opts.HistoryFile != "" || len(b.notifiers) > 0 {
+		next := onEvent
+		onEvent = func(e Event) {
+			if e.Type == EventArtifact {
+				artifacts = append(artifacts, e.Artifact)
+			}
+			if next != nil {
+				next(e)
+			}
+		}
+	}
+	ctx = withEvents(ctx, onEvent)
+	ctx = withRedactor(ctx, b.redactor)
+	ctx = WithRunner(ctx, b.opts.Runner)
+	ctx = withLimiter(ctx, b.limiter)
+	ctx = detectLXD(ctx)
+	if b.opts.VM {
+		ctx = withVM(ctx)
+	}
+	if b.opts, err = resolveRemotes(ctx, b.opts); err != nil {
+		return nil, err
+	}
+	if err := checkPermissions(ctx, b.opts); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	alias := b.opts.Alias
+	serial := b.opts.Serial
+	if serial == "" {
+		var err error
+		serial, err = nextSerial(ctx, b.opts.Remote, alias, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	logf(ctx, "Building %s, serial %s", alias, serial)
+	inputs, err := inputsDigest(b.opts)
+	if err != nil {
+		return nil, err
+	}
+	specHash, err := specDigest(b.opts)
+	if err != nil {
+		return nil, err
+	}
+	keep := retention{
+		serials:  b.opts.KeepSerials,
+		days:     b.opts.KeepDays,
+		now:      started,
+		rollback: b.opts.Rollback,
+	}
+	result := &Result{
+		SchemaVersion:   SchemaVersion,
+		Alias:           alias,
+		Serial:          serial,
+		BaseImage:       b.opts.Image,
+		BaseImageServer: b.opts.ImageServer,
+		Started:         started,
+	}
+	if result.Spec, err = recordedSpec(b.opts, b.redactor); err != nil {
+		return nil, err
+	}
+	if b.opts.HistoryFile != "" || len(b.notifiers) > 0 {
+		// Registered before the diagnostics bundle is written,
+		// so that the bundle is recorded as an artifact.
+		defer func() {
+			rec := HistoryRecord{
+				Started:     started,
+				Duration:    time.Since(started),
+				Status:      HistorySucceeded,
+				Alias:       alias,
+				Serial:      result.Serial,
+				Remote:      b.opts.Remote,
+				Fingerprint: result.Fingerprint,
+				SpecHash:    specHash,
+				ToolVersion: Version,
+				Artifacts:   artifacts,
+			}
+			switch {
+			case err != nil && ctx.Err() != nil:
+				rec.Status = HistoryCancelled
+			case err != nil:
+				rec.Status = HistoryFailed
+				rec.Error = b.redactor.redact(err.Error())
+			case result.Skipped:
+				rec.Status = HistorySkipped
+			}
+			rec.Spec = result.Spec
+			if b.opts.HistoryFile != "" {
+				if histErr := appendHistory(b.opts.HistoryFile, rec); histErr != nil {
+					logf(ctx, "Recording build history: %v", histErr)
+				}
+			}
+			sendNotifications(detach(ctx), b.opts.Notifications, b.notifiers, b.redactor, rec, result, artifacts)
+		}()
+	}
+	if diag != nil {
+		// Registered first, so that it runs after the
+		// container's logs have been captured.
+		defer func() {
+			if err == nil {
+				return
+			}
+			path, diagErr := diag.writeDiagnostics(
+				detach(ctx), b.opts.DiagnosticsDir, b.opts, result, err,
+			)
+			if diagErr != nil {
+				logf(ctx, "Writing diagnostics bundle: %v", diagErr)
+				return
+			}
+			emit(ctx, Event{Type: EventArtifact, Artifact: path})
+			logf(ctx, "Diagnostics bundle written to %s", path)
+		}()
+	}
+
+	// The build directory holds files pushed into the container,
+	// so it must be somewhere lxc can read.
+	tmpRoot, err := hostTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tmpdir, err := ioutil.TempDir(tmpRoot, "juju-lxd-centos")
+	if err != nil {
+		return nil, err
+	}
+	// kept reports whether the build directory and
+	// container are to be kept, once the build finishes.
+	kept := func() bool {
+		return b.opts.Keep == KeepAlways || b.opts.Keep == KeepOnFailure && err != nil
+	}
+	if b.opts.Keep == KeepAlways {
+		logf(ctx, "Build directory: %s", tmpdir)
+	}
+	defer func() {
+		if kept() {
+			if b.opts.Keep == KeepOnFailure {
+				logf(ctx, "Build failed; keeping build directory %s", tmpdir)
+			}
+			return
+		}
+		os.RemoveAll(tmpdir)
+	}()
+
+	// Start a build container.
+	var deleted bool
+	// Include a random suffix in the name, so that concurrent
+	// builds started at the same time do not collide.
+	buildID := fmt.Sprintf("%v-%04x", time.Now().Unix(), rand.Intn(0x10000))
+	containerName := qualify(b.opts.Remote, "juju-lxd-centos-"+buildID)
+	var unchanged *ImageInfo
+	var cache *stepCache
+	var launched bool
+	if err := phase(ctx, PhaseLaunch, func() error {
+		var image string
+		if b.opts.Base != "" {
+			if err := checkBase(ctx, b.opts.Remote, b.opts.Base); err != nil {
+				return err
+			}
+			image = b.opts.Image
+		} else if b.opts.BaseQCOW2 != "" {
+			fingerprint, cleanup, err := importQCOW2Base(ctx, b.opts.Remote, b.opts.BaseQCOW2, tmpdir)
+			if err != nil {
+				return err
+			}
+			// As for downloaded images, the VM has its own
+			// copy of the image once launched.
+			defer cleanup()
+			result.BaseImage, image = b.opts.BaseQCOW2, qualify(b.opts.Remote, fingerprint)
+		} else {
+			name, baseImage, cleanup, err := findBaseImage(ctx, b.opts, b.imageServerAuth)
+			if err != nil {
+				return err
+			}
+			// The container has its own copy of the image
+			// once launched, so any image downloaded, or
+			// the image server's temporary remote, is only
+			// needed for the duration of the phase.
+			defer cleanup()
+			result.BaseImage, image = name, baseImage
+		}
+		var err error
+		if result.BaseFingerprint, err = imageFingerprint(ctx, image); err != nil {
+			return err
+		}
+		if b.opts.BaseFingerprint != "" {
+			if err := verifyBaseFingerprint(image, result.BaseFingerprint, b.opts.BaseFingerprint); err != nil {
+				return err
+			}
+		}
+		if b.opts.BaseKeyring != "" {
+			if err := verifyBaseSignature(ctx, image, result.BaseFingerprint, b.opts.BaseKeyring, b.imageServerAuth); err != nil {
+				return err
+			}
+		}
+		if b.opts.SkipUnchanged {
+			if unchanged, err = unchangedImage(
+				ctx, b.opts.Remote, alias, result.BaseFingerprint, inputs,
+			); err != nil || unchanged != nil {
+				return err
+			}
+		}
+		if !b.opts.SkipSpaceCheck {
+			size, err := imageSize(ctx, image, result.BaseFingerprint)
+			if err != nil {
+				return err
+			}
+			if err := checkSpace(ctx, tmpdir, size, b.opts.ImageFormat); err != nil {
+				return err
+			}
+		}
+		if b.opts.Cache {
+			launchInputs := append([]string{b.userData}, b.opts.BuildArgs...)
+			launchInputs = append(launchInputs, containerConfigArgs(b.opts.ContainerConfig)...)
+			launchInputs = append(launchInputs, fmt.Sprint(b.opts.Devices), fmt.Sprint(b.opts.NIC.config()))
+			if cache, err = newStepCache(
+				b.opts.Remote, alias, result.BaseFingerprint, launchInputs, b.steps,
+			); err != nil {
+				return err
+			}
+			if restored, err := cache.restore(ctx, containerName); restored || err != nil {
+				return err
+			}
+		}
+		// Launch the image by fingerprint, so that what
+		// is launched is what was verified, even if the
+		// alias has since moved.
+		// With pinned addresses, the container is created
+		// and started separately, so that its NIC first
+		// comes up with them; VMs built from qcow2 images
+		// are, so that they first boot with the agent's
+		// drives.
+		remote, _ := splitImage(image)
+		create := "launch"
+		if b.opts.NIC.pinned() || b.opts.BaseQCOW2 != "" {
+			create = "init"
+		}
+		args := []string{create, qualify(remote, result.BaseFingerprint), containerName}
+		if b.opts.VM {
+			args = append(args, "--vm")
+		}
+		args = append(args, containerConfigArgs(b.opts.ContainerConfig)...)
+		if b.userData != "" {
+			args = append(args, "--config=user.user-data="+b.userData)
+		}
+		if b.opts.BaseQCOW2 != "" {
+			args = append(args, "--config=user.vendor-data="+vmAgentVendorData)
+		}
+		if err := lxc(ctx, args...); err != nil {
+			return err
+		}
+		launched = true
+		if b.opts.NIC.pinned() {
+			if err := pinNIC(ctx, containerName, b.opts.NIC); err != nil {
+				return err
+			}
+		}
+		if b.opts.BaseQCOW2 != "" {
+			if err := addDevices(ctx, containerName, vmAgentDevices); err != nil {
+				return err
+			}
+		}
+		if create == "init" {
+			if err := lxc(ctx, "start", containerName); err != nil {
+				return err
+			}
+		}
+		if b.opts.VM {
+			if err := waitVMAgent(ctx, containerName); err != nil {
+				return err
+			}
+		}
+		if err := addDevices(ctx, containerName, b.opts.Devices); err != nil {
+			return err
+		}
+		if b.userData != "" {
+			return waitCloudInit(ctx, containerName)
+		}
+		return nil
+	}); err != nil {
+		if launched && b.opts.Keep == "" {
+			if err := lxc(detach(ctx), "delete", "--force", containerName); err != nil {
+				logf(ctx, "Deleting build container: %v", err)
+			}
+		}
+		return nil, err
+	}
+	if unchanged != nil {
+		logf(ctx, "Image %s is unchanged; skipping build", alias)
+		result.Skipped = true
+		result.Serial = unchanged.Properties[PropertySerial]
+		result.Fingerprint = unchanged.Fingerprint
+		result.Properties = unchanged.Properties
+		result.Finished = time.Now()
+		return result, nil
+	}
+	if b.opts.Keep == KeepAlways {
+		logf(ctx, "Build container: %s", containerName)
+	}
+	defer func() {
+		if deleted {
+			return
+		}
+		if kept() {
+			if b.opts.Keep == KeepOnFailure {
+				logf(ctx, "Build failed; keeping build container %s", containerName)
+			}
+			return
+		}
+		// Clean up even if the build has been cancelled.
+		if err := lxc(detach(ctx), "delete", "--force", containerName); err != nil {
+			logf(ctx, "Deleting build container: %v", err)
+		}
+	}()
+
+	// Cache the provisioning steps that succeeded if the build
+	// fails, before the container is removed.
+	if cache != nil {
+		defer func() {
+			if err == nil || deleted {
+				return
+			}
+			ctx := detach(ctx)
+			if err := lxc(ctx, "stop", "--force", containerName); err != nil {
+				logf(ctx, "Stopping build container: %v", err)
+				return
+			}
+			if err := cache.save(ctx, containerName, kept()); err != nil {
+				logf(ctx, "Caching provisioning steps: %v", err)
+				return
+			}
+			deleted = !kept()
+		}()
+	}
+
+	// logsDir returns the directory to write captured logs to,
+	// creating a temporary directory on first use if needed.
+	var tmpLogsDir string
+	logsDir := func() (string, error) {
+		switch {
+		case b.opts.LogsDir != "":
+			return b.opts.LogsDir, nil
+		case kept():
+			return filepath.Join(tmpdir, "logs"), nil
+		case tmpLogsDir == "":
+			root, err := hostTempDir(ctx)
+			if err != nil {
+				return "", err
+			}
+			if tmpLogsDir, err = ioutil.TempDir(root, "juju-lxd-centos-logs"); err != nil {
+				return "", err
+			}
+		}
+		return tmpLogsDir, nil
+	}
+
+	// Capture the container's logs if the build fails,
+	// before the container is removed.
+	var logsCaptured bool
+	captureLogs := func(ctx context.Context) error {
+		logsCaptured = true
+		dir, err := logsDir()
+		if err != nil {
+			return err
+		}
+		result.Logs, err = captureContainerLogs(ctx, containerName, dir)
+		if err != nil {
+			return err
+		}
+		logf(ctx, "Captured build container logs in %s", dir)
+		return nil
+	}
+	defer func() {
+		if err == nil || deleted || logsCaptured || b.opts.CaptureLogs == CaptureLogsNever {
+			return
+		}
+		if err := captureLogs(detach(ctx)); err != nil {
+			logf(ctx, "Capturing build container logs: %v", err)
+		}
+	}()
+
+	// Update the build container by running commands inside it,
+	// and then publish the container as an image.
+	// Check that the base image is of the distribution the alias
+	// is for, before spending time provisioning it.
+	facts, err := containerFacts(ctx, containerName)
+	if err != nil {
+		return nil, err
+	}
+	result.OS = newOSRelease(facts)
+	logf(ctx, "Base image is %s %s (%s)", result.OS.ID, result.OS.VersionID, result.OS.Arch)
+	if !b.opts.AllowOSMismatch {
+		if err := checkAliasOS(alias, result.OS); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := phase(ctx, PhaseNetwork, func() error {
+		if b.opts.NoContainerNetwork {
+			logf(ctx, "Build container has no network; not waiting for network connectivity")
+			return nil
+		}
+		if len(b.opts.DNS) > 0 {
+			if err := overrideDNS(ctx, containerName, tmpdir, b.opts.DNS); err != nil {
+				return err
+			}
+		}
+		if b.opts.Offline && b.opts.LocalRepo != "" {
+			logf(ctx, "Offline build with a local repository; not waiting for network connectivity")
+			return nil
+		}
+		return waitContainerNetwork(ctx, containerName, b.opts.NetworkWait)
+	}); err != nil {
+		return nil, err
+	}
+	var properties map[string]string
+	if err := phase(ctx, PhaseProvision, func() error {
+		ctx := withBuildArgs(ctx, b.buildArgs)
+		if b.buildArgs != nil {
+			if err := b.buildArgs.push(ctx, containerName, tmpdir); err != nil {
+				return err
+			}
+			defer func() {
+				if err := b.buildArgs.remove(detach(ctx), containerName); err != nil {
+					logf(ctx, "Removing build arguments: %v", err)
+				}
+			}()
+		}
+		retry := &stepRetry{
+			retries: b.opts.StepRetries,
+			restored: func(ctx context.Context) error {
+				// Restoring restarts the container, losing its
+				// network, nameservers and the build arguments
+				// in /run, and VMs their agent until it starts.
+				if b.opts.VM {
+					if err := waitVMAgent(ctx, containerName); err != nil {
+						return err
+					}
+				}
+				if len(b.opts.DNS) > 0 {
+					if err := overrideDNS(ctx, containerName, tmpdir, b.opts.DNS); err != nil {
+						return err
+					}
+				}
+				if !b.opts.NoContainerNetwork && (!b.opts.Offline || b.opts.LocalRepo == "") {
+					if err := waitContainerNetwork(ctx, containerName, b.opts.NetworkWait); err != nil {
+						return err
+					}
+				}
+				if b.buildArgs != nil {
+					return b.buildArgs.push(ctx, containerName, tmpdir)
+				}
+				return nil
+			},
+		}
+		if err := updateContainer(ctx, containerName, b.steps, cache, retry); err != nil {
+			return err
+		}
+		cloudInitVersion, err := containerCloudInitVersion(ctx, containerName)
+		if err != nil {
+			return err
+		}
+		properties = map[string]string{
+			PropertyBuilder:          BuilderName,
+			PropertyCloudInitVersion: cloudInitVersion,
+			PropertyAlias:            alias,
+			PropertySerial:           serial,
+			PropertyBaseImage:        result.BaseImage,
+			PropertyBaseFingerprint:  result.BaseFingerprint,
+			PropertyInputs:           inputs,
+			PropertySpecHash:         specHash,
+			PropertyToolVersion:      Version,
+			PropertyOS:               result.OS.ID,
+			PropertyRelease:          result.OS.VersionID,
+		}
+		date := started
+		if b.opts.Reproducible {
+			date = b.opts.SourceDate
+		}
+		properties[PropertyTimestamp] = date.UTC().Format(time.RFC3339)
+		if err := templateProperties(
+			ctx, containerName, date, b.opts.Description, b.opts.Properties, properties,
+		); err != nil {
+			return err
+		}
+		recommendedProperties(b.opts.RecommendedConfig, properties)
+		packages, err := containerPackages(ctx, containerName)
+		if err != nil {
+			return err
+		}
+		if packages != "" {
+			properties[PropertyPackages] = packages
+		}
+		if result.Previous, err = previousImage(ctx, b.opts.Remote, alias, packages); err != nil {
+			return err
+		}
+		result.Properties = properties
+		if result.Previous != nil {
+			result.Changelog = newChangelogEntry(ctx, result.Previous, properties, result.Spec, b.opts.HistoryFile)
+			logChangelog(ctx, alias, result.Changelog)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if b.opts.SerialOnChange && result.Changelog != nil && result.Changelog.unchanged() {
+		previous := result.Previous
+		logf(ctx, "Image %s has the same packages and inputs as serial %s; keeping it", alias, previous.Serial)
+		if cache != nil {
+			// Later builds may still resume from the steps.
+			if err := lxc(ctx, "stop", containerName); err != nil {
+				return nil, err
+			}
+			if err := cache.save(ctx, containerName, false); err != nil {
+				return nil, err
+			}
+			deleted = true
+		}
+		result.Skipped = true
+		result.Serial = previous.Serial
+		result.Fingerprint = previous.Fingerprint
+		result.Properties = previous.properties
+		result.Previous = nil
+		result.Changelog = nil
+		result.Finished = time.Now()
+		return result, nil
+	}
+
+	// Scan the provisioned container for vulnerabilities,
+	// before anything is published.
+	var vulns []Vulnerability
+	if b.opts.ScanCommand != "" {
+		if err := phase(ctx, PhaseScan, func() error {
+			var err error
+			vulns, err = scanContainer(
+				ctx, containerName,
+				b.opts.ScanCommand, b.opts.ScanFailSeverity,
+			)
+			if err != nil {
+				return err
+			}
+			properties[PropertyVulnerabilities] = vulnerabilitySummary(vulns)
+			result.Vulnerabilities = vulns
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each build is aliased by its serial, so that previous builds
+	// remain addressable once the primary alias moves to the new one.
+	serialAlias := alias + "/" + serial
+	// The container is published under a temporary alias, and the
+	// aliases moved to the final image once the templates are added.
+	// The intermediate image is deleted however the build ends, unless
+	// the templates cannot be added, when it is kept so that the image
+	// is not lost; those left by builds that were killed or failed are
+	// deleted by later builds.
+	intermediate := intermediateAliasPrefix + buildID
+	var published, intermediateDeleted, intermediateKept bool
+	var backup string
+	defer func() {
+		if !published || intermediateDeleted {
+			return
+		}
+		if intermediateKept {
+			logf(ctx, "Keeping intermediate image %s; later builds delete it after %v", qualify(b.opts.Remote, intermediate), intermediateMaxAge)
+			return
+		}
+		ctx := detach(ctx)
+		if !imageExists(ctx, qualify(b.opts.Remote, intermediate)) {
+			return
+		}
+		if err := lxc(ctx, "image", "delete", qualify(b.opts.Remote, intermediate)); err != nil {
+			logf(ctx, "Deleting intermediate image: %v", err)
+		}
+	}()
+	if err := phase(ctx, PhasePublish, func() error {
+		if b.opts.CaptureLogs == CaptureLogsAlways {
+			if err := captureLogs(ctx); err != nil {
+				return err
+			}
+		}
+		if err := lxc(ctx, "stop", containerName); err != nil {
+			return err
+		}
+		if b.opts.ImageFormat == ImageFormatSplit {
+			// The image is generated from an export of the
+			// container, rather than from a published image.
+			var err error
+			if backup, err = exportContainer(ctx, containerName, filepath.Join(tmpdir, "export")); err != nil {
+				return err
+			}
+		} else {
+			if err := pruneIntermediateImages(ctx, b.opts.Remote, started); err != nil {
+				return err
+			}
+			publishArgs := []string{"publish", containerName}
+			if b.opts.Remote != "" {
+				publishArgs = append(publishArgs, b.opts.Remote+":")
+			}
+			publishArgs = append(publishArgs, "--alias="+intermediate)
+			// A failed publish may still have created the image.
+			published = true
+			if err := lxc(ctx, publishArgs...); err != nil {
+				return err
+			}
+		}
+		if cache != nil {
+			// The build container becomes the cache container.
+			if err := cache.save(ctx, containerName, false); err != nil {
+				return err
+			}
+		} else if err := lxc(ctx, "delete", containerName); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Export the image and add the templates.
+	var tarball, fingerprint string
+	var sourceDate time.Time
+	if b.opts.Reproducible {
+		sourceDate = b.opts.SourceDate
+	}
+	if err := phase(ctx, PhaseTemplates, func() error {
+		imageFiles := b.opts.ImageFiles
+		if b.seed != nil {
+			seedFiles, err := b.seed.write(filepath.Join(tmpdir, "seed"), alias, serial)
+			if err != nil {
+				return err
+			}
+			imageFiles = append(append([]ImageFile(nil), imageFiles...), seedFiles...)
+		}
+		if b.opts.VM {
+			metadata, rootfs, unpacked, err := createVMImage(
+				ctx, b.opts.Remote, intermediate, tmpdir, properties, b.opts.TarballFormat, b.templates,
+			)
+			if err != nil {
+				return err
+			}
+			if err := checkImageSize(ctx, result, b.opts.MaxSize, unpacked, metadata, rootfs); err != nil {
+				return err
+			}
+			if fingerprint, err = importImage(ctx, b.opts.Remote, []string{alias, serialAlias}, b.templates, metadata, rootfs); err != nil {
+				return err
+			}
+			if err := lxc(ctx, "image", "delete", qualify(b.opts.Remote, intermediate)); err != nil {
+				return err
+			}
+			intermediateDeleted = true
+			result.Fingerprint = fingerprint
+			emit(ctx, Event{Type: EventArtifact, Artifact: "image:" + fingerprint})
+			return pruneSerials(ctx, b.opts.Remote, alias, keep)
+		}
+		if b.opts.ImageFormat == ImageFormatSplit {
+			ids := idMapping{shift: b.opts.IDShift, strict: b.opts.StrictIDs}
+			metadata, rootfs, unpacked, err := createSplitImage(
+				ctx, backup, tmpdir, properties, sourceDate, b.opts.TarballFormat, &ids,
+				b.templates, imageFiles,
+			)
+			if err != nil {
+				return err
+			}
+			if err := ids.check(ctx); err != nil {
+				return err
+			}
+			if err := checkImageSize(ctx, result, b.opts.MaxSize, unpacked, metadata, rootfs); err != nil {
+				return err
+			}
+			if fingerprint, err = importImage(ctx, b.opts.Remote, []string{alias, serialAlias}, b.templates, metadata, rootfs); err != nil {
+				return err
+			}
+			result.Fingerprint = fingerprint
+			emit(ctx, Event{Type: EventArtifact, Artifact: "image:" + fingerprint})
+			return pruneSerials(ctx, b.opts.Remote, alias, keep)
+		}
+		var unpacked int64
+		var err error
+		tarball, unpacked, err = updateImageTemplates(
+			ctx, b.opts.Remote, intermediate, tmpdir, properties,
+			sourceDate, b.opts.TarballFormat, idMapping{shift: b.opts.IDShift, strict: b.opts.StrictIDs},
+			b.templates, imageFiles,
+		)
+		if err != nil {
+			return err
+		}
+		if err := checkImageSize(ctx, result, b.opts.MaxSize, unpacked, tarball); err != nil {
+			return err
+		}
+		// The intermediate image is only deleted once the
+		// image has been imported; until then, it is kept.
+		if fingerprint, err = importImage(ctx, b.opts.Remote, []string{alias, serialAlias}, b.templates, tarball); err != nil {
+			return err
+		}
+		if err := lxc(ctx, "image", "delete", qualify(b.opts.Remote, intermediate)); err != nil {
+			return err
+		}
+		intermediateDeleted = true
+		result.Fingerprint = fingerprint
+		emit(ctx, Event{Type: EventArtifact, Artifact: "image:" + fingerprint})
+		return pruneSerials(ctx, b.opts.Remote, alias, keep)
+	}); err != nil {
+		intermediateKept = ctx.Err() == nil
+		return nil, err
+	}
+	if len(b.testScenarios) > 0 {
+		if err := phase(ctx, PhaseTest, func() error {
+			capture := func(name, instance string) {
+				dir, err := logsDir()
+				if err != nil {
+					logf(ctx, "Capturing test instance logs: %v", err)
+					return
+				}
+				dir = testLogsDir(dir, name)
+				logs, err := captureTestLogs(detach(ctx), instance, dir)
+				result.TestLogs = append(result.TestLogs, logs...)
+				if err != nil {
+					logf(ctx, "Capturing test instance logs: %v", err)
+					return
+				}
+				logf(ctx, "Captured test instance logs in %s", dir)
+			}
+			var err error
+			result.TestScenarios, err = runTestScenarios(
+				ctx, b.opts.Remote, qualify(b.opts.Remote, result.Fingerprint),
+				"juju-lxd-centos-test-"+buildID, b.testScenarios, capture,
+			)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	attachments := make(map[string]string)
+	if b.opts.Cosign || b.opts.CosignKey != "" {
+		if err := phase(ctx, PhaseSign, func() error {
+			bundle, err := cosignTarball(ctx, tarball, b.opts.CosignKey)
+			attachments[cosignBundleFtype] = bundle
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if b.opts.Provenance {
+		if err := phase(ctx, PhaseProvenance, func() error {
+			builderID := b.opts.BuilderID
+			if builderID == "" {
+				builderID = defaultBuilderID()
+			}
+			path, data, err := writeProvenance(ctx, tmpdir, builderID, b.opts, result)
+			if err != nil {
+				return err
+			}
+			result.Provenance = data
+			attachments[provenanceFtype] = path
+			if b.opts.Cosign || b.opts.CosignKey != "" {
+				bundle, err := attestProvenance(ctx, tarball, data, b.opts.CosignKey)
+				if err != nil {
+					return err
+				}
+				attachments[provenanceBundleFtype] = bundle
+			}
+			if b.opts.SigningKey != "" {
+				if err := gpgSign(ctx, b.opts.SigningKey, path, path+".gpg"); err != nil {
+					return fmt.Errorf("signing provenance: %w", err)
+				}
+				attachments[provenanceSignatureFtype] = path + ".gpg"
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	streamsDir := b.opts.OutputDir
+	if streamsDir == "" && b.uploader != nil {
+		streamsDir = filepath.Join(tmpdir, "streams")
+	}
+	if streamsDir != "" {
+		var written, removed []string
+		if err := phase(ctx, PhaseOutput, func() error {
+			if b.uploader != nil {
+				if err := b.uploader.fetchMetadata(ctx, streamsDir); err != nil {
+					return err
+				}
+			}
+			var err error
+			written, removed, err = writeSimplestreams(
+				ctx, streamsDir, alias, serial, tarball, result.OS, attachments, result.Changelog, keep,
+			)
+			if err != nil {
+				return err
+			}
+			sums, err := writeChecksums(ctx, streamsDir, b.opts.SigningKey)
+			written = append(written, sums...)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if b.uploader != nil {
+			if err := phase(ctx, PhaseUpload, func() error {
+				var err error
+				result.Uploaded, err = b.uploader.upload(ctx, streamsDir, written)
+				if err != nil {
+					return err
+				}
+				// Only remove old images once the metadata
+				// no longer refers to them.
+				return b.uploader.remove(ctx, removed)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Copy the image to the push remotes, if any.
+	images := []string{qualify(b.opts.Remote, alias)}
+	if len(b.opts.PushRemotes) > 0 {
+		if err := phase(ctx, PhasePush, func() error {
+			for _, remote := range b.opts.PushRemotes {
+				if err := pushImage(
+					ctx, b.opts.Remote, remote,
+					[]string{alias, serialAlias}, b.opts.PushPublic,
+				); err != nil {
+					return err
+				}
+				if err := pruneSerials(ctx, remote, alias, keep); err != nil {
+					return err
+				}
+				images = append(images, qualify(remote, alias))
+				result.Pushed = append(result.Pushed, remote)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make the image available to the Juju model, if requested.
+	// A temporary controller for testing uses the local remote.
+	var jujuRemote string
+	if b.opts.JujuModel != "" {
+		if err := phase(ctx, PhaseJujuUpload, func() error {
+			remote, err := uploadToJujuModel(
+				ctx, b.opts.JujuModel, b.opts.JujuRemote,
+				b.opts.Remote, alias, result.Pushed, b.opts.JujuConfig,
+			)
+			if err != nil {
+				return err
+			}
+			jujuRemote = remote
+			if !sameRemote(remote, b.opts.Remote) && !containsRemote(result.Pushed, remote) {
+				images = append(images, qualify(remote, alias))
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if b.opts.JujuTest {
+		if err := phase(ctx, PhaseJujuTest, func() error {
+			capture := func(instance string) {
+				dir, err := logsDir()
+				if err != nil {
+					logf(ctx, "Capturing test instance logs: %v", err)
+					return
+				}
+				logs, err := captureTestLogs(
+					detach(ctx), qualify(jujuRemote, instance), filepath.Join(dir, "juju-test"),
+				)
+				result.TestLogs = append(result.TestLogs, logs...)
+				if err != nil {
+					logf(ctx, "Capturing test instance logs: %v", err)
+					return
+				}
+				logf(ctx, "Captured test instance logs in %s", filepath.Join(dir, "juju-test"))
+			}
+			if err := testJujuMachine(ctx, b.opts.JujuModel, alias, capture); err != nil {
+				return err
+			}
+			// Record the version of Juju the image was tested with.
+			version, err := jujuVersion(ctx)
+			if err != nil {
+				return err
+			}
+			for _, image := range images {
+				if err := setImageProperties(ctx, image, map[string]string{
+					PropertyJujuVersionTested: version,
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	result.Finished = time.Now()
+	return result, nil
+}
@@ -0,0 +1,212 @@
+package imagebuilder_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder/lxdfake"
+)
+
+// newFake returns a fake with images:centos/7 in its image store.
+func newFake(t *testing.T) *lxdfake.Fake {
+	fake := lxdfake.New()
+	if _, err := fake.AddImage("images:centos/7", lxdfake.BaseImage()); err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func build(t *testing.T, opts imagebuilder.Options) (*imagebuilder.Result, error) {
+	b, err := imagebuilder.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Build(context.Background())
+}
+
+func TestBuild(t *testing.T) {
+	fake := newFake(t)
+	result, err := build(t, imagebuilder.Options{
+		Runner:     fake,
+		Serial:     "20200102.1",
+		Properties: map[string]string{"user.team": "juju"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Alias != imagebuilder.DefaultAlias {
+		t.Errorf("got alias %q, expected %q", result.Alias, imagebuilder.DefaultAlias)
+	}
+
+	image := fake.Image(imagebuilder.DefaultAlias)
+	if image == nil {
+		t.Fatalf("image %q not published", imagebuilder.DefaultAlias)
+	}
+	if image.Fingerprint != result.Fingerprint {
+		t.Errorf("got fingerprint %s, expected %s", image.Fingerprint, result.Fingerprint)
+	}
+	if fake.Image(imagebuilder.DefaultAlias+"/20200102.1") != image {
+		t.Errorf("serial alias does not refer to the published image")
+	}
+	for k, v := range map[string]string{
+		"os":                "centos",
+		"release":           "7",
+		"user.team":         "juju",
+		"user.build.serial": "20200102.1",
+	} {
+		if image.Properties[k] != v {
+			t.Errorf("property %s: got %q, expected %q", k, image.Properties[k], v)
+		}
+	}
+
+	files, err := lxdfake.ReadTarball(image.Tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := lxdfake.Metadata(image.Tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := metadata["templates"].(map[interface{}]interface{})
+	for _, target := range []string{
+		"/etc/hostname",
+		"/var/lib/cloud/seed/nocloud-net/meta-data",
+		"/var/lib/cloud/seed/nocloud-net/user-data",
+	} {
+		if _, ok := templates[target]; !ok {
+			t.Errorf("no template for %s in metadata", target)
+		}
+	}
+	if _, ok := files["templates/cloud-init-meta.tpl"]; !ok {
+		t.Errorf("cloud-init-meta.tpl not in image")
+	}
+	if _, ok := files["rootfs/etc/centos-release"]; !ok {
+		t.Errorf("base image's rootfs not in image")
+	}
+
+	// The build container and intermediate image are removed.
+	if containers := fake.Containers(); len(containers) != 0 {
+		t.Errorf("containers left behind: %v", containers[0].Name)
+	}
+	if images := fake.Images(""); len(images) != 1 {
+		t.Errorf("got %d local images, expected 1", len(images))
+	}
+}
+
+func TestBuildImageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "juju")
+	if err := ioutil.WriteFile(source, []byte("juju ALL=(ALL) NOPASSWD:ALL\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFake(t)
+	if _, err := build(t, imagebuilder.Options{
+		Runner: fake,
+		ImageFiles: []imagebuilder.ImageFile{{
+			Source:      source,
+			Destination: "/etc/sudoers.d/juju",
+			Mode:        0440,
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := lxdfake.ReadTarball(fake.Image(imagebuilder.DefaultAlias).Tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(files["rootfs/etc/sudoers.d/juju"]); got != "juju ALL=(ALL) NOPASSWD:ALL\n" {
+		t.Errorf("got /etc/sudoers.d/juju %q", got)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	fake := newFake(t)
+	fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+		if strings.Contains(strings.Join(argv, " "), "yum install") {
+			return errors.New("yum failed")
+		}
+		return nil
+	}
+	if _, err := build(t, imagebuilder.Options{Runner: fake}); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	if image := fake.Image(imagebuilder.DefaultAlias); image != nil {
+		t.Errorf("image published by failed build")
+	}
+	if containers := fake.Containers(); len(containers) != 0 {
+		t.Errorf("containers left behind: %v", containers[0].Name)
+	}
+}
+
+func TestBuildJujuAgentProfile(t *testing.T) {
+	fake := newFake(t)
+	if _, err := build(t, imagebuilder.Options{
+		Runner:   fake,
+		Profiles: []string{"juju-agent"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var installed bool
+	for _, c := range fake.Commands() {
+		if strings.Contains(strings.Join(c, " "), "yum install -y distro-info-data") {
+			installed = true
+		}
+	}
+	if !installed {
+		t.Errorf("distro-info-data not installed")
+	}
+
+	// The build fails if the package cannot be installed,
+	// or does not provide the data.
+	for _, failing := range []string{"yum install -y distro-info-data", "grep -q"} {
+		fake = newFake(t)
+		fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+			if strings.Contains(strings.Join(argv, " "), failing) {
+				return errors.New(failing + " failed")
+			}
+			return nil
+		}
+		if _, err := build(t, imagebuilder.Options{
+			Runner:   fake,
+			Profiles: []string{"juju-agent"},
+		}); err == nil {
+			t.Errorf("expected the build to fail when %q fails", failing)
+		}
+	}
+}
+
+func TestBuildNestingProfile(t *testing.T) {
+	fake := newFake(t)
+	if _, err := build(t, imagebuilder.Options{
+		Runner:            fake,
+		Profiles:          []string{"nesting"},
+		RecommendedConfig: map[string]string{"linux.kernel_modules": "overlay"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	image := fake.Image(imagebuilder.DefaultAlias)
+	if image == nil {
+		t.Fatalf("image %q not published", imagebuilder.DefaultAlias)
+	}
+	for key, value := range map[string]string{
+		"security.nesting": "true",
+		// Recommended config that was given is kept.
+		"linux.kernel_modules": "overlay",
+	} {
+		key = imagebuilder.PropertyRecommendedPrefix + key
+		if got := image.Properties[key]; got != value {
+			t.Errorf("property %s: got %q, expected %q", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package imagebuilder
+
+import (
+	"path"
+	"strings"
+)
+
+// buildPackagesList is the file in the build container recording
+// the build packages that were not already installed, and so are
+// to be removed before the image is published.
+const buildPackagesList = "/var/lib/juju-lxd-centos/build-packages"
+
+// buildPackageSteps returns the steps that install the build-only
+// packages (see Options.BuildPackages) before the provisioning steps,
+// and remove them afterwards, along with the dependencies installed
+// for them alone. Packages already in the container, e.g. from the
+// base image, are left installed.
+func buildPackageSteps(packages []string) (install, remove step) {
+	quoted := make([]string, len(packages))
+	for i, p := range packages {
+		quoted[i] = shellQuote(p)
+	}
+	install = step{"install build packages", packageLockProvisioner{ShellProvisioner{Commands: []string{
+		"mkdir -p " + path.Dir(buildPackagesList),
+		": > " + buildPackagesList,
+		"for p in " + strings.Join(quoted, " ") + `; do
+	rpm -q --whatprovides "$p" >/dev/null 2>&1 || echo "$p" >> ` + buildPackagesList + `
+done`,
+		`if [ -s ` + buildPackagesList + ` ]; then
+	yum install -y $(cat ` + buildPackagesList + `)
+fi`,
+	}}}}
+	remove = step{"remove build packages", packageLockProvisioner{ShellProvisioner{Commands: []string{
+		`if [ -s ` + buildPackagesList + ` ]; then
+	yum remove -y --setopt=clean_requirements_on_remove=1 $(cat ` + buildPackagesList + `)
+fi`,
+		"rm -f " + buildPackagesList,
+		"rmdir " + path.Dir(buildPackagesList) + " 2>/dev/null || true",
+	}}}}
+	return install, remove
+}
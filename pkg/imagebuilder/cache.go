@@ -0,0 +1,233 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// stepCache caches the state of the build container after each
+// provisioning step as LXD snapshots, so that later builds can
+// resume from the deepest step whose inputs are unchanged.
+//
+// The snapshots are kept in a stopped cache container for each
+// alias. A build that resumes from the cache starts its container
+// as a copy of the cache container, restored to the snapshot;
+// the build container then replaces the cache container once
+// it is done with, whether or not the build succeeds.
+type stepCache struct {
+	// container is the name of the cache container,
+	// qualified with the build remote.
+	container string
+
+	// keys holds the snapshot names for the cached steps:
+	// all but the final cleanup step. Each step's key is a
+	// digest of the base image fingerprint and every step up
+	// to and including it, so a change to a step invalidates
+	// it and all the steps after it.
+	keys []string
+
+	// resume is the index of the first step to run.
+	resume int
+}
+
+// newStepCache returns a stepCache for the build of an alias from
+// the base image with the given fingerprint, with the given steps.
+// The launch inputs, such as the user-data and build arguments,
+// are inputs to every step.
+func newStepCache(remote, alias, baseFingerprint string, launchInputs []string, steps []step) (*stepCache, error) {
+	aliasDigest := sha256.Sum256([]byte(alias))
+	c := &stepCache{
+		container: qualify(remote, "juju-lxd-centos-cache-"+hex.EncodeToString(aliasDigest[:6])),
+	}
+	h := sha256.New()
+	h.Write([]byte(baseFingerprint))
+	for _, input := range launchInputs {
+		fmt.Fprintf(h, "\x00%s", input)
+	}
+	for _, s := range steps[:len(steps)-1] {
+		// The %#v format includes unexported fields,
+		// and prints maps sorted by key.
+		fmt.Fprintf(h, "\x00%s\x00%T\x00%#v", s.name, s.provisioner, s.provisioner)
+		for _, file := range stepFiles(s.provisioner) {
+			digest, err := pathSHA256(file)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(h, "\x00%s", digest)
+		}
+		// h.Sum appends to, and does not reset, the hash.
+		c.keys = append(c.keys, "step-"+hex.EncodeToString(h.Sum(nil))[:32])
+	}
+	return c, nil
+}
+
+// stepFiles returns the host files and directories whose
+// contents are copied into the container by the provisioner.
+func stepFiles(p Provisioner) []string {
+	switch p := p.(type) {
+	case FileProvisioner:
+		return []string{p.Source}
+	case ScriptProvisioner:
+		return []string{p.Path}
+	case ConditionalProvisioner:
+		return stepFiles(p.Provisioner)
+	case SensitiveProvisioner:
+		return stepFiles(p.Provisioner)
+	case ParallelProvisioner:
+		var files []string
+		for _, s := range p.Steps {
+			files = append(files, stepFiles(s.Provisioner)...)
+		}
+		return files
+	case AnsibleProvisioner:
+		return []string{p.Playbook}
+	case SaltProvisioner:
+		return nonEmpty(p.StateTree, p.PillarRoots)
+	case PuppetProvisioner:
+		return nonEmpty(p.Manifest, p.ModulePath)
+	case ChefProvisioner:
+		return []string{p.CookbookPath}
+	case offlineRepo:
+		return p.repoFiles
+	}
+	return nil
+}
+
+// nonEmpty returns the non-empty strings of those given.
+func nonEmpty(s ...string) []string {
+	var result []string
+	for _, s := range s {
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// snapshots returns the names of the cache container's snapshots,
+// or nil if the cache container does not exist.
+func (c *stepCache) snapshots(ctx context.Context) ([]string, error) {
+	out, err := runOutput(ctx, "lxc", "list", "--format=json", c.container)
+	if err != nil {
+		return nil, err
+	}
+	var containers []struct {
+		Name      string `json:"name"`
+		Snapshots []struct {
+			Name string `json:"name"`
+		} `json:"snapshots"`
+	}
+	if err := json.Unmarshal(out, &containers); err != nil {
+		return nil, err
+	}
+	_, name := splitImage(c.container)
+	for _, container := range containers {
+		if container.Name != name {
+			// "lxc list" filters by prefix.
+			continue
+		}
+		names := []string{}
+		for _, s := range container.Snapshots {
+			// Older LXD versions name snapshots
+			// "container/snapshot".
+			names = append(names, path.Base(s.Name))
+		}
+		return names, nil
+	}
+	return nil, nil
+}
+
+// restore creates the build container from the cache, restored to
+// the snapshot of the deepest unchanged step, and starts it. If there
+// is no such snapshot, restore returns false without creating the
+// container, and all steps are run. If restoring fails,
+// the container is removed.
+func (c *stepCache) restore(ctx context.Context, container string) (_ bool, err error) {
+	snapshots, err := c.snapshots(ctx)
+	if err != nil {
+		return false, err
+	}
+	have := make(map[string]bool)
+	for _, name := range snapshots {
+		have[name] = true
+	}
+	deepest := -1
+	for i, key := range c.keys {
+		if have[key] {
+			deepest = i
+		}
+	}
+	if deepest == -1 {
+		if snapshots != nil {
+			logf(ctx, "No cached steps are unchanged")
+		}
+		return false, nil
+	}
+
+	logf(ctx, "Resuming from cached step %d of %d", deepest+1, len(c.keys)+1)
+	if err := lxc(ctx, "copy", c.container, container); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := lxc(detach(ctx), "delete", "--force", container); err != nil {
+			logf(ctx, "Deleting build container: %v", err)
+		}
+	}()
+	if err := lxc(ctx, "restore", container, c.keys[deepest]); err != nil {
+		return false, err
+	}
+	// Remove the snapshots of steps that will be run again,
+	// so they can be replaced, and any stale snapshots.
+	valid := make(map[string]bool)
+	for _, key := range c.keys[:deepest+1] {
+		valid[key] = true
+	}
+	for _, name := range snapshots {
+		if !valid[name] {
+			if err := lxc(ctx, "delete", container+"/"+name); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := lxc(ctx, "start", container); err != nil {
+		return false, err
+	}
+	c.resume = deepest + 1
+	return true, nil
+}
+
+// snapshot takes a snapshot of the build container
+// after the i'th step, if the step is cached.
+func (c *stepCache) snapshot(ctx context.Context, container string, i int) error {
+	if i >= len(c.keys) {
+		return nil
+	}
+	return lxc(ctx, "snapshot", container, c.keys[i])
+}
+
+// save replaces the cache container with the stopped build container.
+// If keep is true, the cache container is a copy of the build
+// container; otherwise the build container is renamed, and no
+// longer exists under its own name.
+func (c *stepCache) save(ctx context.Context, container string, keep bool) error {
+	snapshots, err := c.snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	if snapshots != nil {
+		if err := lxc(ctx, "delete", "--force", c.container); err != nil {
+			return err
+		}
+	}
+	if keep {
+		return lxc(ctx, "copy", container, c.container)
+	}
+	return lxc(ctx, "move", container, c.container)
+}
@@ -0,0 +1,86 @@
+package imagebuilder_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder/lxdfake"
+)
+
+// countExecs makes the fake count the commands run in containers
+// that contain each of the given strings.
+func countExecs(fake *lxdfake.Fake, counts map[string]int) {
+	fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+		command := strings.Join(argv, " ")
+		for s := range counts {
+			if strings.Contains(command, s) {
+				counts[s]++
+			}
+		}
+		return nil
+	}
+}
+
+func TestBuildCache(t *testing.T) {
+	fake := newFake(t)
+	shell := func(command string) imagebuilder.Provisioner {
+		return imagebuilder.ShellProvisioner{Commands: []string{command}}
+	}
+	counts := map[string]int{"echo one": 0, "echo two": 0, "echo three": 0}
+	countExecs(fake, counts)
+	if _, err := build(t, imagebuilder.Options{
+		Runner:       fake,
+		Cache:        true,
+		Provisioners: []imagebuilder.Provisioner{shell("echo one"), shell("echo two")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if counts["echo one"] != 1 || counts["echo two"] != 1 {
+		t.Fatalf("got step counts %v, expected each step to run once", counts)
+	}
+
+	// The build container is kept as the cache container,
+	// with a snapshot for each step.
+	containers := fake.Containers()
+	if len(containers) != 1 || !strings.HasPrefix(containers[0].Name, "juju-lxd-centos-cache-") {
+		t.Fatalf("got containers %v, expected the cache container", containers)
+	}
+	cached := len(containers[0].Snapshots)
+	if cached == 0 {
+		t.Fatalf("no steps cached")
+	}
+
+	// Changing the last step runs it alone.
+	if _, err := build(t, imagebuilder.Options{
+		Runner:       fake,
+		Cache:        true,
+		Provisioners: []imagebuilder.Provisioner{shell("echo one"), shell("echo three")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if counts["echo one"] != 1 {
+		t.Errorf("unchanged step run again")
+	}
+	if counts["echo three"] != 1 {
+		t.Errorf("changed step not run")
+	}
+	containers = fake.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("got %d containers, expected the cache container", len(containers))
+	}
+	if got := len(containers[0].Snapshots); got != cached {
+		t.Errorf("got %d cached steps, expected %d", got, cached)
+	}
+
+	// Without the cache, every step runs.
+	if _, err := build(t, imagebuilder.Options{
+		Runner:       fake,
+		Provisioners: []imagebuilder.Provisioner{shell("echo one"), shell("echo three")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if counts["echo one"] != 2 || counts["echo three"] != 2 {
+		t.Errorf("got step counts %v, expected the steps to run again", counts)
+	}
+}
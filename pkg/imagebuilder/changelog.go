@@ -0,0 +1,142 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangelogEntry describes what changed in a build of an alias since
+// the image it replaces. It is recorded in the manifest (see
+// Result.Changelog) and in the image's version of the simplestreams
+// metadata.
+type ChangelogEntry struct {
+	// Serial is the serial of the build, and PreviousSerial
+	// that of the image it replaces.
+	Serial         string `json:"serial"`
+	PreviousSerial string `json:"previous-serial,omitempty"`
+
+	// Date is the image's timestamp (see PropertyTimestamp).
+	Date string `json:"date"`
+
+	// Packages holds the packages that changed, or is nil if the
+	// previous image does not record its packages.
+	Packages *PackageChanges `json:"packages,omitempty"`
+
+	// SpecChanged reports whether the build options changed, going
+	// by the spec hash (see PropertySpecHash), and Options holds the
+	// names of those that changed, if the previous build's options
+	// are recorded in the history file (see Options.HistoryFile).
+	SpecChanged bool     `json:"spec-changed,omitempty"`
+	Options     []string `json:"options,omitempty"`
+
+	// InputsChanged reports whether the inputs of the build
+	// changed (see PropertyInputs): its steps, the files they
+	// copy, or the values of its build arguments.
+	InputsChanged bool `json:"inputs-changed,omitempty"`
+
+	// BaseFingerprint holds the fingerprints of the previous and
+	// new base images, if the base image changed.
+	BaseFingerprint *Change `json:"base-fingerprint,omitempty"`
+}
+
+// Change is a value that changed between builds.
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// empty reports whether no packages changed.
+func (c *PackageChanges) empty() bool {
+	return len(c.Added)+len(c.Removed)+len(c.Upgraded)+len(c.Downgraded) == 0
+}
+
+// unchanged reports whether the build reproduces the image it
+// replaces: it has the same packages, from the same inputs.
+func (e *ChangelogEntry) unchanged() bool {
+	return e.Packages != nil && e.Packages.empty() && !e.InputsChanged
+}
+
+// newChangelogEntry returns the changelog entry of a build, whose
+// image has the given properties and was built with the recorded
+// options spec, describing what changed since the previous image. The
+// options of the previous build are looked up in the history file, if
+// it is non-empty.
+func newChangelogEntry(
+	ctx context.Context, previous *Previous, properties map[string]string,
+	spec json.RawMessage, historyFile string,
+) *ChangelogEntry {
+	old := previous.properties
+	entry := &ChangelogEntry{
+		Serial:         properties[PropertySerial],
+		PreviousSerial: previous.Serial,
+		Date:           properties[PropertyTimestamp],
+		Packages:       previous.Packages,
+		SpecChanged:    old[PropertySpecHash] != properties[PropertySpecHash],
+		InputsChanged:  old[PropertyInputs] != properties[PropertyInputs],
+	}
+	if from, to := old[PropertyBaseFingerprint], properties[PropertyBaseFingerprint]; from != to {
+		entry.BaseFingerprint = &Change{From: from, To: to}
+	}
+	if entry.SpecChanged && historyFile != "" {
+		if rec, err := FindBuild(historyFile, previous.Fingerprint); err == nil && len(rec.Spec) > 0 {
+			options, err := changedOptions(rec.Spec, spec)
+			if err != nil {
+				logf(ctx, "Comparing build options with serial %s: %v", previous.Serial, err)
+			}
+			entry.Options = options
+		}
+	}
+	return entry
+}
+
+// changedOptions returns the names of the options that differ between
+// two recorded specs (see recordedSpec), sorted.
+func changedOptions(from, to json.RawMessage) ([]string, error) {
+	var old, current map[string]json.RawMessage
+	if err := json.Unmarshal(from, &old); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(to, &current); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changed []string
+	for _, name := range names {
+		if string(old[name]) != string(current[name]) {
+			changed = append(changed, name)
+		}
+	}
+	return changed, nil
+}
+
+// logChangelog logs the changes in the changelog entry other than
+// those to packages, which previousImage logs.
+func logChangelog(ctx context.Context, alias string, e *ChangelogEntry) {
+	var changes []string
+	switch {
+	case len(e.Options) > 0:
+		changes = append(changes, "options changed: "+strings.Join(e.Options, ", "))
+	case e.SpecChanged:
+		changes = append(changes, "options changed")
+	case e.InputsChanged:
+		changes = append(changes, "inputs changed")
+	}
+	if e.BaseFingerprint != nil && e.BaseFingerprint.From != "" {
+		changes = append(changes, fmt.Sprintf("base image changed from %.12s", e.BaseFingerprint.From))
+	}
+	if len(changes) > 0 {
+		logf(ctx, "Changes in %s since serial %s: %s", alias, e.PreviousSerial, strings.Join(changes, "; "))
+	}
+}
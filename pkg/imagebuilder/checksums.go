@@ -0,0 +1,74 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// checksumsPath is the path, relative to the simplestreams
+	// tree, of the checksums of the files in the tree.
+	checksumsPath = "SHA256SUMS"
+
+	// checksumsSignaturePath is the path of the detached GPG
+	// signature of checksumsPath.
+	checksumsSignaturePath = "SHA256SUMS.gpg"
+)
+
+// writeChecksums writes a SHA256SUMS file to the root of the
+// simplestreams tree in dir, covering the images and metadata in
+// the tree, so that downloads can be verified with "sha256sum -c".
+// If signingKey is non-empty, the file is signed with that GPG key,
+// writing a detached signature to SHA256SUMS.gpg.
+//
+// The slash-separated paths, relative to dir, of the files written
+// are returned.
+func writeChecksums(ctx context.Context, dir, signingKey string) ([]string, error) {
+	products, err := readStreamsProducts(dir)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, product := range products.Products {
+		for _, version := range product.Versions {
+			for _, item := range version.Items {
+				sums[item.Path] = item.SHA256
+			}
+		}
+	}
+	for _, p := range []string{streamsIndexPath, streamsImagesPath} {
+		if sums[p], err = fileSHA256(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			return nil, err
+		}
+	}
+	paths := make([]string, 0, len(sums))
+	for p := range sums {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[p], p)
+	}
+	checksumsFile := filepath.Join(dir, checksumsPath)
+	if err := ioutil.WriteFile(checksumsFile, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: checksumsFile})
+	written := []string{checksumsPath}
+	if signingKey == "" {
+		return written, nil
+	}
+
+	signatureFile := filepath.Join(dir, checksumsSignaturePath)
+	logf(ctx, "Signing %s with key %s", checksumsPath, signingKey)
+	if err := gpgSign(ctx, signingKey, checksumsFile, signatureFile); err != nil {
+		return written, fmt.Errorf("signing %s: %w", checksumsPath, err)
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: signatureFile})
+	return append(written, checksumsSignaturePath), nil
+}
@@ -0,0 +1,116 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// compression identifies how a tarball is compressed.
+type compression string
+
+const (
+	compressionNone  compression = "none"
+	compressionGzip  compression = "gzip"
+	compressionXz    compression = "xz"
+	compressionZstd  compression = "zstd"
+	compressionBzip2 compression = "bzip2"
+)
+
+// compressionMagic holds the leading bytes of each kind of
+// compressed file.
+var compressionMagic = []struct {
+	magic       []byte
+	compression compression
+}{
+	{[]byte{0x1f, 0x8b}, compressionGzip},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, compressionXz},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, compressionZstd},
+	{[]byte("BZh"), compressionBzip2},
+}
+
+// detectCompression returns the compression of the named file,
+// determined from its content rather than its name, since some
+// versions of LXD export images with extensions that do not match
+// their compression.
+func detectCompression(name string) (compression, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// Uncompressed tarballs have "ustar" at offset 257.
+	header := make([]byte, 262)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("reading %s: %w", filepath.Base(name), err)
+	}
+	header = header[:n]
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression, nil
+		}
+	}
+	if len(header) == 262 && bytes.Equal(header[257:], []byte("ustar")) {
+		return compressionNone, nil
+	}
+	return "", fmt.Errorf("%s is not a tarball, or uses an unsupported compression", filepath.Base(name))
+}
+
+// decompressTarball decompresses the named tarball, whatever its
+// compression, into a file in the same directory, removing the
+// original. The path of the uncompressed tarball is returned; if the
+// tarball is not compressed, it is returned unchanged.
+func decompressTarball(ctx context.Context, name string) (string, error) {
+	c, err := detectCompression(name)
+	if err != nil {
+		return "", err
+	}
+	if c == compressionNone {
+		return name, nil
+	}
+	logf(ctx, "Decompressing %s (%s)", filepath.Base(name), c)
+	fin, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer fin.Close()
+	outName := filepath.Join(filepath.Dir(name), "uncompressed.tar")
+	fout, err := os.Create(outName)
+	if err != nil {
+		return "", err
+	}
+	defer fout.Close()
+	switch c {
+	case compressionGzip, compressionBzip2:
+		var zr io.Reader
+		if c == compressionGzip {
+			gzr, err := gzip.NewReader(fin)
+			if err != nil {
+				return "", fmt.Errorf("decompressing %s: %v", name, err)
+			}
+			zr = gzr
+		} else {
+			zr = bzip2.NewReader(fin)
+		}
+		if _, err := io.Copy(fout, contextReader{ctx, zr}); err != nil {
+			return "", fmt.Errorf("decompressing %s: %v", name, err)
+		}
+	default:
+		// The standard library has no xz or zstd
+		// support, so use the host's tools.
+		if err := runPipe(ctx, fin, fout, string(c), "--decompress", "--stdout"); err != nil {
+			return "", fmt.Errorf("decompressing %s: %w", name, err)
+		}
+	}
+	if err := fout.Close(); err != nil {
+		return "", err
+	}
+	fin.Close()
+	return outName, os.Remove(name)
+}
@@ -0,0 +1,136 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Condition describes the targets a provisioning step applies to.
+// Each field, if non-empty, holds values of which the target must
+// match at least one; a value prefixed with "!" matches targets that
+// do not match the rest of the value. A target must match every
+// non-empty field.
+type Condition struct {
+	// Distro matches the distribution's ID or any of its ID_LIKE
+	// values in /etc/os-release, e.g. "centos" or "rhel".
+	Distro []string `yaml:"distro,omitempty" json:"distro,omitempty"`
+
+	// Release matches the distribution's VERSION_ID, or a prefix
+	// of it ending at a dot, e.g. "7" matches "7" and "7.9".
+	Release []string `yaml:"release,omitempty" json:"release,omitempty"`
+
+	// Arch matches the container's architecture, as reported by
+	// "uname -m", e.g. "x86_64" or "aarch64". The Debian names
+	// "amd64" and "arm64" are accepted as aliases.
+	Arch []string `yaml:"arch,omitempty" json:"arch,omitempty"`
+
+	// Type matches the instance type, "container" or "virtual-machine".
+	// Builds are of containers unless Options.VM is set.
+	Type []string `yaml:"type,omitempty" json:"type,omitempty"`
+}
+
+// targetFacts describes the build container, for evaluating Conditions.
+type targetFacts struct {
+	distros      []string
+	release      string
+	arch         string
+	instanceType string
+}
+
+// archAliases maps Debian architecture names to kernel names.
+var archAliases = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+	"armhf": "armv7l",
+}
+
+// containerFacts returns the facts about the build container.
+func containerFacts(ctx context.Context, container string) (*targetFacts, error) {
+	out, err := runOutput(ctx, "lxc", "exec", container, "--", "cat", "/etc/os-release")
+	if err != nil {
+		return nil, fmt.Errorf("reading os-release: %w", err)
+	}
+	facts := &targetFacts{instanceType: instanceType(ctx)}
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.IndexRune(line, '=')
+		if i == -1 {
+			continue
+		}
+		value := strings.Trim(line[i+1:], `"'`)
+		switch line[:i] {
+		case "ID":
+			facts.distros = append([]string{value}, facts.distros...)
+		case "ID_LIKE":
+			facts.distros = append(facts.distros, strings.Fields(value)...)
+		case "VERSION_ID":
+			facts.release = value
+		}
+	}
+	if out, err = runOutput(ctx, "lxc", "exec", container, "--", "uname", "-m"); err != nil {
+		return nil, err
+	}
+	facts.arch = strings.TrimSpace(string(out))
+	return facts, nil
+}
+
+// matches reports whether the facts match the condition.
+func (c Condition) matches(facts *targetFacts) bool {
+	return matchAny(c.Distro, func(v string) bool {
+		for _, distro := range facts.distros {
+			if v == distro {
+				return true
+			}
+		}
+		return false
+	}) && matchAny(c.Release, func(v string) bool {
+		return v == facts.release || strings.HasPrefix(facts.release, v+".")
+	}) && matchAny(c.Arch, func(v string) bool {
+		if alias, ok := archAliases[v]; ok {
+			v = alias
+		}
+		return v == facts.arch
+	}) && matchAny(c.Type, func(v string) bool {
+		return v == facts.instanceType
+	})
+}
+
+// matchAny reports whether any of the values match,
+// or if there are no values.
+func matchAny(values []string, match func(string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.HasPrefix(v, "!") {
+			if !match(v[1:]) {
+				return true
+			}
+		} else if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConditionalProvisioner is a Provisioner that runs another
+// provisioner only if the build container matches a condition.
+type ConditionalProvisioner struct {
+	When        Condition
+	Provisioner Provisioner
+}
+
+// Run is part of the Provisioner interface.
+func (p ConditionalProvisioner) Run(ctx context.Context, container string) error {
+	facts, err := containerFacts(ctx, container)
+	if err != nil {
+		return err
+	}
+	if !p.When.matches(facts) {
+		logf(ctx, "Skipping step: %s %s (%s) does not match the condition",
+			strings.Join(facts.distros, "/"), facts.release, facts.arch,
+		)
+		return nil
+	}
+	return p.Provisioner.Run(ctx, container)
+}
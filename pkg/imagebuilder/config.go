@@ -0,0 +1,805 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the YAML build configuration file format, which also
+// serves as the build specification submitted to the build server.
+// Each field corresponds to the Options field of the same name.
+// The format is described by SpecSchema.
+type Config struct {
+	// SchemaVersion, if non-empty, must be SchemaVersion.
+	SchemaVersion string `yaml:"schema-version,omitempty" json:"schema-version,omitempty"`
+
+	// Extends names a configuration file that this one builds on,
+	// and Include names further files to combine with it, e.g. shared
+	// cleanup or hardening steps. Relative paths are interpreted
+	// relative to the directory containing the configuration file.
+	// The files are read by ReadConfig, and applied before this
+	// configuration: Extends first, then Include in order.
+	Extends string   `yaml:"extends,omitempty" json:"extends,omitempty"`
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+
+	// parents holds the configurations named by Extends and
+	// Include, once read.
+	parents []*Config
+
+	Image               string                       `yaml:"image,omitempty" json:"image,omitempty"`
+	Base                string                       `yaml:"base,omitempty" json:"base,omitempty"`
+	VM                  bool                         `yaml:"vm,omitempty" json:"vm,omitempty"`
+	BaseQCOW2           string                       `yaml:"base-qcow2,omitempty" json:"base-qcow2,omitempty"`
+	SkipUnchanged       bool                         `yaml:"skip-unchanged,omitempty" json:"skip-unchanged,omitempty"`
+	SerialOnChange      bool                         `yaml:"serial-on-change,omitempty" json:"serial-on-change,omitempty"`
+	Cache               bool                         `yaml:"cache,omitempty" json:"cache,omitempty"`
+	Alias               string                       `yaml:"alias,omitempty" json:"alias,omitempty"`
+	Remote              string                       `yaml:"remote,omitempty" json:"remote,omitempty"`
+	Profiles            []string                     `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+	BuildPackages       []string                     `yaml:"build-packages,omitempty" json:"build-packages,omitempty"`
+	ImageFallbacks      []string                     `yaml:"image-fallbacks,omitempty" json:"image-fallbacks,omitempty"`
+	ImageServer         string                       `yaml:"image-server,omitempty" json:"image-server,omitempty"`
+	ImageServerCA       string                       `yaml:"image-server-ca,omitempty" json:"image-server-ca,omitempty"`
+	ImageServerAuthFile string                       `yaml:"image-server-auth-file,omitempty" json:"image-server-auth-file,omitempty"`
+	BaseFingerprint     string                       `yaml:"base-fingerprint,omitempty" json:"base-fingerprint,omitempty"`
+	AllowOSMismatch     bool                         `yaml:"allow-os-mismatch,omitempty" json:"allow-os-mismatch,omitempty"`
+	BaseKeyring         string                       `yaml:"base-keyring,omitempty" json:"base-keyring,omitempty"`
+	Offline             bool                         `yaml:"offline,omitempty" json:"offline,omitempty"`
+	NoHostNetwork       bool                         `yaml:"no-host-network,omitempty" json:"no-host-network,omitempty"`
+	NoContainerNetwork  bool                         `yaml:"no-container-network,omitempty" json:"no-container-network,omitempty"`
+	NetworkWait         *NetworkWait                 `yaml:"network-wait,omitempty" json:"network-wait,omitempty"`
+	DNS                 []string                     `yaml:"dns,omitempty" json:"dns,omitempty"`
+	NIC                 *NIC                         `yaml:"nic,omitempty" json:"nic,omitempty"`
+	LocalRepo           string                       `yaml:"local-repo,omitempty" json:"local-repo,omitempty"`
+	RepoFiles           []string                     `yaml:"repo-files,omitempty" json:"repo-files,omitempty"`
+	UserData            string                       `yaml:"user-data,omitempty" json:"user-data,omitempty"`
+	Devices             map[string]map[string]string `yaml:"devices,omitempty" json:"devices,omitempty"`
+	ContainerConfig     map[string]string            `yaml:"container-config,omitempty" json:"container-config,omitempty"`
+	LaunchConfig        map[string]string            `yaml:"launch-config,omitempty" json:"launch-config,omitempty"`
+	SELinux             string                       `yaml:"selinux,omitempty" json:"selinux,omitempty"`
+	ImageFormat         string                       `yaml:"image-format,omitempty" json:"image-format,omitempty"`
+	MaxSize             string                       `yaml:"max-size,omitempty" json:"max-size,omitempty"`
+	SkipSpaceCheck      bool                         `yaml:"skip-space-check,omitempty" json:"skip-space-check,omitempty"`
+	LimitRate           string                       `yaml:"limit-rate,omitempty" json:"limit-rate,omitempty"`
+	Description         string                       `yaml:"description,omitempty" json:"description,omitempty"`
+	Properties          map[string]string            `yaml:"properties,omitempty" json:"properties,omitempty"`
+	RecommendedConfig   map[string]string            `yaml:"recommended-config,omitempty" json:"recommended-config,omitempty"`
+	TemplateSet         string                       `yaml:"template-set,omitempty" json:"template-set,omitempty"`
+	TemplateSets        map[string]TemplateSet       `yaml:"template-sets,omitempty" json:"template-sets,omitempty"`
+	TemplateTriggers    map[string][]string          `yaml:"template-triggers,omitempty" json:"template-triggers,omitempty"`
+	ImageFiles          []ImageFileConfig            `yaml:"image-files,omitempty" json:"image-files,omitempty"`
+	BakeSeed            bool                         `yaml:"bake-seed,omitempty" json:"bake-seed,omitempty"`
+	SeedInstanceID      string                       `yaml:"seed-instance-id,omitempty" json:"seed-instance-id,omitempty"`
+	SeedUserData        string                       `yaml:"seed-user-data,omitempty" json:"seed-user-data,omitempty"`
+	SeedNetworkConfig   string                       `yaml:"seed-network-config,omitempty" json:"seed-network-config,omitempty"`
+	Hooks               map[string][]string          `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+	BuildArgs           []string                     `yaml:"build-args,omitempty" json:"build-args,omitempty"`
+	BuildSecrets        []string                     `yaml:"build-secrets,omitempty" json:"build-secrets,omitempty"`
+	Redact              []string                     `yaml:"redact,omitempty" json:"redact,omitempty"`
+	StepRetries         int                          `yaml:"step-retries,omitempty" json:"step-retries,omitempty"`
+	Serial              string                       `yaml:"serial,omitempty" json:"serial,omitempty"`
+	KeepSerials         *int                         `yaml:"keep-serials,omitempty" json:"keep-serials,omitempty"`
+	KeepDays            int                          `yaml:"keep-days,omitempty" json:"keep-days,omitempty"`
+	Rollback            int                          `yaml:"rollback,omitempty" json:"rollback,omitempty"`
+	OutputDir           string                       `yaml:"output,omitempty" json:"output,omitempty"`
+	ScanCommand         string                       `yaml:"scan-command,omitempty" json:"scan-command,omitempty"`
+	ScanFailSeverity    string                       `yaml:"scan-fail-severity,omitempty" json:"scan-fail-severity,omitempty"`
+	Keep                string                       `yaml:"keep,omitempty" json:"keep,omitempty"`
+	CaptureLogs         string                       `yaml:"capture-logs,omitempty" json:"capture-logs,omitempty"`
+	LogsDir             string                       `yaml:"logs-dir,omitempty" json:"logs-dir,omitempty"`
+	DiagnosticsDir      string                       `yaml:"diagnostics-dir,omitempty" json:"diagnostics-dir,omitempty"`
+	HistoryFile         string                       `yaml:"history-file,omitempty" json:"history-file,omitempty"`
+	SigningKey          string                       `yaml:"signing-key,omitempty" json:"signing-key,omitempty"`
+	Cosign              bool                         `yaml:"cosign,omitempty" json:"cosign,omitempty"`
+	CosignKey           string                       `yaml:"cosign-key,omitempty" json:"cosign-key,omitempty"`
+	Provenance          bool                         `yaml:"provenance,omitempty" json:"provenance,omitempty"`
+	BuilderID           string                       `yaml:"builder-id,omitempty" json:"builder-id,omitempty"`
+	Reproducible        bool                         `yaml:"reproducible,omitempty" json:"reproducible,omitempty"`
+	TarballFormat       *TarballFormat               `yaml:"tarball-format,omitempty" json:"tarball-format,omitempty"`
+	IDShift             string                       `yaml:"id-shift,omitempty" json:"id-shift,omitempty"`
+	StrictIDs           bool                         `yaml:"strict-ids,omitempty" json:"strict-ids,omitempty"`
+	Privileged          bool                         `yaml:"privileged,omitempty" json:"privileged,omitempty"`
+	Upload              string                       `yaml:"upload,omitempty" json:"upload,omitempty"`
+	PushRemotes         []string                     `yaml:"push-remotes,omitempty" json:"push-remotes,omitempty"`
+	PushPublic          bool                         `yaml:"push-public,omitempty" json:"push-public,omitempty"`
+	JujuModel           string                       `yaml:"juju-model,omitempty" json:"juju-model,omitempty"`
+	JujuRemote          string                       `yaml:"juju-remote,omitempty" json:"juju-remote,omitempty"`
+	JujuConfig          []string                     `yaml:"juju-config,omitempty" json:"juju-config,omitempty"`
+	JujuTest            bool                         `yaml:"juju-test,omitempty" json:"juju-test,omitempty"`
+	TestScenarios       []string                     `yaml:"test-scenarios,omitempty" json:"test-scenarios,omitempty"`
+	Notifications       []Notification               `yaml:"notifications,omitempty" json:"notifications,omitempty"`
+
+	// Provisioners holds the provisioning steps to run,
+	// in order.
+	Provisioners []ProvisionerConfig `yaml:"provisioners,omitempty" json:"provisioners,omitempty"`
+}
+
+// ProvisionerConfig describes a provisioning step in a Config.
+// Which fields are relevant depends on the type:
+//
+//	shell:   commands, cwd, shell, strict, user, group
+//	file:    source, destination, mode
+//	script:  path, args, cwd, user, group
+//	exec:    command, args
+//	ansible: path, roles-path, args
+//	salt:    path, pillar-roots, states, install
+//	puppet:  path, module-path, install
+//	chef:    path, run-list, install
+//
+// Any step may have a "when" condition; see Condition. Any step may
+// be "sensitive"; see SensitiveProvisioner. Consecutive
+// steps with "parallel" set are run as a ParallelProvisioner, each
+// with its "name" and "depends-on".
+//
+// Relative host paths are interpreted relative to the
+// directory containing the configuration file.
+type ProvisionerConfig struct {
+	Type        string     `yaml:"type" json:"type"`
+	Commands    []string   `yaml:"commands,omitempty" json:"commands,omitempty"`
+	Source      string     `yaml:"source,omitempty" json:"source,omitempty"`
+	Destination string     `yaml:"destination,omitempty" json:"destination,omitempty"`
+	Mode        string     `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Path        string     `yaml:"path,omitempty" json:"path,omitempty"`
+	Command     string     `yaml:"command,omitempty" json:"command,omitempty"`
+	RolesPath   string     `yaml:"roles-path,omitempty" json:"roles-path,omitempty"`
+	PillarRoots string     `yaml:"pillar-roots,omitempty" json:"pillar-roots,omitempty"`
+	ModulePath  string     `yaml:"module-path,omitempty" json:"module-path,omitempty"`
+	States      []string   `yaml:"states,omitempty" json:"states,omitempty"`
+	RunList     []string   `yaml:"run-list,omitempty" json:"run-list,omitempty"`
+	Install     []string   `yaml:"install,omitempty" json:"install,omitempty"`
+	Cwd         string     `yaml:"cwd,omitempty" json:"cwd,omitempty"`
+	Shell       string     `yaml:"shell,omitempty" json:"shell,omitempty"`
+	Strict      bool       `yaml:"strict,omitempty" json:"strict,omitempty"`
+	User        string     `yaml:"user,omitempty" json:"user,omitempty"`
+	Group       string     `yaml:"group,omitempty" json:"group,omitempty"`
+	Args        []string   `yaml:"args,omitempty" json:"args,omitempty"`
+	When        *Condition `yaml:"when,omitempty" json:"when,omitempty"`
+	Name        string     `yaml:"name,omitempty" json:"name,omitempty"`
+	Parallel    bool       `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	DependsOn   []string   `yaml:"depends-on,omitempty" json:"depends-on,omitempty"`
+	Sensitive   bool       `yaml:"sensitive,omitempty" json:"sensitive,omitempty"`
+}
+
+// ImageFileConfig describes a file or directory to add to the
+// image's rootfs in a Config; see ImageFile. The mode is in octal,
+// and the owner and group may be given as ids or names. Relative
+// source paths are interpreted relative to the directory
+// containing the configuration file.
+type ImageFileConfig struct {
+	Source      string `yaml:"source,omitempty" json:"source,omitempty"`
+	Destination string `yaml:"destination" json:"destination"`
+	Directory   bool   `yaml:"directory,omitempty" json:"directory,omitempty"`
+	Mode        string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	UID         int    `yaml:"uid,omitempty" json:"uid,omitempty"`
+	GID         int    `yaml:"gid,omitempty" json:"gid,omitempty"`
+	User        string `yaml:"user,omitempty" json:"user,omitempty"`
+	Group       string `yaml:"group,omitempty" json:"group,omitempty"`
+}
+
+// ImageFile returns the image file described by the config.
+func (c ImageFileConfig) ImageFile() (ImageFile, error) {
+	if c.Destination == "" {
+		return ImageFile{}, fmt.Errorf("image file requires destination")
+	}
+	if c.Directory != (c.Source == "") {
+		return ImageFile{}, fmt.Errorf("image file requires either source or directory")
+	}
+	var mode os.FileMode
+	if c.Mode != "" {
+		m, err := strconv.ParseUint(c.Mode, 8, 32)
+		if err != nil {
+			return ImageFile{}, fmt.Errorf("invalid mode %q", c.Mode)
+		}
+		mode = os.FileMode(m)
+	}
+	return ImageFile{
+		Source:      c.Source,
+		Destination: c.Destination,
+		Mode:        mode,
+		UID:         c.UID,
+		GID:         c.GID,
+		User:        c.User,
+		Group:       c.Group,
+	}, nil
+}
+
+// ReadConfig reads and parses the named configuration file, and
+// the files it extends or includes.
+func ReadConfig(path string) (*Config, error) {
+	return readConfig(path, nil)
+}
+
+// readConfig reads the named configuration file, and those it
+// extends or includes, failing if any of them is already being
+// read in the chain of files leading to it.
+func readConfig(path string, reading []string) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range reading {
+		if other == abs {
+			return nil, fmt.Errorf("%s: configuration includes itself", path)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	parents := config.Include
+	if config.Extends != "" {
+		parents = append([]string{config.Extends}, parents...)
+	}
+	for _, parentPath := range parents {
+		parent, err := readConfig(parentPath, append(reading, abs))
+		if err != nil {
+			return nil, err
+		}
+		config.parents = append(config.parents, parent)
+	}
+	return config, nil
+}
+
+// ParseConfig parses a configuration in YAML (or JSON) format.
+// Relative host paths are interpreted relative to dir.
+func ParseConfig(data []byte, dir string) (*Config, error) {
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	if config.SchemaVersion != "" && config.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf(
+			"unsupported schema-version %q (expected %q)",
+			config.SchemaVersion, SchemaVersion,
+		)
+	}
+	for i := range config.Provisioners {
+		p := &config.Provisioners[i]
+		p.Source = resolvePath(dir, p.Source)
+		p.Path = resolvePath(dir, p.Path)
+		p.PillarRoots = resolvePath(dir, p.PillarRoots)
+		p.ModulePath = resolvePath(dir, p.ModulePath)
+		if filepath.Base(p.Command) != p.Command {
+			// Only resolve commands with a directory
+			// component; others are looked up in $PATH.
+			p.Command = resolvePath(dir, p.Command)
+		}
+		if p.RolesPath != "" {
+			dirs := filepath.SplitList(p.RolesPath)
+			for i, rolesDir := range dirs {
+				dirs[i] = resolvePath(dir, rolesDir)
+			}
+			p.RolesPath = strings.Join(dirs, string(filepath.ListSeparator))
+		}
+	}
+	for i := range config.ImageFiles {
+		f := &config.ImageFiles[i]
+		f.Source = resolvePath(dir, f.Source)
+	}
+	for _, set := range config.TemplateSets {
+		for target, t := range set {
+			t.Source = resolvePath(dir, t.Source)
+			set[target] = t
+		}
+	}
+	config.BaseQCOW2 = resolvePath(dir, config.BaseQCOW2)
+	config.BaseKeyring = resolvePath(dir, config.BaseKeyring)
+	config.ImageServerCA = resolvePath(dir, config.ImageServerCA)
+	config.ImageServerAuthFile = resolvePath(dir, config.ImageServerAuthFile)
+	config.LocalRepo = resolvePath(dir, config.LocalRepo)
+	config.UserData = resolvePath(dir, config.UserData)
+	config.SeedUserData = resolvePath(dir, config.SeedUserData)
+	config.SeedNetworkConfig = resolvePath(dir, config.SeedNetworkConfig)
+	for _, device := range config.Devices {
+		if device["type"] == "disk" && device["source"] != "" {
+			device["source"] = resolvePath(dir, device["source"])
+		}
+	}
+	for i, secret := range config.BuildSecrets {
+		if j := strings.Index(secret, "=file:"); j != -1 {
+			config.BuildSecrets[i] = secret[:j] + "=file:" + resolvePath(dir, secret[j+len("=file:"):])
+		}
+	}
+	for i, path := range config.RepoFiles {
+		config.RepoFiles[i] = resolvePath(dir, path)
+	}
+	config.Extends = resolvePath(dir, config.Extends)
+	for i, path := range config.Include {
+		config.Include[i] = resolvePath(dir, path)
+	}
+	config.LogsDir = resolvePath(dir, config.LogsDir)
+	config.DiagnosticsDir = resolvePath(dir, config.DiagnosticsDir)
+	config.HistoryFile = resolvePath(dir, config.HistoryFile)
+	for i := range config.Notifications {
+		n := &config.Notifications[i]
+		for _, secret := range []*string{&n.Password, &n.Webhook, &n.AccessToken} {
+			if strings.HasPrefix(*secret, "file:") {
+				*secret = "file:" + resolvePath(dir, strings.TrimPrefix(*secret, "file:"))
+			}
+		}
+	}
+	if filepath.Base(config.ScanCommand) != config.ScanCommand {
+		config.ScanCommand = resolvePath(dir, config.ScanCommand)
+	}
+	return &config, nil
+}
+
+// HostFields returns the keys of the fields set in the config that
+// give it access to the host, rather than just the build container:
+// those that run commands on the host, read or write host files or
+// environment variables, use the host's credentials, or weaken the
+// isolation of the build container. Provisioning steps of types
+// other than shell are reported as "provisioner:<type>", NIC devices
+// as "devices:nic", container config keys as "container-config:<key>",
+// and notifications sent to addresses in the config as
+// "notifications:<type>". The keys are sorted. The build server refuses specs with such fields unless
+// its operator allows them.
+func (c *Config) HostFields() []string {
+	fields := make(map[string]bool)
+	set := func(key string, isSet bool) {
+		if isSet {
+			fields[key] = true
+		}
+	}
+	set("extends", c.Extends != "")
+	set("include", len(c.Include) > 0)
+	set("base-qcow2", c.BaseQCOW2 != "")
+	set("base-keyring", c.BaseKeyring != "")
+	set("image-server-ca", c.ImageServerCA != "")
+	set("image-server-auth-file", c.ImageServerAuthFile != "")
+	set("local-repo", c.LocalRepo != "")
+	set("repo-files", len(c.RepoFiles) > 0)
+	set("user-data", c.UserData != "")
+	set("seed-user-data", c.SeedUserData != "")
+	set("seed-network-config", c.SeedNetworkConfig != "")
+	set("scan-command", c.ScanCommand != "")
+	set("logs-dir", c.LogsDir != "")
+	set("diagnostics-dir", c.DiagnosticsDir != "")
+	set("history-file", c.HistoryFile != "")
+	set("output", c.OutputDir != "")
+	set("upload", c.Upload != "")
+	set("signing-key", c.SigningKey != "")
+	set("cosign-key", c.CosignKey != "")
+	set("juju-model", c.JujuModel != "")
+	// Juju tests bootstrap with the host's credentials, even
+	// without a model to upload to.
+	set("juju-test", c.JujuTest)
+	set("build-secrets", len(c.BuildSecrets) > 0)
+	set("privileged", c.Privileged)
+	// Builds act on, and prune images from, the remotes in the
+	// host's lxc config; image servers are added to it.
+	set("remote", c.Remote != "")
+	set("push-remotes", len(c.PushRemotes) > 0)
+	set("push-public", c.PushPublic)
+	set("juju-remote", c.JujuRemote != "")
+	set("image-server", c.ImageServer != "")
+	for _, f := range c.ImageFiles {
+		set("image-files", f.Source != "")
+	}
+	for _, s := range c.TemplateSets {
+		for _, t := range s {
+			set("template-sets", t.Source != "")
+		}
+	}
+	for _, device := range c.Devices {
+		// NICs may be attached to any host interface or network.
+		set("devices:nic", device["type"] == "nic")
+		set("devices", device["type"] != "nic" && device["type"] != "none")
+	}
+	for _, config := range []map[string]string{c.ContainerConfig, c.LaunchConfig} {
+		for key := range config {
+			set("container-config:"+key, !safeContainerConfig(key))
+		}
+	}
+	for _, n := range c.Notifications {
+		for _, secret := range []string{n.Password, n.Webhook, n.AccessToken} {
+			set("notifications", strings.HasPrefix(secret, "file:") || strings.HasPrefix(secret, "env:"))
+		}
+		// Notifications are sent from the host, to any
+		// address the spec gives.
+		set("notifications:"+n.Type, n.Server != "" || n.Homeserver != "" ||
+			n.Webhook != "" && !strings.HasPrefix(n.Webhook, "file:") && !strings.HasPrefix(n.Webhook, "env:"))
+	}
+	for _, p := range c.Provisioners {
+		set("provisioner:"+p.Type, p.Type != "shell")
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// safeContainerConfig reports whether specs may set the container
+// config key without the server's operator allowing it: resource
+// limits, and config that is only seen inside the container. Other
+// keys, such as linux.kernel_modules (which loads modules on the
+// host), raw.* and security.*, may act on the host.
+func safeContainerConfig(key string) bool {
+	for _, prefix := range []string{"limits.", "user.", "environment.", "cloud-init."} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Apply applies the config to the build options. Fields set in
+// the config override those in the options, except for image
+// fallbacks, profiles, build packages, hook commands, repo files,
+// build arguments and secrets, redaction patterns, push remotes,
+// model config, test scenarios, notifications, image files and
+// provisioners, which are added to those already in the options,
+// and devices, container config, properties, recommended config,
+// template sets and template triggers, which are merged with those
+// in the options. The configurations that c extends or includes
+// are applied first.
+func (c *Config) Apply(opts *Options) error {
+	if len(c.parents) == 0 && (c.Extends != "" || len(c.Include) > 0) {
+		return fmt.Errorf("extends and include are only supported in configuration files")
+	}
+	for _, parent := range c.parents {
+		if err := parent.Apply(opts); err != nil {
+			return err
+		}
+	}
+	setString := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	setString(&opts.Image, c.Image)
+	setString(&opts.Base, c.Base)
+	setString(&opts.BaseQCOW2, c.BaseQCOW2)
+	setString(&opts.Alias, c.Alias)
+	setString(&opts.Remote, c.Remote)
+	setString(&opts.ImageServer, c.ImageServer)
+	setString(&opts.ImageServerCA, c.ImageServerCA)
+	setString(&opts.ImageServerAuthFile, c.ImageServerAuthFile)
+	setString(&opts.SELinux, c.SELinux)
+	setString(&opts.ImageFormat, c.ImageFormat)
+	setString(&opts.Description, c.Description)
+	setString(&opts.BaseFingerprint, c.BaseFingerprint)
+	setString(&opts.BaseKeyring, c.BaseKeyring)
+	setString(&opts.LocalRepo, c.LocalRepo)
+	setString(&opts.UserData, c.UserData)
+	setString(&opts.Serial, c.Serial)
+	setString(&opts.OutputDir, c.OutputDir)
+	setString(&opts.SigningKey, c.SigningKey)
+	setString(&opts.CosignKey, c.CosignKey)
+	setString(&opts.BuilderID, c.BuilderID)
+	setString(&opts.Upload, c.Upload)
+	setString(&opts.ScanCommand, c.ScanCommand)
+	setString(&opts.ScanFailSeverity, c.ScanFailSeverity)
+	setString(&opts.Keep, c.Keep)
+	setString(&opts.CaptureLogs, c.CaptureLogs)
+	setString(&opts.LogsDir, c.LogsDir)
+	setString(&opts.DiagnosticsDir, c.DiagnosticsDir)
+	setString(&opts.HistoryFile, c.HistoryFile)
+	setString(&opts.JujuModel, c.JujuModel)
+	setString(&opts.JujuRemote, c.JujuRemote)
+	setString(&opts.TemplateSet, c.TemplateSet)
+	setString(&opts.SeedInstanceID, c.SeedInstanceID)
+	setString(&opts.SeedUserData, c.SeedUserData)
+	setString(&opts.SeedNetworkConfig, c.SeedNetworkConfig)
+	if c.KeepSerials != nil {
+		opts.KeepSerials = *c.KeepSerials
+	}
+	if c.StepRetries != 0 {
+		opts.StepRetries = c.StepRetries
+	}
+	if c.KeepDays != 0 {
+		opts.KeepDays = c.KeepDays
+	}
+	if c.Rollback != 0 {
+		opts.Rollback = c.Rollback
+	}
+	if c.Cache {
+		opts.Cache = true
+	}
+	if c.SkipUnchanged {
+		opts.SkipUnchanged = true
+	}
+	if c.SerialOnChange {
+		opts.SerialOnChange = true
+	}
+	if c.AllowOSMismatch {
+		opts.AllowOSMismatch = true
+	}
+	if c.Offline {
+		opts.Offline = true
+	}
+	if c.NoHostNetwork {
+		opts.NoHostNetwork = true
+	}
+	if c.NoContainerNetwork {
+		opts.NoContainerNetwork = true
+	}
+	if w := c.NetworkWait; w != nil {
+		setString(&opts.NetworkWait.Family, w.Family)
+		setString(&opts.NetworkWait.Interface, w.Interface)
+		setString(&opts.NetworkWait.DNSHost, w.DNSHost)
+		if w.MinInterfaces != 0 {
+			opts.NetworkWait.MinInterfaces = w.MinInterfaces
+		}
+	}
+	if len(c.DNS) > 0 {
+		opts.DNS = c.DNS
+	}
+	if n := c.NIC; n != nil {
+		setString(&opts.NIC.Device, n.Device)
+		setString(&opts.NIC.MAC, n.MAC)
+		setString(&opts.NIC.IPv4, n.IPv4)
+		setString(&opts.NIC.IPv6, n.IPv6)
+	}
+	if c.Reproducible {
+		opts.Reproducible = true
+	}
+	if f := c.TarballFormat; f != nil {
+		if f.GzipModTime != 0 {
+			opts.TarballFormat.GzipModTime = f.GzipModTime
+		}
+		setString(&opts.TarballFormat.GzipOS, f.GzipOS)
+		setString(&opts.TarballFormat.TarFormat, f.TarFormat)
+	}
+	if c.IDShift != "" {
+		shift, err := ParseIDShift(c.IDShift)
+		if err != nil {
+			return err
+		}
+		opts.IDShift = shift
+	}
+	if c.MaxSize != "" {
+		size, err := ParseSize(c.MaxSize)
+		if err != nil {
+			return err
+		}
+		opts.MaxSize = size
+	}
+	if c.LimitRate != "" {
+		rate, err := ParseSize(c.LimitRate)
+		if err != nil {
+			return err
+		}
+		opts.RateLimit = rate
+	}
+	if c.StrictIDs {
+		opts.StrictIDs = true
+	}
+	if c.SkipSpaceCheck {
+		opts.SkipSpaceCheck = true
+	}
+	if c.Privileged {
+		opts.Privileged = true
+	}
+	if c.VM {
+		opts.VM = true
+	}
+	if c.Cosign {
+		opts.Cosign = true
+	}
+	if c.Provenance {
+		opts.Provenance = true
+	}
+	if c.JujuTest {
+		opts.JujuTest = true
+	}
+	if c.PushPublic {
+		opts.PushPublic = true
+	}
+	if c.BakeSeed {
+		opts.BakeSeed = true
+	}
+	for name, device := range c.Devices {
+		if opts.Devices == nil {
+			opts.Devices = make(map[string]map[string]string)
+		}
+		opts.Devices[name] = device
+	}
+	// launch-config is an alias for container-config.
+	for _, config := range []map[string]string{c.ContainerConfig, c.LaunchConfig} {
+		for key, value := range config {
+			if opts.ContainerConfig == nil {
+				opts.ContainerConfig = make(map[string]string)
+			}
+			opts.ContainerConfig[key] = value
+		}
+	}
+	for key, value := range c.Properties {
+		if opts.Properties == nil {
+			opts.Properties = make(map[string]string)
+		}
+		opts.Properties[key] = value
+	}
+	for key, value := range c.RecommendedConfig {
+		if opts.RecommendedConfig == nil {
+			opts.RecommendedConfig = make(map[string]string)
+		}
+		opts.RecommendedConfig[key] = value
+	}
+	for name, set := range c.TemplateSets {
+		if opts.TemplateSets == nil {
+			opts.TemplateSets = make(map[string]TemplateSet)
+		}
+		opts.TemplateSets[name] = set
+	}
+	for name, events := range c.TemplateTriggers {
+		if opts.TemplateTriggers == nil {
+			opts.TemplateTriggers = make(map[string][]string)
+		}
+		opts.TemplateTriggers[name] = events
+	}
+	for name, commands := range c.Hooks {
+		if opts.Hooks == nil {
+			opts.Hooks = make(map[string][]string)
+		}
+		opts.Hooks[name] = append(opts.Hooks[name], commands...)
+	}
+	opts.RepoFiles = append(opts.RepoFiles, c.RepoFiles...)
+	opts.BuildArgs = append(opts.BuildArgs, c.BuildArgs...)
+	opts.BuildSecrets = append(opts.BuildSecrets, c.BuildSecrets...)
+	opts.Redact = append(opts.Redact, c.Redact...)
+	opts.PushRemotes = append(opts.PushRemotes, c.PushRemotes...)
+	opts.Profiles = append(opts.Profiles, c.Profiles...)
+	opts.BuildPackages = append(opts.BuildPackages, c.BuildPackages...)
+	opts.ImageFallbacks = append(opts.ImageFallbacks, c.ImageFallbacks...)
+	opts.JujuConfig = append(opts.JujuConfig, c.JujuConfig...)
+	opts.TestScenarios = append(opts.TestScenarios, c.TestScenarios...)
+	opts.Notifications = append(opts.Notifications, c.Notifications...)
+	for i, f := range c.ImageFiles {
+		file, err := f.ImageFile()
+		if err != nil {
+			return fmt.Errorf("image file %d: %v", i, err)
+		}
+		opts.ImageFiles = append(opts.ImageFiles, file)
+	}
+	var parallel *ParallelProvisioner
+	for i, p := range c.Provisioners {
+		provisioner, err := p.Provisioner()
+		if err != nil {
+			return fmt.Errorf("provisioner %d: %v", i, err)
+		}
+		if !p.Parallel {
+			if len(p.DependsOn) > 0 {
+				return fmt.Errorf("provisioner %d: depends-on requires parallel", i)
+			}
+			parallel = nil
+			opts.Provisioners = append(opts.Provisioners, provisioner)
+			continue
+		}
+		if parallel == nil {
+			opts.Provisioners = append(opts.Provisioners, ParallelProvisioner{})
+			parallel = &ParallelProvisioner{}
+		}
+		parallel.Steps = append(parallel.Steps, ParallelStep{
+			Name:        p.Name,
+			DependsOn:   p.DependsOn,
+			Provisioner: provisioner,
+		})
+		opts.Provisioners[len(opts.Provisioners)-1] = *parallel
+	}
+	return nil
+}
+
+// Provisioner returns the provisioner described by the config.
+func (c ProvisionerConfig) Provisioner() (Provisioner, error) {
+	p, err := c.provisioner()
+	if err != nil {
+		return nil, err
+	}
+	if c.Sensitive {
+		p = SensitiveProvisioner{Provisioner: p}
+	}
+	if c.When == nil {
+		return p, nil
+	}
+	return ConditionalProvisioner{When: *c.When, Provisioner: p}, nil
+}
+
+func (c ProvisionerConfig) provisioner() (Provisioner, error) {
+	if (c.User != "" || c.Group != "" || c.Cwd != "") && c.Type != "shell" && c.Type != "script" {
+		return nil, fmt.Errorf("%s provisioner does not support user, group or cwd", c.Type)
+	}
+	if (c.Shell != "" || c.Strict) && c.Type != "shell" {
+		return nil, fmt.Errorf("%s provisioner does not support shell or strict", c.Type)
+	}
+	if c.Cwd != "" && !path.IsAbs(c.Cwd) {
+		return nil, fmt.Errorf("cwd %q is not absolute", c.Cwd)
+	}
+	switch c.Type {
+	case "shell":
+		if len(c.Commands) == 0 {
+			return nil, fmt.Errorf("shell provisioner requires commands")
+		}
+		if c.Strict && c.Shell != "" && !isPOSIXShell(c.Shell) {
+			return nil, fmt.Errorf("strict is not supported with shell %q", c.Shell)
+		}
+		return ShellProvisioner{
+			Commands: c.Commands,
+			Dir:      c.Cwd,
+			Shell:    c.Shell,
+			Strict:   c.Strict,
+			User:     c.User,
+			Group:    c.Group,
+		}, nil
+	case "file":
+		if c.Source == "" || c.Destination == "" {
+			return nil, fmt.Errorf("file provisioner requires source and destination")
+		}
+		var mode os.FileMode
+		if c.Mode != "" {
+			m, err := strconv.ParseUint(c.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode %q", c.Mode)
+			}
+			mode = os.FileMode(m)
+		}
+		return FileProvisioner{
+			Source:      c.Source,
+			Destination: c.Destination,
+			Mode:        mode,
+		}, nil
+	case "script":
+		if c.Path == "" {
+			return nil, fmt.Errorf("script provisioner requires path")
+		}
+		return ScriptProvisioner{
+			Path:  c.Path,
+			Args:  c.Args,
+			Dir:   c.Cwd,
+			User:  c.User,
+			Group: c.Group,
+		}, nil
+	case "exec":
+		if c.Command == "" {
+			return nil, fmt.Errorf("exec provisioner requires command")
+		}
+		return ExecProvisioner{Command: c.Command, Args: c.Args}, nil
+	case "ansible":
+		if c.Path == "" {
+			return nil, fmt.Errorf("ansible provisioner requires path")
+		}
+		return AnsibleProvisioner{Playbook: c.Path, RolesPath: c.RolesPath, Args: c.Args}, nil
+	case "salt":
+		if c.Path == "" {
+			return nil, fmt.Errorf("salt provisioner requires path")
+		}
+		return SaltProvisioner{
+			StateTree:   c.Path,
+			PillarRoots: c.PillarRoots,
+			States:      c.States,
+			Install:     c.Install,
+		}, nil
+	case "puppet":
+		if c.Path == "" {
+			return nil, fmt.Errorf("puppet provisioner requires path")
+		}
+		return PuppetProvisioner{Manifest: c.Path, ModulePath: c.ModulePath, Install: c.Install}, nil
+	case "chef":
+		if c.Path == "" || len(c.RunList) == 0 {
+			return nil, fmt.Errorf("chef provisioner requires path and run-list")
+		}
+		return ChefProvisioner{CookbookPath: c.Path, RunList: c.RunList, Install: c.Install}, nil
+	}
+	return nil, fmt.Errorf("unknown provisioner type %q", c.Type)
+}
@@ -0,0 +1,241 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configMgmtDir is the directory in the container into which the
+// states, manifests and cookbooks of configuration management
+// provisioners are copied. It is removed after the run.
+const configMgmtDir = "/tmp/juju-lxd-centos-configmgmt"
+
+// SaltProvisioner is a Provisioner that applies Salt states in the
+// container with a masterless minion (salt-call --local). The minion
+// is installed before applying the states, and removed along with its
+// configuration and caches afterwards.
+type SaltProvisioner struct {
+	// StateTree is the path of the directory on the host holding
+	// the Salt state tree, i.e. the minion's file_roots.
+	StateTree string
+
+	// PillarRoots, if non-empty, is the path of the directory on
+	// the host holding the pillar tree.
+	PillarRoots string
+
+	// States holds the states to apply. If empty,
+	// the highstate is applied, per the tree's top.sls.
+	States []string
+
+	// Install, if non-empty, holds the shell commands that install
+	// the minion, replacing the default of installing the latest
+	// stable release with salt-bootstrap. Use this to install from
+	// a local repository.
+	Install []string
+}
+
+// Run is part of the Provisioner interface.
+func (p SaltProvisioner) Run(ctx context.Context, container string) error {
+	install := p.Install
+	if len(install) == 0 {
+		install = []string{
+			"curl -fsSL -o /tmp/bootstrap-salt.sh " +
+				"https://github.com/saltstack/salt-bootstrap/releases/latest/download/bootstrap-salt.sh",
+			// -X: do not start the minion's daemon.
+			"sh /tmp/bootstrap-salt.sh -X stable && rm -f /tmp/bootstrap-salt.sh",
+		}
+	}
+	paths := map[string]string{"states": p.StateTree}
+	apply := "salt-call --local --retcode-passthrough --file-root=" + stagedPath("states", p.StateTree)
+	if p.PillarRoots != "" {
+		paths["pillar"] = p.PillarRoots
+		apply += " --pillar-root=" + stagedPath("pillar", p.PillarRoots)
+	}
+	if len(p.States) == 0 {
+		apply += " state.highstate"
+	} else {
+		apply += " state.apply " + shellQuote(strings.Join(p.States, ","))
+	}
+	return configMgmtRun{
+		name:    "Salt",
+		install: install,
+		paths:   paths,
+		apply:   apply,
+		uninstall: []string{
+			"yum remove -y 'salt*'",
+			"rm -rf /etc/salt /var/cache/salt /var/log/salt /etc/yum.repos.d/salt*.repo",
+		},
+	}.run(ctx, container)
+}
+
+// PuppetProvisioner is a Provisioner that applies a Puppet manifest
+// in the container with "puppet apply". The Puppet agent is installed
+// before applying the manifest, and removed along with its
+// configuration afterwards.
+type PuppetProvisioner struct {
+	// Manifest is the path on the host of the manifest to apply,
+	// or of a directory of manifests.
+	Manifest string
+
+	// ModulePath, if non-empty, is the path of the directory on
+	// the host holding the modules the manifest uses.
+	ModulePath string
+
+	// Install, if non-empty, holds the shell commands that install
+	// the agent, replacing the default of installing the latest
+	// release from yum.puppet.com.
+	Install []string
+}
+
+// Run is part of the Provisioner interface.
+func (p PuppetProvisioner) Run(ctx context.Context, container string) error {
+	install := p.Install
+	if len(install) == 0 {
+		install = []string{
+			"rpm -q puppet-release || yum install -y https://yum.puppet.com/puppet-release-el-7.noarch.rpm",
+			"yum install -y puppet-agent",
+		}
+	}
+	paths := map[string]string{"manifests": p.Manifest}
+	apply := "/opt/puppetlabs/bin/puppet apply --detailed-exitcodes"
+	if p.ModulePath != "" {
+		paths["modules"] = p.ModulePath
+		apply += " --modulepath=" + stagedPath("modules", p.ModulePath)
+	}
+	// With --detailed-exitcodes, 2 means changes were applied
+	// successfully; 4 and 6 mean there were failures.
+	apply = fmt.Sprintf(
+		"%s %s; rc=$?; [ $rc -eq 0 ] || [ $rc -eq 2 ]",
+		apply, stagedPath("manifests", p.Manifest),
+	)
+	return configMgmtRun{
+		name:    "Puppet",
+		install: install,
+		paths:   paths,
+		apply:   apply,
+		uninstall: []string{
+			"yum remove -y puppet-agent puppet-release",
+			"rm -rf /opt/puppetlabs /etc/puppetlabs /var/log/puppetlabs",
+		},
+	}.run(ctx, container)
+}
+
+// ChefProvisioner is a Provisioner that runs Chef Infra Client in
+// local mode (chef-solo) in the container, accepting the Chef
+// license. The client is installed before the run, and removed along
+// with its configuration and caches afterwards.
+type ChefProvisioner struct {
+	// CookbookPath is the path of the directory
+	// on the host holding the cookbooks.
+	CookbookPath string
+
+	// RunList holds the run list, e.g. "recipe[base]".
+	RunList []string
+
+	// Install, if non-empty, holds the shell commands that install
+	// the client, replacing the default of installing the latest
+	// release with the Chef omnitruck installer.
+	Install []string
+}
+
+// Run is part of the Provisioner interface.
+func (p ChefProvisioner) Run(ctx context.Context, container string) error {
+	if len(p.RunList) == 0 {
+		return fmt.Errorf("chef provisioner requires a run list")
+	}
+	install := p.Install
+	if len(install) == 0 {
+		install = []string{
+			"curl -fsSL https://omnitruck.chef.io/install.sh | bash -s -- -P chef",
+		}
+	}
+	solo := path.Join(configMgmtDir, "solo.rb")
+	return configMgmtRun{
+		name:    "Chef",
+		install: install,
+		paths:   map[string]string{"cookbooks": p.CookbookPath},
+		apply: fmt.Sprintf(
+			"printf 'cookbook_path %%s\\n' %s > %s && "+
+				"chef-solo --chef-license accept-silent --config %s --override-runlist %s",
+			shellQuote(`"`+stagedPath("cookbooks", p.CookbookPath)+`"`), solo,
+			solo, shellQuote(strings.Join(p.RunList, ",")),
+		),
+		uninstall: []string{
+			"yum remove -y chef",
+			"rm -rf /opt/chef /etc/chef /var/chef /root/.chef",
+		},
+	}.run(ctx, container)
+}
+
+// stagedPath returns the path in the container to which
+// configMgmtRun copies a host file or directory with the
+// given role, keeping its base name.
+func stagedPath(role, hostPath string) string {
+	return path.Join(configMgmtDir, role, filepath.Base(hostPath))
+}
+
+// configMgmtRun describes a masterless configuration management run.
+type configMgmtRun struct {
+	// name is the name of the tool, for logging.
+	name string
+
+	// install holds the shell commands that install the tool.
+	install []string
+
+	// paths maps roles to host files or directories to copy
+	// into the container before applying; see stagedPath.
+	paths map[string]string
+
+	// apply is the shell command that applies the configuration.
+	apply string
+
+	// uninstall holds the shell commands that remove the tool.
+	uninstall []string
+}
+
+// run installs the tool, copies the paths into the container,
+// applies the configuration, and then removes the tool.
+func (r configMgmtRun) run(ctx context.Context, container string) error {
+	logf(ctx, "Installing %s", r.name)
+	if err := (ShellProvisioner{Commands: r.install}).Run(ctx, container); err != nil {
+		return fmt.Errorf("installing %s: %w", r.name, err)
+	}
+	defer lxc(detach(ctx), "exec", container, "--", "/bin/rm", "-rf", configMgmtDir)
+	roles := make([]string, 0, len(r.paths))
+	for role := range r.paths {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		hostPath := r.paths[role]
+		info, err := os.Stat(hostPath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			push := FileProvisioner{Source: hostPath, Destination: stagedPath(role, hostPath)}
+			if err := push.Run(ctx, container); err != nil {
+				return err
+			}
+			continue
+		}
+		// Directories are pushed into the destination directory.
+		if err := lxc(ctx,
+			"file", "push", "--recursive", "--create-dirs",
+			hostPath, container+path.Join(configMgmtDir, role)+"/",
+		); err != nil {
+			return confinementError(ctx, err, hostPath)
+		}
+	}
+	logf(ctx, "Applying %s configuration", r.name)
+	if err := (ShellProvisioner{Commands: []string{r.apply}}).Run(ctx, container); err != nil {
+		return err
+	}
+	logf(ctx, "Removing %s", r.name)
+	return ShellProvisioner{Commands: r.uninstall}.Run(ctx, container)
+}
@@ -0,0 +1,122 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// NetworkWait holds the criteria for the build container's network
+// to be considered ready for provisioning. The zero value waits for
+// any interface other than lo with a global IPv4 address.
+type NetworkWait struct {
+	// Family is the address family the interfaces must have a global
+	// address of: "inet" (the default, if empty), "inet6" or "any".
+	Family string `yaml:"family,omitempty" json:"family,omitempty"`
+
+	// Interface, if non-empty, is the name of the interface that must
+	// have an address, e.g. "eth1" for build profiles with several
+	// NICs where only one routes to the package mirrors.
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty"`
+
+	// MinInterfaces is the number of interfaces that must have an
+	// address, if greater than one.
+	MinInterfaces int `yaml:"min-interfaces,omitempty" json:"min-interfaces,omitempty"`
+
+	// DNSHost, if non-empty, is a host name that must also resolve
+	// in the container, e.g. "mirrorlist.centos.org".
+	DNSHost string `yaml:"dns-host,omitempty" json:"dns-host,omitempty"`
+}
+
+// check checks that the criteria are valid.
+func (w NetworkWait) check() error {
+	switch w.Family {
+	case "", "inet", "inet6", "any":
+	default:
+		return fmt.Errorf("invalid network wait address family %q (expected inet, inet6 or any)", w.Family)
+	}
+	if w.Interface == "lo" {
+		return fmt.Errorf("invalid network wait interface %q", w.Interface)
+	}
+	if w.MinInterfaces < 0 || w.Interface != "" && w.MinInterfaces > 1 {
+		return fmt.Errorf("invalid network wait minimum interfaces %d", w.MinInterfaces)
+	}
+	return nil
+}
+
+// ready reports whether the container's interfaces meet the criteria,
+// other than DNSHost.
+func (w NetworkWait) ready(status *containerStatus) bool {
+	family := w.Family
+	if family == "" {
+		family = "inet"
+	}
+	var up int
+	for name, network := range status.State.Networks {
+		if name == "lo" || w.Interface != "" && name != w.Interface {
+			continue
+		}
+		if network.State != "up" || len(network.Addresses) == 0 {
+			continue
+		}
+		for _, addr := range network.Addresses {
+			if addr.Scope == "global" && (family == "any" || addr.Family == family) {
+				up++
+				break
+			}
+		}
+	}
+	return up > 0 && up >= w.MinInterfaces
+}
+
+// waitContainerNetwork waits for the container's network to meet
+// the criteria, failing with ErrNetworkTimeout after a minute.
+func waitContainerNetwork(ctx context.Context, container string, w NetworkWait) error {
+	logf(ctx, "Waiting for network connectivity")
+
+	now := time.Now()
+	interval := time.Second
+	deadline := now.Add(time.Minute)
+	for !now.After(deadline) {
+		status, err := getContainerStatus(ctx, container)
+		if err != nil {
+			return err
+		}
+		if status.State.Status == "Running" && w.ready(status) {
+			if w.DNSHost == "" || succeeds(ctx, "lxc", "exec", container, "--", "getent", "hosts", w.DNSHost) {
+				return nil
+			}
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		now = now.Add(interval)
+	}
+	return ErrNetworkTimeout
+}
+
+type containerStatus struct {
+	State struct {
+		Status   string `json:"status"`
+		Networks map[string]struct {
+			Addresses []struct {
+				Family string `json:"family"`
+				Scope  string `json:"scope"`
+			} `json:"addresses"`
+			State string `json:"state"`
+		} `json:"network"`
+	} `json:"state"`
+}
+
+func getContainerStatus(ctx context.Context, container string) (*containerStatus, error) {
+	out, err := runOutput(ctx, "lxc", "list", "--format=json", container)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []containerStatus
+	if err := json.Unmarshal(out, &statuses); err != nil {
+		return nil, err
+	}
+	return &statuses[0], nil
+}
@@ -0,0 +1,44 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+)
+
+// CopyImage copies the built image with the given alias from the
+// source remote to each of the target remotes, independently of a
+// build. The image is copied with its alias and its serial alias,
+// moving them from any existing images on the targets, and its
+// properties are preserved. If public is true, the copies are
+// marked public. Remotes may be empty to denote the default remote.
+func CopyImage(ctx context.Context, alias, source string, targets []string, public bool) error {
+	image, err := findBuiltImage(ctx, source, alias)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		where := "the default remote"
+		if source != "" {
+			where = fmt.Sprintf("remote %q", source)
+		}
+		return fmt.Errorf("no image built by %s with alias %q found in %s", BuilderName, alias, where)
+	}
+	aliases := []string{alias}
+	if serial := image.Properties[PropertySerial]; serial != "" {
+		aliases = append(aliases, alias+"/"+serial)
+	}
+	for _, target := range targets {
+		if sameRemote(source, target) {
+			return fmt.Errorf("cannot copy image %q to its own remote", alias)
+		}
+		if err := pushImage(ctx, source, target, aliases, public); err != nil {
+			return err
+		}
+		// Ensure the properties are carried over, including
+		// any set on the source image after it was built.
+		if err := setImageProperties(ctx, qualify(target, alias), image.Properties); err != nil {
+			return err
+		}
+	}
+	return nil
+}
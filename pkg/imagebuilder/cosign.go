@@ -0,0 +1,38 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+)
+
+// cosignBundleFtype is the simplestreams file type for the Sigstore
+// bundle holding the cosign signature of the image tarball.
+const cosignBundleFtype = combinedFtype + ".sigstore.json"
+
+// cosignTarball signs the image tarball with cosign, writing a
+// Sigstore bundle holding the signature (and, for keyless signing,
+// the signing certificate and transparency log entry) next to it,
+// and returning the bundle's path. If key is empty, the tarball is
+// signed keylessly, using the ambient OIDC identity; otherwise key
+// is passed to cosign's --key flag, and may be a file, a KMS URI or
+// a Kubernetes secret reference.
+//
+// The bundle can be verified with:
+//
+//	cosign verify-blob --bundle lxd_combined.tar.gz.sigstore.json \
+//	    [--key <key> | --certificate-identity ... --certificate-oidc-issuer ...] \
+//	    lxd_combined.tar.gz
+func cosignTarball(ctx context.Context, tarball, key string) (string, error) {
+	bundle := tarball + ".sigstore.json"
+	args := []string{"sign-blob", "--yes", "--bundle", bundle}
+	if key != "" {
+		args = append(args, "--key", key)
+	}
+	args = append(args, tarball)
+	logf(ctx, "Signing %s with cosign", tarball)
+	if err := run(ctx, "cosign", args...); err != nil {
+		return "", fmt.Errorf("signing image with cosign: %w", err)
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: bundle})
+	return bundle, nil
+}
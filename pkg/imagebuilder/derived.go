@@ -0,0 +1,173 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// PropertyBaseImage records the base image an image was
+	// built from: Options.Image, or Options.Base for derived
+	// builds.
+	PropertyBaseImage = "user.build.base-image"
+
+	// PropertyBaseFingerprint records the fingerprint of
+	// the base image an image was built from.
+	PropertyBaseFingerprint = "user.build.base-fingerprint"
+
+	// PropertyInputs records a digest of the inputs to the
+	// build other than the base image; see Options.SkipUnchanged.
+	PropertyInputs = "user.build.inputs-sha256"
+)
+
+// resetCloudInitProvisioner resets cloud-init's state in derived
+// builds, builds with user-data and builds from qcow2 cloud images,
+// whose build instances run cloud-init on boot.
+var resetCloudInitProvisioner = ShellProvisioner{
+	Commands: []string{"cloud-init clean --logs"},
+}
+
+// findBuiltImage returns the image built by this package with the
+// given alias in the remote's image store, or nil if there is none.
+func findBuiltImage(ctx context.Context, remote, alias string) (*ImageInfo, error) {
+	images, err := ListBuiltImages(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		for _, a := range images[i].Aliases {
+			if a.Name == alias {
+				return &images[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// inputsDigest returns a hex-encoded digest of the inputs to the
+// build that determine the image's contents, other than the base
+// image: the builder version, the build arguments (but not the
+// values of secrets), the build packages, hooks, profiles and provisioners, the
+// contents of the host files and directories copied by provisioners
+// (see stepFiles), of the user-data, image files and templates, and the offline repositories. Programs run by exec
+// provisioners, Ansible roles and scan commands are not included.
+func inputsDigest(opts Options) (string, error) {
+	inputs := struct {
+		Version      string
+		BuildArgs    []string
+		BuildSecrets []string
+		Profiles     []string
+		Packages     []string            `json:",omitempty"`
+		Hooks        map[string][]string `json:",omitempty"`
+		Provisioners []provisionerSpec
+		Files        map[string]string `json:",omitempty"`
+		Offline      bool
+		LocalRepo    string
+		RepoFiles    []string
+		Description  string              `json:",omitempty"`
+		Properties   map[string]string   `json:",omitempty"`
+		Recommended  map[string]string   `json:",omitempty"`
+		TemplateSet  string              `json:",omitempty"`
+		Templates    TemplateSet         `json:",omitempty"`
+		Triggers     map[string][]string `json:",omitempty"`
+		ImageFiles   []ImageFile         `json:",omitempty"`
+		BakeSeed     bool                `json:",omitempty"`
+		SeedID       string              `json:",omitempty"`
+	}{
+		Version:      Version,
+		BuildArgs:    opts.BuildArgs,
+		BuildSecrets: buildArgNames(opts.BuildSecrets),
+		Profiles:     opts.Profiles,
+		Packages:     opts.BuildPackages,
+		Hooks:        opts.Hooks,
+		Provisioners: newSpecOptions(opts).Provisioners,
+		Offline:      opts.Offline || opts.NoContainerNetwork,
+		LocalRepo:    opts.LocalRepo,
+		RepoFiles:    opts.RepoFiles,
+		Description:  opts.Description,
+		Properties:   opts.Properties,
+		Recommended:  opts.RecommendedConfig,
+		TemplateSet:  opts.TemplateSet,
+		Templates:    opts.TemplateSets[opts.TemplateSet],
+		Triggers:     opts.TemplateTriggers,
+		ImageFiles:   opts.ImageFiles,
+		BakeSeed:     opts.BakeSeed,
+		SeedID:       opts.SeedInstanceID,
+	}
+	var files []string
+	for _, p := range opts.Provisioners {
+		files = append(files, stepFiles(p)...)
+	}
+	files = append(files, opts.RepoFiles...)
+	for _, f := range opts.ImageFiles {
+		if !f.dir() {
+			files = append(files, f.Source)
+		}
+	}
+	for _, t := range opts.TemplateSets[opts.TemplateSet] {
+		if t.Source != "" {
+			files = append(files, t.Source)
+		}
+	}
+	if opts.UserData != "" {
+		files = append(files, opts.UserData)
+	}
+	for _, file := range []string{opts.SeedUserData, opts.SeedNetworkConfig} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	for _, file := range files {
+		digest, err := pathSHA256(file)
+		if err != nil {
+			return "", err
+		}
+		if inputs.Files == nil {
+			inputs.Files = make(map[string]string)
+		}
+		inputs.Files[file] = digest
+	}
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// unchangedImage returns the image built by this package with the
+// given alias in the remote's image store if it was built from the
+// base image with the given fingerprint and with the same inputs,
+// or nil if there is no such image.
+func unchangedImage(ctx context.Context, remote, alias, baseFingerprint, inputs string) (*ImageInfo, error) {
+	image, err := findBuiltImage(ctx, remote, alias)
+	if err != nil || image == nil {
+		return nil, err
+	}
+	if image.Properties[PropertyBaseFingerprint] != baseFingerprint {
+		logf(ctx, "Base image of %s has changed", alias)
+		return nil, nil
+	}
+	if image.Properties[PropertyInputs] != inputs {
+		logf(ctx, "Inputs to %s have changed", alias)
+		return nil, nil
+	}
+	return image, nil
+}
+
+// checkBase checks that the base image of a derived build
+// exists in the remote's image store, and was built by this
+// package.
+func checkBase(ctx context.Context, remote, base string) error {
+	image, err := findBuiltImage(ctx, remote, base)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return fmt.Errorf("%w: no image built by %s with alias %q", ErrBaseImageNotFound, BuilderName, base)
+	}
+	return nil
+}
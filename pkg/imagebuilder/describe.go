@@ -0,0 +1,71 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PropertySpecHash records a digest of the build spec: the
+	// options the image was built with, encoded as in diagnostics
+	// bundles and provenance documents.
+	PropertySpecHash = "user.build.spec-hash"
+
+	// PropertyToolVersion records the version of the builder
+	// (Version) that built the image.
+	PropertyToolVersion = "user.build.tool-version"
+
+	// PropertyTimestamp records when the image was built, in
+	// RFC 3339 format (UTC). For reproducible builds, it is the
+	// source date.
+	PropertyTimestamp = "user.build.timestamp"
+)
+
+// specDigest returns the value of the PropertySpecHash
+// property for a build with the given options.
+func specDigest(opts Options) (string, error) {
+	data, err := json.Marshal(newSpecOptions(opts))
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(digest[:]), nil
+}
+
+// recordedSpec returns the build options as recorded in manifests
+// and the history file: encoded as in diagnostics bundles, without
+// sensitive steps, and with sensitive text masked by r.
+func recordedSpec(opts Options, r *redactor) (json.RawMessage, error) {
+	opts.Provisioners = hideSensitive(opts.Provisioners)
+	data, err := json.Marshal(newSpecOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return r.redactBytes(data), nil
+}
+
+// DescribeImage returns the image built by this package that the
+// alias refers to. The alias may be qualified with a remote
+// ("remote:alias"); otherwise the default remote is used.
+func DescribeImage(ctx context.Context, alias string) (*ImageInfo, error) {
+	var remote string
+	if i := strings.IndexByte(alias, ':'); i >= 0 {
+		remote, alias = alias[:i], alias[i+1:]
+	}
+	image, err := findBuiltImage(ctx, remote, alias)
+	if err != nil {
+		return nil, err
+	}
+	if image == nil {
+		where := "the default remote"
+		if remote != "" {
+			where = fmt.Sprintf("remote %q", remote)
+		}
+		return nil, fmt.Errorf("no image built by %s with alias %q found in %s", BuilderName, alias, where)
+	}
+	return image, nil
+}
@@ -0,0 +1,126 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseDevice parses a device in the form "name,key=value,...", as
+// accepted on the command line, returning the device's name and its
+// config, which must include the device type as "type".
+func ParseDevice(s string) (string, map[string]string, error) {
+	fields := strings.Split(s, ",")
+	name := fields[0]
+	config := make(map[string]string)
+	for _, kv := range fields[1:] {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return "", nil, fmt.Errorf("invalid device %q: expected key=value, got %q", s, kv)
+		}
+		config[kv[:i]] = kv[i+1:]
+	}
+	if err := checkDevice(name, config); err != nil {
+		return "", nil, err
+	}
+	return name, config, nil
+}
+
+// checkDevice checks that the device has a name that does not clash
+// with the builder's own devices, and a type.
+func checkDevice(name string, config map[string]string) error {
+	if name == "" {
+		return fmt.Errorf("device has no name")
+	}
+	if name == offlineRepoDevice || name == vmAgentDevice || name == vmCloudInitDevice {
+		return fmt.Errorf("device name %q is reserved", name)
+	}
+	if config["type"] == "" {
+		return fmt.Errorf("device %q has no type", name)
+	}
+	return nil
+}
+
+// checkContainerConfig checks that the build container config
+// does not set keys that LXD or the builder manage.
+func checkContainerConfig(config map[string]string) error {
+	for key := range config {
+		for _, prefix := range []string{"volatile.", "image.", "user.user-data"} {
+			if strings.HasPrefix(key, prefix) {
+				return fmt.Errorf("build container config key %q cannot be set", key)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the map's keys, sorted.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedDeviceNames returns the device names, sorted.
+func sortedDeviceNames(devices map[string]map[string]string) []string {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// containerConfigArgs returns the "lxc launch" arguments
+// that set the build container config.
+func containerConfigArgs(config map[string]string) []string {
+	var args []string
+	for _, key := range sortedKeys(config) {
+		args = append(args, "--config="+key+"="+config[key])
+	}
+	return args
+}
+
+// addDevices adds the devices to the build container.
+func addDevices(ctx context.Context, container string, devices map[string]map[string]string) error {
+	for _, name := range sortedDeviceNames(devices) {
+		device := devices[name]
+		args := []string{"config", "device", "add", container, name, device["type"]}
+		for _, key := range sortedKeys(device) {
+			if key != "type" {
+				args = append(args, key+"="+device[key])
+			}
+		}
+		if err := lxc(ctx, args...); err != nil {
+			return fmt.Errorf("adding device %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// detachDevices is a Provisioner that removes the devices added to
+// the build container, and unsets the build container config, so
+// that neither is in effect when the container is published.
+type detachDevices struct {
+	devices []string
+	config  []string
+}
+
+// Run is part of the Provisioner interface.
+func (d detachDevices) Run(ctx context.Context, container string) error {
+	for _, name := range d.devices {
+		if err := lxc(ctx, "config", "device", "remove", container, name); err != nil {
+			return err
+		}
+	}
+	for _, key := range d.config {
+		if err := lxc(ctx, "config", "unset", container, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diagnostics records what is needed to assemble a diagnostics
+// bundle should a build fail.
+type diagnostics struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// record is an event callback that records the event.
+func (d *diagnostics) record(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, e)
+}
+
+// specOptions is the JSON form of the build options recorded in
+// diagnostics bundles and provenance documents. Its fields shadow those of Options that
+// cannot be encoded as they are.
+type specOptions struct {
+	Options
+	BuildArgs    []string          `json:"BuildArgs,omitempty"`
+	Provisioners []provisionerSpec `json:"Provisioners,omitempty"`
+	OnEvent      *struct{}         `json:"OnEvent,omitempty"`
+	Runner       *struct{}         `json:"Runner,omitempty"`
+}
+
+type provisionerSpec struct {
+	Type        string
+	Provisioner Provisioner
+}
+
+func newSpecOptions(opts Options) specOptions {
+	spec := specOptions{Options: opts}
+	if len(opts.BuildArgs) > 0 {
+		spec.BuildArgs = buildArgNames(opts.BuildArgs)
+	}
+	for _, p := range opts.Provisioners {
+		spec.Provisioners = append(spec.Provisioners, provisionerSpec{provisionerType(p), p})
+	}
+	return spec
+}
+
+// diagnosticsPrefix is the prefix of the names
+// of diagnostics bundles.
+const diagnosticsPrefix = "juju-lxd-centos-diagnostics-"
+
+// writeDiagnostics writes a diagnostics bundle for the failed
+// build to a new tarball in dir, returning its path. The bundle
+// contains:
+//
+//	events.jsonl    the build's events, including command output
+//	spec.json       the build options
+//	manifest.json   the partial build result
+//	error.txt       the build error
+//	lxd-info.txt    "lxc info" and "lxc version" output
+//	logs/...        captured container logs
+func (d *diagnostics) writeDiagnostics(
+	ctx context.Context,
+	dir string,
+	opts Options,
+	result *Result,
+	buildErr error,
+) (string, error) {
+	files := make(map[string][]byte)
+
+	d.mu.Lock()
+	var events bytes.Buffer
+	enc := json.NewEncoder(&events)
+	for _, e := range d.events {
+		if err := enc.Encode(e); err != nil {
+			d.mu.Unlock()
+			return "", err
+		}
+	}
+	d.mu.Unlock()
+	files["events.jsonl"] = events.Bytes()
+
+	var err error
+	opts.Provisioners = hideSensitive(opts.Provisioners)
+	if files["spec.json"], err = json.MarshalIndent(newSpecOptions(opts), "", "  "); err != nil {
+		return "", err
+	}
+	if files["manifest.json"], err = json.MarshalIndent(result, "", "  "); err != nil {
+		return "", err
+	}
+	files["error.txt"] = []byte(buildErr.Error() + "\n")
+
+	// Record details of the LXD server, which may
+	// be relevant to the failure.
+	var info bytes.Buffer
+	for _, args := range [][]string{
+		{"version"},
+		{"info", qualify(opts.Remote, "")},
+	} {
+		fmt.Fprintf(&info, "$ lxc %s\n", args[0])
+		out, err := runOutput(ctx, "lxc", args...)
+		if err != nil {
+			fmt.Fprintf(&info, "error: %v\n", err)
+		}
+		info.Write(out)
+		info.WriteString("\n")
+	}
+	files["lxd-info.txt"] = info.Bytes()
+
+	for _, p := range result.Logs {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		files["logs/"+filepath.Base(p)] = content
+	}
+
+	if r := contextRedactor(ctx); r != nil {
+		for name, content := range files {
+			files[name] = r.redactBytes(content)
+		}
+	}
+
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("%s%s-*.tar.gz", diagnosticsPrefix, result.Serial))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := writeBundle(f, files); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeBundle writes the files to f as a gzip-compressed tarball.
+func writeBundle(f *os.File, files map[string][]byte) error {
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	now := time.Now()
+	for _, name := range sortedFileNames(files) {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+func sortedFileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,82 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// resolvConfPath is where the build container's resolv.conf is written
+// when its nameservers are overridden (see Options.DNS). Like the build
+// arguments, it is kept in /run, so is never captured in snapshots or
+// the published image.
+const resolvConfPath = "/run/juju-lxd-centos/resolv.conf"
+
+// maxNameservers is the number of nameservers the resolver uses.
+const maxNameservers = 3
+
+// checkDNS checks that the nameservers are IP addresses,
+// and that there are no more than the resolver uses.
+func checkDNS(nameservers []string) error {
+	if len(nameservers) > maxNameservers {
+		return fmt.Errorf("too many nameservers (%d): the resolver uses at most %d", len(nameservers), maxNameservers)
+	}
+	for _, ns := range nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q: expected an IP address", ns)
+		}
+	}
+	return nil
+}
+
+// overrideDNS points the container's resolver at the nameservers,
+// by bind mounting a resolv.conf listing them, read-only, over
+// /etc/resolv.conf. Search domains and options already in the
+// container's own resolv.conf are kept. Neither NetworkManager nor dhclient
+// can then replace the nameservers, and the override disappears
+// when the container is stopped, so that the published image uses
+// whatever nameservers it is given when launched.
+func overrideDNS(ctx context.Context, container, tmpdir string, nameservers []string) error {
+	logf(ctx, "Overriding build container nameservers: %s", strings.Join(nameservers, ", "))
+	var conf strings.Builder
+	fmt.Fprintf(&conf, "# Written by %s for the build\n", BuilderName)
+	for _, ns := range nameservers {
+		fmt.Fprintf(&conf, "nameserver %s\n", ns)
+	}
+	f, err := ioutil.TempFile(tmpdir, "resolv.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(conf.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	push := FileProvisioner{
+		Source:      f.Name(),
+		Destination: resolvConfPath,
+		Mode:        0644,
+	}
+	if err := push.Run(ctx, container); err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`set -e
+if [ -e /etc/resolv.conf ]; then
+	grep -E '^(search|domain|options)[[:space:]]' /etc/resolv.conf >> %[1]s || true
+else
+	touch /etc/resolv.conf
+fi
+mount --bind %[1]s /etc/resolv.conf
+mount -o remount,bind,ro /etc/resolv.conf
+`, resolvConfPath)
+	if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c", script); err != nil {
+		return fmt.Errorf("overriding nameservers: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package imagebuilder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrBaseImageNotFound is returned when the base image
+	// cannot be found.
+	ErrBaseImageNotFound = errors.New("base image not found")
+
+	// ErrBaseImageUnverified is returned when the base image
+	// does not match the expected fingerprint, or cannot be
+	// verified against signed simplestreams metadata.
+	ErrBaseImageUnverified = errors.New("base image verification failed")
+
+	// ErrNeedsNetwork is returned by New for offline builds, and
+	// builds on hosts without internet access, whose options would
+	// require access to the internet.
+	ErrNeedsNetwork = errors.New("offline build requires network access")
+
+	// ErrNetworkTimeout is returned when the build container
+	// does not acquire network connectivity in time.
+	ErrNetworkTimeout = errors.New("timed out waiting for network connectivity")
+
+	// ErrProvisionFailed is returned, wrapped in a *ProvisionError,
+	// when a provisioning step fails.
+	ErrProvisionFailed = errors.New("provisioning failed")
+
+	// ErrVulnerable is returned, wrapped in a *ScanError, when
+	// the vulnerability scan finds vulnerabilities at or above
+	// the configured severity.
+	ErrVulnerable = errors.New("vulnerabilities found")
+
+	// ErrImportFailed is returned when the final image
+	// cannot be imported into the LXD image store.
+	ErrImportFailed = errors.New("image import failed")
+
+	// ErrOSMismatch is returned when the distribution, release or
+	// architecture of the base image does not match the alias.
+	ErrOSMismatch = errors.New("base image does not match the alias")
+
+	// ErrTooLarge is returned when the final image tarball
+	// exceeds the maximum size, before it is imported.
+	ErrTooLarge = errors.New("image exceeds maximum size")
+
+	// ErrInsufficientSpace is returned when the build directory's
+	// filesystem does not have the space a build is expected to
+	// need, before the build container is launched.
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+)
+
+// ProvisionError is returned when a provisioning step fails.
+// It matches ErrProvisionFailed with errors.Is.
+type ProvisionError struct {
+	// Step describes the provisioning step that failed.
+	Step string
+
+	// Output holds the tail of the output of the failed
+	// command, if the step ran a command.
+	Output string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error is part of the error interface.
+func (e *ProvisionError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", ErrProvisionFailed, e.Step, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProvisionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrProvisionFailed.
+func (e *ProvisionError) Is(target error) bool {
+	return target == ErrProvisionFailed
+}
+
+// ScanError is returned when the vulnerability scan finds
+// vulnerabilities at or above the configured severity.
+// It matches ErrVulnerable with errors.Is.
+type ScanError struct {
+	// Severity is the configured severity threshold.
+	Severity string
+
+	// Vulnerabilities holds the vulnerabilities at
+	// or above the threshold.
+	Vulnerabilities []Vulnerability
+}
+
+// Error is part of the error interface.
+func (e *ScanError) Error() string {
+	ids := make([]string, len(e.Vulnerabilities))
+	for i, v := range e.Vulnerabilities {
+		ids[i] = v.ID
+	}
+	return fmt.Sprintf(
+		"%s: %d at or above %s severity (%s)",
+		ErrVulnerable, len(ids), e.Severity, strings.Join(ids, ", "),
+	)
+}
+
+// Is reports whether target is ErrVulnerable.
+func (e *ScanError) Is(target error) bool {
+	return target == ErrVulnerable
+}
+
+// commandError is returned when a command run by the
+// build fails, recording the tail of its output.
+type commandError struct {
+	command string
+	output  string
+	err     error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("running %s: %v", e.command, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// commandOutput returns the output recorded in err,
+// if it is or wraps a command error.
+func commandOutput(err error) string {
+	var cerr *commandError
+	if errors.As(err, &cerr) {
+		return cerr.output
+	}
+	return ""
+}
+
+// tailWriter is an io.Writer that retains the last
+// max bytes written to it.
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.max; over > 0 {
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	return strings.TrimSpace(string(w.buf))
+}
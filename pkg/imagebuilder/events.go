@@ -0,0 +1,225 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// EventType identifies the type of an Event.
+type EventType string
+
+const (
+	// EventPhaseStarted is emitted when a build phase starts.
+	EventPhaseStarted EventType = "phase-started"
+
+	// EventPhaseFinished is emitted when a build phase finishes,
+	// successfully or otherwise. If the phase failed, the event's
+	// Error field is set.
+	EventPhaseFinished EventType = "phase-finished"
+
+	// EventCommandStarted is emitted when the build
+	// starts running an external command.
+	EventCommandStarted EventType = "command-started"
+
+	// EventCommandFinished is emitted when an external command
+	// finishes. If the command failed, the event's Error field
+	// is set.
+	EventCommandFinished EventType = "command-finished"
+
+	// EventCommandOutput is emitted for each line of output
+	// written by a command run by the build.
+	EventCommandOutput EventType = "command-output"
+
+	// EventArtifact is emitted when the build produces
+	// an artifact, such as an image or file.
+	EventArtifact EventType = "artifact"
+
+	// EventLog is emitted for each progress message
+	// logged by the build.
+	EventLog EventType = "log"
+)
+
+// Build phases, as reported in events.
+const (
+	PhaseLaunch     = "launch"
+	PhaseNetwork    = "network"
+	PhaseProvision  = "provision"
+	PhaseScan       = "scan"
+	PhasePublish    = "publish"
+	PhaseTemplates  = "templates"
+	PhaseTest       = "test"
+	PhaseSign       = "sign"
+	PhaseProvenance = "provenance"
+	PhaseOutput     = "output"
+	PhaseUpload     = "upload"
+	PhasePush       = "push"
+	PhaseJujuUpload = "juju-upload"
+	PhaseJujuTest   = "juju-test"
+)
+
+// Event describes something that happened during a build.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  EventType `json:"type"`
+	Phase string    `json:"phase,omitempty"`
+
+	// Duration is the duration of the phase or command,
+	// for EventPhaseFinished and EventCommandFinished events.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Error is the error that caused the phase or command to
+	// fail, for EventPhaseFinished and EventCommandFinished
+	// events.
+	Error string `json:"error,omitempty"`
+
+	// Command is the name of the command, for EventCommand*
+	// events. Args holds its arguments, for EventCommandStarted
+	// events.
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+
+	// Stream and Output describe a line of output, for
+	// EventCommandOutput events. Stream is either "stdout"
+	// or "stderr".
+	Stream string `json:"stream,omitempty"`
+	Output string `json:"output,omitempty"`
+
+	// Artifact identifies the artifact, for EventArtifact events.
+	// This is either a file path, or "image:<fingerprint>".
+	Artifact string `json:"artifact,omitempty"`
+
+	// Message is the logged message, for EventLog events.
+	Message string `json:"message,omitempty"`
+}
+
+type eventsKey struct{}
+
+// withEvents returns a context that carries the event callback.
+func withEvents(ctx context.Context, f func(Event)) context.Context {
+	if f == nil {
+		return ctx
+	}
+	var mu sync.Mutex
+	return context.WithValue(ctx, eventsKey{}, func(e Event) {
+		// Serialise events, as command output
+		// is written from multiple goroutines.
+		mu.Lock()
+		defer mu.Unlock()
+		f(e)
+	})
+}
+
+// emit sends the event to the context's callback, if any.
+func emit(ctx context.Context, e Event) {
+	f, _ := ctx.Value(eventsKey{}).(func(Event))
+	if f == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	f(redactEvent(ctx, e))
+}
+
+// hasEvents reports whether the context carries an event callback.
+func hasEvents(ctx context.Context) bool {
+	_, ok := ctx.Value(eventsKey{}).(func(Event))
+	return ok
+}
+
+// logf logs a progress message with the standard logger,
+// and emits it as an EventLog event.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	msg := contextRedactor(ctx).redact(fmt.Sprintf(format, args...))
+	log.Print(msg)
+	emit(ctx, Event{Type: EventLog, Message: msg})
+}
+
+// phase runs f as the named build phase, emitting
+// the phase's start and finish events.
+func phase(ctx context.Context, name string, f func() error) error {
+	start := time.Now()
+	emit(ctx, Event{Type: EventPhaseStarted, Phase: name})
+	err := f()
+	finished := Event{
+		Type:     EventPhaseFinished,
+		Phase:    name,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	emit(ctx, finished)
+	return err
+}
+
+// command runs f as the named external command, emitting
+// the command's start and finish events.
+func command(ctx context.Context, arg0 string, args []string, f func() error) error {
+	start := time.Now()
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redactCredentials(arg)
+	}
+	emit(ctx, Event{Type: EventCommandStarted, Command: arg0, Args: redacted})
+	err := f()
+	finished := Event{
+		Type:     EventCommandFinished,
+		Command:  arg0,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	emit(ctx, finished)
+	return err
+}
+
+// outputWriter returns a writer that writes to w, and emits each
+// complete line written to it as an EventCommandOutput event. The
+// returned function must be called once the command has finished,
+// to emit any trailing partial line.
+func outputWriter(ctx context.Context, w io.Writer, command, stream string) (io.Writer, func()) {
+	if !hasEvents(ctx) {
+		return w, func() {}
+	}
+	lw := &lineWriter{emit: func(line string) {
+		emit(ctx, Event{
+			Type:    EventCommandOutput,
+			Command: command,
+			Stream:  stream,
+			Output:  line,
+		})
+	}}
+	return io.MultiWriter(w, lw), lw.flush
+}
+
+type lineWriter struct {
+	buf  bytes.Buffer
+	emit func(line string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+		line := string(bytes.TrimRight(w.buf.Next(i+1), "\r\n"))
+		w.emit(line)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
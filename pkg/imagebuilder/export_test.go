@@ -0,0 +1,31 @@
+package imagebuilder
+
+import (
+	"context"
+	"time"
+)
+
+// RewriteImageTarball rewrites the image tarball with the classic
+// cloud-init templates, the default tarball format and no ID shift.
+func RewriteImageTarball(
+	ctx context.Context,
+	tarball, tmpdir string,
+	properties map[string]string,
+	sourceDate time.Time,
+	files []ImageFile,
+) (string, int64, error) {
+	return rewriteImageTarball(
+		ctx, tarball, tmpdir, properties, sourceDate,
+		TarballFormat{}, idMapping{}, cloudInitTemplates, files,
+	)
+}
+
+// MergeMetadata merges the classic cloud-init templates
+// and the properties into the image metadata.
+func MergeMetadata(data []byte, properties map[string]string, sourceDate time.Time) ([]byte, error) {
+	return mergeMetadata(data, cloudInitTemplates, properties, sourceDate)
+}
+
+// CheckSocketAccess checks that the LXD socket
+// accepts connections from the user.
+var CheckSocketAccess = checkSocketAccess
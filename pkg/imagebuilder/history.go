@@ -0,0 +1,218 @@
+package imagebuilder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Build statuses, as recorded in HistoryRecord.Status.
+const (
+	HistorySucceeded = "succeeded"
+	HistoryFailed    = "failed"
+	HistorySkipped   = "skipped"
+	HistoryCancelled = "cancelled"
+)
+
+// HistoryRecord describes a build, as recorded in the history file
+// (see Options.HistoryFile).
+type HistoryRecord struct {
+	// Started records when the build started, and Duration
+	// how long it took.
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+
+	// Status is one of HistorySucceeded, HistoryFailed,
+	// HistorySkipped or HistoryCancelled. If the build failed,
+	// Error describes why.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Alias and Serial are the alias and serial built, and
+	// Remote the remote the image was built on.
+	Alias  string `json:"alias"`
+	Serial string `json:"serial"`
+	Remote string `json:"remote,omitempty"`
+
+	// Fingerprint is the fingerprint of the image, if the
+	// build got as far as producing one.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// SpecHash is the digest of the build spec, as recorded
+	// in the PropertySpecHash property.
+	SpecHash string `json:"spec-hash"`
+
+	// ToolVersion is the version of the builder (Version).
+	ToolVersion string `json:"tool-version"`
+
+	// Artifacts holds the artifacts the build produced, as
+	// reported in EventArtifact events.
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// Spec holds the build options, encoded as in diagnostics
+	// bundles, so that the build that produced an image can be
+	// repeated.
+	Spec json.RawMessage `json:"spec,omitempty"`
+}
+
+// DefaultHistoryFile returns the path of the history file in the
+// user's state directory ($XDG_STATE_HOME, or ~/.local/state), or ""
+// if the user has no home directory.
+func DefaultHistoryFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "juju-lxd-image-builder", "history.jsonl")
+}
+
+// appendHistory appends the record to the history file, creating
+// it if necessary. The file is only readable by the user, as specs
+// may describe private infrastructure.
+func appendHistory(path string, rec HistoryRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// Records are written with a single write, so that
+	// those of concurrent builds are not interleaved.
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the records in the history file, oldest first.
+// If the file does not exist, there are no records.
+func ReadHistory(path string) ([]HistoryRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec HistoryRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Started.Before(records[j].Started)
+	})
+	return records, nil
+}
+
+// FindBuild returns the most recent build recorded in the history
+// file that produced the image with the given fingerprint, which may
+// be abbreviated to a unique prefix of at least 12 characters.
+func FindBuild(path, fingerprint string) (*HistoryRecord, error) {
+	if len(fingerprint) < 12 {
+		return nil, fmt.Errorf("fingerprint %q too short: at least 12 characters are needed", fingerprint)
+	}
+	records, err := ReadHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	var found *HistoryRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := &records[i]
+		if !strings.HasPrefix(rec.Fingerprint, fingerprint) {
+			continue
+		}
+		if found == nil {
+			found = rec
+		} else if found.Fingerprint != rec.Fingerprint {
+			return nil, fmt.Errorf("fingerprint %q is ambiguous", fingerprint)
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no build of an image with fingerprint %q recorded in %s", fingerprint, path)
+	}
+	return found, nil
+}
+
+// PruneHistory removes records from the history file, returning the
+// number removed: those beyond the keep most recent of their alias,
+// if keep is positive, and those of builds started before the given
+// time, if it is non-zero. Builds that finish while the file is being
+// pruned may not be recorded.
+func PruneHistory(path string, keep int, before time.Time) (int, error) {
+	if keep < 0 {
+		return 0, fmt.Errorf("invalid number of builds to keep %d", keep)
+	}
+	records, err := ReadHistory(path)
+	if err != nil || len(records) == 0 {
+		return 0, err
+	}
+	kept := make([]HistoryRecord, 0, len(records))
+	seen := make(map[string]int)
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		seen[rec.Alias]++
+		if keep > 0 && seen[rec.Alias] > keep || !before.IsZero() && rec.Started.Before(before) {
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	removed := len(records) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+	var buf bytes.Buffer
+	for i := len(kept) - 1; i >= 0; i-- {
+		line, err := json.Marshal(kept[i])
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	// Replace the file atomically, so that it can be
+	// read while it is being pruned.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".history")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
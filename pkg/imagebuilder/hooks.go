@@ -0,0 +1,72 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Hook points, at which Options.Hooks run commands in the
+// build container.
+const (
+	// HookPrePackages runs before the base packages are installed,
+	// after the repositories of offline builds have been set up,
+	// e.g. to add repositories or configure yum.
+	HookPrePackages = "pre-packages"
+
+	// HookPostPackages runs after the base packages are installed,
+	// before the build packages, profiles and provisioners.
+	HookPostPackages = "post-packages"
+
+	// HookPreCleanup runs once provisioning is complete, and the
+	// container's devices have been detached, before the yum cache
+	// and SSH host keys are removed. As for HookPrePublish, files
+	// written by these hooks are not labelled with their SELinux
+	// contexts.
+	HookPreCleanup = "pre-cleanup"
+
+	// HookPrePublish runs after the container has been cleaned up,
+	// as the last provisioning step before it is published, e.g. to
+	// scrub secrets, though the build arguments are checked for after
+	// it (see Options.BuildSecrets). Files written by these hooks are
+	// not labelled with their SELinux contexts.
+	HookPrePublish = "pre-publish"
+)
+
+// hookNames holds the hook points, in the order they run.
+var hookNames = []string{HookPrePackages, HookPostPackages, HookPreCleanup, HookPrePublish}
+
+// checkHooks checks that the keys of hooks (see Options.Hooks)
+// name hook points.
+func checkHooks(hooks map[string][]string) error {
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+names:
+	for _, name := range names {
+		for _, known := range hookNames {
+			if name == known {
+				continue names
+			}
+		}
+		return fmt.Errorf(
+			"unknown hook %q (expected one of %s)",
+			name, strings.Join(hookNames, ", "),
+		)
+	}
+	return nil
+}
+
+// hookStep returns the step running the commands registered for the
+// named hook point, and whether there are any.
+func hookStep(hooks map[string][]string, name string) (step, bool) {
+	commands := hooks[name]
+	if len(commands) == 0 {
+		return step{}, false
+	}
+	// Hooks may install packages or set up repositories,
+	// so wait for other package managers as for profiles.
+	return step{"hook " + name, packageLockProvisioner{ShellProvisioner{Commands: commands}}}, true
+}
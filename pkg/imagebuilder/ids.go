@@ -0,0 +1,146 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// IDShiftAuto, as Options.IDShift, causes the shift to be taken
+// from the owner of the image's rootfs directory.
+const IDShiftAuto = -1
+
+// maxUnprivilegedID is the highest uid or gid that LXD maps into
+// unprivileged containers by default.
+const maxUnprivilegedID = 65535
+
+// ParseIDShift parses an ID shift, as accepted on the command line:
+// a non-negative number, or "auto" for IDShiftAuto.
+func ParseIDShift(s string) (int, error) {
+	if s == "auto" {
+		return IDShiftAuto, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid ID shift %q, expected a non-negative number or \"auto\"", s)
+	}
+	return n, nil
+}
+
+// idMapping remaps and checks the ownership of rootfs
+// entries when the image tarball is rewritten.
+type idMapping struct {
+	// shift is subtracted from rootfs entries' uids and gids.
+	shift int
+
+	// strict causes ids outside the default unprivileged
+	// range to be an error rather than a warning.
+	strict bool
+
+	// outOfRange counts the entries with ids outside the
+	// default unprivileged range, and examples holds the
+	// first few of their names.
+	outOfRange int
+	examples   []string
+}
+
+// rootfsOwner returns the uid and gid of the rootfs directory, with
+// the given name, in the uncompressed image or backup tarball.
+func rootfsOwner(tarball, rootfs string) (int, int, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return 0, 0, fmt.Errorf("%s not found in %s", rootfs, path.Base(tarball))
+		} else if err != nil {
+			return 0, 0, err
+		}
+		if path.Clean(h.Name) == rootfs {
+			return h.Uid, h.Gid, nil
+		}
+	}
+}
+
+// resolveShift detects the shift from the owner of the rootfs
+// directory in the tarball, if it is IDShiftAuto.
+func (m *idMapping) resolveShift(ctx context.Context, tarball, rootfs string) error {
+	if m.shift == IDShiftAuto {
+		uid, gid, err := rootfsOwner(tarball, rootfs)
+		if err != nil {
+			return err
+		}
+		if uid != gid {
+			return fmt.Errorf("cannot detect ID shift: rootfs is owned by %d:%d", uid, gid)
+		}
+		m.shift = uid
+	}
+	if m.shift > 0 {
+		logf(ctx, "Shifting ownership of rootfs entries by %d", m.shift)
+	}
+	return nil
+}
+
+// remap applies the mapping to the header of an
+// image tarball entry, if it is a rootfs entry.
+func (m *idMapping) remap(h *tar.Header) error {
+	name := path.Clean(h.Name)
+	if name != "rootfs" && !strings.HasPrefix(name, "rootfs/") {
+		return nil
+	}
+	return m.remapRootfs(h)
+}
+
+// remapRootfs applies the mapping to the header of a rootfs entry.
+func (m *idMapping) remapRootfs(h *tar.Header) error {
+	if m.shift > 0 {
+		if h.Uid < m.shift || h.Gid < m.shift {
+			return fmt.Errorf(
+				"cannot shift ownership of %s (%d:%d) by %d",
+				h.Name, h.Uid, h.Gid, m.shift,
+			)
+		}
+		h.Uid -= m.shift
+		h.Gid -= m.shift
+		// The names no longer match the ids.
+		h.Uname, h.Gname = "", ""
+		delete(h.PAXRecords, "uname")
+		delete(h.PAXRecords, "gname")
+	}
+	if h.Uid > maxUnprivilegedID || h.Gid > maxUnprivilegedID {
+		m.outOfRange++
+		if len(m.examples) < 5 {
+			m.examples = append(m.examples, fmt.Sprintf("%s (%d:%d)", h.Name, h.Uid, h.Gid))
+		}
+	}
+	return nil
+}
+
+// check reports the entries whose ids are outside the default
+// unprivileged range, which fail to unpack on LXD hosts with the
+// default idmap, returning an error if the mapping is strict.
+func (m *idMapping) check(ctx context.Context) error {
+	if m.outOfRange == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf(
+		"%d rootfs entries are owned by ids above %d, e.g. %s; "+
+			"the image may not unpack in unprivileged containers "+
+			"(was it published from a container with shifted ids? see -id-shift)",
+		m.outOfRange, maxUnprivilegedID, strings.Join(m.examples, ", "),
+	)
+	if m.strict {
+		return fmt.Errorf("%s", msg)
+	}
+	logf(ctx, "Warning: %s", msg)
+	return nil
+}
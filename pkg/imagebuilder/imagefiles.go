@@ -0,0 +1,431 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeNow returns the time to record for the entries written for
+// image files that have no modification time of their own, such as
+// the parent directories created for them. Tests replace it.
+var timeNow = time.Now
+
+// ImageFile is a file on the host to add to the image's rootfs as
+// the image tarball is written, replacing any entry at the same path.
+// Unlike a FileProvisioner, the file is written to the tarball byte
+// for byte, without passing through the build container, so it suits
+// binary payloads such as pre-generated seed images and compiled
+// policy files.
+//
+// An ImageFile with no Source is a directory, created with the
+// given mode and ownership, or updated to them if the rootfs already
+// has it. Any other missing parent directories are created with
+// mode 0755, owned by root. The extended attributes of the entries
+// that image files replace, such as their SELinux labels, are kept.
+// Entries that replace no labelled entry take the SELinux label of
+// their nearest labelled parent directory, as files created in it
+// would; if there is none, and the image's SELinux policy is enabled,
+// /.autorelabel is added so that instances relabel at first boot.
+type ImageFile struct {
+	// Source is the path of the file on the host,
+	// or empty for a directory.
+	Source string
+
+	// Destination is the absolute path of the file in the rootfs.
+	Destination string
+
+	// Mode, if non-zero, is the mode of the file in the image.
+	// Otherwise the host file's mode is used, except on Windows,
+	// where files are given mode 0644. Directories are given mode
+	// 0755 by default.
+	Mode os.FileMode
+
+	// UID and GID are the owner and group of the file in the
+	// image. The file is owned by root by default.
+	UID, GID int
+
+	// User and Group, if non-empty, name the owner and group of
+	// the file in the image, overriding UID and GID. They are
+	// looked up in the image's /etc/passwd and /etc/group, so must
+	// exist by the end of provisioning.
+	User, Group string
+}
+
+// dir reports whether f is a directory.
+func (f ImageFile) dir() bool {
+	return f.Source == ""
+}
+
+// check checks that the file's destination and ownership are
+// valid, and that its source, if any, is a regular file.
+func (f ImageFile) check() error {
+	if !path.IsAbs(f.Destination) || path.Clean(f.Destination) == "/" {
+		return fmt.Errorf("image file destination %q is not an absolute file path", f.Destination)
+	}
+	if f.UID < 0 || f.GID < 0 {
+		return fmt.Errorf("invalid owner %d:%d for image file %q", f.UID, f.GID, f.Destination)
+	}
+	if (f.User != "" && f.UID != 0) || (f.Group != "" && f.GID != 0) {
+		return fmt.Errorf("image file %q has both a name and an id for its owner or group", f.Destination)
+	}
+	if f.dir() {
+		return nil
+	}
+	info, err := os.Stat(f.Source)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("image file source %q is not a regular file", f.Source)
+	}
+	return nil
+}
+
+// rootfsPath returns the path of the file relative to the rootfs.
+func (f ImageFile) rootfsPath() string {
+	return path.Clean(f.Destination)[1:]
+}
+
+// checkImageFiles checks the files (see Options.ImageFiles), that
+// no two have the same destination, and that none is inside another
+// that is not a directory.
+func checkImageFiles(files []ImageFile) error {
+	seen := make(map[string]ImageFile)
+	for _, f := range files {
+		if err := f.check(); err != nil {
+			return err
+		}
+		if _, ok := seen[f.rootfsPath()]; ok {
+			return fmt.Errorf("duplicate image file destination %q", f.Destination)
+		}
+		seen[f.rootfsPath()] = f
+	}
+	for _, f := range files {
+		for _, parent := range parentDirs(f.rootfsPath()) {
+			if p, ok := seen[parent]; ok && !p.dir() {
+				return fmt.Errorf("image file %q is inside file %q", f.Destination, p.Destination)
+			}
+		}
+	}
+	return nil
+}
+
+// parentDirs returns the parent directories of the path relative
+// to the rootfs, outermost first, excluding the rootfs itself.
+func parentDirs(rel string) []string {
+	var dirs []string
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// imageFileWriter adds image files to a tarball holding a rootfs,
+// as it is copied: the entries the files replace are skipped, and
+// the files and any missing parent directories written at the end.
+type imageFileWriter struct {
+	// prefix is the path of the rootfs in the tarball: "rootfs/"
+	// in unified image tarballs, and "" in the rootfs tarballs of
+	// split images.
+	prefix string
+
+	// files holds the files to write, sorted by path,
+	// with their ownership resolved.
+	files []ImageFile
+
+	// replace holds the rootfs paths of the files.
+	replace map[string]bool
+
+	// parents records, for the parent directories of the files,
+	// whether they are in the rootfs.
+	parents map[string]bool
+
+	// xattrs holds the extended attributes, as PAX records,
+	// of the entries replaced by the files.
+	xattrs map[string]map[string]string
+
+	// labels holds the SELinux labels of the parent directories
+	// of the files, including those written by the writer.
+	labels map[string]string
+
+	// policy records whether the image's SELinux policy is enabled,
+	// and autorelabel whether the rootfs has /.autorelabel.
+	policy, autorelabel bool
+
+	// unlabelled records whether an entry was written without
+	// an SELinux label.
+	unlabelled bool
+}
+
+// newImageFileWriter returns an imageFileWriter for the files,
+// resolving their User and Group names from the image's /etc/passwd
+// and /etc/group, which are read with readFile, given paths relative
+// to the rootfs.
+func newImageFileWriter(prefix string, files []ImageFile, readFile func(rel string) ([]byte, error)) (*imageFileWriter, error) {
+	files, err := resolveImageFileOwners(files, readFile)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].rootfsPath() < files[j].rootfsPath()
+	})
+	w := &imageFileWriter{
+		prefix:  prefix,
+		files:   files,
+		replace: make(map[string]bool),
+		parents: make(map[string]bool),
+		xattrs:  make(map[string]map[string]string),
+		labels:  make(map[string]string),
+	}
+	for _, f := range files {
+		w.replace[f.rootfsPath()] = true
+		for _, dir := range parentDirs(f.rootfsPath()) {
+			w.parents[dir] = false
+		}
+	}
+	if len(files) > 0 {
+		// An image without the config has no policy to enforce.
+		if config, err := readFile("etc/selinux/config"); err == nil {
+			w.policy = selinuxEnabled(config)
+		}
+	}
+	return w, nil
+}
+
+// skip records the tarball entry at the path relative to the rootfs,
+// and reports whether it is replaced by an image file, and so should
+// not be copied.
+func (w *imageFileWriter) skip(rel string, h *tar.Header) bool {
+	rel = path.Clean(rel)
+	if _, ok := w.parents[rel]; ok {
+		w.parents[rel] = true
+		if label, ok := h.PAXRecords[selinuxXattr]; ok {
+			w.labels[rel] = label
+		}
+	}
+	if rel == ".autorelabel" {
+		w.autorelabel = true
+	}
+	if !w.replace[rel] {
+		return false
+	}
+	for key, value := range h.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			if w.xattrs[rel] == nil {
+				w.xattrs[rel] = make(map[string]string)
+			}
+			w.xattrs[rel][key] = value
+		}
+	}
+	return true
+}
+
+// write writes the files to the tarball, after any missing parent
+// directories, returning their total size. If sourceDate is non-zero,
+// they are written reproducibly.
+func (w *imageFileWriter) write(ctx context.Context, out *tarWriter, sourceDate time.Time) (int64, error) {
+	var size int64
+	for _, f := range w.files {
+		for _, dir := range parentDirs(f.rootfsPath()) {
+			if w.parents[dir] || w.replace[dir] {
+				continue
+			}
+			h := &tar.Header{
+				Name:     w.prefix + dir + "/",
+				Mode:     0755,
+				ModTime:  timeNow(),
+				Typeflag: tar.TypeDir,
+
+				PAXRecords: w.pax(dir),
+			}
+			if err := w.writeHeader(out, h, sourceDate); err != nil {
+				return 0, fmt.Errorf("writing directory %q: %v", "/"+dir, err)
+			}
+			w.parents[dir] = true
+		}
+		n, err := w.writeFile(ctx, out, f, sourceDate)
+		if err != nil {
+			return 0, fmt.Errorf("writing image file %q: %v", f.Destination, err)
+		}
+		size += n
+	}
+	if w.unlabelled && w.policy && !w.autorelabel {
+		h := &tar.Header{
+			Name:     w.prefix + ".autorelabel",
+			Mode:     0644,
+			ModTime:  timeNow(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := w.writeHeader(out, h, sourceDate); err != nil {
+			return 0, fmt.Errorf("writing /.autorelabel: %v", err)
+		}
+		w.autorelabel = true
+	}
+	return size, nil
+}
+
+// pax returns the PAX records for the entry written at the path
+// relative to the rootfs: the extended attributes of the entry it
+// replaces and, if that had no SELinux label, the label of the
+// nearest labelled parent directory.
+func (w *imageFileWriter) pax(rel string) map[string]string {
+	records := make(map[string]string)
+	for key, value := range w.xattrs[rel] {
+		records[key] = value
+	}
+	if _, ok := records[selinuxXattr]; !ok {
+		dirs := parentDirs(rel)
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if label, ok := w.labels[dirs[i]]; ok {
+				records[selinuxXattr] = label
+				break
+			}
+		}
+	}
+	if label, ok := records[selinuxXattr]; ok {
+		if _, ok := w.parents[rel]; ok {
+			w.labels[rel] = label
+		}
+	} else {
+		w.unlabelled = true
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return records
+}
+
+func (w *imageFileWriter) writeHeader(out *tarWriter, h *tar.Header, sourceDate time.Time) error {
+	if !sourceDate.IsZero() {
+		normaliseHeader(h, sourceDate)
+	}
+	return out.WriteHeader(h)
+}
+
+func (w *imageFileWriter) writeFile(ctx context.Context, out *tarWriter, f ImageFile, sourceDate time.Time) (int64, error) {
+	if f.dir() {
+		mode := f.Mode
+		if mode == 0 {
+			mode = 0755
+		}
+		return 0, w.writeHeader(out, &tar.Header{
+			Name:     w.prefix + f.rootfsPath() + "/",
+			Mode:     int64(mode.Perm()),
+			ModTime:  timeNow(),
+			Typeflag: tar.TypeDir,
+			Uid:      f.UID,
+			Gid:      f.GID,
+
+			PAXRecords: w.pax(f.rootfsPath()),
+		}, sourceDate)
+	}
+	in, err := os.Open(f.Source)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	mode := f.Mode
+	if mode == 0 {
+		mode = info.Mode()
+		if runtime.GOOS == "windows" {
+			mode = 0644
+		}
+	}
+	h := &tar.Header{
+		Name:     w.prefix + f.rootfsPath(),
+		Mode:     int64(mode.Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Typeflag: tar.TypeReg,
+		Uid:      f.UID,
+		Gid:      f.GID,
+
+		PAXRecords: w.pax(f.rootfsPath()),
+	}
+	if err := w.writeHeader(out, h, sourceDate); err != nil {
+		return 0, err
+	}
+	// The file may have changed size since it was checked.
+	n, err := io.Copy(out, contextReader{ctx, io.LimitReader(in, h.Size)})
+	if err == nil && n != h.Size {
+		err = fmt.Errorf("%s changed while being read", f.Source)
+	}
+	return n, err
+}
+
+// resolveImageFileOwners returns a copy of the files with the ids
+// of their User and Group names set, looked up in the image's
+// /etc/passwd and /etc/group, read with readFile. The files are
+// only read if some image file names its owner or group.
+func resolveImageFileOwners(files []ImageFile, readFile func(rel string) ([]byte, error)) ([]ImageFile, error) {
+	files = append([]ImageFile(nil), files...)
+	var users, groups map[string]int
+	for i := range files {
+		f := &files[i]
+		if f.User != "" {
+			if users == nil {
+				var err error
+				if users, err = readIDs(readFile, "etc/passwd"); err != nil {
+					return nil, err
+				}
+			}
+			uid, ok := users[f.User]
+			if !ok {
+				return nil, fmt.Errorf("user %q of image file %q not found in the image", f.User, f.Destination)
+			}
+			f.UID = uid
+		}
+		if f.Group != "" {
+			if groups == nil {
+				var err error
+				if groups, err = readIDs(readFile, "etc/group"); err != nil {
+					return nil, err
+				}
+			}
+			gid, ok := groups[f.Group]
+			if !ok {
+				return nil, fmt.Errorf("group %q of image file %q not found in the image", f.Group, f.Destination)
+			}
+			f.GID = gid
+		}
+	}
+	return files, nil
+}
+
+// readIDs reads the names and ids from the image's passwd or
+// group file, both of which hold the id in the third field.
+func readIDs(readFile func(rel string) ([]byte, error), rel string) (map[string]int, error) {
+	data, err := readFile(rel)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		ids[fields[0]] = id
+	}
+	return ids, scanner.Err()
+}
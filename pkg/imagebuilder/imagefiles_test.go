@@ -0,0 +1,211 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	etcLabel  = "system_u:object_r:etc_t:s0"
+	motdLabel = "system_u:object_r:motd_t:s0"
+)
+
+// testEntry is an entry of a tarball written by writeTestTarball.
+type testEntry struct {
+	name    string
+	content string
+	label   string
+}
+
+// writeTestTarball writes a gzip-compressed image tarball holding
+// metadata.yaml and the entries, returning its path. Entries whose
+// names end in "/" are directories; the others are regular files.
+func writeTestTarball(t *testing.T, dir string, entries ...testEntry) string {
+	name := filepath.Join(dir, "image.tar.gz")
+	entries = append([]testEntry{
+		{name: "metadata.yaml", content: "architecture: x86_64\n"},
+		{name: "rootfs/"},
+	}, entries...)
+	err := writeGzipTarball(name, gzip.DefaultCompression, TarballFormat{}, func(out *tarWriter) error {
+		for _, e := range entries {
+			h := &tar.Header{
+				Name:     e.name,
+				Mode:     0644,
+				Size:     int64(len(e.content)),
+				ModTime:  time.Unix(1577836800, 0),
+				Typeflag: tar.TypeReg,
+				Format:   tar.FormatPAX,
+			}
+			if e.name[len(e.name)-1] == '/' {
+				h.Mode = 0755
+				h.Typeflag = tar.TypeDir
+			}
+			if e.label != "" {
+				h.PAXRecords = map[string]string{selinuxXattr: e.label}
+			}
+			if err := out.WriteHeader(h); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(out, e.content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// readTestTarball returns the headers of the entries in the
+// gzip-compressed tarball, keyed by their cleaned names, failing
+// the test if any name appears twice.
+func readTestTarball(t *testing.T, name string) map[string]*tar.Header {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		name := path.Clean(h.Name)
+		if _, ok := headers[name]; ok {
+			t.Errorf("%s appears twice in tarball", name)
+		}
+		headers[name] = h
+	}
+}
+
+// rewriteWithFiles rewrites the tarball with image files
+// for /etc/motd and /etc/sudoers.d/juju, returning the
+// headers of the rewritten tarball's entries.
+func rewriteWithFiles(t *testing.T, dir, tarball string) map[string]*tar.Header {
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := rewriteImageTarball(
+		context.Background(), tarball, dir, nil, time.Time{},
+		TarballFormat{}, idMapping{}, nil,
+		[]ImageFile{
+			{Source: source, Destination: "/etc/motd"},
+			{Source: source, Destination: "/etc/sudoers.d/juju", Mode: 0440},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readTestTarball(t, out)
+}
+
+func TestImageFilesSELinuxLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := writeTestTarball(t, dir,
+		testEntry{name: "rootfs/etc/", label: etcLabel},
+		testEntry{name: "rootfs/etc/motd", label: motdLabel},
+		testEntry{name: "rootfs/etc/selinux/", label: etcLabel},
+		testEntry{name: "rootfs/etc/selinux/config", content: "SELINUX=enforcing\n", label: etcLabel},
+	)
+	headers := rewriteWithFiles(t, dir, tarball)
+	for name, label := range map[string]string{
+		// The replaced file keeps its label.
+		"rootfs/etc/motd": motdLabel,
+		// New entries take their parent directory's.
+		"rootfs/etc/sudoers.d":      etcLabel,
+		"rootfs/etc/sudoers.d/juju": etcLabel,
+	} {
+		h, ok := headers[name]
+		if !ok {
+			t.Errorf("%s not in tarball", name)
+			continue
+		}
+		if got := h.PAXRecords[selinuxXattr]; got != label {
+			t.Errorf("%s: got label %q, expected %q", name, got, label)
+		}
+	}
+	if _, ok := headers["rootfs/.autorelabel"]; ok {
+		t.Errorf("relabel requested, though every image file was labelled")
+	}
+}
+
+func TestImageFilesSELinuxAutorelabel(t *testing.T) {
+	for _, test := range []struct {
+		about   string
+		entries []testEntry
+		expect  bool
+	}{{
+		about: "unlabelled rootfs with an enabled policy",
+		entries: []testEntry{
+			{name: "rootfs/etc/"},
+			{name: "rootfs/etc/selinux/"},
+			{name: "rootfs/etc/selinux/config", content: "SELINUX=enforcing\n"},
+		},
+		expect: true,
+	}, {
+		about: "unlabelled rootfs with a disabled policy",
+		entries: []testEntry{
+			{name: "rootfs/etc/"},
+			{name: "rootfs/etc/selinux/"},
+			{name: "rootfs/etc/selinux/config", content: "SELINUX=disabled\n"},
+		},
+	}, {
+		about:   "unlabelled rootfs with no policy",
+		entries: []testEntry{{name: "rootfs/etc/"}},
+	}} {
+		dir, err := ioutil.TempDir("", "imagebuilder-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		headers := rewriteWithFiles(t, dir, writeTestTarball(t, dir, test.entries...))
+		h, ok := headers["rootfs/.autorelabel"]
+		if ok != test.expect {
+			t.Errorf("%s: got /.autorelabel %v, expected %v", test.about, ok, test.expect)
+		}
+		if ok && h.Typeflag != tar.TypeReg {
+			t.Errorf("%s: /.autorelabel is not a regular file", test.about)
+		}
+	}
+}
+
+func TestImageFilesSELinuxExistingAutorelabel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := writeTestTarball(t, dir,
+		testEntry{name: "rootfs/.autorelabel"},
+		testEntry{name: "rootfs/etc/"},
+		testEntry{name: "rootfs/etc/selinux/"},
+		testEntry{name: "rootfs/etc/selinux/config", content: "SELINUX=permissive\n"},
+	)
+	headers := rewriteWithFiles(t, dir, tarball)
+	if _, ok := headers["rootfs/.autorelabel"]; !ok {
+		t.Errorf("/.autorelabel dropped")
+	}
+}
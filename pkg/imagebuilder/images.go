@@ -0,0 +1,247 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Image properties recorded by the builder. LXD image properties
+// are free-form; we namespace ours with "user.".
+const (
+	// PropertyBuilder identifies images produced by this package.
+	PropertyBuilder = "user.build.tool"
+
+	// PropertyCloudInitVersion records the version of cloud-init
+	// installed in the image.
+	PropertyCloudInitVersion = "user.cloud-init.version"
+
+	// PropertyJujuVersionTested records the version of Juju
+	// that the image was validated against (see Options.JujuTest).
+	PropertyJujuVersionTested = "user.juju.version-tested"
+)
+
+// BuilderName is the value of the PropertyBuilder property
+// on images produced by this package.
+const BuilderName = "juju-lxd-centos-image-builder"
+
+// containerCloudInitVersion returns the version of cloud-init
+// installed in the container.
+func containerCloudInitVersion(ctx context.Context, container string) (string, error) {
+	out, err := runOutput(ctx, "lxc", "exec", container, "--", "cloud-init", "--version")
+	if err != nil {
+		return "", err
+	}
+	// Output is of the form "[/usr/bin/]cloud-init 19.4".
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unexpected cloud-init --version output: %q", out)
+	}
+	return fields[len(fields)-1], nil
+}
+
+// qualify returns the name qualified with the given lxc remote.
+// If remote is empty, name is returned unchanged, referring to
+// the default remote.
+func qualify(remote, name string) string {
+	if remote == "" {
+		return name
+	}
+	return remote + ":" + name
+}
+
+// sameRemote reports whether the two remote names refer to the
+// same remote, treating the empty string as "local".
+func sameRemote(a, b string) bool {
+	if a == "" {
+		a = "local"
+	}
+	if b == "" {
+		b = "local"
+	}
+	return a == b
+}
+
+// containsRemote reports whether remotes contains
+// a remote that is the same as remote.
+func containsRemote(remotes []string, remote string) bool {
+	for _, r := range remotes {
+		if sameRemote(r, remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// intermediateAliasPrefix prefixes the temporary aliases that
+// build containers are published under, before the cloud-init
+// templates are added to the image.
+const intermediateAliasPrefix = "juju-builder/tmp/"
+
+// intermediateMaxAge is the age after which an intermediate image
+// is taken to have been left by a build that was killed.
+const intermediateMaxAge = 24 * time.Hour
+
+// pruneIntermediateImages deletes the intermediate images in the
+// remote's image store that were uploaded more than intermediateMaxAge
+// before now. Younger ones may belong to builds still running.
+func pruneIntermediateImages(ctx context.Context, remote string, now time.Time) error {
+	out, err := runOutput(ctx, "lxc", "image", "list", qualify(remote, ""), "--format=json")
+	if err != nil {
+		return err
+	}
+	var images []ImageInfo
+	if err := json.Unmarshal(out, &images); err != nil {
+		return err
+	}
+	for _, image := range images {
+		for _, a := range image.Aliases {
+			if !strings.HasPrefix(a.Name, intermediateAliasPrefix) {
+				continue
+			}
+			uploaded, err := time.Parse(time.RFC3339, image.UploadedAt)
+			if err != nil || now.Sub(uploaded) < intermediateMaxAge {
+				continue
+			}
+			logf(ctx, "Deleting intermediate image %s left by an earlier build", a.Name)
+			if err := lxc(ctx, "image", "delete", qualify(remote, image.Fingerprint)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// imageExists reports whether the image, which may be an alias or
+// fingerprint optionally qualified with a remote, exists.
+func imageExists(ctx context.Context, image string) bool {
+	return succeeds(ctx, "lxc", "image", "info", image)
+}
+
+// imageFingerprint returns the fingerprint of the image, which may
+// be an alias or fingerprint optionally qualified with a remote.
+func imageFingerprint(ctx context.Context, image string) (string, error) {
+	out, err := runOutput(ctx, "lxc", "image", "info", image)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Fingerprint:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Fingerprint:")), nil
+		}
+	}
+	return "", fmt.Errorf("cannot find fingerprint of image %q", image)
+}
+
+// pushImage copies the image with the given aliases from the source
+// remote to the target remote. The image is copied by fingerprint,
+// and the aliases only moved to it on the target once it is there,
+// so that a failed copy leaves the target's aliases as they were.
+func pushImage(ctx context.Context, source, target string, aliases []string, public bool) error {
+	logf(ctx, "Copying image %s to remote %q", aliases[0], target)
+	fingerprint, err := imageFingerprint(ctx, qualify(source, aliases[0]))
+	if err != nil {
+		return err
+	}
+	args := []string{"image", "copy", qualify(source, fingerprint), target + ":"}
+	if public {
+		args = append(args, "--public")
+	}
+	if err := lxcTransfer(ctx, args...); err != nil {
+		return err
+	}
+	for _, alias := range aliases {
+		if imageExists(ctx, qualify(target, alias)) {
+			if err := lxc(ctx, "image", "alias", "delete", qualify(target, alias)); err != nil {
+				return err
+			}
+		}
+		if err := lxc(ctx, "image", "alias", "create", qualify(target, alias), fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jujuVersion returns the version of the Juju client.
+func jujuVersion(ctx context.Context) (string, error) {
+	out, err := runOutput(ctx, "juju", "version")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setImageProperties updates the properties of an existing image,
+// which may be qualified with a remote (e.g. "remote:alias").
+func setImageProperties(ctx context.Context, image string, properties map[string]string) error {
+	out, err := runOutput(ctx, "lxc", "image", "show", image)
+	if err != nil {
+		return err
+	}
+	info := make(map[string]interface{})
+	if err := yaml.Unmarshal(out, &info); err != nil {
+		return err
+	}
+	props, _ := info["properties"].(map[interface{}]interface{})
+	if props == nil {
+		props = make(map[interface{}]interface{})
+		info["properties"] = props
+	}
+	for k, v := range properties {
+		props[k] = v
+	}
+	in, err := yaml.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = runInputOutput(ctx, bytes.NewReader(in), "lxc", "image", "edit", image)
+	return err
+}
+
+// ImageInfo holds information about an image in an LXD image store.
+type ImageInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	Aliases     []struct {
+		Name string `json:"name"`
+	} `json:"aliases"`
+	Properties map[string]string `json:"properties"`
+	UploadedAt string            `json:"uploaded_at"`
+	Size       int64             `json:"size"`
+}
+
+// ListBuiltImages returns the images in the given remote's image
+// store that were produced by this package. If remote is empty,
+// the default remote is used.
+func ListBuiltImages(ctx context.Context, remote string) ([]ImageInfo, error) {
+	all, err := listImages(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	for _, image := range all {
+		if image.Properties[PropertyBuilder] == BuilderName {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// listImages returns all of the images in the remote's image store.
+func listImages(ctx context.Context, remote string) ([]ImageInfo, error) {
+	out, err := runOutput(ctx, "lxc", "image", "list", qualify(remote, ""), "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	var images []ImageInfo
+	if err := json.Unmarshal(out, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
@@ -0,0 +1,266 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imageServerAuth holds the CA certificate and credentials to
+// access the image server with (see Options.ImageServerCA and
+// Options.ImageServerAuthFile).
+type imageServerAuth struct {
+	// ca holds the PEM-encoded certificate to trust,
+	// if any.
+	ca []byte
+
+	// user and password are the HTTP basic authentication
+	// credentials, if any.
+	user, password string
+}
+
+// loadImageServerAuth reads the image server's CA certificate and
+// credentials. If neither is specified, it returns nil.
+func loadImageServerAuth(opts Options) (*imageServerAuth, error) {
+	if opts.ImageServerCA == "" && opts.ImageServerAuthFile == "" {
+		return nil, nil
+	}
+	auth := &imageServerAuth{}
+	if opts.ImageServerCA != "" {
+		ca, err := ioutil.ReadFile(opts.ImageServerCA)
+		if err != nil {
+			return nil, err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", opts.ImageServerCA)
+		}
+		auth.ca = ca
+	}
+	if opts.ImageServerAuthFile != "" {
+		data, err := ioutil.ReadFile(opts.ImageServerAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials := strings.TrimSpace(string(data))
+		i := strings.IndexRune(credentials, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%s: expected user:password", opts.ImageServerAuthFile)
+		}
+		auth.user, auth.password = credentials[:i], credentials[i+1:]
+	}
+	return auth, nil
+}
+
+// url returns the image server's address with the credentials, if
+// any, which LXD's simplestreams client sends with each request.
+func (a *imageServerAuth) url(addr string) (string, error) {
+	if a == nil || a.user == "" {
+		return addr, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(a.user, a.password)
+	return u.String(), nil
+}
+
+// get fetches the URL from the image server, trusting
+// its CA certificate and sending its credentials.
+func (a *imageServerAuth) get(ctx context.Context, rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.DefaultClient
+	if a != nil && a.ca != nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(a.ca)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client = &http.Client{Transport: transport}
+	}
+	if a != nil && a.user != "" {
+		req.SetBasicAuth(a.user, a.password)
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// lxcConfigDir returns the lxc client's configuration directory,
+// which holds the certificates of its remotes.
+func lxcConfigDir(ctx context.Context) (string, error) {
+	if dir := os.Getenv("LXD_CONF"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if contextLXDInstall(ctx).snap {
+		return filepath.Join(home, "snap", "lxd", "common", "config"), nil
+	}
+	return filepath.Join(home, ".config", "lxc"), nil
+}
+
+// imageServerRemote returns the name of an lxc remote for the
+// simplestreams image server at addr. If no remote has that address,
+// or auth is non-nil, a temporary remote is added, trusting auth's CA
+// certificate and with its credentials; the returned function removes
+// it, and must be called once the remote is no longer needed.
+func imageServerRemote(ctx context.Context, addr string, auth *imageServerAuth) (string, func(), error) {
+	if auth == nil {
+		remotes, err := listRemotes(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		for name, remote := range remotes {
+			if remote.imageServer() && sameEndpoint(remote.Addr, addr) {
+				logf(ctx, "Using remote %q for image server %s", name, addr)
+				return name, func() {}, nil
+			}
+		}
+	}
+
+	name := fmt.Sprintf("juju-lxd-centos-images-%v-%04x", time.Now().Unix(), rand.Intn(0x10000))
+	logf(ctx, "Adding temporary remote %q for image server %s", name, addr)
+	var cert string
+	if auth != nil && auth.ca != nil {
+		// The lxc client trusts the certificate stored for
+		// the remote, whether it is a CA's or the server's.
+		dir, err := lxcConfigDir(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "servercerts"), 0700); err != nil {
+			return "", nil, err
+		}
+		cert = filepath.Join(dir, "servercerts", name+".crt")
+		if err := ioutil.WriteFile(cert, auth.ca, 0600); err != nil {
+			return "", nil, err
+		}
+	}
+	removeCert := func() {
+		if cert != "" {
+			if err := os.Remove(cert); err != nil && !os.IsNotExist(err) {
+				logf(ctx, "Removing temporary remote certificate: %v", err)
+			}
+		}
+	}
+	remoteAddr, err := auth.url(addr)
+	if err != nil {
+		removeCert()
+		return "", nil, err
+	}
+	if err := lxc(ctx, "remote", "add", name, remoteAddr, "--protocol=simplestreams", "--public"); err != nil {
+		removeCert()
+		return "", nil, err
+	}
+	return name, func() {
+		// Clean up even if the build has been cancelled.
+		if err := lxc(detach(ctx), "remote", "remove", name); err != nil {
+			logf(ctx, "Removing temporary remote: %v", err)
+		}
+		removeCert()
+	}, nil
+}
+
+// pullImage has the LXD server of the remote download the image with
+// the given alias from the simplestreams image server at addr. The
+// server resolves the alias itself, rather than the lxc client, so
+// this works when the host cannot reach the image server but the
+// server (or its core.proxy_https proxy) can. The fingerprint of the
+// image is returned. If the image was not already in the remote's
+// image store, the returned function deletes it, and must be called
+// once the image is no longer needed. If auth is non-nil, the server
+// is given its CA certificate and credentials.
+func pullImage(ctx context.Context, remote, addr, alias string, auth *imageServerAuth) (string, func(), error) {
+	out, err := runOutput(ctx, "lxc", "image", "list", qualify(remote, ""), "--format=json")
+	if err != nil {
+		return "", nil, err
+	}
+	var images []ImageInfo
+	if err := json.Unmarshal(out, &images); err != nil {
+		return "", nil, err
+	}
+	server, err := auth.url(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	source := map[string]string{
+		"type":     "image",
+		"mode":     "pull",
+		"server":   server,
+		"protocol": "simplestreams",
+		"alias":    alias,
+	}
+	if auth != nil && auth.ca != nil {
+		source["certificate"] = string(auth.ca)
+	}
+	req, err := json.Marshal(map[string]interface{}{"source": source})
+	if err != nil {
+		return "", nil, err
+	}
+	logf(ctx, "Downloading %s from %s on the LXD server", alias, addr)
+	if out, err = runOutput(
+		ctx, "lxc", "query", "--wait", "-X", "POST", "-d", string(req),
+		qualify(remote, "/1.0/images"),
+	); err != nil {
+		return "", nil, fmt.Errorf("%w: %s from %s: %v", ErrBaseImageNotFound, alias, addr, err)
+	}
+	var metadata struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(out, &metadata); err != nil || metadata.Fingerprint == "" {
+		return "", nil, fmt.Errorf("unexpected image download result: %q", out)
+	}
+	for _, image := range images {
+		if image.Fingerprint == metadata.Fingerprint {
+			return metadata.Fingerprint, func() {}, nil
+		}
+	}
+	return metadata.Fingerprint, func() {
+		// Clean up even if the build has been cancelled.
+		if err := lxc(detach(ctx), "image", "delete", qualify(remote, metadata.Fingerprint)); err != nil {
+			logf(ctx, "Deleting downloaded base image: %v", err)
+		}
+	}, nil
+}
+
+// serverBaseImage returns the base image for a build whose host
+// has no internet access (see Options.NoHostNetwork). Images on
+// simplestreams remotes, or on the image server, are downloaded into
+// the build remote's image store by its LXD server (see pullImage);
+// others are returned unchanged. The returned function removes any image
+// downloaded, and must be called once the image is no longer needed.
+// auth applies to the image server.
+func serverBaseImage(ctx context.Context, opts Options, auth *imageServerAuth) (string, func(), error) {
+	addr, name := opts.ImageServer, opts.Image
+	if addr == "" {
+		auth = nil
+		var remote string
+		remote, name = splitImage(opts.Image)
+		remotes, err := listRemotes(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		if r, ok := remotes[remote]; !ok || !r.imageServer() {
+			return opts.Image, func() {}, nil
+		}
+		addr = remotes[remote].Addr
+	}
+	fingerprint, cleanup, err := pullImage(ctx, opts.Remote, addr, name, auth)
+	if err != nil {
+		return "", nil, err
+	}
+	return qualify(opts.Remote, fingerprint), cleanup, nil
+}
@@ -0,0 +1,102 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImportOptions holds the options for ImportTarball.
+type ImportOptions struct {
+	// Tarball is the path of the image tarball to import: a unified
+	// image, holding both metadata.yaml and the rootfs, compressed
+	// in any of the formats LXD accepts. It need not have been built
+	// by this package.
+	Tarball string
+
+	// Alias is the alias to import the image under. It is first
+	// removed from any existing image.
+	Alias string
+
+	// Remote is the lxc remote to import the image into. If empty,
+	// the default remote is used.
+	Remote string
+
+	// Properties holds additional user.* properties to record
+	// on the image.
+	Properties map[string]string
+
+	// TemplateSet and TemplateSets select the templates to add,
+	// as for Options.TemplateSet and Options.TemplateSets.
+	TemplateSet  string
+	TemplateSets map[string]TemplateSet
+
+	// TemplateTriggers holds the events to render the
+	// templates on, as for Options.TemplateTriggers.
+	TemplateTriggers map[string][]string
+}
+
+// ImportTarball imports an existing image tarball under an alias,
+// adding the templates to its metadata, and the properties,
+// as a build does, but without launching a container. The fingerprint
+// of the imported image is returned.
+func ImportTarball(ctx context.Context, opts ImportOptions) (string, error) {
+	if opts.Alias == "" {
+		return "", fmt.Errorf("no alias specified")
+	}
+	for _, key := range sortedKeys(opts.Properties) {
+		if !strings.HasPrefix(key, "user.") {
+			return "", fmt.Errorf("invalid property %q: only user.* properties may be set", key)
+		}
+	}
+	templates, err := resolveTemplates(opts.TemplateSet, opts.TemplateSets, opts.TemplateTriggers)
+	if err != nil {
+		return "", err
+	}
+	ctx = detectLXD(ctx)
+	tmpRoot, err := hostTempDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	tmpdir, err := ioutil.TempDir(tmpRoot, "juju-lxd-centos-import")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// The tarball is decompressed in place, replacing it,
+	// so work on a link to it or, failing that, a copy.
+	tarball := filepath.Join(tmpdir, filepath.Base(opts.Tarball))
+	if err := os.Link(opts.Tarball, tarball); err != nil {
+		if _, _, err := copyFileSHA256(tarball, opts.Tarball); err != nil {
+			return "", err
+		}
+	}
+	outdir := filepath.Join(tmpdir, "out")
+	if err := os.Mkdir(outdir, 0700); err != nil {
+		return "", err
+	}
+	properties := map[string]string{
+		PropertyToolVersion: Version,
+		PropertyTimestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range opts.Properties {
+		properties[key] = value
+	}
+	out, _, err := rewriteImageTarball(
+		ctx, tarball, outdir, properties, time.Time{}, TarballFormat{}, idMapping{}, templates, nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	fingerprint, err := importImage(ctx, opts.Remote, []string{opts.Alias}, templates, out)
+	if err != nil {
+		return "", err
+	}
+	logf(ctx, "Imported %s as %s (%s)", opts.Tarball, qualify(opts.Remote, opts.Alias), fingerprint)
+	return fingerprint, nil
+}
@@ -0,0 +1,321 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type jujuModelInfo struct {
+	Name           string `json:"name"`
+	ControllerName string `json:"controller-name"`
+	Cloud          string `json:"cloud"`
+	Region         string `json:"region"`
+	Type           string `json:"type"`
+}
+
+type jujuCloudInfo struct {
+	Type     string `json:"type"`
+	Endpoint string `json:"endpoint"`
+	Regions  map[string]struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"regions"`
+}
+
+// uploadToJujuModel makes the image with the given alias on the
+// source remote available to the Juju model, identified as
+// "[controller:]model". The image is copied to the LXD server backing
+// the model's cloud, unless that is the source remote or one of the
+// remotes the image has already been pushed to, and then any model
+// config is applied.
+//
+// If remote is non-empty, it names the lxc remote to copy the image
+// to; otherwise the remote is determined by matching the cloud's
+// endpoint against the configured lxc remotes. The name of the remote
+// the image was made available on is returned.
+func uploadToJujuModel(
+	ctx context.Context,
+	model, remote, source, alias string,
+	pushed, config []string,
+) (string, error) {
+	info, err := getJujuModelInfo(ctx, model)
+	if err != nil {
+		return "", err
+	}
+	if info.Type != "lxd" {
+		return "", fmt.Errorf(
+			"model %q uses a %q cloud, expected lxd",
+			model, info.Type,
+		)
+	}
+	if remote == "" {
+		remote, err = findJujuCloudRemote(ctx, info)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !sameRemote(remote, source) && !containsRemote(pushed, remote) {
+		var old string
+		if target := qualify(remote, alias); imageExists(ctx, target) {
+			if old, err = imageFingerprint(ctx, target); err != nil {
+				return "", err
+			}
+		}
+		if err := pushImage(ctx, source, remote, []string{alias}, false); err != nil {
+			return "", err
+		}
+		// Replace any existing image with the same alias once the
+		// new one is in place, so that Juju picks up the new one,
+		// and a failed copy leaves the model with the old one.
+		fingerprint, err := imageFingerprint(ctx, qualify(remote, alias))
+		if err != nil {
+			return "", err
+		}
+		if old != "" && old != fingerprint {
+			if err := lxc(ctx, "image", "delete", qualify(remote, old)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if len(config) > 0 {
+		args := append([]string{"model-config", "-m", model}, config...)
+		if err := run(ctx, "juju", args...); err != nil {
+			return "", err
+		}
+	}
+	return remote, nil
+}
+
+func getJujuModelInfo(ctx context.Context, model string) (*jujuModelInfo, error) {
+	out, err := runOutput(ctx, "juju", "show-model", model, "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	models := make(map[string]jujuModelInfo)
+	if err := json.Unmarshal(out, &models); err != nil {
+		return nil, err
+	}
+	for _, info := range models {
+		return &info, nil
+	}
+	return nil, fmt.Errorf("model %q not found", model)
+}
+
+// findJujuCloudRemote returns the name of the lxc remote whose
+// address matches the endpoint of the model's cloud.
+func findJujuCloudRemote(ctx context.Context, model *jujuModelInfo) (string, error) {
+	args := []string{"show-cloud", model.Cloud, "--format=json"}
+	if model.ControllerName != "" {
+		args = append(args, "-c", model.ControllerName)
+	}
+	out, err := runOutput(ctx, "juju", args...)
+	if err != nil {
+		return "", err
+	}
+	var cloud jujuCloudInfo
+	if err := json.Unmarshal(out, &cloud); err != nil {
+		return "", err
+	}
+	endpoint := cloud.Endpoint
+	if region, ok := cloud.Regions[model.Region]; ok && region.Endpoint != "" {
+		endpoint = region.Endpoint
+	}
+	if endpoint == "" {
+		// The cloud has no endpoint, which means it is
+		// the LXD server local to the controller.
+		return "local", nil
+	}
+
+	remotes, err := listRemotes(ctx)
+	if err != nil {
+		return "", err
+	}
+	for name, remote := range remotes {
+		if sameEndpoint(remote.Addr, endpoint) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"no lxc remote found for cloud %q endpoint %q; "+
+			"add one with \"lxc remote add\", or specify -juju-remote",
+		model.Cloud, endpoint,
+	)
+}
+
+// sameEndpoint reports whether the two LXD endpoints are equivalent,
+// ignoring the scheme and the default port.
+func sameEndpoint(a, b string) bool {
+	normalise := func(s string) string {
+		s = strings.TrimPrefix(s, "https://")
+		s = strings.TrimSuffix(s, "/")
+		return strings.TrimSuffix(s, ":8443")
+	}
+	return normalise(a) == normalise(b)
+}
+
+// testJujuMachine validates the image with the given alias by
+// provisioning a Juju machine from it, and waiting for the machine
+// to reach the "started" state. The machine is removed afterwards.
+//
+// If model is empty, a throwaway controller is bootstrapped on the
+// local LXD cloud, and destroyed once the test is complete.
+//
+// If capture is non-nil, it is called with the name of the machine's
+// LXD instance before the machine is removed, whether or not the test
+// succeeded, so that its logs can be captured.
+func testJujuMachine(ctx context.Context, model, alias string, capture func(instance string)) (err error) {
+	series, err := aliasSeries(alias)
+	if err != nil {
+		return err
+	}
+	if model == "" {
+		controller := fmt.Sprintf("juju-lxd-centos-test-%v", time.Now().Unix())
+		if err := run(ctx, "juju", "bootstrap", "localhost", controller); err != nil {
+			return err
+		}
+		defer func() {
+			// Tear down even if the build has been cancelled.
+			destroyErr := run(
+				detach(ctx), "juju", "destroy-controller", "-y",
+				"--destroy-all-models", controller,
+			)
+			if destroyErr != nil && err == nil {
+				err = destroyErr
+			}
+		}()
+		model = controller + ":default"
+	}
+
+	logf(ctx, "Adding %s machine to model %q", series, model)
+	var out bytes.Buffer
+	err = runner(ctx).Run(ctx, &Command{
+		Name:   "juju",
+		Args:   []string{"add-machine", "-m", model, "--series=" + series},
+		Stdout: &out,
+		Stderr: &out,
+	})
+	if err != nil {
+		return fmt.Errorf("adding machine: %v (%s)", err, bytes.TrimSpace(out.Bytes()))
+	}
+	machine, err := parseAddedMachine(out.Bytes())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		removeErr := run(
+			detach(ctx), "juju",
+			"remove-machine", "-m", model, "--force", machine,
+		)
+		if removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}()
+	if capture != nil {
+		defer func() {
+			instance, err := jujuMachineInstance(detach(ctx), model, machine)
+			if err != nil {
+				logf(ctx, "Finding the instance of machine %s: %v", machine, err)
+				return
+			}
+			capture(instance)
+		}()
+	}
+	return waitJujuMachineStarted(ctx, model, machine)
+}
+
+// aliasSeries returns the Juju series encoded in an image alias
+// of the form "juju/<series>/<arch>[/<variant>]".
+func aliasSeries(alias string) (string, error) {
+	parts := strings.Split(alias, "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "juju" {
+		return "", fmt.Errorf(
+			"cannot determine series from alias %q, "+
+				"expected juju/<series>/<arch>", alias,
+		)
+	}
+	return parts[1], nil
+}
+
+// parseAddedMachine returns the machine ID from the output
+// of "juju add-machine", e.g. "created machine 0".
+func parseAddedMachine(out []byte) (string, error) {
+	const prefix = "created machine "
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), nil
+		}
+	}
+	return "", fmt.Errorf("unexpected add-machine output: %s", bytes.TrimSpace(out))
+}
+
+type jujuMachineStatus struct {
+	Machines map[string]struct {
+		InstanceID string `json:"instance-id"`
+		JujuStatus struct {
+			Current string `json:"current"`
+			Message string `json:"message"`
+		} `json:"juju-status"`
+		MachineStatus struct {
+			Current string `json:"current"`
+			Message string `json:"message"`
+		} `json:"machine-status"`
+	} `json:"machines"`
+}
+
+// jujuMachineInstance returns the name of the
+// LXD instance of the machine in the model.
+func jujuMachineInstance(ctx context.Context, model, machine string) (string, error) {
+	out, err := runOutput(ctx, "juju", "show-machine", "-m", model, machine, "--format=json")
+	if err != nil {
+		return "", err
+	}
+	var status jujuMachineStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return "", err
+	}
+	instance := status.Machines[machine].InstanceID
+	if instance == "" || instance == "pending" {
+		return "", fmt.Errorf("machine %s has no instance", machine)
+	}
+	return instance, nil
+}
+
+func waitJujuMachineStarted(ctx context.Context, model, machine string) error {
+	logf(ctx, "Waiting for machine %s to start", machine)
+
+	now := time.Now()
+	interval := 10 * time.Second
+	deadline := now.Add(15 * time.Minute)
+	for !now.After(deadline) {
+		out, err := runOutput(ctx, "juju", "show-machine", "-m", model, machine, "--format=json")
+		if err != nil {
+			return err
+		}
+		var status jujuMachineStatus
+		if err := json.Unmarshal(out, &status); err != nil {
+			return err
+		}
+		m := status.Machines[machine]
+		switch {
+		case m.JujuStatus.Current == "started":
+			logf(ctx, "Machine %s started", machine)
+			return nil
+		case m.MachineStatus.Current == "provisioning error":
+			return fmt.Errorf(
+				"machine %s failed to provision: %s",
+				machine, m.MachineStatus.Message,
+			)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		now = now.Add(interval)
+	}
+	return fmt.Errorf("timed out waiting for machine %s to start", machine)
+}
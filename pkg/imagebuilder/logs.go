@@ -0,0 +1,117 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Log capture modes, for Options.CaptureLogs.
+const (
+	// CaptureLogsOnFailure captures logs from the build
+	// container only if the build fails. This is the default.
+	CaptureLogsOnFailure = "failure"
+
+	// CaptureLogsAlways captures logs from the build container
+	// for every build, just before it is published.
+	CaptureLogsAlways = "always"
+
+	// CaptureLogsNever disables log capture.
+	CaptureLogsNever = "never"
+)
+
+// containerLogFiles holds the log files to copy out
+// of the build container, if they exist.
+var containerLogFiles = []string{
+	"/var/log/cloud-init.log",
+	"/var/log/cloud-init-output.log",
+	"/var/log/yum.log",
+	"/var/log/dnf.log",
+}
+
+// captureContainerLogs copies the systemd journal and the log
+// files in containerLogFiles out of the container and into dir,
+// returning the paths of the files written. Logs that cannot be
+// captured are skipped, as the container may be in any state.
+func captureContainerLogs(ctx context.Context, container, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	journal, err := runOutput(ctx, "lxc", "exec", container, "--", "journalctl", "-b", "--no-pager")
+	if err != nil {
+		logf(ctx, "Capturing journal: %v", err)
+	} else {
+		p := filepath.Join(dir, "journal.log")
+		if err := ioutil.WriteFile(p, journal, 0644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+	if contextLXDInstall(ctx).snap && !snapAccessible(dir) {
+		logf(ctx, "Warning: the LXD snap cannot write to %s; log files will not be pulled", dir)
+	}
+	for _, file := range containerLogFiles {
+		p := filepath.Join(dir, path.Base(file))
+		if !succeeds(ctx, "lxc", "file", "pull", container+file, p) {
+			// Most likely the file does not exist.
+			continue
+		}
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		emit(ctx, Event{Type: EventArtifact, Artifact: p})
+	}
+	return paths, nil
+}
+
+// testLogCommands holds the commands whose output is captured from
+// the instance started to test the image, keyed by the name of the
+// file to write it to. "lxc" is prepended to each command, and the
+// instance name substituted for "{}".
+var testLogCommands = []struct {
+	file string
+	args []string
+}{
+	{"console.log", []string{"console", "--show-log", "{}"}},
+	{"cloud-init-status.log", []string{"exec", "{}", "--", "cloud-init", "status", "--long"}},
+	{"cloud-init-output.log", []string{"exec", "{}", "--", "cat", "/var/log/cloud-init-output.log"}},
+	{"cloud-init.log", []string{"exec", "{}", "--", "cat", "/var/log/cloud-init.log"}},
+}
+
+// captureTestLogs copies the boot console log and cloud-init output
+// of the instance started to test the image into dir, returning the
+// paths of the files written. As with captureContainerLogs, logs that
+// cannot be captured are skipped.
+func captureTestLogs(ctx context.Context, instance, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, c := range testLogCommands {
+		args := make([]string, len(c.args))
+		for i, arg := range c.args {
+			args[i] = strings.Replace(arg, "{}", instance, 1)
+		}
+		// "cloud-init status" exits non-zero if cloud-init failed,
+		// which is when its output is most useful.
+		var out bytes.Buffer
+		if err := runPipe(ctx, nil, &out, "lxc", args...); err != nil && out.Len() == 0 {
+			logf(ctx, "Capturing %s: %v", c.file, err)
+			continue
+		}
+		p := filepath.Join(dir, c.file)
+		if err := ioutil.WriteFile(p, out.Bytes(), 0644); err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		emit(ctx, Event{Type: EventArtifact, Artifact: p})
+	}
+	return paths, nil
+}
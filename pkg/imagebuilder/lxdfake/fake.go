@@ -0,0 +1,1513 @@
+// Package lxdfake provides an in-memory fake of the lxc client, for
+// exercising builds without a real LXD daemon.
+//
+// A *Fake implements imagebuilder.Runner, interpreting the lxc
+// commands that builds run against an in-memory model of containers
+// and image stores. Commands run inside containers are recorded and
+// succeed unless an ExecHook says otherwise. Other programs (such as
+// juju, or exec provisioner plugins) fail unless a handler has been
+// registered with Handle.
+//
+//	fake := lxdfake.New()
+//	fake.AddImage("images:centos/7", lxdfake.BaseImage())
+//	b, err := imagebuilder.New(imagebuilder.Options{Runner: fake})
+//	...
+//	result, err := b.Build(ctx)
+//	image := fake.Image(result.Alias)
+package lxdfake
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// DefaultCloudInitVersion is the version of cloud-init reported
+// by containers, unless overridden with Fake.CloudInitVersion.
+const DefaultCloudInitVersion = "19.4"
+
+// DefaultCloudInitLog is the content of /var/log/cloud-init.log in
+// containers once "cloud-init status" has been run in them, unless
+// overridden with Fake.CloudInitLog.
+const DefaultCloudInitLog = "2020-01-01 00:00:00,000 - util.py[DEBUG]: Cloud-init v. 19.4 finished\n"
+
+// Fake is an in-memory fake of the lxc client.
+type Fake struct {
+	// CloudInitVersion is the version reported by
+	// "cloud-init --version" inside containers. If empty,
+	// DefaultCloudInitVersion is used.
+	CloudInitVersion string
+
+	// CloudInitLog is the content of /var/log/cloud-init.log
+	// inside containers once "cloud-init status" has been run
+	// in them. If empty, DefaultCloudInitLog is used.
+	CloudInitLog string
+
+	// Architecture is the architecture reported by "uname -m"
+	// inside containers. If empty, "x86_64" is used.
+	Architecture string
+
+	// ExecHook, if non-nil, is called for each command run in a
+	// container with "lxc exec". If it returns an error, the
+	// command fails. Output may be written to cmd.Stdout and
+	// cmd.Stderr. It may be called concurrently, for commands
+	// run at the same time.
+	ExecHook func(container string, argv []string, cmd *imagebuilder.Command) error
+
+	// Remotes maps remote names to their addresses, as
+	// reported by "lxc remote list".
+	Remotes map[string]string
+
+	// ImageServers maps image server addresses to the names of
+	// remotes in the fake whose images they serve. Remotes added
+	// with "lxc remote add" for these addresses share the images.
+	ImageServers map[string]string
+
+	// DefaultRemote, if non-empty, is the remote reported
+	// by "lxc remote get-default"; otherwise it is "local".
+	DefaultRemote string
+
+	mu         sync.Mutex
+	links      map[string]string
+	handlers   map[string]func(context.Context, *imagebuilder.Command) error
+	containers map[string]*Container
+	images     map[string][]*Image
+	commands   [][]string
+}
+
+// Container is a container, or virtual machine, in the fake.
+type Container struct {
+	Name    string
+	Remote  string
+	Image   string
+	Running bool
+
+	// VM reports whether the instance is a virtual
+	// machine, created with "lxc init --vm". Commands
+	// cannot be run in a virtual machine until its
+	// lxd-agent has been installed.
+	VM bool
+
+	// Files holds the files pushed into the container,
+	// keyed by absolute path.
+	Files map[string][]byte
+
+	// Execs records the commands run in the
+	// container, in order.
+	Execs [][]string
+
+	// Config holds the container's config, as set with
+	// "lxc launch --config".
+	Config map[string]string
+
+	// Devices holds the devices added to the container with
+	// "lxc config device add", keyed by name. Each device is
+	// described by its type and config, keyed by "type" and
+	// the config keys.
+	Devices map[string]map[string]string
+
+	// Snapshots holds the container's snapshots, oldest first.
+	Snapshots []*Snapshot
+
+	base *Image
+}
+
+// Snapshot is a snapshot of a container in the fake.
+type Snapshot struct {
+	Name    string
+	Files   map[string][]byte
+	Devices map[string]map[string]string
+}
+
+// Image is an image in the fake's image store.
+type Image struct {
+	Fingerprint string
+	Aliases     []string
+	Properties  map[string]string
+	Tarball     []byte
+	UploadedAt  time.Time
+	Public      bool
+
+	// Type is "virtual-machine" for VM images, and
+	// "container" for the others.
+	Type string
+
+	// Rootfs holds the qcow2 root disk of VM images (see
+	// QCOW2), whose Tarball holds only the metadata.
+	Rootfs []byte
+}
+
+// New returns a new Fake with an empty local image
+// store and no containers.
+func New() *Fake {
+	return &Fake{
+		Remotes:      make(map[string]string),
+		ImageServers: make(map[string]string),
+		links:        make(map[string]string),
+		handlers:     make(map[string]func(context.Context, *imagebuilder.Command) error),
+		containers:   make(map[string]*Container),
+		images:       make(map[string][]*Image),
+	}
+}
+
+// Handle registers f to be called for commands with the
+// given program name, other than lxc.
+func (f *Fake) Handle(name string, h func(context.Context, *imagebuilder.Command) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[name] = h
+}
+
+// AddImage adds an image to the fake, with the given alias qualified
+// with a remote (e.g. "images:centos/7"). The image's properties are
+// taken from the metadata in the tarball.
+func (f *Fake) AddImage(ref string, tarball []byte) (*Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	remote, alias := splitRef(ref)
+	return f.addImage(remote, tarball, []string{alias})
+}
+
+// Image returns the image with the given alias or fingerprint,
+// optionally qualified with a remote, or nil if there is none.
+func (f *Fake) Image(ref string) *Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.findImage(splitRef(ref))
+}
+
+// Images returns the images in the given remote's image store.
+// If remote is empty, the local store is used.
+func (f *Fake) Images(remote string) []*Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	remote = f.store(remote)
+	return append([]*Image(nil), f.images[remote]...)
+}
+
+// Containers returns the containers that exist in the fake,
+// sorted by name.
+func (f *Fake) Containers() []*Container {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var containers []*Container
+	for _, c := range f.containers {
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+	return containers
+}
+
+// Commands returns the commands run through the fake, in order,
+// each with the program name as the first element.
+func (f *Fake) Commands() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+// Run is part of the imagebuilder.Runner interface.
+func (f *Fake) Run(ctx context.Context, cmd *imagebuilder.Command) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.commands = append(f.commands, append([]string{cmd.Name}, cmd.Args...))
+	if cmd.Name != "lxc" {
+		h := f.handlers[cmd.Name]
+		f.mu.Unlock()
+		if h == nil {
+			return fmt.Errorf("%s: command not handled by fake", cmd.Name)
+		}
+		return h(ctx, cmd)
+	}
+	defer f.mu.Unlock()
+	err := f.lxc(cmd)
+	if err != nil && cmd.Stderr != nil {
+		fmt.Fprintf(cmd.Stderr, "Error: %v\n", err)
+	}
+	return err
+}
+
+func (f *Fake) lxc(cmd *imagebuilder.Command) error {
+	args := cmd.Args
+	if len(args) == 0 {
+		return errors.New("no command specified")
+	}
+	switch args[0] {
+	case "launch":
+		return f.launch(args[1:], true)
+	case "init":
+		return f.launch(args[1:], false)
+	case "list":
+		return f.list(cmd, args[1:])
+	case "exec":
+		return f.exec(cmd, args[1:])
+	case "file":
+		if len(args) < 2 {
+			break
+		}
+		switch args[1] {
+		case "push":
+			return f.filePush(args[2:])
+		case "pull":
+			return f.filePull(args[2:])
+		}
+	case "config":
+		if len(args) == 4 && args[1] == "unset" {
+			return f.configUnset(args[2:])
+		}
+		if len(args) < 3 || args[1] != "device" {
+			break
+		}
+		switch args[2] {
+		case "add":
+			return f.deviceAdd(args[3:])
+		case "remove":
+			return f.deviceRemove(args[3:])
+		}
+	case "snapshot":
+		return f.snapshot(args[1:])
+	case "restore":
+		return f.restore(args[1:])
+	case "copy":
+		return f.copyContainer(args[1:])
+	case "move":
+		return f.move(args[1:])
+	case "start":
+		return f.start(args[1:])
+	case "stop":
+		return f.stop(args[1:])
+	case "delete":
+		return f.deleteContainer(args[1:])
+	case "publish":
+		return f.publish(args[1:])
+	case "export":
+		return f.export(args[1:])
+	case "image":
+		return f.image(cmd, args[1:])
+	case "version":
+		fmt.Fprintln(stdout(cmd), "Client version: 4.0.0")
+		fmt.Fprintln(stdout(cmd), "Server version: 4.0.0 (lxdfake)")
+		return nil
+	case "info":
+		arch := f.Architecture
+		if arch == "" {
+			arch = "x86_64"
+		}
+		fmt.Fprintln(stdout(cmd), "environment:")
+		fmt.Fprintln(stdout(cmd), "  kernel_architecture: "+arch)
+		fmt.Fprintln(stdout(cmd), "  server: lxd")
+		fmt.Fprintln(stdout(cmd), "  server_name: lxdfake")
+		return nil
+	case "query":
+		return f.query(cmd, args[1:])
+	case "remote":
+		if len(args) < 2 {
+			break
+		}
+		switch args[1] {
+		case "list":
+			return f.remoteList(cmd)
+		case "add":
+			return f.remoteAdd(args[2:])
+		case "remove":
+			return f.remoteRemove(args[2:])
+		case "get-default":
+			name := f.DefaultRemote
+			if name == "" {
+				name = "local"
+			}
+			fmt.Fprintln(stdout(cmd), name)
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported command: lxc %s", strings.Join(args, " "))
+}
+
+// launch handles "lxc launch" and, if start is false, "lxc init".
+func (f *Fake) launch(args []string, start bool) error {
+	config := make(map[string]string)
+	for _, arg := range args {
+		if kv := strings.TrimPrefix(arg, "--config="); kv != arg {
+			if i := strings.IndexRune(kv, '='); i != -1 {
+				config[kv[:i]] = kv[i+1:]
+			}
+		}
+	}
+	flags, args := splitFlags(args)
+	if len(args) != 2 {
+		return errors.New("usage: lxc launch <image> <container>")
+	}
+	image := f.findImage(splitRef(args[0]))
+	if image == nil {
+		return fmt.Errorf("image %q not found", args[0])
+	}
+	if flags["vm"] != (image.Type == "virtual-machine") {
+		return fmt.Errorf("requested image's type %q doesn't match instance type", image.Type)
+	}
+	remote, name := splitRef(args[1])
+	key := qualify(remote, name)
+	if _, ok := f.containers[key]; ok {
+		return fmt.Errorf("container %q already exists", args[1])
+	}
+	c := &Container{
+		Name:    name,
+		Remote:  remote,
+		Image:   image.Fingerprint,
+		VM:      flags["vm"],
+		Files:   make(map[string][]byte),
+		Config:  config,
+		Devices: make(map[string]map[string]string),
+		base:    image,
+	}
+	f.containers[key] = c
+	if start {
+		c.boot()
+	}
+	return nil
+}
+
+// lxdAgentUnit is the systemd unit installed
+// with lxd-agent in virtual machines.
+const lxdAgentUnit = "/etc/systemd/system/lxd-agent.service"
+
+// boot starts the container. As on any boot of a virtual machine,
+// systemd writes a new random seed to its disk. Virtual machines with
+// the agent:config drive attached, and vendor-data to run its
+// installer, have lxd-agent installed by cloud-init, as cloud images
+// lack it.
+func (c *Container) boot() {
+	c.Running = true
+	if !c.VM {
+		return
+	}
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	c.Files["/var/lib/systemd/random-seed"] = seed
+	if c.Config["user.vendor-data"] == "" {
+		return
+	}
+	for _, device := range c.Devices {
+		if device["type"] == "disk" && device["source"] == "agent:config" {
+			c.Files[lxdAgentUnit] = []byte("[Service]\nExecStart=/run/lxd_agent/lxd-agent\n")
+			return
+		}
+	}
+}
+
+// readFile returns the content of a file in the container's rootfs:
+// one pushed into it, or else the base image's.
+func (c *Container) readFile(name string) ([]byte, bool, error) {
+	if data, ok := c.Files[name]; ok {
+		return data, true, nil
+	}
+	if c.base.Rootfs != nil {
+		files, err := ReadQCOW2(c.base.Rootfs)
+		if err != nil {
+			return nil, false, err
+		}
+		data, ok := files[strings.TrimPrefix(name, "/")]
+		return data, ok, nil
+	}
+	files, err := ReadTarball(c.base.Tarball)
+	if err != nil {
+		return nil, false, err
+	}
+	data, ok := files[path.Join("rootfs", name)]
+	return data, ok, nil
+}
+
+// checkAgent returns an error if the container is a
+// virtual machine whose lxd-agent is not installed.
+func (c *Container) checkAgent() error {
+	if !c.VM {
+		return nil
+	}
+	_, ok, err := c.readFile(lxdAgentUnit)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("VM agent isn't currently running")
+	}
+	return nil
+}
+
+func (f *Fake) configUnset(args []string) error {
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	delete(c.Config, args[1])
+	return nil
+}
+
+func (f *Fake) container(ref string) (*Container, error) {
+	c, ok := f.containers[qualify(splitRef(ref))]
+	if !ok {
+		return nil, fmt.Errorf("container %q not found", ref)
+	}
+	return c, nil
+}
+
+type containerJSON struct {
+	Name      string         `json:"name"`
+	Snapshots []snapshotJSON `json:"snapshots"`
+	State     struct {
+		Status  string                 `json:"status"`
+		Network map[string]networkJSON `json:"network"`
+	} `json:"state"`
+}
+
+type snapshotJSON struct {
+	Name string `json:"name"`
+}
+
+type networkJSON struct {
+	Addresses []addressJSON `json:"addresses"`
+	State     string        `json:"state"`
+}
+
+type addressJSON struct {
+	Family  string `json:"family"`
+	Address string `json:"address"`
+	Scope   string `json:"scope"`
+}
+
+func (f *Fake) list(cmd *imagebuilder.Command, args []string) error {
+	_, args = splitFlags(args)
+	var out []containerJSON
+	for _, c := range f.containers {
+		if len(args) > 0 {
+			remote, name := splitRef(args[0])
+			if remote != c.Remote || !strings.HasPrefix(c.Name, name) {
+				continue
+			}
+		}
+		var j containerJSON
+		j.Name = c.Name
+		for _, s := range c.Snapshots {
+			j.Snapshots = append(j.Snapshots, snapshotJSON{s.Name})
+		}
+		j.State.Status = "Stopped"
+		if c.Running {
+			j.State.Status = "Running"
+			j.State.Network = map[string]networkJSON{
+				"lo": {
+					State:     "up",
+					Addresses: []addressJSON{{"inet", "127.0.0.1", "local"}},
+				},
+				"eth0": {
+					State:     "up",
+					Addresses: []addressJSON{{"inet", "10.0.8.2", "global"}},
+				},
+			}
+			if c.Config["user.network_mode"] == "link-local" {
+				// cloud-init leaves eth0 unconfigured.
+				j.State.Network["eth0"] = networkJSON{
+					State:     "up",
+					Addresses: []addressJSON{{"inet6", "fe80::216:3eff:fe00:1", "link"}},
+				}
+			}
+		}
+		out = append(out, j)
+	}
+	if out == nil {
+		out = []containerJSON{}
+	}
+	return writeJSON(cmd.Stdout, out)
+}
+
+func (f *Fake) exec(cmd *imagebuilder.Command, args []string) error {
+	// Skip flags such as --user and --env, and their values.
+	for len(args) > 2 && args[1] != "--" && strings.HasPrefix(args[1], "--") {
+		if strings.ContainsRune(args[1], '=') {
+			args = append(args[:1:1], args[2:]...)
+		} else {
+			args = append(args[:1:1], args[3:]...)
+		}
+	}
+	if len(args) < 3 || args[1] != "--" {
+		return errors.New("usage: lxc exec <container> -- <command>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if !c.Running {
+		return fmt.Errorf("container %q is not running", args[0])
+	}
+	if err := c.checkAgent(); err != nil {
+		return err
+	}
+	argv := args[2:]
+	c.Execs = append(c.Execs, argv)
+	if hook := f.ExecHook; hook != nil {
+		// The hook is called without the lock held, so that
+		// it may block commands run concurrently, as in parallel
+		// provisioning steps, and use the fake's methods.
+		f.mu.Unlock()
+		err := hook(c.Name, argv, cmd)
+		f.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case len(argv) == 2 && argv[0] == "cloud-init" && argv[1] == "--version":
+		version := f.CloudInitVersion
+		if version == "" {
+			version = DefaultCloudInitVersion
+		}
+		fmt.Fprintf(stdout(cmd), "/usr/bin/cloud-init %s\n", version)
+	case len(argv) >= 2 && argv[0] == "cloud-init" && argv[1] == "status":
+		// cloud-init has run, and logged nothing of note.
+		if _, ok := c.Files["/var/log/cloud-init.log"]; !ok {
+			log := f.CloudInitLog
+			if log == "" {
+				log = DefaultCloudInitLog
+			}
+			c.Files["/var/log/cloud-init.log"] = []byte(log)
+		}
+	case len(argv) == 3 && argv[0] == "/bin/rm" && argv[1] == "-f":
+		delete(c.Files, argv[2])
+	case len(argv) == 2 && argv[0] == "cat":
+		// Files pushed into the container shadow
+		// those in the base image's rootfs.
+		data, ok, err := c.readFile(argv[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("cat: %s: No such file or directory", argv[1])
+		}
+		stdout(cmd).Write(data)
+	case len(argv) == 2 && argv[0] == "uname" && argv[1] == "-m":
+		arch := f.Architecture
+		if arch == "" {
+			arch = "x86_64"
+		}
+		fmt.Fprintln(stdout(cmd), arch)
+	case len(argv) == 3 && argv[0] == "getent":
+		// Every user and group exists, with ID 1000
+		// unless the name is numeric, and every host
+		// name resolves.
+		id := argv[2]
+		if _, err := strconv.Atoi(id); err != nil {
+			id = "1000"
+		}
+		switch argv[1] {
+		case "passwd":
+			fmt.Fprintf(stdout(cmd), "%s:x:%s:%s::/home/%s:/bin/bash\n", argv[2], id, id, argv[2])
+		case "group":
+			fmt.Fprintf(stdout(cmd), "%s:x:%s:\n", argv[2], id)
+		case "hosts":
+			fmt.Fprintf(stdout(cmd), "192.0.2.1       %s\n", argv[2])
+		}
+	}
+	return nil
+}
+
+func (f *Fake) filePush(args []string) error {
+	flags, args := splitFlags(args)
+	if len(args) != 2 {
+		return errors.New("usage: lxc file push <source> <container>/<path>")
+	}
+	i := strings.IndexRune(args[1], '/')
+	if i == -1 {
+		return fmt.Errorf("invalid target %q", args[1])
+	}
+	c, err := f.container(args[1][:i])
+	if err != nil {
+		return err
+	}
+	if err := c.checkAgent(); err != nil {
+		return err
+	}
+	if flags["recursive"] {
+		// Directories are pushed into the target directory.
+		src := filepath.Clean(args[0])
+		target := path.Join(args[1][i:], filepath.Base(src))
+		return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			c.Files[path.Join(target, filepath.ToSlash(rel))] = data
+			return nil
+		})
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	c.Files[args[1][i:]] = data
+	return nil
+}
+
+func (f *Fake) filePull(args []string) error {
+	_, args = splitFlags(args)
+	if len(args) != 2 {
+		return errors.New("usage: lxc file pull <container>/<path> <target>")
+	}
+	i := strings.IndexRune(args[0], '/')
+	if i == -1 {
+		return fmt.Errorf("invalid source %q", args[0])
+	}
+	c, err := f.container(args[0][:i])
+	if err != nil {
+		return err
+	}
+	if err := c.checkAgent(); err != nil {
+		return err
+	}
+	data, ok := c.Files[args[0][i:]]
+	if !ok {
+		return fmt.Errorf("file %q not found", args[0][i:])
+	}
+	return ioutil.WriteFile(args[1], data, 0644)
+}
+
+func (f *Fake) deviceAdd(args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: lxc config device add <container> <name> <type> [key=value...]")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := c.Devices[args[1]]; ok {
+		return fmt.Errorf("device %q already exists", args[1])
+	}
+	device := map[string]string{"type": args[2]}
+	for _, kv := range args[3:] {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid device config %q", kv)
+		}
+		device[kv[:i]] = kv[i+1:]
+	}
+	c.Devices[args[1]] = device
+	return nil
+}
+
+func (f *Fake) deviceRemove(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lxc config device remove <container> <name>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := c.Devices[args[1]]; !ok {
+		return fmt.Errorf("device %q not found", args[1])
+	}
+	delete(c.Devices, args[1])
+	return nil
+}
+
+func (f *Fake) snapshot(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lxc snapshot <container> <name>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if c.findSnapshot(args[1]) != nil {
+		return fmt.Errorf("snapshot %q already exists", args[1])
+	}
+	c.Snapshots = append(c.Snapshots, &Snapshot{
+		Name:    args[1],
+		Files:   copyFiles(c.Files),
+		Devices: copyDevices(c.Devices),
+	})
+	return nil
+}
+
+func (f *Fake) restore(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lxc restore <container> <snapshot>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	s := c.findSnapshot(args[1])
+	if s == nil {
+		return fmt.Errorf("snapshot %q not found", args[1])
+	}
+	c.Files = copyFiles(s.Files)
+	c.Devices = copyDevices(s.Devices)
+	return nil
+}
+
+func (f *Fake) copyContainer(args []string) error {
+	flags, args := splitFlags(args)
+	if len(args) != 2 {
+		return errors.New("usage: lxc copy <source>[/<snapshot>] <target>")
+	}
+	source, snapshotName := args[0], ""
+	if i := strings.IndexRune(source, '/'); i != -1 {
+		source, snapshotName = source[:i], source[i+1:]
+	}
+	c, err := f.container(source)
+	if err != nil {
+		return err
+	}
+	remote, name := splitRef(args[1])
+	key := qualify(remote, name)
+	if _, ok := f.containers[key]; ok {
+		return fmt.Errorf("container %q already exists", args[1])
+	}
+	copied := &Container{
+		Name:    name,
+		Remote:  remote,
+		Image:   c.Image,
+		VM:      c.VM,
+		Files:   copyFiles(c.Files),
+		Config:  copyProperties(c.Config),
+		Devices: copyDevices(c.Devices),
+		base:    c.base,
+	}
+	if snapshotName != "" {
+		s := c.findSnapshot(snapshotName)
+		if s == nil {
+			return fmt.Errorf("snapshot %q not found", snapshotName)
+		}
+		copied.Files = copyFiles(s.Files)
+		copied.Devices = copyDevices(s.Devices)
+	} else if !flags["instance-only"] {
+		for _, s := range c.Snapshots {
+			copied.Snapshots = append(copied.Snapshots, &Snapshot{
+				Name:    s.Name,
+				Files:   copyFiles(s.Files),
+				Devices: copyDevices(s.Devices),
+			})
+		}
+	}
+	f.containers[key] = copied
+	return nil
+}
+
+func (f *Fake) move(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: lxc move <container> <target>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if c.Running {
+		return fmt.Errorf("container %q is running", args[0])
+	}
+	remote, name := splitRef(args[1])
+	if remote != c.Remote {
+		return errors.New("moving containers between remotes is not supported")
+	}
+	key := qualify(remote, name)
+	if _, ok := f.containers[key]; ok {
+		return fmt.Errorf("container %q already exists", args[1])
+	}
+	delete(f.containers, qualify(c.Remote, c.Name))
+	c.Name = name
+	f.containers[key] = c
+	return nil
+}
+
+func (f *Fake) start(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lxc start <container>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	c.boot()
+	return nil
+}
+
+func (c *Container) findSnapshot(name string) *Snapshot {
+	for _, s := range c.Snapshots {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func copyFiles(files map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte)
+	for name, data := range files {
+		copied[name] = data
+	}
+	return copied
+}
+
+func copyDevices(devices map[string]map[string]string) map[string]map[string]string {
+	copied := make(map[string]map[string]string)
+	for name, device := range devices {
+		d := make(map[string]string)
+		for k, v := range device {
+			d[k] = v
+		}
+		copied[name] = d
+	}
+	return copied
+}
+
+func (f *Fake) stop(args []string) error {
+	_, args = splitFlags(args)
+	if len(args) != 1 {
+		return errors.New("usage: lxc stop <container>")
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	c.Running = false
+	return nil
+}
+
+func (f *Fake) deleteContainer(args []string) error {
+	flags, args := splitFlags(args)
+	if len(args) != 1 {
+		return errors.New("usage: lxc delete [--force] <container>[/<snapshot>]")
+	}
+	if i := strings.IndexRune(args[0], '/'); i != -1 {
+		c, err := f.container(args[0][:i])
+		if err != nil {
+			return err
+		}
+		for j, s := range c.Snapshots {
+			if s.Name == args[0][i+1:] {
+				c.Snapshots = append(c.Snapshots[:j], c.Snapshots[j+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("snapshot %q not found", args[0])
+	}
+	c, err := f.container(args[0])
+	if err != nil {
+		return err
+	}
+	if c.Running && !flags["force"] {
+		return fmt.Errorf("container %q is running", args[0])
+	}
+	delete(f.containers, qualify(c.Remote, c.Name))
+	return nil
+}
+
+func (f *Fake) publish(args []string) error {
+	_, rest := splitFlagValues(args)
+	if len(rest) < 1 || len(rest) > 2 {
+		return errors.New("usage: lxc publish <container> [<remote>:] [--alias=<alias>]")
+	}
+	c, err := f.container(rest[0])
+	if err != nil {
+		return err
+	}
+	if c.Running {
+		return fmt.Errorf("container %q is running", rest[0])
+	}
+	remote := c.Remote
+	if len(rest) == 2 {
+		remote = strings.TrimSuffix(rest[1], ":")
+	}
+	if c.VM {
+		// VM images keep their base's metadata, and
+		// have the files written to their root disk.
+		disk, err := vmDisk(c.base.Rootfs, c.Files)
+		if err != nil {
+			return err
+		}
+		_, err = f.addVMImage(remote, c.base.Tarball, disk, aliasFlags(args))
+		return err
+	}
+	tarball, err := publishTarball(c.base.Tarball, c.Files)
+	if err != nil {
+		return err
+	}
+	_, err = f.addImage(remote, tarball, aliasFlags(args))
+	return err
+}
+
+// export writes a backup tarball of a stopped container, with
+// the layout of "lxc export --instance-only".
+func (f *Fake) export(args []string) error {
+	flags, rest := splitFlagValues(args)
+	if len(rest) != 2 {
+		return errors.New("usage: lxc export <container> <file> [--instance-only] [--compression=none]")
+	}
+	c, err := f.container(rest[0])
+	if err != nil {
+		return err
+	}
+	if c.Running {
+		return fmt.Errorf("container %q is running", rest[0])
+	}
+	if c.VM {
+		return errors.New("exporting virtual machines is not supported by the fake")
+	}
+	tarball, err := exportTarball(c.base.Tarball, c.Files, c.Name, flags["compression"] == "none")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(rest[1], tarball, 0644)
+}
+
+func (f *Fake) image(cmd *imagebuilder.Command, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lxc image <command>")
+	}
+	_, rest := splitFlagValues(args[1:])
+	switch args[0] {
+	case "info":
+		if len(rest) != 1 {
+			break
+		}
+		image, err := f.image1(rest[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout(cmd), "Fingerprint: %s\n", image.Fingerprint)
+		fmt.Fprintf(stdout(cmd), "Size: %.2fMB\n", float64(image.size())/1e6)
+		return nil
+	case "show":
+		if len(rest) != 1 {
+			break
+		}
+		image, err := f.image1(rest[0])
+		if err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(map[string]interface{}{
+			"fingerprint": image.Fingerprint,
+			"properties":  image.Properties,
+			"public":      false,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = stdout(cmd).Write(out)
+		return err
+	case "edit":
+		if len(rest) != 1 || cmd.Stdin == nil {
+			break
+		}
+		image, err := f.image1(rest[0])
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		var info struct {
+			Properties map[string]string `yaml:"properties"`
+		}
+		if err := yaml.Unmarshal(data, &info); err != nil {
+			return err
+		}
+		image.Properties = info.Properties
+		return nil
+	case "list":
+		var remote string
+		if len(rest) > 0 {
+			remote, _ = splitRef(rest[0])
+		}
+		remote = f.store(remote)
+		type aliasJSON struct {
+			Name string `json:"name"`
+		}
+		type imageJSON struct {
+			Fingerprint string            `json:"fingerprint"`
+			Aliases     []aliasJSON       `json:"aliases"`
+			Properties  map[string]string `json:"properties"`
+			UploadedAt  string            `json:"uploaded_at"`
+			Size        int64             `json:"size"`
+		}
+		out := []imageJSON{}
+		for _, image := range f.images[remote] {
+			j := imageJSON{
+				Fingerprint: image.Fingerprint,
+				Aliases:     []aliasJSON{},
+				Properties:  image.Properties,
+				UploadedAt:  image.UploadedAt.Format(time.RFC3339),
+				Size:        image.size(),
+			}
+			for _, alias := range image.Aliases {
+				j.Aliases = append(j.Aliases, aliasJSON{alias})
+			}
+			out = append(out, j)
+		}
+		return writeJSON(cmd.Stdout, out)
+	case "export":
+		if len(rest) != 2 {
+			break
+		}
+		image, err := f.image1(rest[0])
+		if err != nil {
+			return err
+		}
+		if image.Rootfs != nil {
+			// Like LXD, VM images are exported
+			// as a metadata tarball and a disk.
+			if err := ioutil.WriteFile(
+				filepath.Join(rest[1], "meta-"+image.Fingerprint+".tar.gz"),
+				image.Tarball, 0644,
+			); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(
+				filepath.Join(rest[1], image.Fingerprint+".qcow2"),
+				image.Rootfs, 0644,
+			)
+		}
+		return ioutil.WriteFile(
+			filepath.Join(rest[1], image.Fingerprint+".tar.gz"),
+			image.Tarball, 0644,
+		)
+	case "import":
+		// The files may be a unified tarball, or the metadata
+		// and rootfs tarballs of a split image, or the metadata
+		// tarball and qcow2 root disk of a VM image.
+		remote := "local"
+		if n := len(rest); n > 0 && strings.HasSuffix(rest[n-1], ":") {
+			remote = strings.TrimSuffix(rest[n-1], ":")
+			rest = rest[:n-1]
+		}
+		if len(rest) < 1 || len(rest) > 2 {
+			break
+		}
+		var files [][]byte
+		for _, name := range rest {
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			files = append(files, data)
+		}
+		if len(files) == 1 {
+			_, err := f.addImage(remote, files[0], aliasFlags(args[1:]))
+			return err
+		}
+		if _, err := ReadQCOW2(files[1]); err == nil {
+			_, err := f.addVMImage(remote, files[0], files[1], aliasFlags(args[1:]))
+			return err
+		}
+		// Split images are stored unified, so that they can be
+		// launched, but are fingerprinted as LXD does.
+		tarball, err := unifiedTarball(files[0], files[1])
+		if err != nil {
+			return err
+		}
+		image, err := f.addImage(remote, tarball, aliasFlags(args[1:]))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(append(files[0], files[1]...))
+		image.Fingerprint = hex.EncodeToString(sum[:])
+		return nil
+	case "delete":
+		if len(rest) != 1 {
+			break
+		}
+		remote, name := splitRef(rest[0])
+		image := f.findImage(remote, name)
+		if image == nil {
+			return fmt.Errorf("image %q not found", rest[0])
+		}
+		f.removeImage(remote, image)
+		return nil
+	case "copy":
+		if len(rest) != 2 {
+			break
+		}
+		image, err := f.image1(rest[0])
+		if err != nil {
+			return err
+		}
+		copied, err := f.copyImage(strings.TrimSuffix(rest[1], ":"), image, aliasFlags(args[1:]))
+		if err != nil {
+			return err
+		}
+		copied.Properties = copyProperties(image.Properties)
+		copied.Public = hasFlag(args[1:], "--public")
+		return nil
+	case "alias":
+		if len(rest) == 3 && rest[0] == "create" {
+			remote, alias := splitRef(rest[1])
+			if image := f.findImage(remote, alias); image != nil && contains(image.Aliases, alias) {
+				return fmt.Errorf("alias %q already exists", rest[1])
+			}
+			image := f.findImage(remote, rest[2])
+			if image == nil {
+				return fmt.Errorf("image %q not found", rest[2])
+			}
+			image.Aliases = append(image.Aliases, alias)
+			return nil
+		}
+		if len(rest) != 2 || rest[0] != "delete" {
+			break
+		}
+		remote, alias := splitRef(rest[1])
+		image := f.findImage(remote, alias)
+		if image == nil || !contains(image.Aliases, alias) {
+			return fmt.Errorf("alias %q not found", rest[1])
+		}
+		image.Aliases = without(image.Aliases, alias)
+		return nil
+	}
+	return fmt.Errorf("unsupported command: lxc image %s", strings.Join(args, " "))
+}
+
+// query handles "lxc query", supporting only image downloads
+// (POST /1.0/images) from image servers known to the fake.
+func (f *Fake) query(cmd *imagebuilder.Command, args []string) error {
+	var method, data, target string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-X":
+			i++
+			method = args[i]
+		case "-d":
+			i++
+			data = args[i]
+		case "--wait":
+		default:
+			target = args[i]
+		}
+	}
+	remote, path := splitRef(target)
+	if method != "POST" || path != "/1.0/images" {
+		return fmt.Errorf("unsupported query: %s %s", method, target)
+	}
+	var req struct {
+		Source struct {
+			Mode     string `json:"mode"`
+			Server   string `json:"server"`
+			Protocol string `json:"protocol"`
+			Alias    string `json:"alias"`
+		} `json:"source"`
+	}
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return err
+	}
+	server, ok := f.ImageServers[req.Source.Server]
+	if !ok && req.Source.Server == "https://images.linuxcontainers.org" {
+		server = "images"
+	} else if !ok {
+		return fmt.Errorf("unknown image server %q", req.Source.Server)
+	}
+	image := f.findImage(server, req.Source.Alias)
+	if image == nil {
+		return fmt.Errorf("image %q not found on %s", req.Source.Alias, req.Source.Server)
+	}
+	if f.findImage(remote, image.Fingerprint) == nil {
+		copied, err := f.copyImage(remote, image, nil)
+		if err != nil {
+			return err
+		}
+		copied.Properties = copyProperties(image.Properties)
+	}
+	return writeJSON(cmd.Stdout, map[string]string{"fingerprint": image.Fingerprint})
+}
+
+func (f *Fake) remoteList(cmd *imagebuilder.Command) error {
+	type remoteJSON struct {
+		Addr     string `json:"Addr"`
+		Protocol string `json:"Protocol"`
+		Public   bool   `json:"Public"`
+	}
+	// Like lxc, the fake has the images: remote by default.
+	out := map[string]remoteJSON{
+		"local":  {"unix://", "lxd", false},
+		"images": {"https://images.linuxcontainers.org", "simplestreams", true},
+	}
+	for name, addr := range f.Remotes {
+		// Remotes for image servers, and images:, are
+		// simplestreams remotes; others are LXD servers.
+		if _, ok := f.ImageServers[addr]; ok || name == "images" {
+			out[name] = remoteJSON{addr, "simplestreams", true}
+		} else {
+			out[name] = remoteJSON{addr, "lxd", false}
+		}
+	}
+	return writeJSON(cmd.Stdout, out)
+}
+
+func (f *Fake) remoteAdd(args []string) error {
+	_, args = splitFlagValues(args)
+	if len(args) != 2 {
+		return errors.New("usage: lxc remote add <name> <addr>")
+	}
+	name, addr := args[0], args[1]
+	if _, ok := f.Remotes[name]; ok || name == "local" {
+		return fmt.Errorf("remote %s exists as <%s>", name, f.Remotes[name])
+	}
+	f.Remotes[name] = addr
+	if server, ok := f.ImageServers[addr]; ok {
+		f.links[name] = server
+	}
+	return nil
+}
+
+func (f *Fake) remoteRemove(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lxc remote remove <name>")
+	}
+	if _, ok := f.Remotes[args[0]]; !ok {
+		return fmt.Errorf("remote %s doesn't exist", args[0])
+	}
+	delete(f.Remotes, args[0])
+	delete(f.links, args[0])
+	return nil
+}
+
+// store returns the name of the image store for the remote:
+// "local" for the default remote, or the remote whose images
+// are served by the remote's image server.
+func (f *Fake) store(remote string) string {
+	if remote == "" {
+		return "local"
+	}
+	if server, ok := f.links[remote]; ok {
+		return server
+	}
+	if server, ok := f.ImageServers[f.Remotes[remote]]; ok {
+		return server
+	}
+	return remote
+}
+
+// image1 returns the image with the given reference,
+// or an error if there is none.
+func (f *Fake) image1(ref string) (*Image, error) {
+	image := f.findImage(splitRef(ref))
+	if image == nil {
+		return nil, fmt.Errorf("image %q not found", ref)
+	}
+	return image, nil
+}
+
+func (f *Fake) findImage(remote, name string) *Image {
+	remote = f.store(remote)
+	for _, image := range f.images[remote] {
+		if contains(image.Aliases, name) {
+			return image
+		}
+	}
+	// Accept unique fingerprint prefixes, as lxc does.
+	var found *Image
+	for _, image := range f.images[remote] {
+		if name != "" && strings.HasPrefix(image.Fingerprint, name) {
+			if found != nil {
+				return nil
+			}
+			found = image
+		}
+	}
+	return found
+}
+
+func (f *Fake) addImage(remote string, tarball []byte, aliases []string) (*Image, error) {
+	return f.addVMImage(remote, tarball, nil, aliases)
+}
+
+// addVMImage adds an image with the given metadata tarball and,
+// unless it is nil, qcow2 root disk, making a VM image.
+func (f *Fake) addVMImage(remote string, tarball, rootfs []byte, aliases []string) (*Image, error) {
+	remote = f.store(remote)
+	properties, err := tarballProperties(tarball)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append(tarball[:len(tarball):len(tarball)], rootfs...))
+	fingerprint := hex.EncodeToString(sum[:])
+	for _, alias := range aliases {
+		if image := f.findImage(remote, alias); image != nil && contains(image.Aliases, alias) {
+			return nil, fmt.Errorf("alias %q already exists", alias)
+		}
+	}
+	for _, image := range f.images[remote] {
+		if image.Fingerprint == fingerprint {
+			return nil, fmt.Errorf("image with same fingerprint already exists")
+		}
+	}
+	image := &Image{
+		Fingerprint: fingerprint,
+		Aliases:     append([]string{}, aliases...),
+		Properties:  properties,
+		Tarball:     tarball,
+		UploadedAt:  time.Now(),
+		Type:        "container",
+		Rootfs:      rootfs,
+	}
+	if rootfs != nil {
+		image.Type = "virtual-machine"
+	}
+	f.images[remote] = append(f.images[remote], image)
+	return image, nil
+}
+
+// copyImage adds a copy of the image to the remote's store.
+func (f *Fake) copyImage(remote string, image *Image, aliases []string) (*Image, error) {
+	return f.addVMImage(remote, image.Tarball, image.Rootfs, aliases)
+}
+
+// size returns the size of the image's files.
+func (image *Image) size() int64 {
+	return int64(len(image.Tarball) + len(image.Rootfs))
+}
+
+func (f *Fake) removeImage(remote string, image *Image) {
+	remote = f.store(remote)
+	images := f.images[remote]
+	for i, other := range images {
+		if other == image {
+			f.images[remote] = append(images[:i:i], images[i+1:]...)
+			return
+		}
+	}
+}
+
+// splitRef splits a reference of the form [remote:]name.
+func splitRef(ref string) (remote, name string) {
+	if i := strings.IndexRune(ref, ':'); i != -1 {
+		return ref[:i], ref[i+1:]
+	}
+	return "", ref
+}
+
+func qualify(remote, name string) string {
+	if remote == "" || remote == "local" {
+		return name
+	}
+	return remote + ":" + name
+}
+
+// splitFlags separates boolean --flags from positional arguments.
+func splitFlags(args []string) (map[string]bool, []string) {
+	values, rest := splitFlagValues(args)
+	flags := make(map[string]bool)
+	for name := range values {
+		flags[name] = true
+	}
+	return flags, rest
+}
+
+// splitFlagValues separates --flag[=value] arguments from
+// positional arguments. Repeated flags take the last value.
+func splitFlagValues(args []string) (map[string]string, []string) {
+	flags := make(map[string]string)
+	var rest []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+		arg = strings.TrimPrefix(arg, "--")
+		if i := strings.IndexRune(arg, '='); i != -1 {
+			flags[arg[:i]] = arg[i+1:]
+		} else {
+			flags[arg] = ""
+		}
+	}
+	return flags, rest
+}
+
+// aliasFlags returns the values of all --alias flags in args.
+func aliasFlags(args []string) []string {
+	var aliases []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--alias=") {
+			aliases = append(aliases, strings.TrimPrefix(arg, "--alias="))
+		}
+	}
+	return aliases
+}
+
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func stdout(cmd *imagebuilder.Command) io.Writer {
+	if cmd.Stdout == nil {
+		return ioutil.Discard
+	}
+	return cmd.Stdout
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	if w == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, bytes.NewReader(append(data, '\n')))
+	return err
+}
+
+func copyProperties(in map[string]string) map[string]string {
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func without(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,306 @@
+package lxdfake
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BaseMetadata is the metadata.yaml of the image returned by
+// BaseImage, modelled on that of images:centos/7.
+const BaseMetadata = `architecture: x86_64
+creation_date: 1577836800
+properties:
+  architecture: amd64
+  description: Centos 7 amd64 (20200101_07:08)
+  name: centos-7-amd64-default-20200101_07:08
+  os: centos
+  release: "7"
+  serial: "20200101_07:08"
+  variant: default
+templates:
+  /etc/hostname:
+    when:
+    - create
+    - copy
+    template: hostname.tpl
+  /etc/hosts:
+    when:
+    - create
+    - copy
+    template: hosts.tpl
+`
+
+// BaseImage returns a unified image tarball (gzip-compressed, with
+// both metadata and rootfs) standing in for images:centos/7.
+func BaseImage() []byte {
+	data, err := Tarball(map[string]string{
+		"metadata.yaml":              BaseMetadata,
+		"templates/hostname.tpl":     "{{ container.name }}\n",
+		"templates/hosts.tpl":        "127.0.0.1 localhost\n127.0.1.1 {{ container.name }}\n",
+		"rootfs/etc/centos-release":  "CentOS Linux release 7.7.1908 (Core)\n",
+		"rootfs/etc/os-release":      "NAME=\"CentOS Linux\"\nVERSION=\"7 (Core)\"\nID=\"centos\"\nVERSION_ID=\"7\"\n",
+		"rootfs/etc/cloud/cloud.cfg": "cloud_init_modules:\n - set_hostname\n - update_hostname\n",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Tarball returns a gzip-compressed tarball containing the given
+// files, keyed by path. Entries are written in path order, with
+// parent directories added as needed.
+func Tarball(files map[string]string) ([]byte, error) {
+	entries := make(map[string][]byte)
+	for name, content := range files {
+		entries[name] = []byte(content)
+	}
+	return writeTarball(entries)
+}
+
+// ReadTarball returns the regular files in a gzip-compressed
+// tarball, keyed by path.
+func ReadTarball(data []byte) (map[string][]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(h.Name)] = content
+	}
+}
+
+// Metadata returns the parsed metadata.yaml of a
+// gzip-compressed image tarball.
+func Metadata(data []byte) (map[string]interface{}, error) {
+	files, err := ReadTarball(data)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := files["metadata.yaml"]
+	if !ok {
+		return nil, fmt.Errorf("metadata.yaml not found")
+	}
+	metadata := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// tarballProperties returns the properties
+// recorded in the tarball's metadata.
+func tarballProperties(data []byte) (map[string]string, error) {
+	metadata, err := Metadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading image metadata: %v", err)
+	}
+	properties := make(map[string]string)
+	m, _ := metadata["properties"].(map[interface{}]interface{})
+	for k, v := range m {
+		properties[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+	return properties, nil
+}
+
+// publishTarball returns the tarball for an image published from
+// a container launched from base, with the given files pushed
+// into its root filesystem.
+func publishTarball(base []byte, files map[string][]byte) ([]byte, error) {
+	existing, err := ReadTarball(base)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte)
+	for name, content := range existing {
+		entries[name] = content
+	}
+	for name, content := range files {
+		entries[path.Join("rootfs", name)] = content
+	}
+	return writeTarball(entries)
+}
+
+// exportTarball returns the backup tarball for a container launched
+// from base, with the given files pushed into its root filesystem,
+// as written by "lxc export --instance-only". If uncompressed is
+// true, it is not gzip-compressed.
+func exportTarball(base []byte, files map[string][]byte, container string, uncompressed bool) ([]byte, error) {
+	published, err := publishTarball(base, files)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ReadTarball(published)
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string][]byte{
+		"backup/index.yaml": []byte("name: " + container + "\nbackend: dir\n"),
+	}
+	for name, content := range existing {
+		entries[path.Join("backup/container", name)] = content
+	}
+	data, err := writeTarball(entries)
+	if err != nil || !uncompressed {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// unifiedTarball returns the unified tarball equivalent to
+// the metadata and rootfs tarballs of a split image.
+func unifiedTarball(metadata, rootfs []byte) ([]byte, error) {
+	entries, err := ReadTarball(metadata)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ReadTarball(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	for name, content := range files {
+		entries[path.Join("rootfs", name)] = content
+	}
+	return writeTarball(entries)
+}
+
+func writeTarball(entries map[string][]byte) ([]byte, error) {
+	dirs := make(map[string]bool)
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		names = append(names, dir+"/")
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range names {
+		h := &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		content, ok := entries[name]
+		if !strings.HasSuffix(name, "/") && ok {
+			h = &tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(content)),
+				Typeflag: tar.TypeReg,
+			}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// qcow2HeaderSize is the size of the header of the qcow2
+// disks written by QCOW2, as of qcow2 version 3.
+const qcow2HeaderSize = 104
+
+// qcow2VirtualSize is the disk size recorded
+// in the header of disks written by QCOW2.
+const qcow2VirtualSize = 10 << 30
+
+// CloudImage returns a qcow2 disk (see QCOW2) standing
+// in for a Rocky Linux 9 GenericCloud image.
+func CloudImage() []byte {
+	data, err := QCOW2(map[string]string{
+		"etc/rocky-release": "Rocky Linux release 9.2 (Blue Onyx)\n",
+		"etc/os-release":    "NAME=\"Rocky Linux\"\nVERSION=\"9.2 (Blue Onyx)\"\nID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\nVERSION_ID=\"9.2\"\n",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// QCOW2 returns a fake qcow2 disk holding the given files, keyed by
+// path relative to the root: a qcow2 header, which records a 10GiB
+// disk, followed by a gzip-compressed tarball of the files, which
+// ReadQCOW2 reads back.
+func QCOW2(files map[string]string) ([]byte, error) {
+	entries := make(map[string][]byte)
+	for name, content := range files {
+		entries[name] = []byte(content)
+	}
+	return writeQCOW2(entries)
+}
+
+// ReadQCOW2 returns the regular files in a fake qcow2
+// disk written by QCOW2, keyed by path.
+func ReadQCOW2(data []byte) (map[string][]byte, error) {
+	if len(data) < qcow2HeaderSize || !bytes.HasPrefix(data, []byte("QFI\xfb")) {
+		return nil, fmt.Errorf("not a qcow2 disk")
+	}
+	return ReadTarball(data[qcow2HeaderSize:])
+}
+
+// vmDisk returns the disk for an image published from a VM
+// launched from base, with the given files pushed into it.
+func vmDisk(base []byte, files map[string][]byte) ([]byte, error) {
+	entries, err := ReadQCOW2(base)
+	if err != nil {
+		return nil, err
+	}
+	for name, content := range files {
+		entries[strings.TrimPrefix(name, "/")] = content
+	}
+	return writeQCOW2(entries)
+}
+
+func writeQCOW2(entries map[string][]byte) ([]byte, error) {
+	tarball, err := writeTarball(entries)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, qcow2HeaderSize)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint32(header[20:], 16)
+	binary.BigEndian.PutUint64(header[24:], qcow2VirtualSize)
+	return append(header, tarball...), nil
+}
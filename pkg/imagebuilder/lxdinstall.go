@@ -0,0 +1,175 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// snapLXC is where the LXD snap installs the lxc client.
+	snapLXC = "/snap/bin/lxc"
+
+	// snapSocket and nativeSocket are the default
+	// LXD sockets of snap and native installations.
+	snapSocket   = "/var/snap/lxd/common/lxd/unix.socket"
+	nativeSocket = "/var/lib/lxd/unix.socket"
+)
+
+// lxdInstall describes how LXD is installed on the host.
+type lxdInstall struct {
+	// snap records whether the lxc client is the LXD snap's,
+	// which is confined: it cannot read or write files in the
+	// host's /tmp, or in hidden directories of $HOME.
+	snap bool
+
+	// lxc is the path of the lxc client.
+	lxc string
+
+	// socket is the path of the LXD socket the client uses.
+	socket string
+}
+
+var (
+	lxcPathOnce sync.Once
+	lxcPath     string
+)
+
+// lxcCommand returns the path of the lxc client: the one in $PATH or,
+// if there is none, the snap's, which is not always in $PATH (e.g.
+// under sudo, or in systemd units).
+func lxcCommand() string {
+	lxcPathOnce.Do(func() {
+		if path, err := exec.LookPath("lxc"); err == nil {
+			lxcPath = path
+		} else if _, err := os.Stat(snapLXC); err == nil {
+			lxcPath = snapLXC
+		} else {
+			lxcPath = "lxc"
+		}
+	})
+	return lxcPath
+}
+
+type lxdInstallKey struct{}
+
+// detectLXD returns a context carrying a description of the
+// host's LXD installation, logging it. Installations are only
+// probed if commands are run with the default Runner; other
+// Runners are treated as native installations. On clients other
+// than Linux, which talk only to remote LXD servers, there is no
+// snap or socket to probe for.
+func detectLXD(ctx context.Context) context.Context {
+	install := &lxdInstall{lxc: "lxc"}
+	if _, ok := runner(ctx).(execRunner); ok && runtime.GOOS != "linux" {
+		install.lxc = lxcCommand()
+		logf(ctx, "Using LXD client %s on %s", install.lxc, runtime.GOOS)
+	} else if ok {
+		install.lxc = lxcCommand()
+		// /snap/bin/lxc is a symlink to the snap launcher.
+		resolved, _ := filepath.EvalSymlinks(install.lxc)
+		install.snap = strings.HasPrefix(install.lxc, "/snap/") || filepath.Base(resolved) == "snap"
+
+		install.socket = nativeSocket
+		if install.snap {
+			install.socket = snapSocket
+		}
+		if dir := os.Getenv("LXD_DIR"); dir != "" {
+			install.socket = filepath.Join(dir, "unix.socket")
+		}
+		kind := "native"
+		if install.snap {
+			kind = "snap"
+		}
+		logf(ctx, "Using %s LXD client %s (socket %s)", kind, install.lxc, install.socket)
+		if _, err := os.Stat(install.socket); err != nil && os.Getenv("LXD_DIR") == "" {
+			other := snapSocket
+			if install.snap {
+				other = nativeSocket
+			}
+			if _, err := os.Stat(other); err == nil {
+				logf(ctx,
+					"Warning: %s does not exist but %s does; the %s client may be "+
+						"talking to the wrong LXD (was lxd.migrate run?)",
+					install.socket, other, kind,
+				)
+			}
+		}
+	}
+	return context.WithValue(ctx, lxdInstallKey{}, install)
+}
+
+// contextLXDInstall returns the context's LXD installation,
+// or a native installation if none was detected.
+func contextLXDInstall(ctx context.Context) *lxdInstall {
+	if install, ok := ctx.Value(lxdInstallKey{}).(*lxdInstall); ok {
+		return install
+	}
+	return &lxdInstall{lxc: "lxc"}
+}
+
+// hostTempDir returns the directory in which to create temporary
+// files and directories that lxc reads or writes. For the snap,
+// this is the snap's common directory in $HOME, which it can access;
+// otherwise it is "", the default temporary directory.
+func hostTempDir(ctx context.Context) (string, error) {
+	if !contextLXDInstall(ctx).snap {
+		return "", nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, "snap", "lxd", "common", "juju-lxd-centos")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// snapAccessible reports whether the LXD snap's lxc
+// client can access the host path.
+func snapAccessible(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(home, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	if strings.HasPrefix(rel, filepath.Join("snap", "lxd")) {
+		return true
+	}
+	// The home interface excludes hidden files and directories.
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// confinementError checks whether err, from an lxc command that reads
+// or writes the host path, can be explained by the LXD snap's
+// confinement, returning an error that says so if it can, or err
+// otherwise.
+func confinementError(ctx context.Context, err error, path string) error {
+	if err == nil || !contextLXDInstall(ctx).snap || snapAccessible(path) {
+		return err
+	}
+	return fmt.Errorf(
+		"%w (lxc is the LXD snap, whose confinement prevents it accessing %s; "+
+			"move it under your home directory, outside any hidden directory)",
+		err, path,
+	)
+}
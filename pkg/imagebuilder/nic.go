@@ -0,0 +1,111 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DefaultNICDevice is the name of the build container's network
+// device whose address is pinned by NIC, if its Device is empty.
+const DefaultNICDevice = "eth0"
+
+// NIC pins the addresses of the build container's network device,
+// for networks where firewall rules and repository ACLs permit
+// traffic by source address. The zero value pins nothing.
+type NIC struct {
+	// Device is the name of the device, which must be inherited
+	// from the container's profiles: DefaultNICDevice if empty.
+	Device string `yaml:"device,omitempty" json:"device,omitempty"`
+
+	// MAC, if non-empty, is the device's MAC address.
+	MAC string `yaml:"mac,omitempty" json:"mac,omitempty"`
+
+	// IPv4, if non-empty, is the IPv4 address to assign the device.
+	// Like IPv6, it requires a NIC on an LXD managed bridge, which
+	// assigns it by DHCP.
+	IPv4 string `yaml:"ipv4,omitempty" json:"ipv4,omitempty"`
+
+	// IPv6, if non-empty, is the IPv6 address to assign the device.
+	IPv6 string `yaml:"ipv6,omitempty" json:"ipv6,omitempty"`
+}
+
+// pinned reports whether any address is pinned.
+func (n NIC) pinned() bool {
+	return n.MAC != "" || n.IPv4 != "" || n.IPv6 != ""
+}
+
+// device returns the name of the device.
+func (n NIC) device() string {
+	if n.Device == "" {
+		return DefaultNICDevice
+	}
+	return n.Device
+}
+
+// check checks that the addresses are valid, and that the device
+// is not one of the builder's, nor one of the devices added to the
+// build container (whose addresses can be set in their config).
+func (n NIC) check(devices map[string]map[string]string) error {
+	if !n.pinned() {
+		if n.Device != "" {
+			return fmt.Errorf("NIC device %q specified without a MAC or IP address", n.Device)
+		}
+		return nil
+	}
+	name := n.device()
+	if name == offlineRepoDevice {
+		return fmt.Errorf("device name %q is reserved", name)
+	}
+	if _, ok := devices[name]; ok {
+		return fmt.Errorf("NIC %q is added as a device; set its addresses in its device config", name)
+	}
+	if n.MAC != "" {
+		if _, err := net.ParseMAC(n.MAC); err != nil {
+			return fmt.Errorf("invalid NIC MAC address %q", n.MAC)
+		}
+	}
+	if n.IPv4 != "" {
+		if ip := net.ParseIP(n.IPv4); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid NIC IPv4 address %q", n.IPv4)
+		}
+	}
+	if n.IPv6 != "" {
+		if ip := net.ParseIP(n.IPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid NIC IPv6 address %q", n.IPv6)
+		}
+	}
+	return nil
+}
+
+// config returns the device config that pins the addresses.
+func (n NIC) config() map[string]string {
+	config := make(map[string]string)
+	if n.MAC != "" {
+		config["hwaddr"] = n.MAC
+	}
+	if n.IPv4 != "" {
+		config["ipv4.address"] = n.IPv4
+	}
+	if n.IPv6 != "" {
+		config["ipv6.address"] = n.IPv6
+	}
+	return config
+}
+
+// pinNIC overrides the config of the container's profile NIC to pin
+// its addresses. The container must be stopped, so that the device
+// comes up with them.
+func pinNIC(ctx context.Context, container string, n NIC) error {
+	name := n.device()
+	config := n.config()
+	logf(ctx, "Pinning the addresses of build container device %s", name)
+	args := []string{"config", "device", "override", container, name}
+	for _, key := range sortedKeys(config) {
+		args = append(args, key+"="+config[key])
+	}
+	if err := lxc(ctx, args...); err != nil {
+		return fmt.Errorf("pinning the addresses of device %s: %w", name, err)
+	}
+	return nil
+}
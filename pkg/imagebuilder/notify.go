@@ -0,0 +1,353 @@
+package imagebuilder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification types, for Notification.Type.
+const (
+	NotifySMTP   = "smtp"
+	NotifySlack  = "slack"
+	NotifyMatrix = "matrix"
+)
+
+// When to notify, for Notification.On.
+const (
+	NotifyAlways  = "always"
+	NotifyFailure = "failure"
+)
+
+// notifyTimeout bounds the time taken to send each notification.
+const notifyTimeout = 30 * time.Second
+
+// Notification describes where to send a summary of the build when it
+// finishes: its outcome, alias, serial and fingerprint, and the paths
+// of its logs and diagnostics bundle. Notifications that cannot be
+// sent are logged, and do not fail the build.
+//
+// Password, Webhook and AccessToken may be given as "file:PATH" or
+// "env:NAME", to read them from a file or the environment rather
+// than the configuration file. They are masked in logs and events.
+type Notification struct {
+	// Type is NotifySMTP, NotifySlack or NotifyMatrix.
+	Type string `yaml:"type" json:"type"`
+
+	// On is when to notify: NotifyAlways (the default, if empty),
+	// or NotifyFailure to notify only if the build fails or is
+	// cancelled.
+	On string `yaml:"on,omitempty" json:"on,omitempty"`
+
+	// Server is the SMTP server's host:port, From the sender and To
+	// the recipients of the email. Username and Password, if
+	// specified, authenticate to the server with PLAIN
+	// authentication, which requires TLS (STARTTLS) unless the
+	// server is on localhost.
+	Server   string   `yaml:"server,omitempty" json:"server,omitempty"`
+	From     string   `yaml:"from,omitempty" json:"from,omitempty"`
+	To       []string `yaml:"to,omitempty" json:"to,omitempty"`
+	Username string   `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string   `yaml:"password,omitempty" json:"password,omitempty"`
+
+	// Webhook is the URL of the Slack incoming webhook to post to.
+	Webhook string `yaml:"webhook,omitempty" json:"webhook,omitempty"`
+
+	// Homeserver is the URL of the Matrix homeserver, Room the ID
+	// of the room to send to (e.g. "!abc:example.org"), which the
+	// user must have joined, and AccessToken the user's token.
+	Homeserver  string `yaml:"homeserver,omitempty" json:"homeserver,omitempty"`
+	Room        string `yaml:"room,omitempty" json:"room,omitempty"`
+	AccessToken string `yaml:"access-token,omitempty" json:"access-token,omitempty"`
+}
+
+// notifier sends build summaries to a notification sink.
+type notifier interface {
+	notify(ctx context.Context, subject, body string) error
+}
+
+// newNotifier returns the notifier for the notification, having
+// read its secrets, which are also returned so that they can be
+// masked.
+func newNotifier(n Notification) (notifier, []string, error) {
+	switch n.On {
+	case "", NotifyAlways, NotifyFailure:
+	default:
+		return nil, nil, fmt.Errorf("invalid %s notification condition %q (expected %s or %s)", n.Type, n.On, NotifyAlways, NotifyFailure)
+	}
+	switch n.Type {
+	case NotifySMTP:
+		if n.Server == "" || n.From == "" || len(n.To) == 0 {
+			return nil, nil, fmt.Errorf("smtp notification requires a server, sender and recipients")
+		}
+		if _, _, err := net.SplitHostPort(n.Server); err != nil {
+			return nil, nil, fmt.Errorf("invalid smtp notification server: %v", err)
+		}
+		password, err := notificationSecret(n.Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading smtp notification password: %v", err)
+		}
+		if n.Username != "" && password == "" {
+			return nil, nil, fmt.Errorf("smtp notification username specified without a password")
+		}
+		return smtpNotifier{n: n, password: password}, compactSecrets(password), nil
+	case NotifySlack:
+		webhook, err := notificationSecret(n.Webhook)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading slack notification webhook: %v", err)
+		}
+		if err := checkNotifyURL(webhook); err != nil {
+			return nil, nil, fmt.Errorf("invalid slack notification webhook: %v", err)
+		}
+		return slackNotifier{webhook: webhook}, compactSecrets(webhook), nil
+	case NotifyMatrix:
+		if n.Room == "" {
+			return nil, nil, fmt.Errorf("matrix notification requires a room")
+		}
+		if err := checkNotifyURL(n.Homeserver); err != nil {
+			return nil, nil, fmt.Errorf("invalid matrix notification homeserver: %v", err)
+		}
+		token, err := notificationSecret(n.AccessToken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading matrix notification access token: %v", err)
+		}
+		if token == "" {
+			return nil, nil, fmt.Errorf("matrix notification requires an access token")
+		}
+		return matrixNotifier{n: n, token: token}, compactSecrets(token), nil
+	}
+	return nil, nil, fmt.Errorf(
+		"invalid notification type %q (expected %s, %s or %s)",
+		n.Type, NotifySMTP, NotifySlack, NotifyMatrix,
+	)
+}
+
+// notificationSecret returns the value of a secret field of a
+// Notification, reading it from a file ("file:PATH") or the
+// environment ("env:NAME") if so specified.
+func notificationSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(s, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(s, "env:"):
+		name := strings.TrimPrefix(s, "env:")
+		value := os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("$%s is not set", name)
+		}
+		return value, nil
+	}
+	return s, nil
+}
+
+// compactSecrets returns the non-empty secrets.
+func compactSecrets(secrets ...string) []string {
+	var values []string
+	for _, s := range secrets {
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// checkNotifyURL checks that s is an absolute HTTP(S) URL.
+func checkNotifyURL(s string) error {
+	if s == "" {
+		return fmt.Errorf("no URL specified")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// The error would include the URL, which may be secret.
+		return fmt.Errorf("malformed URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	return nil
+}
+
+// buildSummary returns the subject and body of the notification of
+// the build described by rec, run on the named host, whose logs and
+// diagnostics bundle have the given paths.
+func buildSummary(host string, rec HistoryRecord, result *Result, paths []string) (string, string) {
+	subject := fmt.Sprintf("%s build %s %s", BuilderName, rec.Alias, rec.Status)
+	if rec.Serial != "" {
+		subject = fmt.Sprintf("%s build %s (%s) %s", BuilderName, rec.Alias, rec.Serial, rec.Status)
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", subject)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&body, "%s: %s\n", name, value)
+		}
+	}
+	field("Alias", rec.Alias)
+	field("Serial", rec.Serial)
+	field("Fingerprint", rec.Fingerprint)
+	field("Remote", rec.Remote)
+	field("Host", host)
+	field("Started", rec.Started.UTC().Format(time.RFC3339))
+	field("Duration", rec.Duration.Round(time.Second).String())
+	field("Error", rec.Error)
+	if result != nil && result.Changelog != nil && result.Changelog.Packages != nil {
+		p := result.Changelog.Packages
+		field("Packages", fmt.Sprintf(
+			"%d added, %d removed, %d upgraded, %d downgraded since %s",
+			len(p.Added), len(p.Removed), len(p.Upgraded), len(p.Downgraded),
+			result.Changelog.PreviousSerial,
+		))
+	}
+	for _, path := range paths {
+		field("Log", path)
+	}
+	return subject, body.String()
+}
+
+// notificationPaths returns the paths of the logs and diagnostics
+// bundle of the build, to refer to in notifications, from its result
+// and the artifacts it produced.
+func notificationPaths(result *Result, artifacts []string) []string {
+	var paths []string
+	if result != nil {
+		paths = append(paths, result.Logs...)
+		paths = append(paths, result.TestLogs...)
+	}
+	for _, artifact := range artifacts {
+		if strings.Contains(artifact, diagnosticsPrefix) {
+			paths = append(paths, artifact)
+		}
+	}
+	return paths
+}
+
+// smtpNotifier sends notifications by email.
+type smtpNotifier struct {
+	n        Notification
+	password string
+}
+
+func (s smtpNotifier) notify(ctx context.Context, subject, body string) error {
+	host, _, _ := net.SplitHostPort(s.n.Server)
+	var auth smtp.Auth
+	if s.n.Username != "" {
+		auth = smtp.PlainAuth("", s.n.Username, s.password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	// smtp.SendMail cannot be cancelled, so it is abandoned
+	// if it does not complete in time.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.n.Server, auth, s.n.From, s.n.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook.
+type slackNotifier struct {
+	webhook string
+}
+
+func (s slackNotifier) notify(ctx context.Context, subject, body string) error {
+	return postNotification(ctx, "POST", s.webhook, nil, map[string]string{
+		"text": "*" + subject + "*\n```\n" + body + "```",
+	})
+}
+
+// matrixNotifier sends notifications to a Matrix room.
+type matrixNotifier struct {
+	n     Notification
+	token string
+}
+
+func (m matrixNotifier) notify(ctx context.Context, subject, body string) error {
+	// Each message is sent with a new transaction ID,
+	// which the homeserver uses to deduplicate retries.
+	txn := strconv.FormatInt(time.Now().UnixNano(), 10)
+	endpoint := strings.TrimRight(m.n.Homeserver, "/") +
+		"/_matrix/client/v3/rooms/" + url.PathEscape(m.n.Room) +
+		"/send/m.room.message/" + txn
+	return postNotification(ctx, "PUT", endpoint, map[string]string{
+		"Authorization": "Bearer " + m.token,
+	}, map[string]string{
+		"msgtype": "m.text",
+		"body":    body,
+	})
+}
+
+// postNotification sends the JSON-encoded message to the URL,
+// returning an error if the response is not successful.
+func postNotification(ctx context.Context, method, rawurl string, header map[string]string, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sendNotifications sends the summary of the build to each of the
+// notifiers whose condition it meets, logging any that fail.
+func sendNotifications(
+	ctx context.Context, notifications []Notification, notifiers []notifier,
+	r *redactor, rec HistoryRecord, result *Result, artifacts []string,
+) {
+	host, _ := os.Hostname()
+	subject, body := buildSummary(host, rec, result, notificationPaths(result, artifacts))
+	subject, body = r.redact(subject), r.redact(body)
+	for i, n := range notifiers {
+		if notifications[i].On == NotifyFailure && rec.Status != HistoryFailed && rec.Status != HistoryCancelled {
+			continue
+		}
+		notifyCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := n.notify(notifyCtx, subject, body)
+		cancel()
+		if err != nil {
+			logf(ctx, "Sending %s notification: %v", notifications[i].Type, err)
+		}
+	}
+}
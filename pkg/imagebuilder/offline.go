@@ -0,0 +1,149 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// offlineRepoDevice is the name of the disk device through
+	// which Options.LocalRepo is mounted in the build container.
+	offlineRepoDevice = "juju-lxd-centos-repo"
+
+	// offlineRepoPath is where Options.LocalRepo is mounted.
+	offlineRepoPath = "/srv/juju-lxd-centos-repo"
+
+	// offlineReposBackup is where the base image's yum repository
+	// configuration is kept during an offline build.
+	offlineReposBackup = "/etc/yum.repos.d.juju-lxd-centos"
+)
+
+// checkOffline checks that the options do not require access to the
+// internet, returning an error wrapping ErrNeedsNetwork if they do.
+func checkOffline(opts Options) error {
+	if opts.LocalRepo == "" && len(opts.RepoFiles) == 0 {
+		return fmt.Errorf("offline builds require a local repository or repo files")
+	}
+	for _, image := range append([]string{opts.Image}, opts.ImageFallbacks...) {
+		if remote, _ := splitImage(image); remote == "images" && opts.ImageServer == "" {
+			return fmt.Errorf(
+				"%w: base image %q is on the public images: remote; "+
+					"specify an image in the local image store, or an image server",
+				ErrNeedsNetwork, image,
+			)
+		}
+	}
+	if opts.Cosign || opts.CosignKey != "" {
+		return fmt.Errorf("%w: cosign signing uses the Sigstore transparency log", ErrNeedsNetwork)
+	}
+	if opts.JujuTest && opts.JujuModel == "" {
+		return fmt.Errorf("%w: bootstrapping a temporary controller downloads Juju agents", ErrNeedsNetwork)
+	}
+	return nil
+}
+
+// checkNoHostNetwork checks that the options do not require the host
+// to access the internet, returning an error wrapping ErrNeedsNetwork
+// if they do. LXD servers copy images between themselves, so pushing
+// images to other remotes is allowed.
+func checkNoHostNetwork(opts Options) error {
+	if opts.BaseKeyring != "" {
+		return fmt.Errorf("%w: verifying the base image fetches its simplestreams metadata on the host", ErrNeedsNetwork)
+	}
+	if opts.Upload != "" {
+		return fmt.Errorf("%w: uploading to S3 is done from the host", ErrNeedsNetwork)
+	}
+	if opts.Cosign || opts.CosignKey != "" {
+		return fmt.Errorf("%w: cosign signing uses the Sigstore transparency log", ErrNeedsNetwork)
+	}
+	if opts.JujuTest && opts.JujuModel == "" {
+		return fmt.Errorf("%w: bootstrapping a temporary controller downloads Juju agents", ErrNeedsNetwork)
+	}
+	return nil
+}
+
+// offlineRepo is a Provisioner that replaces the build container's
+// yum repositories with the local repositories of an offline build.
+// The original repositories are restored by the provisioner
+// returned by restore.
+type offlineRepo struct {
+	// dir is the host directory holding a yum repository
+	// to mount into the container, if any.
+	dir string
+
+	// repoFiles holds the paths of yum .repo files
+	// on the host to install in the container.
+	repoFiles []string
+}
+
+// Run is part of the Provisioner interface.
+func (r offlineRepo) Run(ctx context.Context, container string) error {
+	logf(ctx, "Replacing yum repositories for an offline build")
+	if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c", fmt.Sprintf(
+		"mv /etc/yum.repos.d %s && mkdir /etc/yum.repos.d", offlineReposBackup,
+	)); err != nil {
+		return err
+	}
+	if r.dir != "" {
+		dir, err := filepath.Abs(r.dir)
+		if err != nil {
+			return err
+		}
+		if err := lxc(ctx,
+			"config", "device", "add", container, offlineRepoDevice, "disk",
+			"source="+dir, "path="+offlineRepoPath, "readonly=true",
+		); err != nil {
+			return err
+		}
+		if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c", fmt.Sprintf(
+			"printf '[juju-lxd-centos-local]\\nname=Local repository\\nbaseurl=file://%s\\ngpgcheck=0\\n' "+
+				"> /etc/yum.repos.d/juju-lxd-centos-local.repo",
+			offlineRepoPath,
+		)); err != nil {
+			return err
+		}
+	}
+	for _, file := range r.repoFiles {
+		push := FileProvisioner{
+			Source:      file,
+			Destination: path.Join("/etc/yum.repos.d", filepath.Base(file)),
+			Mode:        0644,
+		}
+		if err := push.Run(ctx, container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore returns a Provisioner that restores the build container's
+// original yum repositories, and unmounts the local repository.
+func (r offlineRepo) restore() Provisioner {
+	return restoreRepos{mounted: r.dir != ""}
+}
+
+// restoreRepos is a Provisioner that undoes offlineRepo.
+type restoreRepos struct {
+	// mounted records whether a local repository was mounted.
+	mounted bool
+}
+
+// Run is part of the Provisioner interface.
+func (r restoreRepos) Run(ctx context.Context, container string) error {
+	if err := lxc(ctx, "exec", container, "--", "/bin/sh", "-c", fmt.Sprintf(
+		"rm -rf /etc/yum.repos.d && mv %s /etc/yum.repos.d", offlineReposBackup,
+	)); err != nil {
+		return err
+	}
+	if !r.mounted {
+		return nil
+	}
+	if err := lxc(ctx, "config", "device", "remove", container, offlineRepoDevice); err != nil {
+		return err
+	}
+	return lxc(ctx, "exec", container, "--", "/bin/sh", "-c", fmt.Sprintf(
+		"[ ! -d %[1]s ] || rmdir %[1]s", offlineRepoPath,
+	))
+}
@@ -0,0 +1,76 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Standard LXD image properties, which the builder sets from the
+// build container's /etc/os-release.
+const (
+	// PropertyOS is the distribution's ID, e.g. "centos".
+	PropertyOS = "os"
+
+	// PropertyRelease is the distribution's VERSION_ID, e.g. "7".
+	PropertyRelease = "release"
+)
+
+// OSRelease describes the distribution of the base image, as
+// read from /etc/os-release in the build container.
+type OSRelease struct {
+	// ID is the distribution's ID, e.g. "centos" or "rocky".
+	ID string `json:"id"`
+
+	// IDLike holds the IDs of the distributions it derives
+	// from, e.g. "rhel" and "fedora".
+	IDLike []string `json:"id-like,omitempty"`
+
+	// VersionID is the distribution's VERSION_ID, e.g. "7".
+	VersionID string `json:"version-id"`
+
+	// Arch is the container's architecture, e.g. "x86_64".
+	Arch string `json:"arch"`
+}
+
+// newOSRelease returns the OSRelease described by the facts.
+func newOSRelease(facts *targetFacts) *OSRelease {
+	info := &OSRelease{VersionID: facts.release, Arch: facts.arch}
+	if len(facts.distros) > 0 {
+		info.ID = facts.distros[0]
+		info.IDLike = facts.distros[1:]
+	}
+	return info
+}
+
+// aliasSeriesPattern matches the Juju series in image aliases, which
+// name the distribution by its ID followed by its major release,
+// e.g. "centos7".
+var aliasSeriesPattern = regexp.MustCompile(`^([a-z]+)([0-9]+)$`)
+
+// checkAliasOS checks that the distribution and architecture of the
+// base image match those implied by an alias of the form
+// "juju/<series>/<arch>[/<variant>]", returning an error wrapping
+// ErrOSMismatch if they do not. Aliases of other forms imply nothing.
+func checkAliasOS(alias string, info *OSRelease) error {
+	series, err := aliasSeries(alias)
+	if err != nil {
+		return nil
+	}
+	m := aliasSeriesPattern.FindStringSubmatch(series)
+	if m == nil {
+		return nil
+	}
+	arch := strings.Split(alias, "/")[2]
+	if kernelArch, ok := archAliases[arch]; ok {
+		arch = kernelArch
+	}
+	id, release := m[1], m[2]
+	if info.ID != id || info.VersionID != release && !strings.HasPrefix(info.VersionID, release+".") || info.Arch != arch {
+		return fmt.Errorf(
+			"%w: the base image is %s %s (%s), but alias %q is for %s %s (%s)",
+			ErrOSMismatch, info.ID, info.VersionID, info.Arch, alias, id, release, arch,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// packageLockTimeout is how long to wait for other package
+	// managers in the build container to finish, e.g. a first-boot
+	// "dnf makecache" started by the base image.
+	packageLockTimeout = 10 * time.Minute
+
+	// packageLockPoll is how often to check whether they have.
+	packageLockPoll = 5 * time.Second
+
+	// packageLockRetries is the number of times to retry a package
+	// step that fails because the package database is locked.
+	packageLockRetries = 3
+)
+
+// packageLockErrors holds messages that yum, dnf and rpm
+// report when the package database is locked.
+var packageLockErrors = []string{
+	"can't create transaction lock",
+	"holding the yum lock",
+	"Waiting for process with pid",
+	"Failed to obtain the transaction lock",
+	"rpmdb open failed",
+	"Lock table is out of available locker entries",
+}
+
+// packageManagersScript lists the package manager processes running
+// in the container, as "name pid" lines. It reads /proc directly, as
+// minimal images may not have pgrep.
+const packageManagersScript = `for p in /proc/[0-9]*; do
+	comm=$(cat "$p/comm" 2>/dev/null) || continue
+	case "$comm" in
+	yum|dnf|dnf-automatic|rpm|packagekitd) echo "$comm ${p#/proc/}" ;;
+	esac
+done`
+
+// packageLockProvisioner is a Provisioner that runs a step that
+// installs packages once no other package manager is running in the
+// build container, and retries it if it fails because the package
+// database is locked, rather than failing with a confusing
+// transaction error.
+type packageLockProvisioner struct {
+	Provisioner
+}
+
+// Run is part of the Provisioner interface.
+func (p packageLockProvisioner) Run(ctx context.Context, container string) error {
+	for attempt := 0; ; attempt++ {
+		if err := waitPackageManagers(ctx, container); err != nil {
+			return err
+		}
+		err := p.Provisioner.Run(ctx, container)
+		if err == nil || !isPackageLockError(err) || attempt == packageLockRetries {
+			return err
+		}
+		logf(ctx, "Package database is locked; retrying (%d/%d)", attempt+1, packageLockRetries)
+		if err := sleep(ctx, packageLockPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// waitPackageManagers waits for package managers running
+// in the container to exit.
+func waitPackageManagers(ctx context.Context, container string) error {
+	deadline := time.Now().Add(packageLockTimeout)
+	var logged string
+	for {
+		out, err := runOutput(ctx, "lxc", "exec", container, "--", "/bin/sh", "-c", packageManagersScript)
+		if err != nil {
+			return fmt.Errorf("checking for running package managers: %w", err)
+		}
+		running := strings.TrimSpace(string(out))
+		if running == "" {
+			return nil
+		}
+		running = strings.Replace(running, "\n", ", ", -1)
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"timed out after %v waiting for package managers in the build container to exit: %s",
+				packageLockTimeout, running,
+			)
+		}
+		if running != logged {
+			logf(ctx, "Waiting for package managers in the build container to exit: %s", running)
+			logged = running
+		}
+		if err := sleep(ctx, packageLockPoll); err != nil {
+			return err
+		}
+	}
+}
+
+// isPackageLockError reports whether err, from a step that
+// installs packages, was caused by a locked package database.
+func isPackageLockError(err error) bool {
+	output := commandOutput(err)
+	for _, msg := range packageLockErrors {
+		if strings.Contains(output, msg) {
+			return true
+		}
+	}
+	return false
+}
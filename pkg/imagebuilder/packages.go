@@ -0,0 +1,244 @@
+package imagebuilder
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// PropertyPackages records the packages installed in an image, as
+// space-separated name=epoch:version-release.arch entries, so that
+// later builds of the alias can report what changed.
+const PropertyPackages = "user.build.packages"
+
+// Previous describes the image an alias referred to
+// before a build moved it to the new image.
+type Previous struct {
+	// Fingerprint is the fingerprint of the previous image.
+	Fingerprint string `json:"fingerprint"`
+
+	// Serial is the build serial of the previous image.
+	Serial string `json:"serial,omitempty"`
+
+	// Packages holds the packages that changed since the previous
+	// image, or is nil if the previous image does not record its
+	// packages (it was built by an older version of the builder).
+	Packages *PackageChanges `json:"packages,omitempty"`
+
+	// properties holds the properties of the previous image.
+	properties map[string]string
+}
+
+// PackageChanges holds the packages that differ between two
+// images. Packages are identified by name and architecture, and
+// versions are given as epoch:version-release.
+type PackageChanges struct {
+	Added      []PackageVersion `json:"added,omitempty"`
+	Removed    []PackageVersion `json:"removed,omitempty"`
+	Upgraded   []PackageChange  `json:"upgraded,omitempty"`
+	Downgraded []PackageChange  `json:"downgraded,omitempty"`
+}
+
+// PackageVersion is a package installed in an image.
+type PackageVersion struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// PackageChange is a package whose version changed.
+type PackageChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// containerPackages returns the packages installed in the
+// container, as the value of the PropertyPackages property.
+func containerPackages(ctx context.Context, container string) (string, error) {
+	out, err := runOutput(
+		ctx, "lxc", "exec", container, "--",
+		"rpm", "-qa", "--queryformat", packageQueryFormat,
+	)
+	if err != nil {
+		return "", err
+	}
+	var entries []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 2 {
+			// Packages without an epoch have "(none)", which
+			// rpm treats as 0.
+			version := strings.Replace(fields[1], "(none):", "0:", 1)
+			entries = append(entries, fields[0]+"="+version)
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " "), nil
+}
+
+// parsePackages parses the value of the PropertyPackages property,
+// returning the versions of the packages keyed by name.arch. Packages
+// with several versions installed (e.g. kernel) have them joined
+// with commas, oldest first.
+func parsePackages(s string) map[string]string {
+	versions := make(map[string][]string)
+	for _, entry := range strings.Fields(s) {
+		i := strings.IndexByte(entry, '=')
+		j := strings.LastIndexByte(entry, '.')
+		if i < 0 || j < i {
+			continue
+		}
+		name := entry[:i] + entry[j:]
+		versions[name] = append(versions[name], entry[i+1:j])
+	}
+	packages := make(map[string]string)
+	for name, v := range versions {
+		sort.Slice(v, func(i, j int) bool {
+			return rpmVersionCompare(v[i], v[j]) < 0
+		})
+		packages[name] = strings.Join(v, ",")
+	}
+	return packages
+}
+
+// diffPackages returns the changes between two values
+// of the PropertyPackages property.
+func diffPackages(from, to string) *PackageChanges {
+	old, current := parsePackages(from), parsePackages(to)
+	changes := &PackageChanges{}
+	for _, name := range sortedKeys(current) {
+		oldVersion, ok := old[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, PackageVersion{name, current[name]})
+		case current[name] == oldVersion:
+		case rpmVersionCompare(current[name], oldVersion) >= 0:
+			changes.Upgraded = append(changes.Upgraded, PackageChange{name, oldVersion, current[name]})
+		case rpmVersionCompare(current[name], oldVersion) < 0:
+			changes.Downgraded = append(changes.Downgraded, PackageChange{name, oldVersion, current[name]})
+		}
+	}
+	for _, name := range sortedKeys(old) {
+		if _, ok := current[name]; !ok {
+			changes.Removed = append(changes.Removed, PackageVersion{name, old[name]})
+		}
+	}
+	return changes
+}
+
+// rpmVersionCompare compares two package versions as rpm does,
+// returning -1, 0 or 1. The epoch is compared numerically, then
+// the version and release segment by segment: numeric segments
+// compare numerically and sort after alphabetic ones, and "~"
+// sorts before anything, even the end of the version. Packages
+// with several versions compare by their newest.
+func rpmVersionCompare(a, b string) int {
+	a = a[strings.LastIndexByte(a, ',')+1:]
+	b = b[strings.LastIndexByte(b, ',')+1:]
+	for a != "" || b != "" {
+		a = strings.TrimLeftFunc(a, rpmSeparator)
+		b = strings.TrimLeftFunc(b, rpmSeparator)
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			} else if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+		var x, y string
+		numeric := unicode.IsDigit(rune(a[0]))
+		x, a = rpmSegment(a, numeric)
+		y, b = rpmSegment(b, numeric)
+		if y == "" {
+			// Numeric segments are newer than alphabetic ones.
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			x = strings.TrimLeft(x, "0")
+			y = strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return compareInts(len(x), len(y))
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// rpmSeparator reports whether r separates the segments of a
+// version. The epoch and release separators are treated as any
+// other, which orders versions correctly as long as both have an
+// epoch, as those recorded by containerPackages do.
+func rpmSeparator(r rune) bool {
+	return r != '~' && !unicode.IsDigit(r) && !unicode.IsLetter(r)
+}
+
+// rpmSegment splits the leading numeric or alphabetic segment from s.
+func rpmSegment(s string, numeric bool) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		if numeric {
+			return !unicode.IsDigit(r)
+		}
+		return !unicode.IsLetter(r)
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// previousImage returns the image built by this package that the
+// alias refers to in the remote, which the build is to replace, or
+// nil if there is none. The image's packages are compared with those
+// of the new image, given as the value of the PropertyPackages
+// property.
+func previousImage(ctx context.Context, remote, alias, packages string) (*Previous, error) {
+	image, err := findBuiltImage(ctx, remote, alias)
+	if err != nil || image == nil {
+		return nil, err
+	}
+	previous := &Previous{
+		Fingerprint: image.Fingerprint,
+		Serial:      image.Properties[PropertySerial],
+		properties:  image.Properties,
+	}
+	oldPackages, ok := image.Properties[PropertyPackages]
+	if !ok || packages == "" {
+		logf(ctx, "Replacing serial %s of %s, which does not record its packages", previous.Serial, alias)
+		return previous, nil
+	}
+	previous.Packages = diffPackages(oldPackages, packages)
+	logf(ctx,
+		"Replacing serial %s of %s: %d packages added, %d removed, %d upgraded, %d downgraded",
+		previous.Serial, alias,
+		len(previous.Packages.Added), len(previous.Packages.Removed),
+		len(previous.Packages.Upgraded), len(previous.Packages.Downgraded),
+	)
+	return previous, nil
+}
@@ -0,0 +1,143 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ParallelStep is a named step of a ParallelProvisioner.
+type ParallelStep struct {
+	// Name identifies the step, for DependsOn and logging.
+	Name string
+
+	// DependsOn holds the names of the steps in the same
+	// ParallelProvisioner that must finish before this
+	// step starts.
+	DependsOn []string
+
+	Provisioner Provisioner
+}
+
+// ParallelProvisioner is a Provisioner that runs its steps
+// concurrently, with each step starting once the steps it depends on
+// have finished. If a step fails, the steps that have not started are
+// abandoned, and the error is returned once running steps finish.
+//
+// The steps run in the same container, so steps that install packages
+// contend for the yum lock and are effectively run one at a time;
+// parallelism helps most with downloads and builds.
+type ParallelProvisioner struct {
+	Steps []ParallelStep
+
+	// Limit, if positive, is the maximum number
+	// of steps to run at the same time.
+	Limit int
+}
+
+// validate checks that the step names are unique, and that the
+// dependencies exist and do not form a cycle.
+func (p ParallelProvisioner) validate() error {
+	index := make(map[string]int)
+	for i, s := range p.Steps {
+		if s.Name == "" {
+			return fmt.Errorf("parallel step %d has no name", i)
+		}
+		if _, ok := index[s.Name]; ok {
+			return fmt.Errorf("duplicate parallel step name %q", s.Name)
+		}
+		index[s.Name] = i
+	}
+	// 0: unvisited, 1: visiting, 2: done.
+	state := make([]int, len(p.Steps))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case 1:
+			return fmt.Errorf("parallel step %q is in a dependency cycle", p.Steps[i].Name)
+		case 2:
+			return nil
+		}
+		state[i] = 1
+		for _, dep := range p.Steps[i].DependsOn {
+			j, ok := index[dep]
+			if !ok {
+				return fmt.Errorf("parallel step %q depends on unknown step %q", p.Steps[i].Name, dep)
+			}
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = 2
+		return nil
+	}
+	for i := range p.Steps {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run is part of the Provisioner interface.
+func (p ParallelProvisioner) Run(ctx context.Context, container string) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(map[string]chan struct{})
+	for _, s := range p.Steps {
+		done[s.Name] = make(chan struct{})
+	}
+	var limit chan struct{}
+	if p.Limit > 0 {
+		limit = make(chan struct{}, p.Limit)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, s := range p.Steps {
+		wg.Add(1)
+		go func(s ParallelStep) {
+			defer wg.Done()
+			// Closing the channel even if the step fails or is
+			// abandoned unblocks dependent steps, which then see
+			// that the context is cancelled.
+			defer close(done[s.Name])
+			for _, dep := range s.DependsOn {
+				<-done[dep]
+			}
+			if limit != nil {
+				select {
+				case limit <- struct{}{}:
+					defer func() { <-limit }()
+				case <-ctx.Done():
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logf(ctx, "Starting parallel step %s", s.Name)
+			if err := s.Provisioner.Run(ctx, container); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("parallel step %s: %w", s.Name, err)
+				}
+				mu.Unlock()
+				cancel()
+				return
+			}
+			logf(ctx, "Finished parallel step %s", s.Name)
+		}(s)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		// Steps are abandoned without error
+		// if the build is cancelled.
+		return parent.Err()
+	}
+	return firstErr
+}
@@ -0,0 +1,177 @@
+package imagebuilder_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// parallelStep returns a ParallelStep named name that runs
+// "echo parallel-step-<name>", after the steps it depends on.
+func parallelStep(name string, dependsOn ...string) imagebuilder.ParallelStep {
+	return imagebuilder.ParallelStep{
+		Name:        name,
+		DependsOn:   dependsOn,
+		Provisioner: imagebuilder.ShellProvisioner{Commands: []string{"echo parallel-step-" + name}},
+	}
+}
+
+// stepName returns the name of the parallel step that
+// runs the command, or "" if it is not one.
+func stepName(argv []string) string {
+	if len(argv) == 0 {
+		return ""
+	}
+	command := argv[len(argv)-1]
+	if !strings.HasPrefix(command, "echo parallel-step-") {
+		return ""
+	}
+	return strings.TrimPrefix(command, "echo parallel-step-")
+}
+
+func TestBuildParallelSteps(t *testing.T) {
+	fake := newFake(t)
+	// a and b only finish once both have started,
+	// so the build fails unless they run concurrently.
+	var mu sync.Mutex
+	var order []string
+	started := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+		name := stepName(argv)
+		if name == "" {
+			return nil
+		}
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+		if ch, ok := started[name]; ok {
+			close(ch)
+			for _, ch := range started {
+				select {
+				case <-ch:
+				case <-time.After(10 * time.Second):
+					return errors.New("steps a and b did not run concurrently")
+				}
+			}
+		}
+		return nil
+	}
+	if _, err := build(t, imagebuilder.Options{
+		Runner: fake,
+		Provisioners: []imagebuilder.Provisioner{imagebuilder.ParallelProvisioner{
+			Steps: []imagebuilder.ParallelStep{
+				parallelStep("c", "a", "b"),
+				parallelStep("a"),
+				parallelStep("b"),
+			},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 3 || order[2] != "c" {
+		t.Errorf("got steps run in order %v, expected c after a and b", order)
+	}
+}
+
+func TestBuildParallelStepsLimit(t *testing.T) {
+	fake := newFake(t)
+	var mu sync.Mutex
+	var running, most int
+	fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+		if stepName(argv) == "" {
+			return nil
+		}
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+	if _, err := build(t, imagebuilder.Options{
+		Runner: fake,
+		Provisioners: []imagebuilder.Provisioner{imagebuilder.ParallelProvisioner{
+			Steps: []imagebuilder.ParallelStep{parallelStep("a"), parallelStep("b"), parallelStep("c")},
+			Limit: 1,
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if most != 1 {
+		t.Errorf("got %d steps running at once, expected 1", most)
+	}
+}
+
+func TestBuildParallelStepsFailure(t *testing.T) {
+	fake := newFake(t)
+	var mu sync.Mutex
+	ran := make(map[string]bool)
+	fake.ExecHook = func(container string, argv []string, cmd *imagebuilder.Command) error {
+		name := stepName(argv)
+		mu.Lock()
+		ran[name] = true
+		mu.Unlock()
+		if name == "a" {
+			return errors.New("a failed")
+		}
+		return nil
+	}
+	_, err := build(t, imagebuilder.Options{
+		Runner: fake,
+		Provisioners: []imagebuilder.Provisioner{imagebuilder.ParallelProvisioner{
+			Steps: []imagebuilder.ParallelStep{parallelStep("a"), parallelStep("b", "a")},
+		}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "parallel step a") {
+		t.Fatalf("got error %v, expected step a to fail the build", err)
+	}
+	if ran["b"] {
+		t.Errorf("step depending on a failed step was run")
+	}
+	if image := fake.Image(imagebuilder.DefaultAlias); image != nil {
+		t.Errorf("image published by failed build")
+	}
+}
+
+func TestBuildParallelStepsInvalid(t *testing.T) {
+	for _, test := range []struct {
+		steps  []imagebuilder.ParallelStep
+		expect string
+	}{{
+		steps:  []imagebuilder.ParallelStep{parallelStep("a", "b"), parallelStep("b", "a")},
+		expect: "dependency cycle",
+	}, {
+		steps:  []imagebuilder.ParallelStep{parallelStep("a", "z")},
+		expect: `unknown step "z"`,
+	}, {
+		steps:  []imagebuilder.ParallelStep{parallelStep("a"), parallelStep("a")},
+		expect: `duplicate parallel step name "a"`,
+	}} {
+		fake := newFake(t)
+		b, err := imagebuilder.New(imagebuilder.Options{
+			Runner:       fake,
+			Provisioners: []imagebuilder.Provisioner{imagebuilder.ParallelProvisioner{Steps: test.steps}},
+		})
+		if err == nil {
+			_, err = b.Build(context.Background())
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("got error %v, expected %q", err, test.expect)
+		}
+		for _, c := range fake.Commands() {
+			if name := stepName(c); name != "" {
+				t.Errorf("step %s of invalid steps was run", name)
+			}
+		}
+	}
+}
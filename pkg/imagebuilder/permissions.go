@@ -0,0 +1,157 @@
+package imagebuilder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// checkPermissions checks, before anything is built, that the user
+// has the permissions a build needs, returning an error that says
+// which is missing if not. Builds need no root privileges: only
+// access to the local LXD's socket, if building on it, which members
+// of the lxd group have, and write access to the directories the
+// build writes to.
+func checkPermissions(ctx context.Context, opts Options) error {
+	if os.Geteuid() == 0 && os.Getenv("SUDO_USER") != "" {
+		logf(ctx,
+			"Warning: running as root under sudo, which is not needed: members of "+
+				"the lxd group can build, and files written will be owned by root",
+		)
+	}
+	install := contextLXDInstall(ctx)
+	if opts.Remote == "" && install.socket != "" {
+		if err := checkSocketAccess(install.socket); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []struct{ what, path string }{
+		{"output directory", opts.OutputDir},
+		{"diagnostics directory", opts.DiagnosticsDir},
+		{"logs directory", opts.LogsDir},
+	} {
+		if dir.path == "" {
+			continue
+		}
+		if err := checkWritable(dir.what, dir.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSocketAccess checks that the LXD socket accepts connections
+// from the user.
+func checkSocketAccess(socket string) error {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err == nil {
+		return conn.Close()
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf(
+			"LXD socket %s does not exist: install LXD (e.g. \"snap install lxd\") and run \"lxd init\", "+
+				"or set $LXD_DIR to the directory of its socket",
+			socket,
+		)
+	case errors.Is(err, os.ErrPermission):
+		return lxdGroupError(socket)
+	}
+	return fmt.Errorf("connecting to the LXD socket %s: %v (is LXD running?)", socket, err)
+}
+
+// lxdGroupError returns an error describing why the user
+// cannot access the LXD socket.
+func lxdGroupError(socket string) error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("permission denied accessing the LXD socket %s: %v", socket, err)
+	}
+	group, err := user.LookupGroup("lxd")
+	if err != nil {
+		return fmt.Errorf(
+			"user %s cannot access the LXD socket %s, and there is no lxd group to grant access: "+
+				"create it with \"sudo groupadd --system lxd\", restart LXD, and add the user to it",
+			u.Username, socket,
+		)
+	}
+	member := false
+	if gids, err := u.GroupIds(); err == nil {
+		for _, gid := range gids {
+			if gid == group.Gid {
+				member = true
+				break
+			}
+		}
+	}
+	if member {
+		// Group membership only takes effect in new sessions.
+		gids, _ := os.Getgroups()
+		for _, gid := range gids {
+			if strconv.Itoa(gid) == group.Gid {
+				return fmt.Errorf(
+					"user %s is in the lxd group but cannot access the LXD socket %s: "+
+						"check that the socket belongs to the lxd group",
+					u.Username, socket,
+				)
+			}
+		}
+		return fmt.Errorf(
+			"user %s was added to the lxd group after this session started, so cannot yet access "+
+				"the LXD socket %s: log out and back in, or run \"newgrp lxd\"",
+			u.Username, socket,
+		)
+	}
+	return fmt.Errorf(
+		"user %s cannot access the LXD socket %s: add it to the lxd group with "+
+			"\"sudo usermod -aG lxd %s\", then log out and back in (building needs no root privileges)",
+		u.Username, socket, u.Username,
+	)
+}
+
+// checkWritable checks that files can be created in dir or, if it
+// does not exist yet, in its nearest existing parent, where it will
+// be created.
+func checkWritable(what, dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Stat(existing); err == nil {
+			break
+		} else if os.IsPermission(err) {
+			return fmt.Errorf("%s %s is not accessible by %s", what, dir, currentUsername())
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		existing = parent
+	}
+	f, err := ioutil.TempFile(existing, ".juju-lxd-centos-check")
+	if os.IsPermission(err) {
+		if existing != dir {
+			return fmt.Errorf("%s %s cannot be created: %s cannot write to %s", what, dir, currentUsername(), existing)
+		}
+		return fmt.Errorf("%s %s is not writable by %s", what, dir, currentUsername())
+	} else if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// currentUsername describes the current user, for errors.
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return "user " + u.Username
+	}
+	return "the current user"
+}
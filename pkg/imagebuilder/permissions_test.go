@@ -0,0 +1,111 @@
+package imagebuilder_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// launched reports whether the fake was asked to launch a container.
+func launched(commands [][]string) bool {
+	for _, c := range commands {
+		if len(c) > 1 && c[0] == "lxc" && c[1] == "launch" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildChecksDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Directories that do not exist yet are created.
+	fake := newFake(t)
+	logs := filepath.Join(dir, "logs", "today")
+	if _, err := build(t, imagebuilder.Options{Runner: fake, LogsDir: logs}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory that cannot be created fails the build
+	// before anything is launched.
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake = newFake(t)
+	if _, err := build(t, imagebuilder.Options{
+		Runner:         fake,
+		DiagnosticsDir: filepath.Join(file, "diagnostics"),
+	}); err == nil {
+		t.Errorf("expected the build to fail")
+	}
+	if launched(fake.Commands()) {
+		t.Errorf("container launched")
+	}
+}
+
+func TestBuildChecksDirectoriesWritable(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("directory modes do not restrict root or Windows users")
+	}
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	readonly := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(readonly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		opts   imagebuilder.Options
+		expect string
+	}{{
+		opts:   imagebuilder.Options{LogsDir: readonly},
+		expect: "logs directory " + readonly + " is not writable by user",
+	}, {
+		opts:   imagebuilder.Options{DiagnosticsDir: filepath.Join(readonly, "diagnostics")},
+		expect: "cannot be created",
+	}} {
+		fake := newFake(t)
+		test.opts.Runner = fake
+		_, err := build(t, test.opts)
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("got error %v, expected %q", err, test.expect)
+		}
+		if launched(fake.Commands()) {
+			t.Errorf("container launched")
+		}
+	}
+}
+
+func TestCheckSocketAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "unix.socket")
+	err = imagebuilder.CheckSocketAccess(socket)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("got error %v for a missing socket", err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("cannot listen on a unix socket: %v", err)
+	}
+	defer l.Close()
+	if err := imagebuilder.CheckSocketAccess(socket); err != nil {
+		t.Errorf("got error %v for an accessible socket", err)
+	}
+}
@@ -0,0 +1,172 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profile is a named set of provisioning commands that may be
+// optionally applied to the build container.
+type profile struct {
+	// description is a short, human-readable description
+	// of the profile, displayed in the command's usage.
+	description string
+
+	// commands are run inside the build container, after
+	// the base packages have been installed, and before the
+	// container is cleaned up for publishing.
+	commands []string
+
+	// recommended holds the instance config that instances of the
+	// image need for what the profile prepares them for. It is
+	// added to Options.RecommendedConfig, so that it is recorded
+	// in the image's properties.
+	recommended map[string]string
+}
+
+// distroInfoPath is the distro-info data file listing the Ubuntu
+// releases, which Juju reads to learn of series newer than it was
+// built with.
+const distroInfoPath = "/usr/share/distro-info/ubuntu.csv"
+
+var profiles = map[string]profile{
+	"controller": {
+		description: "install the extra packages and tuning needed by a Juju controller machine",
+		commands: []string{
+			// The juju-db (MongoDB) snap requires snapd, from EPEL.
+			"yum install -y epel-release",
+			"yum install -y snapd",
+			"systemctl enable snapd.socket",
+			"ln -sfn /var/lib/snapd/snap /snap",
+			// MongoDB and the controller's API server hold many
+			// connections open; raise the file descriptor limits.
+			"printf '%s\\n' '* soft nofile 65536' '* hard nofile 65536' > /etc/security/limits.d/90-juju-controller.conf",
+			"mkdir -p /etc/systemd/system.conf.d",
+			"printf '[Manager]\\nDefaultLimitNOFILE=65536\\n' > /etc/systemd/system.conf.d/90-juju-controller.conf",
+			// MongoDB performs poorly when swapped out. Note that swap
+			// accounting itself (swapaccount=1) must be enabled in the
+			// host kernel for memory limits to include swap.
+			"printf 'vm.swappiness = 1\\n' > /etc/sysctl.d/60-juju-controller.conf",
+		},
+	},
+	"fan": {
+		description: "install and configure the prerequisites of Juju fan networking",
+		commands: []string{
+			"yum install -y iproute iptables bridge-utils",
+			// Fan overlays route between the underlay and the fan
+			// bridges, so forwarding must be enabled and strict
+			// reverse-path filtering relaxed.
+			"printf '%s\\n' " +
+				"'net.ipv4.ip_forward = 1' " +
+				"'net.ipv4.conf.all.rp_filter = 2' " +
+				"'net.ipv4.conf.default.rp_filter = 2' " +
+				"> /etc/sysctl.d/60-juju-fan.conf",
+		},
+	},
+	"juju-agent": {
+		description: "install the prerequisites of the Juju machine agent",
+		commands: []string{
+			"yum install -y curl tar gzip ca-certificates sudo which iproute procps-ng",
+			// Juju identifies the OS using os-release; make sure
+			// /etc/os-release and /usr/lib/os-release agree.
+			"[ -e /usr/lib/os-release ] || cp /etc/os-release /usr/lib/os-release",
+			"ln -sf ../usr/lib/os-release /etc/os-release",
+			// Juju learns of Ubuntu series from distro-info-data, which
+			// EL only has in EPEL; enable EPEL unless the image's
+			// repositories already have the package, and fail if it
+			// still cannot be installed.
+			"yum info distro-info-data >/dev/null 2>&1 || yum install -y epel-release",
+			"yum install -y distro-info-data",
+			"if ! grep -q '^[0-9.]* LTS,' " + distroInfoPath + "; then " +
+				"echo 'distro-info data is missing from " + distroInfoPath + "' >&2; exit 1; fi",
+			// Create the directories the agent expects to exist,
+			// so first boot doesn't need to.
+			"mkdir -p /var/lib/juju /var/log/juju",
+		},
+	},
+	"nesting": {
+		description: "prepare the image for running containers inside it, recommending security.nesting=true",
+		commands: []string{
+			"yum install -y fuse squashfs-tools",
+			"if yum info fuse-overlayfs >/dev/null 2>&1; then yum install -y fuse-overlayfs; fi",
+			// Delegate cgroup controllers to user sessions, so nested
+			// (rootless) container runtimes work under cgroup v2 (EL9).
+			"mkdir -p /etc/systemd/system/user@.service.d",
+			"printf '[Service]\\nDelegate=yes\\n' > /etc/systemd/system/user@.service.d/delegate.conf",
+		},
+		// Containers cannot load kernel modules, so those nested
+		// workloads expect are loaded on the host by LXD when
+		// instances start.
+		recommended: map[string]string{
+			"security.nesting":     "true",
+			"linux.kernel_modules": "overlay,br_netfilter,nf_nat,ip_tables,fuse",
+		},
+	},
+}
+
+// ProfileNames returns the sorted names of the known profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProfileDescription returns a short description of the named
+// profile, or the empty string if there is no such profile.
+func ProfileDescription(name string) string {
+	return profiles[name].description
+}
+
+// profileSteps returns provisioning steps for the named profiles,
+// in the order specified. Profiles named more than once are only
+// applied once.
+func profileSteps(names []string) ([]step, error) {
+	var steps []step
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		p, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf(
+				"unknown profile %q, expected one of: %s",
+				name, strings.Join(ProfileNames(), ", "),
+			)
+		}
+		steps = append(steps, step{
+			name:        "profile " + name,
+			provisioner: packageLockProvisioner{ShellProvisioner{Commands: p.commands}},
+		})
+	}
+	return steps, nil
+}
+
+// profileRecommendedConfig returns the recommended config with that
+// of the named profiles added, unless it already has the keys.
+func profileRecommendedConfig(names []string, config map[string]string) map[string]string {
+	var merged map[string]string
+	for _, name := range names {
+		for key, value := range profiles[name].recommended {
+			if _, ok := config[key]; ok {
+				continue
+			}
+			if merged == nil {
+				merged = make(map[string]string)
+				for key, value := range config {
+					merged[key] = value
+				}
+			}
+			merged[key] = value
+		}
+	}
+	if merged == nil {
+		return config
+	}
+	return merged
+}
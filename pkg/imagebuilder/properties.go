@@ -0,0 +1,115 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TemplateVariables lists the variables that Options.Description and
+// the values of Options.Properties may refer to, as {{name}}, with a
+// description of each.
+var TemplateVariables = map[string]string{
+	"alias":              "the alias the image is published under",
+	"serial":             "the build serial",
+	"date":               "the build date (YYYY-MM-DD, UTC)",
+	"distro":             "the distribution's ID in /etc/os-release, e.g. centos",
+	"release":            "the distribution's VERSION_ID in /etc/os-release, e.g. 7",
+	"arch":               "the image's architecture, e.g. x86_64",
+	"base_image":         "the base image",
+	"base_fingerprint":   "the base image's fingerprint",
+	"cloud_init_version": "the version of cloud-init in the image",
+}
+
+// reservedProperties holds the properties that the builder records
+// on images, which cannot be set with Options.Properties.
+var reservedProperties = map[string]bool{
+	PropertyCloudInitVersion:  true,
+	PropertyJujuVersionTested: true,
+	PropertyVulnerabilities:   true,
+}
+
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]*)\s*\}\}`)
+
+// expandTemplate replaces the {{name}} references in s with the
+// values of the named variables. If vars is nil, the references
+// are only checked.
+func expandTemplate(s string, vars map[string]string) (string, error) {
+	var err error
+	expanded := templateVariable.ReplaceAllStringFunc(s, func(ref string) string {
+		name := templateVariable.FindStringSubmatch(ref)[1]
+		if _, ok := TemplateVariables[name]; !ok && err == nil {
+			err = fmt.Errorf("unknown variable %q in %q", name, s)
+		}
+		return vars[name]
+	})
+	return expanded, err
+}
+
+// checkPropertyTemplates checks that the description and properties
+// refer only to known variables, and that the properties are user
+// properties that the builder does not itself record.
+func checkPropertyTemplates(description string, properties map[string]string) error {
+	if _, err := expandTemplate(description, nil); err != nil {
+		return fmt.Errorf("invalid description: %w", err)
+	}
+	for _, key := range sortedKeys(properties) {
+		if !strings.HasPrefix(key, "user.") {
+			return fmt.Errorf("invalid property %q: only user.* properties may be set", key)
+		}
+		if reservedProperties[key] || strings.HasPrefix(key, "user.build.") {
+			return fmt.Errorf("invalid property %q: the property is recorded by the builder", key)
+		}
+		if _, err := expandTemplate(properties[key], nil); err != nil {
+			return fmt.Errorf("invalid property %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// templateProperties adds the expanded description and properties
+// to the image properties, which must hold the builder's properties.
+func templateProperties(
+	ctx context.Context,
+	container string,
+	date time.Time,
+	description string,
+	templates map[string]string,
+	properties map[string]string,
+) error {
+	if description == "" && len(templates) == 0 {
+		return nil
+	}
+	facts, err := containerFacts(ctx, container)
+	if err != nil {
+		return err
+	}
+	var distro string
+	if len(facts.distros) > 0 {
+		distro = facts.distros[0]
+	}
+	vars := map[string]string{
+		"alias":              properties[PropertyAlias],
+		"serial":             properties[PropertySerial],
+		"date":               date.UTC().Format("2006-01-02"),
+		"distro":             distro,
+		"release":            facts.release,
+		"arch":               facts.arch,
+		"base_image":         properties[PropertyBaseImage],
+		"base_fingerprint":   properties[PropertyBaseFingerprint],
+		"cloud_init_version": properties[PropertyCloudInitVersion],
+	}
+	if description != "" {
+		if properties["description"], err = expandTemplate(description, vars); err != nil {
+			return err
+		}
+	}
+	for key, template := range templates {
+		if properties[key], err = expandTemplate(template, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
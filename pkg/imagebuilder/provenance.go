@@ -0,0 +1,183 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version is the version of the builder recorded in provenance
+// documents. It may be set at link time, with
+// "-ldflags -X github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder.Version=...".
+var Version = "dev"
+
+const (
+	// provenanceFtype is the simplestreams file type for the
+	// image's provenance document.
+	provenanceFtype = combinedFtype + ".provenance.json"
+
+	// provenanceBundleFtype is the simplestreams file type for
+	// the cosign-signed provenance attestation.
+	provenanceBundleFtype = combinedFtype + ".provenance.sigstore.json"
+
+	// provenanceSignatureFtype is the simplestreams file type
+	// for the GPG signature of the provenance document.
+	provenanceSignatureFtype = provenanceFtype + ".gpg"
+
+	provenanceBuildType = "https://github.com/axw/juju-lxd-centos-image-builder/build/v1"
+)
+
+// The provenance document is an in-toto statement with a SLSA v1
+// provenance predicate; see https://slsa.dev/spec/v1.0/provenance.
+type provenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []provenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     provenancePredicate `json:"predicate"`
+}
+
+type provenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type provenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]interface{} `json:"externalParameters"`
+		ResolvedDependencies []provenanceSubject    `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId"`
+			StartedOn    time.Time `json:"startedOn"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// defaultBuilderID returns the builder ID to record in provenance
+// documents if Options.BuilderID is not specified, identifying
+// this host.
+func defaultBuilderID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return "https://github.com/axw/juju-lxd-centos-image-builder@" + hostname
+}
+
+// writeProvenance writes the provenance document for the build to
+// a file in dir, returning its path and contents.
+func writeProvenance(ctx context.Context, dir, builderID string, opts Options, result *Result) (string, []byte, error) {
+	spec, err := json.Marshal(newSpecOptions(opts))
+	if err != nil {
+		return "", nil, err
+	}
+	specDigest := sha256.Sum256(spec)
+
+	var statement provenanceStatement
+	statement.Type = "https://in-toto.io/Statement/v1"
+	statement.PredicateType = "https://slsa.dev/provenance/v1"
+	statement.Subject = []provenanceSubject{{
+		Name:   combinedFtype,
+		Digest: map[string]string{"sha256": result.Fingerprint},
+	}}
+	p := &statement.Predicate
+	p.BuildDefinition.BuildType = provenanceBuildType
+	p.BuildDefinition.ExternalParameters = map[string]interface{}{
+		"image":        opts.Image,
+		"alias":        opts.Alias,
+		"profiles":     opts.Profiles,
+		"image-server": opts.ImageServer,
+		"spec": map[string]string{
+			"sha256": hex.EncodeToString(specDigest[:]),
+		},
+	}
+	if result.BaseFingerprint != "" {
+		p.BuildDefinition.ResolvedDependencies = []provenanceSubject{{
+			Name:   result.BaseImage,
+			Digest: map[string]string{"sha256": result.BaseFingerprint},
+		}}
+	}
+	p.RunDetails.Builder.ID = builderID
+	p.RunDetails.Builder.Version = map[string]string{BuilderName: Version}
+	if out, err := runOutput(ctx, "lxc", "version"); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if i := strings.Index(line, " version: "); i != -1 {
+				name := "lxc-" + strings.ToLower(line[:i])
+				p.RunDetails.Builder.Version[name] = strings.TrimSpace(line[i+len(" version: "):])
+			}
+		}
+	}
+	p.RunDetails.Metadata.InvocationID = result.Alias + "/" + result.Serial
+	p.RunDetails.Metadata.StartedOn = result.Started.UTC()
+	p.RunDetails.Metadata.FinishedOn = time.Now().UTC()
+
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+	data = contextRedactor(ctx).redactBytes(data)
+	path := filepath.Join(dir, "provenance.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", nil, err
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: path})
+	return path, data, nil
+}
+
+// attestProvenance signs the provenance predicate for the image
+// tarball with cosign, writing a Sigstore bundle next to the tarball
+// and returning its path. The key is as for cosignTarball.
+func attestProvenance(ctx context.Context, tarball string, provenance []byte, key string) (string, error) {
+	var statement provenanceStatement
+	if err := json.Unmarshal(provenance, &statement); err != nil {
+		return "", err
+	}
+	predicate, err := json.Marshal(statement.Predicate)
+	if err != nil {
+		return "", err
+	}
+	predicateFile := tarball + ".predicate.json"
+	if err := ioutil.WriteFile(predicateFile, predicate, 0644); err != nil {
+		return "", err
+	}
+	bundle := tarball + ".provenance.sigstore.json"
+	args := []string{
+		"attest-blob", "--yes",
+		"--predicate", predicateFile,
+		"--type", "slsaprovenance1",
+		"--bundle", bundle,
+	}
+	if key != "" {
+		args = append(args, "--key", key)
+	}
+	args = append(args, tarball)
+	logf(ctx, "Attesting provenance of %s with cosign", tarball)
+	if err := run(ctx, "cosign", args...); err != nil {
+		return "", fmt.Errorf("attesting provenance with cosign: %w", err)
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: bundle})
+	return bundle, nil
+}
+
+// gpgSign writes a detached GPG signature of the named file
+// to the given path, signing with key.
+func gpgSign(ctx context.Context, key, file, signature string) error {
+	return run(ctx,
+		"gpg", "--batch", "--yes", "--local-user", key,
+		"--detach-sign", "--output", signature, file,
+	)
+}
@@ -0,0 +1,322 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+)
+
+// Provisioner is the interface for a provisioning step, which
+// modifies the build container before it is published.
+type Provisioner interface {
+	// Run runs the provisioning step against the named container.
+	Run(ctx context.Context, container string) error
+}
+
+// ShellProvisioner is a Provisioner that runs shell commands
+// inside the container, in sequence, stopping at the first
+// command that fails.
+type ShellProvisioner struct {
+	Commands []string
+
+	// Dir, if non-empty, is the absolute path of the
+	// directory in the container to run the commands in.
+	Dir string
+
+	// Shell, if non-empty, is the shell or other interpreter to
+	// run each command with, passing the command with -c, e.g.
+	// "/bin/bash" or "python3". The default is "/bin/sh".
+	Shell string
+
+	// Strict, if true, runs each command with "set -euo pipefail",
+	// so that it fails if any part of it fails. It is supported
+	// only with POSIX-like shells such as sh and bash.
+	Strict bool
+
+	// User and Group, if non-empty, are the user and group, by
+	// name or numeric ID, to run the commands as. If only User is
+	// set, the user's primary group is used. HOME and USER are set
+	// for the user.
+	User  string
+	Group string
+}
+
+// Run is part of the Provisioner interface.
+func (p ShellProvisioner) Run(ctx context.Context, container string) error {
+	user, err := lookupExecUser(ctx, container, p.User, p.Group)
+	if err != nil {
+		return err
+	}
+	shell := p.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	posix := isPOSIXShell(shell)
+	if p.Strict && !posix {
+		return fmt.Errorf("strict mode is not supported with %s", shell)
+	}
+	if p.Dir != "" && !path.IsAbs(p.Dir) {
+		return fmt.Errorf("working directory %q is not absolute", p.Dir)
+	}
+	load, err := user.loadBuildArgs(ctx, container)
+	if err != nil {
+		return err
+	}
+	for _, command := range p.Commands {
+		if p.Strict {
+			command = "set -euo pipefail; " + command
+		}
+		args := user.execArgs(container, p.Dir)
+		switch {
+		case posix:
+			args = append(args, shell, "-c", load+command)
+		case load != "":
+			// Load the build arguments with the shell,
+			// and then run the interpreter.
+			args = append(args, "/bin/sh", "-c", load+`exec "$0" "$@"`, shell, "-c", command)
+		default:
+			args = append(args, shell, "-c", command)
+		}
+		if err := lxc(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPOSIXShell reports whether the named shell
+// accepts POSIX shell syntax.
+func isPOSIXShell(shell string) bool {
+	switch path.Base(shell) {
+	case "sh", "bash", "dash", "ksh", "zsh":
+		return true
+	}
+	return false
+}
+
+// FileProvisioner is a Provisioner that copies a file from the
+// host into the container.
+type FileProvisioner struct {
+	// Source is the path of the file on the host.
+	Source string
+
+	// Destination is the absolute path of the file in the container.
+	Destination string
+
+	// Mode, if non-zero, is the mode to set on the file
+	// in the container. Otherwise the host file's mode is used,
+	// except on Windows, where files are given mode 0644.
+	Mode os.FileMode
+}
+
+// Run is part of the Provisioner interface.
+func (p FileProvisioner) Run(ctx context.Context, container string) error {
+	if !path.IsAbs(p.Destination) {
+		return fmt.Errorf("file destination %q is not absolute", p.Destination)
+	}
+	args := []string{"file", "push", "--create-dirs"}
+	mode := p.Mode
+	if mode == 0 && runtime.GOOS == "windows" {
+		// Windows file modes do not carry over usefully:
+		// every writable file would be world-writable.
+		mode = 0644
+	}
+	if mode != 0 {
+		args = append(args, fmt.Sprintf("--mode=%04o", mode.Perm()))
+	}
+	args = append(args, p.Source, container+p.Destination)
+	return confinementError(ctx, lxc(ctx, args...), p.Source)
+}
+
+// ScriptProvisioner is a Provisioner that copies a script from the
+// host into the container and executes it there. The script is
+// removed from the container afterwards.
+type ScriptProvisioner struct {
+	// Path is the path of the script on the host.
+	Path string
+
+	// Args holds the arguments to pass to the script.
+	Args []string
+
+	// Dir, User and Group are the working directory, and the user
+	// and group to run the script as, as for ShellProvisioner.
+	Dir   string
+	User  string
+	Group string
+}
+
+// Run is part of the Provisioner interface.
+func (p ScriptProvisioner) Run(ctx context.Context, container string) error {
+	user, err := lookupExecUser(ctx, container, p.User, p.Group)
+	if err != nil {
+		return err
+	}
+	target := path.Join("/tmp", "juju-lxd-centos-"+filepath.Base(p.Path))
+	push := []string{"file", "push", "--create-dirs", "--mode=0700"}
+	if user != nil {
+		// The script must be executable by the user.
+		push = append(push, "--uid="+user.uid, "--gid="+user.gid)
+	}
+	if err := lxc(ctx, append(push, p.Path, container+target)...); err != nil {
+		return confinementError(ctx, err, p.Path)
+	}
+	defer lxc(detach(ctx), "exec", container, "--", "/bin/rm", "-f", target)
+	load, err := user.loadBuildArgs(ctx, container)
+	if err != nil {
+		return err
+	}
+	args := user.execArgs(container, p.Dir)
+	if load != "" {
+		args = append(args, "/bin/sh", "-c", load+`exec "$0" "$@"`)
+	}
+	args = append(args, target)
+	return lxc(ctx, append(args, p.Args...)...)
+}
+
+// ExecProvisioner is a Provisioner that runs an external program
+// on the host, allowing provisioning steps to be implemented as
+// plugins. The program is run with the container name as its first
+// argument, followed by Args, and with the environment variable
+// JUJU_LXD_BUILDER_CONTAINER set to the container name, along with
+// any build arguments.
+type ExecProvisioner struct {
+	// Command is the name or path of the program to run.
+	Command string
+
+	// Args holds additional arguments to pass to the program.
+	Args []string
+}
+
+// Run is part of the Provisioner interface.
+func (p ExecProvisioner) Run(ctx context.Context, container string) error {
+	args := append([]string{container}, p.Args...)
+	env := []string{"JUJU_LXD_BUILDER_CONTAINER=" + container}
+	if a := contextBuildArgs(ctx); a != nil {
+		env = append(env, a.env...)
+	}
+	return runEnv(ctx, env, p.Command, args...)
+}
+
+// baseProvisioner installs the packages cloud-init and Juju require.
+var baseProvisioner = ShellProvisioner{
+	Commands: []string{
+		"yum install -y openssh-server redhat-lsb-core cloud-init",
+		// Disable the set_hostname/update_hostname modules, or SELinux sadness ensues.
+		"sed -i -E 's/.*(set|update)_hostname.*/#\\0/' /etc/cloud/cloud.cfg",
+	},
+}
+
+// cleanupProvisioner cleans up the container for publishing.
+var cleanupProvisioner = ShellProvisioner{
+	Commands: []string{
+		// Clean out yum cache from previous installs.
+		"yum clean all",
+		// Remove SSH host keys so we don't end up with all instances having the same.
+		"/bin/rm -f /etc/ssh/*key*",
+	},
+}
+
+// step is a named provisioning step.
+type step struct {
+	name        string
+	provisioner Provisioner
+}
+
+// provisionerType returns the type of the provisioner, as named
+// in configuration files.
+func provisionerType(p Provisioner) string {
+	switch p := p.(type) {
+	case ConditionalProvisioner:
+		return provisionerType(p.Provisioner)
+	case SensitiveProvisioner:
+		if p.Provisioner == nil {
+			// Hidden; see hideSensitive.
+			return "sensitive"
+		}
+		return provisionerType(p.Provisioner)
+	case ParallelProvisioner:
+		return "parallel"
+	case ShellProvisioner:
+		return "shell"
+	case FileProvisioner:
+		return "file"
+	case ScriptProvisioner:
+		return "script"
+	case ExecProvisioner:
+		return "exec"
+	case AnsibleProvisioner:
+		return "ansible"
+	case SaltProvisioner:
+		return "salt"
+	case PuppetProvisioner:
+		return "puppet"
+	case ChefProvisioner:
+		return "chef"
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+// buildSteps returns all the provisioning steps of a build: the
+// base provisioner, followed by the additional steps, and finally
+// cleaning up the container for publishing. If offline is non-nil,
+// the container's repositories are replaced before the base
+// provisioner runs, and restored before cleaning up. The hooks
+// (see Options.Hooks) run at their hook points among these. If
+// scrub is true, the build arguments are scrubbed last of all,
+// so that none of the steps or hooks can leave secrets behind.
+func buildSteps(steps []step, offline *offlineRepo, hooks map[string][]string, scrub bool) []step {
+	var all []step
+	addHook := func(name string) {
+		if s, ok := hookStep(hooks, name); ok {
+			all = append(all, s)
+		}
+	}
+	if offline != nil {
+		all = append(all, step{"offline repositories", *offline})
+	}
+	addHook(HookPrePackages)
+	all = append(all, step{"base", packageLockProvisioner{baseProvisioner}})
+	addHook(HookPostPackages)
+	all = append(all, steps...)
+	if offline != nil {
+		all = append(all, step{"restore repositories", offline.restore()})
+	}
+	addHook(HookPreCleanup)
+	all = append(all, step{"cleanup", cleanupProvisioner})
+	addHook(HookPrePublish)
+	if scrub {
+		all = append(all, step{"scrub build arguments", scrubBuildArgs{}})
+	}
+	return all
+}
+
+// updateContainer provisions the build container, running the steps
+// in order. If cache is non-nil, the steps restored from the cache
+// are skipped, and the container is snapshotted after each step that
+// is run. Failed steps are retried according to retry, which may be
+// nil. If a step fails, a *ProvisionError is returned.
+func updateContainer(ctx context.Context, container string, steps []step, cache *stepCache, retry *stepRetry) error {
+	for i, s := range steps {
+		if cache != nil && i < cache.resume {
+			continue
+		}
+		err := retry.run(ctx, container, s)
+		if err == nil && cache != nil {
+			err = cache.snapshot(ctx, container, i)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &ProvisionError{
+				Step:   s.name,
+				Output: commandOutput(err),
+				Err:    err,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package imagebuilder
+
+import (
+	"context"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/ratelimit"
+)
+
+type limiterKey struct{}
+
+// WithRateLimit returns a context that causes the image transfers
+// made on behalf of functions in this package, such as CopyImage,
+// to be limited to rate bytes per second. Builds use
+// Options.RateLimit instead.
+func WithRateLimit(ctx context.Context, rate int64) context.Context {
+	return withLimiter(ctx, ratelimit.NewLimiter(rate))
+}
+
+func withLimiter(ctx context.Context, l *ratelimit.Limiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, limiterKey{}, l)
+}
+
+// contextLimiter returns the context's rate limiter, if any.
+func contextLimiter(ctx context.Context) *ratelimit.Limiter {
+	l, _ := ctx.Value(limiterKey{}).(*ratelimit.Limiter)
+	return l
+}
+
+// lxcTransfer runs an lxc command that transfers an image or backup
+// to or from an LXD server. If the context has a rate limit, lxc's
+// connections are tunnelled through a proxy that applies it, and
+// image copies are relayed through the client rather than made
+// between the servers directly, so that they are limited too.
+// Transfers over the local unix socket are not limited.
+func lxcTransfer(ctx context.Context, args ...string) error {
+	l := contextLimiter(ctx)
+	if l == nil {
+		return lxc(ctx, args...)
+	}
+	if len(args) > 1 && args[0] == "image" && args[1] == "copy" {
+		args = append(args, "--mode=relay")
+	}
+	proxy, err := ratelimit.ListenProxy(l)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+	return runEnv(ctx, proxy.Env(), "lxc", args...)
+}
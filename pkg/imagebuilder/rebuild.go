@@ -0,0 +1,242 @@
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RebuildOptions holds the options for OptionsForRebuild.
+type RebuildOptions struct {
+	// Manifest is the manifest of the build to repeat.
+	Manifest *Result
+
+	// HistoryFile, if non-empty, is the history file to find the
+	// build's options in, if the manifest does not record them
+	// (see Result.Spec).
+	HistoryFile string
+
+	// BuildArgs holds the build arguments (KEY=VALUE) given to the
+	// original build, whose values are not recorded.
+	BuildArgs []string
+
+	// Force, if true, allows the build to be repeated even if its
+	// inputs have changed since, or it was built by another version
+	// of the builder, whose templates may differ.
+	Force bool
+}
+
+// OptionsForRebuild returns the options to repeat the build described
+// by a manifest: the same steps and inputs, from the same base image,
+// pinned by its fingerprint, with the same version of the builder and
+// so the same templates. The options that distribute the image, such
+// as OutputDir, Upload, PushRemotes and JujuModel, and those that
+// depend on the host, such as LogsDir and Notifications, are cleared, as is Serial so
+// that the image is given a new serial; callers may set them again.
+func OptionsForRebuild(r RebuildOptions) (Options, error) {
+	m := r.Manifest
+	spec := m.Spec
+	if len(spec) == 0 && r.HistoryFile != "" && m.Fingerprint != "" {
+		if rec, err := FindBuild(r.HistoryFile, m.Fingerprint); err == nil {
+			spec = rec.Spec
+		}
+	}
+	if len(spec) == 0 {
+		return Options{}, fmt.Errorf("the manifest of %s does not record the build's options, nor does the history file", m.Alias)
+	}
+	opts, err := decodeSpec(spec)
+	if err != nil {
+		return Options{}, fmt.Errorf("decoding the build's options: %v", err)
+	}
+
+	if version := m.Properties[PropertyToolVersion]; version != Version && !r.Force {
+		return Options{}, fmt.Errorf(
+			"%s was built by version %s of %s, not %s, whose templates may differ",
+			m.Alias, orUnknown(version), BuilderName, Version,
+		)
+	}
+	if len(r.BuildArgs) > 0 || len(opts.BuildArgs) > 0 {
+		if got, want := buildArgNames(r.BuildArgs), opts.BuildArgs; strings.Join(got, ",") != strings.Join(want, ",") {
+			return Options{}, fmt.Errorf(
+				"the build was given build arguments %s, but %s were specified",
+				orNone(want), orNone(got),
+			)
+		}
+		opts.BuildArgs = r.BuildArgs
+	}
+	if want := m.Properties[PropertyInputs]; want != "" {
+		got, err := inputsDigest(opts)
+		if err != nil {
+			return Options{}, err
+		}
+		if got != want && !r.Force {
+			return Options{}, fmt.Errorf(
+				"the inputs of %s (its files, steps or build arguments) have changed since it was built",
+				m.Alias,
+			)
+		}
+	}
+
+	// Pin the base image, which an alias may since have moved from.
+	if m.BaseFingerprint != "" {
+		opts.BaseFingerprint = m.BaseFingerprint
+		if remote, _ := splitImage(m.BaseImage); opts.Base == "" && opts.ImageServer == "" {
+			opts.Image = qualify(remote, m.BaseFingerprint)
+			opts.ImageFallbacks = nil
+		}
+	}
+	opts.Alias = m.Alias
+	opts.Serial = ""
+	opts.SkipUnchanged = false
+	opts.SerialOnChange = false
+	opts.OutputDir = ""
+	opts.Upload = ""
+	opts.PushRemotes = nil
+	opts.JujuModel = ""
+	opts.JujuRemote = ""
+	opts.JujuConfig = nil
+	opts.LogsDir = ""
+	opts.DiagnosticsDir = ""
+	opts.HistoryFile = ""
+	opts.Notifications = nil
+	return opts, nil
+}
+
+// decodeSpec decodes build options encoded as in diagnostics bundles
+// (see newSpecOptions). Build arguments are decoded as their names.
+func decodeSpec(data []byte) (Options, error) {
+	var spec struct {
+		Options
+		BuildArgs    []string
+		Provisioners []struct {
+			Type        string
+			Provisioner json.RawMessage
+		}
+		OnEvent json.RawMessage
+		Runner  json.RawMessage
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return Options{}, err
+	}
+	opts := spec.Options
+	opts.BuildArgs = spec.BuildArgs
+	for i, p := range spec.Provisioners {
+		if p.Type == "sensitive" {
+			return Options{}, fmt.Errorf("provisioner %d is sensitive, so was not recorded", i)
+		}
+		provisioner, err := decodeProvisioner(p.Provisioner)
+		if err != nil {
+			return Options{}, fmt.Errorf("provisioner %d (%s): %v", i, p.Type, err)
+		}
+		opts.Provisioners = append(opts.Provisioners, provisioner)
+	}
+	return opts, nil
+}
+
+// decodeProvisioner decodes a provisioner encoded as JSON, identifying
+// its type by the fields it has: the provisioners of parallel steps
+// are encoded without their types.
+func decodeProvisioner(data json.RawMessage) (Provisioner, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	has := func(field string) bool {
+		_, ok := fields[field]
+		return ok
+	}
+	switch {
+	case has("When"):
+		var c struct{ When Condition }
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		inner, err := decodeProvisioner(fields["Provisioner"])
+		if err != nil {
+			return nil, err
+		}
+		return ConditionalProvisioner{When: c.When, Provisioner: inner}, nil
+	case has("Steps"):
+		var parallel struct {
+			Steps []struct {
+				Name        string
+				DependsOn   []string
+				Provisioner json.RawMessage
+			}
+			Limit int
+		}
+		if err := json.Unmarshal(data, &parallel); err != nil {
+			return nil, err
+		}
+		result := ParallelProvisioner{Limit: parallel.Limit}
+		for _, s := range parallel.Steps {
+			inner, err := decodeProvisioner(s.Provisioner)
+			if err != nil {
+				return nil, fmt.Errorf("parallel step %q: %v", s.Name, err)
+			}
+			result.Steps = append(result.Steps, ParallelStep{
+				Name: s.Name, DependsOn: s.DependsOn, Provisioner: inner,
+			})
+		}
+		return result, nil
+	case has("Provisioner"):
+		if string(fields["Provisioner"]) == "null" {
+			return nil, fmt.Errorf("sensitive step was not recorded")
+		}
+		inner, err := decodeProvisioner(fields["Provisioner"])
+		if err != nil {
+			return nil, err
+		}
+		return SensitiveProvisioner{Provisioner: inner}, nil
+	case has("Commands"):
+		var s ShellProvisioner
+		err := json.Unmarshal(data, &s)
+		return s, err
+	case has("Destination"):
+		var f FileProvisioner
+		err := json.Unmarshal(data, &f)
+		return f, err
+	case has("Path"):
+		var s ScriptProvisioner
+		err := json.Unmarshal(data, &s)
+		return s, err
+	case has("Command"):
+		var e ExecProvisioner
+		err := json.Unmarshal(data, &e)
+		return e, err
+	case has("Playbook"):
+		var a AnsibleProvisioner
+		err := json.Unmarshal(data, &a)
+		return a, err
+	case has("StateTree"):
+		var s SaltProvisioner
+		err := json.Unmarshal(data, &s)
+		return s, err
+	case has("Manifest"):
+		var pp PuppetProvisioner
+		err := json.Unmarshal(data, &pp)
+		return pp, err
+	case has("CookbookPath"):
+		var c ChefProvisioner
+		err := json.Unmarshal(data, &c)
+		return c, err
+	}
+	return nil, fmt.Errorf("unknown provisioner %s", data)
+}
+
+// orUnknown returns s, or "unknown" if s is empty.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// orNone returns the names joined by commas,
+// or "none" if there are none.
+func orNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
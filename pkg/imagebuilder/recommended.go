@@ -0,0 +1,52 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PropertyRecommendedPrefix prefixes the image properties recording
+// the instance config recommended for launching the image (see
+// Options.RecommendedConfig), e.g. "user.recommended.limits.memory".
+const PropertyRecommendedPrefix = "user.recommended."
+
+// checkRecommendedConfig checks that the recommended config keys
+// could be set on an instance.
+func checkRecommendedConfig(config map[string]string) error {
+	for _, key := range sortedKeys(config) {
+		if key == "" || strings.ContainsAny(key, " \t\n=") {
+			return fmt.Errorf("invalid recommended config key %q", key)
+		}
+		for _, prefix := range []string{"volatile.", "image."} {
+			if strings.HasPrefix(key, prefix) {
+				return fmt.Errorf("recommended config key %q cannot be set on instances", key)
+			}
+		}
+	}
+	return nil
+}
+
+// recommendedProperties adds the recommended config to the image
+// properties.
+func recommendedProperties(config, properties map[string]string) {
+	for key, value := range config {
+		properties[PropertyRecommendedPrefix+key] = value
+	}
+}
+
+// RecommendedConfig returns the instance config recommended for
+// launching an image, as recorded in its properties, or nil if
+// none is recorded.
+func RecommendedConfig(properties map[string]string) map[string]string {
+	var config map[string]string
+	for key, value := range properties {
+		if !strings.HasPrefix(key, PropertyRecommendedPrefix) {
+			continue
+		}
+		if config == nil {
+			config = make(map[string]string)
+		}
+		config[strings.TrimPrefix(key, PropertyRecommendedPrefix)] = value
+	}
+	return config
+}
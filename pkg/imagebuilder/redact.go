@@ -0,0 +1,203 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// redactedText replaces the sensitive text masked by a redactor.
+const redactedText = "[REDACTED]"
+
+// redactor masks sensitive text (see Options.Redact and
+// Options.BuildSecrets) in logs, events and build artifacts.
+type redactor struct {
+	// patterns holds the expressions whose
+	// matches are masked.
+	patterns []*regexp.Regexp
+
+	// values holds literal values to mask, such
+	// as the values of build secrets.
+	values []string
+}
+
+// newRedactor returns a redactor masking matches of the regular
+// expressions, and the literal values. If there are neither, it
+// returns nil, which masks nothing.
+func newRedactor(patterns, values []string) (*redactor, error) {
+	if len(patterns) == 0 && len(values) == 0 {
+		return nil, nil
+	}
+	r := &redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", pattern, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("invalid redaction pattern %q: matches the empty string", pattern)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, value := range values {
+		r.values = append(r.values, value)
+		// Values are also masked in JSON documents,
+		// where they may be escaped.
+		if quoted, err := json.Marshal(value); err == nil {
+			if escaped := string(quoted[1 : len(quoted)-1]); escaped != value {
+				r.values = append(r.values, escaped)
+			}
+		}
+	}
+	return r, nil
+}
+
+// redact returns s with the sensitive text masked.
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, value := range r.values {
+		s = strings.Replace(s, value, redactedText, -1)
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, redactedText)
+	}
+	return s
+}
+
+// redactBytes returns data with the sensitive text masked.
+func (r *redactor) redactBytes(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+	return []byte(r.redact(string(data)))
+}
+
+type redactorKey struct{}
+
+// withRedactor returns a context that causes logs, events and
+// command output to be masked by r.
+func withRedactor(ctx context.Context, r *redactor) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, redactorKey{}, r)
+}
+
+// contextRedactor returns the context's redactor, or nil.
+func contextRedactor(ctx context.Context) *redactor {
+	r, _ := ctx.Value(redactorKey{}).(*redactor)
+	return r
+}
+
+type sensitiveKey struct{}
+
+// sensitive reports whether the context is that of a sensitive
+// provisioning step (see SensitiveProvisioner).
+func sensitive(ctx context.Context) bool {
+	return ctx.Value(sensitiveKey{}) != nil
+}
+
+// redactEvent returns the event with its sensitive text masked.
+// The arguments and output of commands run by sensitive steps are
+// masked entirely.
+func redactEvent(ctx context.Context, e Event) Event {
+	r := contextRedactor(ctx)
+	if sensitive(ctx) && e.Type == EventCommandOutput {
+		e.Output = redactedText
+	}
+	if len(e.Args) > 0 {
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = r.redact(arg)
+		}
+		if sensitive(ctx) {
+			args = redactCommandArgs(args)
+		}
+		e.Args = args
+	}
+	e.Error = r.redact(e.Error)
+	e.Output = r.redact(e.Output)
+	e.Message = r.redact(e.Message)
+	return e
+}
+
+// redactCommandArgs masks the arguments of a command run in the build
+// container by a sensitive step: those following "--", if any.
+func redactCommandArgs(args []string) []string {
+	for i, arg := range args {
+		if arg == "--" {
+			masked := append([]string{}, args[:i+1]...)
+			if i+1 < len(args) {
+				masked = append(masked, redactedText)
+			}
+			return masked
+		}
+	}
+	return args
+}
+
+// redactWriter returns a writer that writes the lines written to it
+// to w with the sensitive text masked, or nothing for the commands of
+// sensitive steps. The returned function must be called once the
+// command has finished, to write any trailing partial line.
+func redactWriter(ctx context.Context, w io.Writer) (io.Writer, func()) {
+	r := contextRedactor(ctx)
+	if r == nil && !sensitive(ctx) {
+		return w, func() {}
+	}
+	if sensitive(ctx) {
+		return ioutil.Discard, func() {}
+	}
+	lw := &lineWriter{emit: func(line string) {
+		io.WriteString(w, r.redact(line)+"\n")
+	}}
+	return lw, lw.flush
+}
+
+// SensitiveProvisioner is a Provisioner that runs another provisioner
+// whose commands or output are secret, such as one passing a token to
+// a registration command. The arguments and output of the commands it
+// runs in the build container are masked in the build's logs and
+// events, and the provisioner is not described in diagnostics
+// bundles.
+type SensitiveProvisioner struct {
+	Provisioner Provisioner
+}
+
+// Run is part of the Provisioner interface.
+func (p SensitiveProvisioner) Run(ctx context.Context, container string) error {
+	logf(ctx, "Running sensitive step; its commands and output are not logged")
+	return p.Provisioner.Run(context.WithValue(ctx, sensitiveKey{}, true), container)
+}
+
+// hideSensitive returns the provisioners with those wrapped by
+// sensitive provisioners removed, so that they are not recorded.
+func hideSensitive(provisioners []Provisioner) []Provisioner {
+	hidden := make([]Provisioner, len(provisioners))
+	for i, p := range provisioners {
+		switch p := p.(type) {
+		case SensitiveProvisioner:
+			hidden[i] = SensitiveProvisioner{}
+		case ConditionalProvisioner:
+			p.Provisioner = hideSensitive([]Provisioner{p.Provisioner})[0]
+			hidden[i] = p
+		case ParallelProvisioner:
+			steps := make([]ParallelStep, len(p.Steps))
+			for j, s := range p.Steps {
+				s.Provisioner = hideSensitive([]Provisioner{s.Provisioner})[0]
+				steps[j] = s
+			}
+			p.Steps = steps
+			hidden[i] = p
+		default:
+			hidden[i] = p
+		}
+	}
+	return hidden
+}
@@ -0,0 +1,156 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// lxcRemote is an lxc remote, as reported by "lxc remote list".
+type lxcRemote struct {
+	Addr     string `json:"Addr"`
+	Protocol string `json:"Protocol"`
+	Public   bool   `json:"Public"`
+}
+
+// local reports whether the remote is an LXD server on this host,
+// reached through its unix socket.
+func (r lxcRemote) local() bool {
+	return strings.HasPrefix(r.Addr, "unix:")
+}
+
+// imageServer reports whether the remote is a simplestreams image
+// server, from which images can be launched but not published to.
+func (r lxcRemote) imageServer() bool {
+	return r.Protocol == "simplestreams"
+}
+
+// listRemotes returns the user's lxc remotes, keyed by name.
+func listRemotes(ctx context.Context) (map[string]lxcRemote, error) {
+	out, err := runOutput(ctx, "lxc", "remote", "list", "--format=json")
+	if err != nil {
+		return nil, err
+	}
+	remotes := make(map[string]lxcRemote)
+	if err := json.Unmarshal(out, &remotes); err != nil {
+		return nil, fmt.Errorf("parsing lxc remotes: %w", err)
+	}
+	return remotes, nil
+}
+
+// defaultRemote returns the name of the user's default lxc remote,
+// which unqualified image and container names refer to.
+func defaultRemote(ctx context.Context) (string, error) {
+	out, err := runOutput(ctx, "lxc", "remote", "get-default")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// resolveRemotes checks the remotes named in the options against the
+// user's lxc remotes, so that mistakes are reported before anything
+// is built, and returns the options with the build remote set to the
+// default remote if none was specified and the default is not "local".
+// Names are resolved as the lxc client resolves them, so remotes are
+// referred to by name rather than by URL.
+func resolveRemotes(ctx context.Context, opts Options) (Options, error) {
+	remotes, err := listRemotes(ctx)
+	if err != nil {
+		return opts, err
+	}
+	lookup := func(what, name string) (lxcRemote, error) {
+		if name == "" {
+			name = "local"
+		}
+		remote, ok := remotes[name]
+		if !ok {
+			names := make([]string, 0, len(remotes))
+			for name := range remotes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return remote, fmt.Errorf(
+				"%s %q is not a known lxc remote (known remotes: %s)",
+				what, name, strings.Join(names, ", "),
+			)
+		}
+		return remote, nil
+	}
+	if opts.Remote == "" {
+		name, err := defaultRemote(ctx)
+		if err != nil {
+			return opts, err
+		}
+		if name != "local" {
+			logf(ctx, "Building on the default remote %q", name)
+			opts.Remote = name
+		}
+	}
+	remote, err := lookup("build remote", opts.Remote)
+	if err != nil {
+		return opts, err
+	}
+	if remote.imageServer() {
+		return opts, fmt.Errorf("build remote %q is an image server; images cannot be built on it", opts.Remote)
+	}
+	if runtime.GOOS != "linux" {
+		if err := checkClientRemote(opts, remote); err != nil {
+			return opts, err
+		}
+	}
+	for _, image := range append([]string{opts.Image}, opts.ImageFallbacks...) {
+		if name, _ := splitImage(image); name != "" {
+			if _, err := lookup("image remote", name); err != nil {
+				return opts, err
+			}
+		}
+	}
+	for _, name := range opts.PushRemotes {
+		if sameRemote(name, opts.Remote) {
+			return opts, fmt.Errorf("push remote %q is the build remote", name)
+		}
+		remote, err := lookup("push remote", name)
+		if err != nil {
+			return opts, err
+		}
+		if remote.imageServer() {
+			return opts, fmt.Errorf("push remote %q is an image server; images cannot be pushed to it", name)
+		}
+	}
+	if opts.JujuRemote != "" {
+		if _, err := lookup("Juju remote", opts.JujuRemote); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// checkClientRemote checks that the build remote can be used from a
+// client other than Linux, such as macOS or Windows, where LXD does not
+// run: it must be a remote Linux LXD server, and so cannot mount the
+// client's directories.
+func checkClientRemote(opts Options, remote lxcRemote) error {
+	if remote.local() {
+		name := opts.Remote
+		if name == "" {
+			name = "local"
+		}
+		return fmt.Errorf(
+			"build remote %q is a local LXD, which %s clients do not have; "+
+				"add a remote Linux LXD server with \"lxc remote add\", and build on it with -remote",
+			name, runtime.GOOS,
+		)
+	}
+	if opts.LocalRepo != "" {
+		return fmt.Errorf(
+			"local repository %s cannot be mounted into a container on remote %q from a %s client; "+
+				"serve it over HTTP, and use -repo-file instead",
+			opts.LocalRepo, opts.Remote, runtime.GOOS,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package imagebuilder_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+func TestBuildDefaultRemote(t *testing.T) {
+	fake := newFake(t)
+	fake.Remotes["builder"] = "https://10.0.0.1:8443"
+	fake.DefaultRemote = "builder"
+	if _, err := build(t, imagebuilder.Options{Runner: fake}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Image("builder:"+imagebuilder.DefaultAlias) == nil {
+		t.Errorf("image not published to the default remote")
+	}
+	if images := fake.Images("local"); len(images) != 0 {
+		t.Errorf("got %d images in the local store, expected none", len(images))
+	}
+}
+
+func TestBuildRemotesInvalid(t *testing.T) {
+	for _, test := range []struct {
+		about         string
+		defaultRemote string
+		opts          imagebuilder.Options
+		expect        string
+	}{{
+		about:  "unknown build remote",
+		opts:   imagebuilder.Options{Remote: "nosuch"},
+		expect: `build remote "nosuch" is not a known lxc remote (known remotes: builder, images, local)`,
+	}, {
+		about:  "image server build remote",
+		opts:   imagebuilder.Options{Remote: "images"},
+		expect: `build remote "images" is an image server`,
+	}, {
+		about:  "unknown image remote",
+		opts:   imagebuilder.Options{Image: "nosuch:centos/7"},
+		expect: `image remote "nosuch" is not a known lxc remote`,
+	}, {
+		about:  "unknown push remote",
+		opts:   imagebuilder.Options{PushRemotes: []string{"nosuch"}},
+		expect: `push remote "nosuch" is not a known lxc remote`,
+	}, {
+		about:         "push remote is the default build remote",
+		defaultRemote: "builder",
+		opts:          imagebuilder.Options{PushRemotes: []string{"builder"}},
+		expect:        `push remote "builder" is the build remote`,
+	}, {
+		about:  "image server push remote",
+		opts:   imagebuilder.Options{PushRemotes: []string{"images"}},
+		expect: `push remote "images" is an image server`,
+	}} {
+		fake := newFake(t)
+		fake.Remotes["builder"] = "https://10.0.0.1:8443"
+		fake.DefaultRemote = test.defaultRemote
+		test.opts.Runner = fake
+		_, err := build(t, test.opts)
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("%s: got error %v, expected %q", test.about, err, test.expect)
+		}
+		for _, c := range fake.Commands() {
+			if len(c) > 1 && c[0] == "lxc" && c[1] == "launch" {
+				t.Errorf("%s: container launched", test.about)
+			}
+		}
+	}
+}
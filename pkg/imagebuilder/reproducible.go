@@ -0,0 +1,102 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvSourceDateEpoch is the environment variable holding the time,
+// in seconds since the Unix epoch, that reproducible builds clamp
+// timestamps to; see https://reproducible-builds.org/specs/source-date-epoch/.
+const EnvSourceDateEpoch = "SOURCE_DATE_EPOCH"
+
+// sourceDateEpoch returns the time in $SOURCE_DATE_EPOCH.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv(EnvSourceDateEpoch)
+	if v == "" {
+		return time.Time{}, fmt.Errorf("reproducible builds require $%s to be set", EnvSourceDateEpoch)
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid $%s %q", EnvSourceDateEpoch, v)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// normaliseHeader normalises a tar header for a reproducible
+// tarball: modification times are truncated to the second and
+// clamped to sourceDate, access and change times are dropped,
+// and owner names are dropped in favour of the numeric IDs.
+func normaliseHeader(h *tar.Header, sourceDate time.Time) {
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	if h.ModTime.After(sourceDate) {
+		h.ModTime = sourceDate
+	}
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	h.Uname = ""
+	h.Gname = ""
+	for _, key := range []string{"atime", "ctime", "mtime", "uname", "gname"} {
+		delete(h.PAXRecords, key)
+	}
+	h.Format = tar.FormatUnknown
+}
+
+// tarEntry records the location of an entry's
+// contents in an uncompressed tarball.
+type tarEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// indexTarball returns the entries of the uncompressed tarball,
+// sorted by name.
+func indexTarball(f *os.File) ([]tarEntry, error) {
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	var entries []tarEntry
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeGNUSparse || hasSparseRecords(h) {
+			return nil, fmt.Errorf("cannot reproducibly rewrite sparse file %q", h.Name)
+		}
+		entries = append(entries, tarEntry{header: h, offset: cr.n})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].header.Name < entries[j].header.Name
+	})
+	return entries, nil
+}
+
+func hasSparseRecords(h *tar.Header) bool {
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader is an io.Reader that
+// counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
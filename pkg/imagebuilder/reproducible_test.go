@@ -0,0 +1,248 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestNormaliseHeader(t *testing.T) {
+	sourceDate := time.Unix(1577836800, 0).UTC()
+	h := &tar.Header{
+		Name:       "rootfs/etc/motd",
+		ModTime:    sourceDate.Add(time.Hour + time.Millisecond),
+		AccessTime: sourceDate,
+		ChangeTime: sourceDate,
+		Uname:      "root",
+		Gname:      "root",
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{
+			"atime":                         "1577836800",
+			"ctime":                         "1577836800",
+			"mtime":                         "1577840400.001",
+			"uname":                         "root",
+			"gname":                         "root",
+			"SCHILY.xattr.security.selinux": motdLabel,
+			"SCHILY.xattr.user.comment":     "motd",
+		},
+	}
+	normaliseHeader(h, sourceDate)
+	if !h.ModTime.Equal(sourceDate) {
+		t.Errorf("got modification time %v, expected %v", h.ModTime, sourceDate)
+	}
+	if !h.AccessTime.IsZero() || !h.ChangeTime.IsZero() {
+		t.Errorf("access and change times not dropped")
+	}
+	if h.Uname != "" || h.Gname != "" {
+		t.Errorf("owner names not dropped")
+	}
+	expect := map[string]string{
+		"SCHILY.xattr.security.selinux": motdLabel,
+		"SCHILY.xattr.user.comment":     "motd",
+	}
+	if len(h.PAXRecords) != len(expect) {
+		t.Errorf("got PAX records %v, expected %v", h.PAXRecords, expect)
+	}
+	for key, value := range expect {
+		if h.PAXRecords[key] != value {
+			t.Errorf("%s: got %q, expected %q", key, h.PAXRecords[key], value)
+		}
+	}
+}
+
+func TestRewriteImageTarballReproducible(t *testing.T) {
+	defer os.Setenv(EnvSourceDateEpoch, os.Getenv(EnvSourceDateEpoch))
+	os.Setenv(EnvSourceDateEpoch, "1577836800")
+	sourceDate, err := sourceDateEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { timeNow = time.Now }()
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		// The rewrite consumes the tarball, so each is written
+		// afresh, as is the image file, and the directories
+		// created for the image file are stamped with a later
+		// time than the last rewrite's.
+		clock := sourceDate.Add(time.Duration(i+1) * time.Hour)
+		timeNow = func() time.Time { return clock }
+		dir, err := ioutil.TempDir("", "imagebuilder-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		tarball := writeTestTarball(t, dir,
+			testEntry{name: "rootfs/etc/motd", content: "Welcome\n", label: motdLabel},
+			testEntry{name: "rootfs/etc/", label: etcLabel},
+			testEntry{name: "rootfs/etc/centos-release", content: "CentOS Linux release 7.7.1908 (Core)\n"},
+		)
+		source := filepath.Join(dir, "juju")
+		if err := ioutil.WriteFile(source, []byte("juju ALL=(ALL) NOPASSWD:ALL\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tmpdir := filepath.Join(dir, "out")
+		if err := os.Mkdir(tmpdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		out, _, err := rewriteImageTarball(
+			context.Background(), tarball, tmpdir,
+			map[string]string{"user.team": "juju"},
+			sourceDate, TarballFormat{}, idMapping{}, cloudInitTemplates,
+			[]ImageFile{{Source: source, Destination: "/etc/sudoers.d/juju", Mode: 0440}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+
+		headers := readTestTarball(t, out)
+		for name, h := range headers {
+			if h.ModTime.After(sourceDate) {
+				t.Errorf("%s: modification time %v not clamped", name, h.ModTime)
+			}
+		}
+		for name, label := range map[string]string{
+			"rootfs/etc":                etcLabel,
+			"rootfs/etc/motd":           motdLabel,
+			"rootfs/etc/sudoers.d":      etcLabel,
+			"rootfs/etc/sudoers.d/juju": etcLabel,
+		} {
+			if got := headers[name].PAXRecords[selinuxXattr]; got != label {
+				t.Errorf("%s: got label %q, expected %q", name, got, label)
+			}
+		}
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("rewriting the same tarball twice gave different outputs")
+	}
+}
+
+// goldenFormats are the tarball formats that
+// TestCreateFinalTarballGolden writes, keyed by the names
+// the golden hashes are recorded under.
+var goldenFormats = map[string]TarballFormat{
+	"default":          {},
+	"gzip-mtime":       {GzipModTime: 1577836800},
+	"gzip-os-unix":     {GzipOS: "unix"},
+	"gzip-os-fat":      {GzipOS: "fat"},
+	"gzip-mtime-os-42": {GzipModTime: 1577836800, GzipOS: "42"},
+}
+
+// readGolden reads the SHA-256 hashes in the golden file, which
+// has the format sha256sum writes, keyed by the names after them.
+func readGolden(t *testing.T, name string) map[string]string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			t.Fatalf("%s: invalid line %q", name, scanner.Text())
+		}
+		hashes[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+// TestCreateFinalTarballGolden checks that the tarball written for
+// testdata/reproducible.tar, with testdata/sudoers added, is the one
+// recorded in testdata/reproducible.sha256, byte for byte, for each
+// of goldenFormats. The tarballs are written uncompressed, in gzip's
+// stored blocks, so that the hashes do not depend on the DEFLATE
+// encoder of the Go release. Run "go test -update" to rewrite the
+// hashes after an intended change to the output.
+func TestCreateFinalTarballGolden(t *testing.T) {
+	sourceDate := time.Unix(1577836800, 0).UTC()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return sourceDate.Add(time.Hour) }
+
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metadata := []byte("architecture: x86_64\ncreation_date: 1577836800\n")
+	golden := filepath.Join("testdata", "reproducible.sha256")
+
+	hashes := make(map[string]string)
+	for name, format := range goldenFormats {
+		out := filepath.Join(dir, name+".tar.gz")
+		_, err := createFinalTarball(
+			context.Background(), out, filepath.Join("testdata", "reproducible.tar"),
+			metadata, gzip.NoCompression, sourceDate, format, &idMapping{}, cloudInitTemplates,
+			[]ImageFile{{
+				Source:      filepath.Join("testdata", "sudoers"),
+				Destination: "/etc/sudoers.d/juju",
+				Mode:        0440,
+			}},
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:])
+
+		// The gzip header records what the format asks for.
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expectOS, _ := format.gzipOS()
+		if zr.Header.OS != expectOS {
+			t.Errorf("%s: got gzip OS %d, expected %d", name, zr.Header.OS, expectOS)
+		}
+		if got := zr.Header.ModTime; format.GzipModTime == 0 && !got.IsZero() ||
+			format.GzipModTime != 0 && got.Unix() != format.GzipModTime {
+			t.Errorf("%s: got gzip modification time %v", name, got)
+		}
+	}
+
+	if *updateGolden {
+		var buf bytes.Buffer
+		for _, name := range sortedKeys(hashes) {
+			fmt.Fprintf(&buf, "%s  %s\n", hashes[name], name)
+		}
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := readGolden(t, golden)
+	for name := range goldenFormats {
+		if hashes[name] != expect[name] {
+			t.Errorf("%s: got SHA-256 %s, expected %s", name, hashes[name], expect[name])
+		}
+	}
+	if len(expect) != len(goldenFormats) {
+		t.Errorf("%s has %d hashes, expected %d", golden, len(expect), len(goldenFormats))
+	}
+}
@@ -0,0 +1,182 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// PropertyRetemplated records when the image's templates
+// were last updated by RetemplateImage, and by which version of the
+// builder, as "<RFC 3339 time> <version>".
+const PropertyRetemplated = "user.build.retemplated"
+
+// RetemplateOptions holds the options for RetemplateImage.
+type RetemplateOptions struct {
+	// Alias is the alias of the image to update.
+	Alias string
+
+	// Remote is the lxc remote holding the image. If empty,
+	// the default remote is used.
+	Remote string
+
+	// Properties holds additional user.* properties to record
+	// on the image.
+	Properties map[string]string
+
+	// TemplateSet and TemplateSets select the templates to update
+	// images with, as for Options.TemplateSet and Options.TemplateSets.
+	TemplateSet  string
+	TemplateSets map[string]TemplateSet
+
+	// TemplateTriggers holds the events to render the
+	// templates on, as for Options.TemplateTriggers.
+	TemplateTriggers map[string][]string
+}
+
+// RetemplateImage updates the templates of an image
+// already in the remote's image store to those of this version of the
+// builder, without rebuilding it: the image is exported, its templates
+// and properties updated as a build does, and the result imported in
+// its place, with its aliases and properties. The original image is
+// then deleted. The fingerprint of the updated image is returned.
+//
+// Only unified images can be updated. The updated image is private,
+// as imported images are.
+func RetemplateImage(ctx context.Context, opts RetemplateOptions) (string, error) {
+	templates, err := retemplateTemplates(opts)
+	if err != nil {
+		return "", err
+	}
+	images, err := listImages(ctx, opts.Remote)
+	if err != nil {
+		return "", err
+	}
+	var image *ImageInfo
+	for i := range images {
+		for _, a := range images[i].Aliases {
+			if a.Name == opts.Alias {
+				image = &images[i]
+			}
+		}
+	}
+	if image == nil {
+		return "", fmt.Errorf("image %q not found", qualify(opts.Remote, opts.Alias))
+	}
+	return retemplateImage(detectLXD(ctx), opts, templates, image)
+}
+
+// RetemplateBuiltImages updates the templates of every
+// image in the remote's image store built by this package, as
+// RetemplateImage does, e.g. to fix a broken template everywhere at
+// once. It stops at the first image that cannot be updated.
+// opts.Alias must be empty. The fingerprints of the updated images
+// are returned.
+func RetemplateBuiltImages(ctx context.Context, opts RetemplateOptions) ([]string, error) {
+	if opts.Alias != "" {
+		return nil, fmt.Errorf("cannot specify an alias when updating all images")
+	}
+	templates, err := retemplateTemplates(opts)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ListBuiltImages(ctx, opts.Remote)
+	if err != nil {
+		return nil, err
+	}
+	ctx = detectLXD(ctx)
+	var fingerprints []string
+	for i := range images {
+		if isIntermediateImage(&images[i]) {
+			// Belongs to a build still in progress.
+			continue
+		}
+		fingerprint, err := retemplateImage(ctx, opts, templates, &images[i])
+		if err != nil {
+			return fingerprints, err
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, nil
+}
+
+// retemplateTemplates checks the properties to update images with,
+// and returns the templates to update them with.
+func retemplateTemplates(opts RetemplateOptions) (map[string]template, error) {
+	for _, key := range sortedKeys(opts.Properties) {
+		if !strings.HasPrefix(key, "user.") {
+			return nil, fmt.Errorf("invalid property %q: only user.* properties may be set", key)
+		}
+	}
+	return resolveTemplates(opts.TemplateSet, opts.TemplateSets, opts.TemplateTriggers)
+}
+
+// retemplateImage updates the templates of the image, moving
+// all of its aliases to the updated image.
+func retemplateImage(ctx context.Context, opts RetemplateOptions, templates map[string]template, image *ImageInfo) (string, error) {
+	var aliases []string
+	for _, a := range image.Aliases {
+		aliases = append(aliases, a.Name)
+	}
+	name := image.Fingerprint
+	if len(aliases) > 0 {
+		name = aliases[0]
+	}
+
+	tmpRoot, err := hostTempDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	tmpdir, err := ioutil.TempDir(tmpRoot, "juju-lxd-centos-retemplate")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	logf(ctx, "Updating the templates of %s (%s)", qualify(opts.Remote, name), image.Fingerprint)
+	properties := make(map[string]string)
+	for key, value := range image.Properties {
+		properties[key] = value
+	}
+	for key, value := range opts.Properties {
+		properties[key] = value
+	}
+	properties[PropertyRetemplated] = time.Now().UTC().Format(time.RFC3339) + " " + Version
+	tarball, _, err := updateImageTemplates(
+		ctx, opts.Remote, image.Fingerprint, tmpdir, properties,
+		time.Time{}, TarballFormat{}, idMapping{}, templates, nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	// The aliases are only moved from the original
+	// image once the updated image has been imported.
+	fingerprint, err := importImage(ctx, opts.Remote, aliases, templates, tarball)
+	if err != nil {
+		return "", err
+	}
+	// Carry over the properties set on the image after it was
+	// imported, which are not in its metadata.
+	if err := setImageProperties(ctx, qualify(opts.Remote, fingerprint), properties); err != nil {
+		return "", err
+	}
+	if err := lxc(ctx, "image", "delete", qualify(opts.Remote, image.Fingerprint)); err != nil {
+		return "", err
+	}
+	logf(ctx, "Updated %s: %s", qualify(opts.Remote, name), fingerprint)
+	return fingerprint, nil
+}
+
+// isIntermediateImage reports whether the image is the intermediate
+// image of a build.
+func isIntermediateImage(image *ImageInfo) bool {
+	for _, a := range image.Aliases {
+		if strings.HasPrefix(a.Name, intermediateAliasPrefix) {
+			return true
+		}
+	}
+	return false
+}
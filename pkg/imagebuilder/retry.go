@@ -0,0 +1,68 @@
+package imagebuilder
+
+import (
+	"context"
+	"time"
+)
+
+// retrySnapshot is the name of the snapshot of the build container
+// taken before each attempt at a provisioning step that may be
+// retried.
+const retrySnapshot = "juju-lxd-centos-retry"
+
+// stepRetryDelay is the delay before the first retry of a failed
+// provisioning step. The delay doubles with each retry.
+var stepRetryDelay = 5 * time.Second
+
+// stepRetry is a policy for retrying failed provisioning steps.
+type stepRetry struct {
+	// retries is the number of times to retry a failed step.
+	retries int
+
+	// restored, if non-nil, is called after the container is
+	// restored and before the step is retried, e.g. to wait for
+	// its network.
+	restored func(ctx context.Context) error
+}
+
+// run runs the provisioning step in the container. If the step fails,
+// the container is restored to its state before the step, and the
+// step is retried, up to r.retries times. If r is nil, the step is
+// run once.
+func (r *stepRetry) run(ctx context.Context, container string, s step) error {
+	if r == nil || r.retries == 0 {
+		return s.provisioner.Run(ctx, container)
+	}
+	if err := lxc(ctx, "snapshot", container, retrySnapshot); err != nil {
+		return err
+	}
+	defer func() {
+		// Clean up even if the build has been cancelled.
+		if err := lxc(detach(ctx), "delete", container+"/"+retrySnapshot); err != nil {
+			logf(ctx, "Deleting snapshot: %v", err)
+		}
+	}()
+	delay := stepRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.provisioner.Run(ctx, container)
+		if err == nil || attempt > r.retries || ctx.Err() != nil {
+			return err
+		}
+		logf(ctx,
+			"Step %s failed (attempt %d of %d): %v; restoring the container and retrying in %v",
+			s.name, attempt, r.retries+1, err, delay,
+		)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		if err := lxc(ctx, "restore", container, retrySnapshot); err != nil {
+			return err
+		}
+		if r.restored != nil {
+			if err := r.restored(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PropertyVulnerabilities records the number of vulnerabilities
+// found by the scan at each severity, e.g. "critical=0,high=2",
+// for images built with Options.ScanCommand.
+const PropertyVulnerabilities = "user.scan.vulnerabilities"
+
+// Severities, in increasing order of severity.
+var severities = []string{"unknown", "low", "medium", "high", "critical"}
+
+// Vulnerability is a vulnerability reported by a scanner.
+type Vulnerability struct {
+	// ID identifies the vulnerability, e.g. "CVE-2020-1234".
+	ID string `json:"id"`
+
+	// Package is the name of the affected package.
+	Package string `json:"package"`
+
+	// Severity is one of "unknown", "low", "medium",
+	// "high" or "critical".
+	Severity string `json:"severity"`
+
+	// FixedIn, if non-empty, is the package version
+	// that fixes the vulnerability.
+	FixedIn string `json:"fixed-in,omitempty"`
+}
+
+// packageQueryFormat is the rpm --queryformat for listing installed
+// packages, one per line as name<TAB>epoch:version-release.arch.
+const packageQueryFormat = `%{NAME}\t%{EPOCH}:%{VERSION}-%{RELEASE}.%{ARCH}\n`
+
+// severityRank returns the rank of the severity, with higher
+// values being more severe, or -1 if it is not recognised.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if strings.EqualFold(s, severity) {
+			return i
+		}
+	}
+	return -1
+}
+
+// scanContainer lists the packages installed in the container,
+// writing them to a temporary file, and runs the scanner command
+// with the path to the file. The scanner must write a JSON array of
+// vulnerabilities to stdout. If any vulnerability is at least as
+// severe as failSeverity, a *ScanError is returned.
+func scanContainer(
+	ctx context.Context,
+	container, scanCommand, failSeverity string,
+) ([]Vulnerability, error) {
+	logf(ctx, "Scanning for vulnerabilities")
+	packages, err := runOutput(
+		ctx, "lxc", "exec", container, "--",
+		"rpm", "-qa", "--queryformat", packageQueryFormat,
+	)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "juju-lxd-centos-packages")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(packages); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	out, err := runOutput(ctx, scanCommand, f.Name())
+	if err != nil {
+		return nil, err
+	}
+	var vulns []Vulnerability
+	if err := json.Unmarshal(out, &vulns); err != nil {
+		return nil, fmt.Errorf("parsing %s output: %v", scanCommand, err)
+	}
+	sort.SliceStable(vulns, func(i, j int) bool {
+		return severityRank(vulns[i].Severity) > severityRank(vulns[j].Severity)
+	})
+	for _, v := range vulns {
+		logf(ctx, "%s (%s) in %s", v.ID, v.Severity, v.Package)
+	}
+
+	if failSeverity == "" {
+		return vulns, nil
+	}
+	threshold := severityRank(failSeverity)
+	var failed []Vulnerability
+	for _, v := range vulns {
+		if severityRank(v.Severity) >= threshold {
+			failed = append(failed, v)
+		}
+	}
+	if len(failed) > 0 {
+		return vulns, &ScanError{Severity: failSeverity, Vulnerabilities: failed}
+	}
+	return vulns, nil
+}
+
+// vulnerabilitySummary returns the value of the
+// PropertyVulnerabilities property for vulns.
+func vulnerabilitySummary(vulns []Vulnerability) string {
+	counts := make(map[string]int)
+	for _, v := range vulns {
+		counts[strings.ToLower(v.Severity)]++
+	}
+	var parts []string
+	for i := len(severities) - 1; i >= 0; i-- {
+		parts = append(parts, fmt.Sprintf("%s=%d", severities[i], counts[severities[i]]))
+	}
+	return strings.Join(parts, ",")
+}
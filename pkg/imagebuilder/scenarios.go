@@ -0,0 +1,281 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TestScenarioAll names every test scenario, for
+// Options.TestScenarios.
+const TestScenarioAll = "all"
+
+// testMarker is the file written by the user-data
+// test scenario's cloud-config.
+const testMarker = "/run/juju-lxd-centos-test"
+
+// cloudInitLog is cloud-init's log file, which is checked for
+// problems by each test scenario.
+const cloudInitLog = "/var/log/cloud-init.log"
+
+// cloudInitLogProblems match the lines of cloud-init's log that show
+// the image's templates or datasource to be misconfigured, even if
+// the instance still booted: errors, and warnings about the
+// cloud-config schema, templates, or the datasource and its seed.
+var cloudInitLogProblems = []*regexp.Regexp{
+	regexp.MustCompile(`\[(ERROR|CRITICAL)\]`),
+	regexp.MustCompile(`(?i)\[WARNING\].*(schema|invalid cloud-config|invalid config|template|jinja|datasource|data source|seed)`),
+}
+
+// maxLogProblems is the number of problems found in
+// cloud-init's log to describe in errors.
+const maxLogProblems = 5
+
+// testScenario describes a configuration to start an instance of the
+// built image with, exercising a branch of its cloud-init templates,
+// and how to check that the instance came up as configured.
+type testScenario struct {
+	description string
+	config      map[string]string
+	check       func(ctx context.Context, instance string) error
+}
+
+var testScenarios = map[string]testScenario{
+	"default": {
+		description: "no user-data or network-config: the default network config brings up eth0 with DHCP",
+		check: func(ctx context.Context, instance string) error {
+			return waitContainerNetwork(ctx, instance, NetworkWait{Interface: "eth0"})
+		},
+	},
+	"user-data": {
+		description: "custom user-data (user.user-data) is applied",
+		config: map[string]string{
+			"user.user-data": "#cloud-config\nwrite_files:\n- path: " + testMarker + "\n  content: juju-lxd-centos\n",
+		},
+		check: func(ctx context.Context, instance string) error {
+			out, err := runOutput(ctx, "lxc", "exec", instance, "--", "cat", testMarker)
+			if err != nil {
+				return fmt.Errorf("file written by user-data not found: %v", err)
+			}
+			if strings.TrimSpace(string(out)) != "juju-lxd-centos" {
+				return fmt.Errorf("unexpected content in file written by user-data: %q", out)
+			}
+			return nil
+		},
+	},
+	"network-config": {
+		description: "custom network config (user.network-config) replaces the default",
+		config: map[string]string{
+			"user.network-config": "version: 1\nconfig:\n  - type: physical\n    name: eth0\n    mtu: 1400\n" +
+				"    subnets:\n      - type: dhcp\n        control: auto\n",
+		},
+		check: func(ctx context.Context, instance string) error {
+			if err := waitContainerNetwork(ctx, instance, NetworkWait{Interface: "eth0"}); err != nil {
+				return err
+			}
+			out, err := runOutput(ctx, "lxc", "exec", instance, "--", "cat", "/sys/class/net/eth0/mtu")
+			if err != nil {
+				return err
+			}
+			if mtu := strings.TrimSpace(string(out)); mtu != "1400" {
+				return fmt.Errorf("network config not applied: eth0 has MTU %s, expected 1400", mtu)
+			}
+			return nil
+		},
+	},
+	"link-local": {
+		description: "link-local network mode (user.network_mode=link-local) leaves eth0 unconfigured",
+		config: map[string]string{
+			"user.network_mode": "link-local",
+		},
+		check: func(ctx context.Context, instance string) error {
+			status, err := getContainerStatus(ctx, instance)
+			if err != nil {
+				return err
+			}
+			if (NetworkWait{Interface: "eth0"}).ready(status) {
+				return fmt.Errorf("eth0 has a global IPv4 address in link-local mode")
+			}
+			return nil
+		},
+	},
+}
+
+// TestScenarioNames returns the sorted names of the known
+// test scenarios.
+func TestScenarioNames() []string {
+	names := make([]string, 0, len(testScenarios))
+	for name := range testScenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestScenarioDescription returns a short description of the named
+// test scenario, or the empty string if there is no such scenario.
+func TestScenarioDescription(name string) string {
+	return testScenarios[name].description
+}
+
+// ScenarioResult holds the outcome of a test scenario
+// (see Options.TestScenarios).
+type ScenarioResult struct {
+	// Name is the name of the scenario.
+	Name string `json:"name"`
+
+	// Passed reports whether the instance started
+	// as the scenario expects.
+	Passed bool `json:"passed"`
+
+	// Error describes why the scenario failed,
+	// if it did.
+	Error string `json:"error,omitempty"`
+
+	// Duration is how long the scenario took.
+	Duration time.Duration `json:"duration"`
+}
+
+// testScenarioNames returns the names of the scenarios to run, in the
+// order specified, expanding TestScenarioAll. Scenarios named more
+// than once are only run once.
+func testScenarioNames(names []string) ([]string, error) {
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		all := []string{name}
+		if name == TestScenarioAll {
+			all = TestScenarioNames()
+		} else if _, ok := testScenarios[name]; !ok {
+			return nil, fmt.Errorf(
+				"unknown test scenario %q, expected %s or one of: %s",
+				name, TestScenarioAll, strings.Join(TestScenarioNames(), ", "),
+			)
+		}
+		for _, name := range all {
+			if !seen[name] {
+				seen[name] = true
+				expanded = append(expanded, name)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// runTestScenarios starts an instance of the image on the remote for
+// each of the named scenarios in turn, checking that cloud-init
+// succeeds and that the instance is configured as the scenario
+// expects. Every scenario is run, and the results returned; the error
+// is non-nil if any failed.
+//
+// If capture is non-nil, it is called with the scenario's name and
+// instance if the scenario fails, before the instance is deleted, so
+// that its logs can be captured.
+func runTestScenarios(
+	ctx context.Context, remote, image, prefix string, names []string,
+	capture func(name, instance string),
+) ([]ScenarioResult, error) {
+	var results []ScenarioResult
+	var failed []string
+	for _, name := range names {
+		start := time.Now()
+		instance := qualify(remote, prefix+"-"+name)
+		logf(ctx, "Running test scenario %s", name)
+		err := runTestScenario(ctx, testScenarios[name], image, instance, func() {
+			if capture != nil {
+				capture(name, instance)
+			}
+		})
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		result := ScenarioResult{Name: name, Passed: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, fmt.Sprintf("%s (%v)", name, err))
+			logf(ctx, "Test scenario %s failed: %v", name, err)
+		} else {
+			logf(ctx, "Test scenario %s passed", name)
+		}
+		results = append(results, result)
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("image failed test scenarios: %s", strings.Join(failed, "; "))
+	}
+	return results, nil
+}
+
+// runTestScenario runs a single scenario with the named instance,
+// calling onFailure if it fails. The instance is deleted afterwards.
+func runTestScenario(ctx context.Context, s testScenario, image, instance string, onFailure func()) (err error) {
+	args := []string{"launch", image, instance}
+	for _, key := range sortedKeys(s.config) {
+		args = append(args, "--config="+key+"="+s.config[key])
+	}
+	if err := lxc(ctx, args...); err != nil {
+		// The instance may have been created but not started.
+		succeeds(detach(ctx), "lxc", "delete", "--force", instance)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			onFailure()
+		}
+		if deleteErr := lxc(detach(ctx), "delete", "--force", instance); deleteErr != nil {
+			logf(ctx, "Deleting test instance: %v", deleteErr)
+		}
+	}()
+	if err := lxc(ctx, "exec", instance, "--", "cloud-init", "status", "--wait", "--long"); err != nil {
+		return fmt.Errorf("cloud-init failed: %v", err)
+	}
+	if err := checkCloudInitLog(ctx, instance); err != nil {
+		return err
+	}
+	return s.check(ctx, instance)
+}
+
+// checkCloudInitLog returns an error describing the problems that
+// cloud-init logged in the instance (see cloudInitLogProblems), if
+// any. These catch misconfigurations that do not stop cloud-init
+// from finishing, such as user-data failing schema validation or the
+// NoCloud seed not being found.
+func checkCloudInitLog(ctx context.Context, instance string) error {
+	out, err := runOutput(ctx, "lxc", "exec", instance, "--", "cat", cloudInitLog)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", cloudInitLog, err)
+	}
+	var problems []string
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, re := range cloudInitLogProblems {
+			if re.MatchString(line) {
+				problems = append(problems, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, problem := range problems {
+		logf(ctx, "cloud-init: %s", problem)
+	}
+	described := problems
+	if len(described) > maxLogProblems {
+		described = described[:maxLogProblems]
+	}
+	msg := strings.Join(described, "; ")
+	if n := len(problems) - len(described); n > 0 {
+		msg += fmt.Sprintf("; and %d more", n)
+	}
+	return fmt.Errorf("cloud-init logged %d problem(s): %s", len(problems), msg)
+}
+
+// testLogsDir returns the directory under dir that the logs
+// of a failed test scenario are captured in.
+func testLogsDir(dir, name string) string {
+	return filepath.Join(dir, "test-"+name)
+}
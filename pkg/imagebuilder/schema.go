@@ -0,0 +1,406 @@
+package imagebuilder
+
+import "fmt"
+
+// SchemaVersion is the version of the build spec (Config) and
+// manifest (Result) formats. It is incremented only for changes
+// that are not backwards compatible; new optional fields may be
+// added without changing it.
+const SchemaVersion = "1"
+
+// SpecSchema is the JSON Schema for build specs, in either
+// JSON or YAML form; see Config.
+const SpecSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/axw/juju-lxd-centos-image-builder/schema/v1/spec.json",
+  "title": "juju-lxd-centos-image-builder build spec",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "schema-version": {"const": "1"},
+    "extends": {"type": "string", "description": "Configuration file that this one builds on"},
+    "include": {"type": "array", "items": {"type": "string"}, "description": "Further configuration files to combine with this one"},
+    "image": {"type": "string", "description": "Base image to build from"},
+    "base": {"type": "string", "description": "Alias of a built image to build from instead of image"},
+    "vm": {"type": "boolean", "description": "Build a virtual machine image"},
+    "base-qcow2": {"type": "string", "description": "qcow2 cloud image to build a virtual machine image from instead of image"},
+    "skip-unchanged": {"type": "boolean", "description": "Skip the build if the base image and inputs are unchanged"},
+    "serial-on-change": {"type": "boolean", "description": "Only publish a new serial if the build changes the image's packages or inputs"},
+    "cache": {"type": "boolean", "description": "Cache the build container in LXD snapshots after each provisioning step"},
+    "alias": {"type": "string", "description": "Alias to publish the image under"},
+    "remote": {"type": "string", "description": "lxc remote on which to build and publish the image"},
+    "profiles": {"type": "array", "items": {"type": "string"}},
+    "build-packages": {"type": "array", "items": {"type": "string"}, "description": "Packages to install for provisioning and remove before publishing"},
+    "serial": {"type": "string"},
+    "image-fallbacks": {"type": "array", "items": {"type": "string"}, "description": "Images to build from, in order, if image is not found"},
+    "image-server": {"type": "string", "format": "uri", "description": "Simplestreams image server to take the base image from"},
+    "image-server-ca": {"type": "string", "description": "PEM certificate (of a private CA, or the server's own) to trust for the image server"},
+    "image-server-auth-file": {"type": "string", "description": "File holding user:password to authenticate to the image server with"},
+    "base-fingerprint": {"type": "string", "pattern": "^[0-9a-fA-F]{12,64}$", "description": "Expected fingerprint of the base image"},
+    "allow-os-mismatch": {"type": "boolean", "description": "Allow a base image whose distribution does not match the alias"},
+    "base-keyring": {"type": "string", "description": "GPG keyring to verify the base image's simplestreams metadata with"},
+    "offline": {"type": "boolean", "description": "Build without access to the internet"},
+    "no-host-network": {"type": "boolean", "description": "Build on a host without internet access, downloading base images on the LXD server"},
+    "no-container-network": {"type": "boolean", "description": "Build in a container without network access, installing packages only from local-repo"},
+    "network-wait": {
+      "type": "object",
+      "additionalProperties": false,
+      "description": "Criteria for the build container's network to be ready",
+      "properties": {
+        "family": {"enum": ["inet", "inet6", "any"], "description": "Address family of the global addresses to wait for"},
+        "interface": {"type": "string", "description": "Interface that must have an address"},
+        "min-interfaces": {"type": "integer", "minimum": 0, "description": "Number of interfaces that must have an address"},
+        "dns-host": {"type": "string", "description": "Host name that must resolve in the container"}
+      }
+    },
+    "dns": {"type": "array", "maxItems": 3, "items": {"type": "string"}, "description": "Nameservers (IP addresses) for the build container, instead of those its network configures"},
+    "nic": {
+      "type": "object",
+      "additionalProperties": false,
+      "description": "Addresses to pin on the build container's network device",
+      "properties": {
+        "device": {"type": "string", "description": "Name of the profile NIC to pin (default: eth0)"},
+        "mac": {"type": "string", "description": "MAC address of the device"},
+        "ipv4": {"type": "string", "format": "ipv4", "description": "IPv4 address to assign the device"},
+        "ipv6": {"type": "string", "format": "ipv6", "description": "IPv6 address to assign the device"}
+      }
+    },
+    "local-repo": {"type": "string", "description": "Host directory holding a yum repository to mount for offline builds"},
+    "repo-files": {"type": "array", "items": {"type": "string"}, "description": "Host yum .repo files to install for offline builds"},
+    "user-data": {"type": "string", "description": "Path of a cloud-init user-data file to apply at launch"},
+    "devices": {
+      "type": "object",
+      "description": "Devices to add to the build container, keyed by name",
+      "additionalProperties": {
+        "type": "object",
+        "required": ["type"],
+        "additionalProperties": {"type": "string"}
+      }
+    },
+    "container-config": {"type": "object", "additionalProperties": {"type": "string"}, "description": "LXD config for the build container, e.g. security.nesting"},
+    "launch-config": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Alias for container-config"},
+    "privileged": {"type": "boolean", "description": "Run the build container privileged"},
+    "image-format": {"enum": ["unified", "split"], "description": "Format of the published image: unified (a single tarball) or split (separate metadata and rootfs tarballs)"},
+    "max-size": {"type": "string", "pattern": "^[0-9]+([KkMmGgTt]([Ii]?[Bb])?|[Bb])?$", "description": "Maximum size of the published image, e.g. 2GiB"},
+    "skip-space-check": {"type": "boolean", "description": "Do not check that the build directory has space for the build before starting it"},
+    "limit-rate": {"type": "string", "pattern": "^[0-9]+([KkMmGgTt]([Ii]?[Bb])?|[Bb])?$", "description": "Bandwidth limit, per second, for image transfers and uploads, e.g. 10MiB"},
+    "selinux": {"enum": ["auto", "relabel", "off"], "description": "How to give files SELinux labels: auto, relabel (also relabel at first boot) or off"},
+    "description": {"type": "string", "description": "Description of the published image; may refer to variables as {{name}}"},
+    "properties": {"type": "object", "propertyNames": {"pattern": "^user\\."}, "additionalProperties": {"type": "string"}, "description": "Additional user.* properties of the published image; values may refer to variables as {{name}}"},
+    "recommended-config": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Instance config recommended for launching the image, e.g. limits.memory"},
+    "template-set": {"type": "string", "description": "Name of the set of templates to add to the image: nocloud-classic (the default), lxd-datasource, static-network, or one of template-sets"},
+    "template-sets": {
+      "type": "object",
+      "propertyNames": {"not": {"enum": ["nocloud-classic", "lxd-datasource", "static-network"]}},
+      "description": "Additional template sets, keyed by name",
+      "additionalProperties": {
+        "type": "object",
+        "minProperties": 1,
+        "propertyNames": {"pattern": "^/."},
+        "description": "Templates keyed by the absolute path of the file each renders",
+        "additionalProperties": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {
+            "source": {"type": "string", "description": "Path of the template on the host"},
+            "content": {"type": "string", "description": "The template itself, instead of source"},
+            "name": {"type": "string", "pattern": "^[^/]+$", "description": "File name of the template in the image (default: the base name of the file rendered, with .tpl appended)"},
+            "when": {"type": "array", "minItems": 1, "items": {"enum": ["create", "copy", "start"]}, "description": "Events on which LXD renders the template (default: create and copy)"},
+            "properties": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Values the template refers to as properties.<key>"}
+          },
+          "oneOf": [{"required": ["source"]}, {"required": ["content"]}]
+        }
+      }
+    },
+    "template-triggers": {
+      "type": "object",
+      "additionalProperties": {"type": "array", "minItems": 1, "items": {"enum": ["create", "copy", "start"]}},
+      "description": "Events on which LXD renders each template, keyed by the base name of the file rendered, e.g. meta-data, network-config, user-data or vendor-data (default: create and copy)"
+    },
+    "image-files": {
+      "type": "array",
+      "description": "Host files, and directories, to add to the image's rootfs as is, e.g. binary payloads",
+      "items": {
+        "type": "object",
+        "required": ["destination"],
+        "additionalProperties": false,
+        "properties": {
+          "source": {"type": "string", "description": "Path of the file on the host"},
+          "destination": {"type": "string", "pattern": "^/.", "description": "Absolute path of the file in the rootfs"},
+          "directory": {"type": "boolean", "description": "Create a directory at the destination instead of copying a file"},
+          "mode": {"type": "string", "pattern": "^[0-7]{3,4}$", "description": "Mode of the file (default: the host file's mode, or 0755 for directories)"},
+          "uid": {"type": "integer", "minimum": 0, "description": "Owner of the file (default: 0)"},
+          "gid": {"type": "integer", "minimum": 0, "description": "Group of the file (default: 0)"},
+          "user": {"type": "string", "description": "Name of the owner of the file in the image, instead of uid"},
+          "group": {"type": "string", "description": "Name of the group of the file in the image, instead of gid"}
+        },
+        "oneOf": [{"required": ["source"]}, {"required": ["directory"], "properties": {"directory": {"const": true}}}]
+      }
+    },
+    "bake-seed": {"type": "boolean", "description": "Also bake a static cloud-init NoCloud seed into the rootfs, for clones made outside LXD"},
+    "seed-instance-id": {"enum": ["serial", "alias"], "description": "What the baked seed's instance-id is derived from: the image's alias and serial, changing with every build, or its alias alone (default: serial)"},
+    "seed-user-data": {"type": "string", "description": "Path of the user-data to bake into the seed (default: an empty #cloud-config)"},
+    "seed-network-config": {"type": "string", "description": "Path of the network config to bake into the seed (default: DHCP on eth0)"},
+    "hooks": {
+      "type": "object",
+      "propertyNames": {"enum": ["pre-packages", "post-packages", "pre-cleanup", "pre-publish"]},
+      "additionalProperties": {"type": "array", "items": {"type": "string"}},
+      "description": "Shell commands to run in the build container at each hook point"
+    },
+    "build-args": {"type": "array", "items": {"type": "string", "pattern": "^[A-Za-z_][A-Za-z0-9_]*="}, "description": "Build arguments (KEY=VALUE) for provisioning steps"},
+    "build-secrets": {"type": "array", "items": {"type": "string", "pattern": "^[A-Za-z_][A-Za-z0-9_]*=(file|env):"}, "description": "Secret build arguments (KEY=file:PATH or KEY=env:NAME)"},
+    "redact": {"type": "array", "items": {"type": "string", "format": "regex"}, "description": "Regular expressions matching sensitive text to mask in logs and build artifacts"},
+    "step-retries": {"type": "integer", "minimum": 0, "description": "Number of times to retry a failed provisioning step"},
+    "keep-serials": {"type": "integer", "minimum": 0},
+    "keep-days": {"type": "integer", "minimum": 0},
+    "rollback": {"type": "integer", "minimum": 0, "description": "Number of previous builds to keep under <alias>/previous aliases"},
+    "output": {"type": "string", "description": "Directory in which to write simplestreams metadata"},
+    "scan-command": {"type": "string", "description": "Host program to scan the installed packages for vulnerabilities"},
+    "scan-fail-severity": {"enum": ["low", "medium", "high", "critical"]},
+    "keep": {"enum": ["failure", "always"], "description": "When to keep the build directory, container and logs"},
+    "capture-logs": {"enum": ["failure", "always", "never"]},
+    "logs-dir": {"type": "string", "description": "Directory to write captured container logs to"},
+    "diagnostics-dir": {"type": "string", "description": "Directory to write a diagnostics bundle to on failure"},
+    "history-file": {"type": "string", "description": "File to record builds in"},
+    "signing-key": {"type": "string", "description": "GPG key to sign SHA256SUMS with"},
+    "cosign": {"type": "boolean", "description": "Sign the image tarball with cosign"},
+    "cosign-key": {"type": "string", "description": "Key to sign the image tarball with cosign, instead of signing keylessly"},
+    "provenance": {"type": "boolean", "description": "Generate a SLSA provenance document for the image"},
+    "builder-id": {"type": "string", "description": "Builder identity to record in provenance documents"},
+    "reproducible": {"type": "boolean", "description": "Write the image tarball reproducibly, clamping timestamps to $SOURCE_DATE_EPOCH"},
+    "tarball-format": {
+      "type": "object",
+      "additionalProperties": false,
+      "description": "Gzip header fields and tar header format of the image tarballs",
+      "properties": {
+        "gzip-mtime": {"type": "integer", "minimum": 0, "maximum": 4294967295, "description": "Modification time to record in the gzip header, in seconds since the epoch (default: none)"},
+        "gzip-os": {"type": "string", "pattern": "^(unix|fat|ntfs|unknown|[0-9]+)$", "description": "OS to record in the gzip header (default: unknown)"},
+        "tar-format": {"enum": ["ustar", "pax", "gnu"], "description": "Format to write every tar header in"}
+      }
+    },
+    "id-shift": {"type": "string", "pattern": "^(auto|[0-9]+)$", "description": "Amount to subtract from rootfs entries' uids and gids, or auto to detect it"},
+    "strict-ids": {"type": "boolean", "description": "Fail the build if rootfs entries are owned by ids above 65535"},
+    "upload": {"type": "string", "pattern": "^s3://", "description": "S3 URL to upload the image and simplestreams metadata to"},
+    "push-remotes": {"type": "array", "items": {"type": "string"}},
+    "push-public": {"type": "boolean"},
+    "juju-model": {"type": "string"},
+    "juju-remote": {"type": "string"},
+    "juju-config": {"type": "array", "items": {"type": "string", "pattern": "^[^=]+="}},
+    "juju-test": {"type": "boolean"},
+    "test-scenarios": {"type": "array", "items": {"enum": ["all", "default", "link-local", "network-config", "user-data"]}, "description": "Scenarios to test the image with"},
+    "notifications": {"type": "array", "items": {"$ref": "#/definitions/notification"}, "description": "Where to send a summary of the build when it finishes"},
+    "provisioners": {"type": "array", "items": {"$ref": "#/definitions/provisioner"}}
+  },
+  "definitions": {
+    "notification": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["type"],
+      "properties": {
+        "type": {"enum": ["smtp", "slack", "matrix"]},
+        "on": {"enum": ["always", "failure"], "description": "When to notify (default: always)"},
+        "server": {"type": "string", "description": "SMTP server, as host:port"},
+        "from": {"type": "string"},
+        "to": {"type": "array", "items": {"type": "string"}},
+        "username": {"type": "string"},
+        "password": {"type": "string", "description": "SMTP password, or file:PATH or env:NAME"},
+        "webhook": {"type": "string", "description": "Slack incoming webhook URL, or file:PATH or env:NAME"},
+        "homeserver": {"type": "string", "description": "Matrix homeserver URL"},
+        "room": {"type": "string", "description": "Matrix room ID"},
+        "access-token": {"type": "string", "description": "Matrix access token, or file:PATH or env:NAME"}
+      }
+    },
+    "provisioner": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["type"],
+      "properties": {
+        "type": {"enum": ["shell", "file", "script", "exec", "ansible", "salt", "puppet", "chef"]},
+        "commands": {"type": "array", "items": {"type": "string"}},
+        "source": {"type": "string"},
+        "destination": {"type": "string"},
+        "mode": {"type": "string", "pattern": "^[0-7]{3,4}$"},
+        "path": {"type": "string"},
+        "command": {"type": "string"},
+        "roles-path": {"type": "string"},
+        "pillar-roots": {"type": "string"},
+        "module-path": {"type": "string"},
+        "states": {"type": "array", "items": {"type": "string"}},
+        "run-list": {"type": "array", "items": {"type": "string"}},
+        "install": {"type": "array", "items": {"type": "string"}},
+        "cwd": {"type": "string", "pattern": "^/"},
+        "shell": {"type": "string"},
+        "strict": {"type": "boolean"},
+        "user": {"type": "string"},
+        "group": {"type": "string"},
+        "args": {"type": "array", "items": {"type": "string"}},
+        "name": {"type": "string"},
+        "parallel": {"type": "boolean"},
+        "depends-on": {"type": "array", "items": {"type": "string"}},
+        "sensitive": {"type": "boolean"},
+        "when": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {
+            "distro": {"type": "array", "items": {"type": "string"}},
+            "release": {"type": "array", "items": {"type": "string"}},
+            "arch": {"type": "array", "items": {"type": "string"}},
+            "type": {"type": "array", "items": {"type": "string", "pattern": "^!?(container|virtual-machine)$"}}
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+// ManifestSchema is the JSON Schema for build manifests;
+// see Result.
+const ManifestSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/axw/juju-lxd-centos-image-builder/schema/v1/manifest.json",
+  "title": "juju-lxd-centos-image-builder build manifest",
+  "type": "object",
+  "required": ["schema-version", "alias", "serial", "fingerprint", "base-image", "started", "finished"],
+  "properties": {
+    "schema-version": {"const": "1"},
+    "extends": {"type": "string", "description": "Configuration file that this one builds on"},
+    "include": {"type": "array", "items": {"type": "string"}, "description": "Further configuration files to combine with this one"},
+    "alias": {"type": "string"},
+    "serial": {"type": "string"},
+    "fingerprint": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+    "size": {"type": "integer", "minimum": 0},
+    "unpacked-size": {"type": "integer", "minimum": 0},
+    "base-image": {"type": "string"},
+    "base-image-server": {"type": "string"},
+    "base-fingerprint": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+    "os": {
+      "type": "object",
+      "properties": {
+        "id": {"type": "string"},
+        "id-like": {"type": "array", "items": {"type": "string"}},
+        "version-id": {"type": "string"},
+        "arch": {"type": "string"}
+      }
+    },
+    "skipped": {"type": "boolean"},
+    "spec": {"type": "object", "description": "The build options, as in diagnostics bundles"},
+    "provenance": {"type": "object"},
+    "properties": {"type": "object", "additionalProperties": {"type": "string"}},
+    "vulnerabilities": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["id", "package", "severity"],
+        "properties": {
+          "id": {"type": "string"},
+          "package": {"type": "string"},
+          "severity": {"type": "string"},
+          "fixed-in": {"type": "string"}
+        }
+      }
+    },
+    "pushed": {"type": "array", "items": {"type": "string"}},
+    "uploaded": {"type": "array", "items": {"type": "string"}},
+    "previous": {
+      "type": "object",
+      "required": ["fingerprint"],
+      "properties": {
+        "fingerprint": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+        "serial": {"type": "string"},
+        "packages": {
+          "type": "object",
+          "properties": {
+            "added": {"$ref": "#/definitions/packages"},
+            "removed": {"$ref": "#/definitions/packages"},
+            "upgraded": {"$ref": "#/definitions/package-changes"},
+            "downgraded": {"$ref": "#/definitions/package-changes"}
+          }
+        }
+      }
+    },
+    "changelog": {
+      "type": "object",
+      "required": ["serial", "date"],
+      "properties": {
+        "serial": {"type": "string"},
+        "previous-serial": {"type": "string"},
+        "date": {"type": "string", "format": "date-time"},
+        "packages": {
+          "type": "object",
+          "properties": {
+            "added": {"$ref": "#/definitions/packages"},
+            "removed": {"$ref": "#/definitions/packages"},
+            "upgraded": {"$ref": "#/definitions/package-changes"},
+            "downgraded": {"$ref": "#/definitions/package-changes"}
+          }
+        },
+        "spec-changed": {"type": "boolean"},
+        "options": {"type": "array", "items": {"type": "string"}, "description": "Build options that changed"},
+        "inputs-changed": {"type": "boolean"},
+        "base-fingerprint": {
+          "type": "object",
+          "required": ["from", "to"],
+          "properties": {
+            "from": {"type": "string"},
+            "to": {"type": "string"}
+          }
+        }
+      }
+    },
+    "logs": {"type": "array", "items": {"type": "string"}},
+    "test-logs": {"type": "array", "items": {"type": "string"}},
+    "test-scenarios": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "passed", "duration"],
+        "properties": {
+          "name": {"type": "string"},
+          "passed": {"type": "boolean"},
+          "error": {"type": "string"},
+          "duration": {"type": "integer", "description": "Duration in nanoseconds"}
+        }
+      }
+    },
+    "started": {"type": "string", "format": "date-time"},
+    "finished": {"type": "string", "format": "date-time"}
+  },
+  "definitions": {
+    "packages": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "version"],
+        "properties": {
+          "name": {"type": "string"},
+          "version": {"type": "string"}
+        }
+      }
+    },
+    "package-changes": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "from", "to"],
+        "properties": {
+          "name": {"type": "string"},
+          "from": {"type": "string"},
+          "to": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
+
+// Schema returns the named JSON Schema: "spec" or "manifest".
+func Schema(name string) (string, error) {
+	switch name {
+	case "spec":
+		return SpecSchema, nil
+	case "manifest":
+		return ManifestSchema, nil
+	}
+	return "", fmt.Errorf("unknown schema %q (expected spec or manifest)", name)
+}
@@ -0,0 +1,153 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// SeedInstanceIDSerial, the default Options.SeedInstanceID, bakes
+	// an instance-id derived from the image's alias and serial, so
+	// that it changes with every build.
+	SeedInstanceIDSerial = "serial"
+
+	// SeedInstanceIDAlias bakes an instance-id derived from the
+	// image's alias alone, so that it is the same for every build.
+	SeedInstanceIDAlias = "alias"
+)
+
+// rootfsSeedDir is the directory the static seed is baked into: that
+// of the NoCloud seed the default templates render, so that LXD replaces
+// the baked seed with its own in the instances it creates and copies.
+const rootfsSeedDir = "/var/lib/cloud/seed/nocloud-net"
+
+// rootfsSeedFiles holds the names of the files in the baked seed.
+var rootfsSeedFiles = []string{"meta-data", "network-config", "user-data", "vendor-data"}
+
+// defaultSeedNetworkConfig is the network config baked into the
+// seed by default, as the default templates render it.
+const defaultSeedNetworkConfig = `version: 1
+config:
+    - type: physical
+      name: eth0
+      subnets:
+          - type: dhcp
+            control: auto
+`
+
+// rootfsSeed holds the contents of the static NoCloud seed
+// to bake into the image's rootfs (see Options.BakeSeed).
+type rootfsSeed struct {
+	instanceID    string
+	userData      string
+	networkConfig string
+}
+
+// loadRootfsSeed checks the seed options, and reads the seed's
+// user-data and network config. It returns nil if no seed is to
+// be baked.
+func loadRootfsSeed(opts Options) (*rootfsSeed, error) {
+	if !opts.BakeSeed {
+		if opts.SeedInstanceID != "" || opts.SeedUserData != "" || opts.SeedNetworkConfig != "" {
+			return nil, fmt.Errorf("seed options require a baked seed")
+		}
+		return nil, nil
+	}
+	seed := &rootfsSeed{
+		instanceID:    opts.SeedInstanceID,
+		userData:      "#cloud-config\n{}\n",
+		networkConfig: defaultSeedNetworkConfig,
+	}
+	switch seed.instanceID {
+	case "":
+		seed.instanceID = SeedInstanceIDSerial
+	case SeedInstanceIDSerial, SeedInstanceIDAlias:
+	default:
+		return nil, fmt.Errorf(
+			"invalid seed instance-id %q (expected %s or %s)",
+			opts.SeedInstanceID, SeedInstanceIDSerial, SeedInstanceIDAlias,
+		)
+	}
+	if opts.SeedUserData != "" {
+		userData, err := readUserData(opts.SeedUserData)
+		if err != nil {
+			return nil, err
+		}
+		seed.userData = userData
+	}
+	if opts.SeedNetworkConfig != "" {
+		data, err := ioutil.ReadFile(opts.SeedNetworkConfig)
+		if err != nil {
+			return nil, err
+		}
+		seed.networkConfig = string(data)
+	}
+	for _, f := range opts.ImageFiles {
+		if path.Dir(f.rootfsPath()) == rootfsSeedDir[1:] {
+			return nil, fmt.Errorf("image file %q conflicts with the baked seed", f.Destination)
+		}
+	}
+	return seed, nil
+}
+
+// instanceIDFor returns the instance-id to bake into the
+// seed of the image with the given alias and serial.
+func (s *rootfsSeed) instanceIDFor(alias, serial string) string {
+	id := alias
+	if s.instanceID == SeedInstanceIDSerial {
+		id += "-" + serial
+	}
+	return "iid-" + strings.NewReplacer("/", "-", ":", "-").Replace(id)
+}
+
+// write writes the seed files to dir, which is created if need be,
+// returning the image files that add them to the rootfs. They are
+// only readable by root, as the user-data may hold credentials.
+func (s *rootfsSeed) write(dir, alias, serial string) ([]ImageFile, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	contents := map[string]string{
+		"meta-data":      "instance-id: " + s.instanceIDFor(alias, serial) + "\n",
+		"network-config": s.networkConfig,
+		"user-data":      s.userData,
+		"vendor-data":    "#cloud-config\n{}\n",
+	}
+	var imageFiles []ImageFile
+	for _, name := range rootfsSeedFiles {
+		source := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(source, []byte(contents[name]), 0600); err != nil {
+			return nil, err
+		}
+		imageFiles = append(imageFiles, ImageFile{
+			Source:      source,
+			Destination: path.Join(rootfsSeedDir, name),
+			Mode:        0600,
+		})
+	}
+	return imageFiles, nil
+}
+
+// labelTargets returns the sorted files that the image's templates
+// render, given as targets, with the seed's files added, so that
+// they exist in the build container to be labelled (see
+// selinuxLabels) and the baked files keep the labels.
+func (s *rootfsSeed) labelTargets(targets []string) []string {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		seen[target] = true
+	}
+	targets = append([]string(nil), targets...)
+	for _, name := range rootfsSeedFiles {
+		if target := path.Join(rootfsSeedDir, name); !seen[target] {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
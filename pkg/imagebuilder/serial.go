@@ -0,0 +1,205 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PropertyAlias records the primary alias an image was
+	// built for; the alias itself moves to newer builds.
+	PropertyAlias = "user.build.alias"
+
+	// PropertySerial records the build serial of an image,
+	// of the form "YYYYMMDD.N".
+	PropertySerial = "user.build.serial"
+)
+
+// nextSerial returns the serial for a new build of the given alias,
+// which is the date followed by one more than the number of the
+// latest build for that date in the remote's image store.
+func nextSerial(ctx context.Context, remote, alias string, now time.Time) (string, error) {
+	images, err := ListBuiltImages(ctx, remote)
+	if err != nil {
+		return "", err
+	}
+	date := now.UTC().Format("20060102")
+	var n int
+	for _, image := range images {
+		if image.Properties[PropertyAlias] != alias {
+			continue
+		}
+		imageDate, imageN, ok := parseSerial(image.Properties[PropertySerial])
+		if ok && imageDate == date && imageN > n {
+			n = imageN
+		}
+	}
+	return fmt.Sprintf("%s.%d", date, n+1), nil
+}
+
+// parseSerial parses a serial of the form "YYYYMMDD.N".
+func parseSerial(serial string) (date string, n int, ok bool) {
+	i := strings.IndexRune(serial, '.')
+	if i == -1 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(serial[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return serial[:i], n, true
+}
+
+// serialLess reports whether serial a is older than serial b.
+func serialLess(a, b string) bool {
+	adate, an, aok := parseSerial(a)
+	bdate, bn, bok := parseSerial(b)
+	if !aok || !bok {
+		return a < b
+	}
+	if adate != bdate {
+		return adate < bdate
+	}
+	return an < bn
+}
+
+// sortSerials sorts serials from newest to oldest.
+func sortSerials(serials []string) {
+	sort.Slice(serials, func(i, j int) bool {
+		return serialLess(serials[j], serials[i])
+	})
+}
+
+// retention is a policy for which builds of an alias to keep.
+type retention struct {
+	// serials is the number of newest builds to keep.
+	// If zero, builds are not limited by number.
+	serials int
+
+	// days is the number of days to keep builds for,
+	// going by the date in their serial. If zero,
+	// builds are not limited by age.
+	days int
+
+	// now is the time that build ages are measured from.
+	now time.Time
+
+	// rollback is the number of builds before the newest
+	// that are kept regardless, under rollback aliases.
+	rollback int
+}
+
+// expired sorts serials from newest to oldest, and returns those
+// that fall outside the retention policy. The newest build and the
+// rollback builds before it are always kept, as are builds whose
+// serials do not record a date.
+func (r retention) expired(serials []string) []string {
+	sortSerials(serials)
+	cutoff := r.now.UTC().AddDate(0, 0, -r.days).Format("20060102")
+	for i := 1 + r.rollback; i < len(serials); i++ {
+		if r.serials > 0 && i >= r.serials {
+			return serials[i:]
+		}
+		date, _, ok := parseSerial(serials[i])
+		if r.days > 0 && ok && date < cutoff {
+			return serials[i:]
+		}
+	}
+	return nil
+}
+
+// pruneSerials deletes the builds of the given alias that fall
+// outside the retention policy from the remote's image store. If the
+// policy keeps rollback builds, their aliases are updated first.
+func pruneSerials(ctx context.Context, remote, alias string, r retention) error {
+	if r.rollback > 0 {
+		if err := updateRollbackAliases(ctx, remote, alias, r.rollback); err != nil {
+			return err
+		}
+	}
+	images, err := ListBuiltImages(ctx, remote)
+	if err != nil {
+		return err
+	}
+	bySerial := make(map[string]string)
+	var serials []string
+	for _, image := range images {
+		if image.Properties[PropertyAlias] != alias {
+			continue
+		}
+		serial := image.Properties[PropertySerial]
+		bySerial[serial] = image.Fingerprint
+		serials = append(serials, serial)
+	}
+	for _, serial := range r.expired(serials) {
+		logf(ctx, "Deleting build %s of %s from %s", serial, alias, qualify(remote, ""))
+		if err := lxc(ctx, "image", "delete", qualify(remote, bySerial[serial])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackAlias returns the alias under which the nth build of the
+// alias before the newest is kept: "<alias>/previous" for the first,
+// and "<alias>/previous-<n>" for older ones.
+func rollbackAlias(alias string, n int) string {
+	if n == 1 {
+		return alias + "/previous"
+	}
+	return fmt.Sprintf("%s/previous-%d", alias, n)
+}
+
+// updateRollbackAliases points the rollback aliases of the alias in
+// the remote's image store at the depth builds before the newest,
+// so that operators can roll back to them, and removes any rollback
+// aliases beyond depth.
+func updateRollbackAliases(ctx context.Context, remote, alias string, depth int) error {
+	images, err := ListBuiltImages(ctx, remote)
+	if err != nil {
+		return err
+	}
+	bySerial := make(map[string]string)
+	var serials []string
+	existing := make(map[string]string)
+	for _, image := range images {
+		for _, a := range image.Aliases {
+			if strings.HasPrefix(a.Name, alias+"/previous") {
+				existing[a.Name] = image.Fingerprint
+			}
+		}
+		if image.Properties[PropertyAlias] != alias {
+			continue
+		}
+		serial := image.Properties[PropertySerial]
+		bySerial[serial] = image.Fingerprint
+		serials = append(serials, serial)
+	}
+	sortSerials(serials)
+	wanted := make(map[string]string)
+	for n := 1; n <= depth && n < len(serials); n++ {
+		wanted[rollbackAlias(alias, n)] = bySerial[serials[n]]
+		if existing[rollbackAlias(alias, n)] != bySerial[serials[n]] {
+			logf(ctx, "Keeping build %s of %s as %s", serials[n], alias, rollbackAlias(alias, n))
+		}
+	}
+	for _, name := range sortedKeys(existing) {
+		if wanted[name] != existing[name] {
+			if err := lxc(ctx, "image", "alias", "delete", qualify(remote, name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range sortedKeys(wanted) {
+		if wanted[name] != existing[name] {
+			if err := lxc(ctx, "image", "alias", "create", qualify(remote, name), wanted[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package imagebuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The simplestreams tree written with -output is laid out as follows,
+// and may be served over HTTP(S) and consumed with
+// "lxc remote add <name> <url> --protocol=simplestreams":
+//
+//	streams/v1/index.json
+//	streams/v1/images.json
+//	images/<alias>/<serial>/lxd_combined.tar.gz
+//	images/<alias>/<serial>/lxd_combined.tar.gz.sigstore.json (if signed)
+//	SHA256SUMS
+//	SHA256SUMS.gpg (if signed)
+const (
+	streamsIndexPath  = "streams/v1/index.json"
+	streamsImagesPath = "streams/v1/images.json"
+
+	// combinedFtype is the simplestreams file type for unified
+	// LXD image tarballs, containing both metadata and rootfs.
+	combinedFtype = "lxd_combined.tar.gz"
+)
+
+type streamsIndex struct {
+	Format  string                       `json:"format"`
+	Updated string                       `json:"updated"`
+	Index   map[string]streamsIndexEntry `json:"index"`
+}
+
+type streamsIndexEntry struct {
+	Datatype string   `json:"datatype"`
+	Format   string   `json:"format"`
+	Path     string   `json:"path"`
+	Products []string `json:"products"`
+	Updated  string   `json:"updated"`
+}
+
+type streamsProducts struct {
+	ContentID string                    `json:"content_id"`
+	Datatype  string                    `json:"datatype"`
+	Format    string                    `json:"format"`
+	Updated   string                    `json:"updated"`
+	Products  map[string]streamsProduct `json:"products"`
+}
+
+type streamsProduct struct {
+	Aliases      string                    `json:"aliases"`
+	Arch         string                    `json:"arch"`
+	OS           string                    `json:"os"`
+	Release      string                    `json:"release"`
+	ReleaseTitle string                    `json:"release_title"`
+	Variant      string                    `json:"variant,omitempty"`
+	Versions     map[string]streamsVersion `json:"versions"`
+}
+
+type streamsVersion struct {
+	Items     map[string]streamsItem `json:"items"`
+	Changelog *ChangelogEntry        `json:"changelog,omitempty"`
+}
+
+type streamsItem struct {
+	Ftype  string `json:"ftype"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// writeSimplestreams copies the image tarball into the simplestreams
+// tree rooted at dir, and adds it as the given serial of the alias's
+// product, whose distribution is that of the base image. Each
+// attachment, mapping a file type to a file, is copied alongside the
+// image and listed in the same version, along with the changelog
+// entry, if non-nil. Versions of the product that fall outside the
+// retention policy, and their files, are removed.
+//
+// The slash-separated paths, relative to dir, of the files written
+// are returned, with the image and attachments first and the metadata
+// last, along with the paths of the image files removed.
+func writeSimplestreams(
+	ctx context.Context,
+	dir, alias, serial, tarball string,
+	info *OSRelease,
+	attachments map[string]string,
+	changelog *ChangelogEntry,
+	r retention,
+) (written, removed []string, err error) {
+	logf(ctx, "Writing simplestreams metadata for %s (%s) to %s", alias, serial, dir)
+	version := streamsVersion{Items: make(map[string]streamsItem), Changelog: changelog}
+	addItem := func(ftype, file string) error {
+		itemPath := path.Join("images", alias, serial, ftype)
+		sha256sum, size, err := copyFileSHA256(
+			filepath.Join(dir, filepath.FromSlash(itemPath)), file,
+		)
+		if err != nil {
+			return err
+		}
+		emit(ctx, Event{Type: EventArtifact, Artifact: filepath.Join(dir, filepath.FromSlash(itemPath))})
+		version.Items[ftype] = streamsItem{
+			Ftype:  ftype,
+			Path:   itemPath,
+			SHA256: sha256sum,
+			Size:   size,
+		}
+		written = append(written, itemPath)
+		return nil
+	}
+	if err := addItem(combinedFtype, tarball); err != nil {
+		return nil, nil, err
+	}
+	ftypes := make([]string, 0, len(attachments))
+	for ftype := range attachments {
+		ftypes = append(ftypes, ftype)
+	}
+	sort.Strings(ftypes)
+	for _, ftype := range ftypes {
+		if err := addItem(ftype, attachments[ftype]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	products, err := readStreamsProducts(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	productName := strings.Replace(alias, "/", ":", -1)
+	// The product's distribution is refreshed, in case
+	// it was written by a release that assumed CentOS.
+	product := newStreamsProduct(alias, info)
+	if existing, ok := products.Products[productName]; ok {
+		product.Versions = existing.Versions
+	}
+	product.Versions[serial] = version
+	removed, err = pruneStreamsVersions(dir, &product, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	products.Products[productName] = product
+	if err := writeStreams(dir, products); err != nil {
+		return nil, nil, err
+	}
+	emit(ctx, Event{Type: EventArtifact, Artifact: filepath.Join(dir, filepath.FromSlash(streamsIndexPath))})
+	written = append(written, streamsImagesPath, streamsIndexPath)
+	return written, removed, nil
+}
+
+// streamsOSNames maps distribution IDs, as in /etc/os-release, to
+// the names recorded as the os of simplestreams products, which
+// consumers match on. Products for CentOS have always been "CentOS".
+var streamsOSNames = map[string]string{
+	"almalinux": "AlmaLinux",
+	"centos":    "CentOS",
+	"fedora":    "Fedora",
+	"ol":        "OracleLinux",
+	"rhel":      "RHEL",
+	"rocky":     "Rocky",
+}
+
+// streamsOSName returns the simplestreams os name of the distribution
+// with the given ID: that in streamsOSNames or, for distributions not
+// listed there, the ID with its first letter in upper case.
+func streamsOSName(id string) string {
+	if name, ok := streamsOSNames[id]; ok {
+		return name
+	}
+	if id == "" {
+		return ""
+	}
+	return strings.ToUpper(id[:1]) + id[1:]
+}
+
+// newStreamsProduct returns a simplestreams product for an alias
+// of the form "juju/<series>/<arch>[/<variant>]", of the given
+// distribution. The release is taken from the series, e.g. "7" for
+// "centos7", or else from the distribution's version.
+func newStreamsProduct(alias string, info *OSRelease) streamsProduct {
+	product := streamsProduct{
+		Aliases:  alias,
+		OS:       streamsOSName(info.ID),
+		Release:  info.VersionID,
+		Versions: make(map[string]streamsVersion),
+	}
+	parts := strings.Split(alias, "/")
+	if len(parts) >= 3 {
+		if m := aliasSeriesPattern.FindStringSubmatch(parts[1]); m != nil {
+			product.Release = m[2]
+		}
+		product.Arch = parts[2]
+	}
+	if len(parts) >= 4 {
+		product.Variant = parts[3]
+	}
+	product.ReleaseTitle = product.Release
+	return product
+}
+
+// pruneStreamsVersions removes the versions of the product that fall
+// outside the retention policy, and their files, returning the paths
+// of the items removed.
+func pruneStreamsVersions(dir string, product *streamsProduct, r retention) ([]string, error) {
+	serials := make([]string, 0, len(product.Versions))
+	for serial := range product.Versions {
+		serials = append(serials, serial)
+	}
+	var removed []string
+	for _, serial := range r.expired(serials) {
+		for _, item := range product.Versions[serial].Items {
+			itemDir := filepath.Dir(filepath.Join(dir, filepath.FromSlash(item.Path)))
+			if err := os.RemoveAll(itemDir); err != nil {
+				return removed, err
+			}
+			removed = append(removed, item.Path)
+		}
+		delete(product.Versions, serial)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+func readStreamsProducts(dir string) (*streamsProducts, error) {
+	products := &streamsProducts{
+		ContentID: "images",
+		Datatype:  "image-downloads",
+		Format:    "products:1.0",
+		Products:  make(map[string]streamsProduct),
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(streamsImagesPath)))
+	if os.IsNotExist(err) {
+		return products, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, products); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", streamsImagesPath, err)
+	}
+	if products.Products == nil {
+		products.Products = make(map[string]streamsProduct)
+	}
+	return products, nil
+}
+
+func writeStreams(dir string, products *streamsProducts) error {
+	updated := time.Now().UTC().Format(time.RFC1123Z)
+	products.Updated = updated
+
+	names := make([]string, 0, len(products.Products))
+	for name := range products.Products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	index := streamsIndex{
+		Format:  "index:1.0",
+		Updated: updated,
+		Index: map[string]streamsIndexEntry{
+			products.ContentID: {
+				Datatype: products.Datatype,
+				Format:   products.Format,
+				Path:     streamsImagesPath,
+				Products: names,
+				Updated:  updated,
+			},
+		},
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, filepath.FromSlash(streamsImagesPath)), products); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, filepath.FromSlash(streamsIndexPath)), index)
+}
+
+// writeJSONFile atomically writes v to the named file as indented JSON.
+func writeJSONFile(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// fileSHA256 returns the SHA-256 checksum of the named file.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pathSHA256 returns the SHA-256 checksum of the named file or, if
+// it is a directory, of the names, modes and contents of the files
+// in the tree.
+func pathSHA256(name string) (string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fileSHA256(name)
+	}
+	h := sha256.New()
+	if err := filepath.Walk(name, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%v\x00", filepath.ToSlash(rel), info.Mode())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		digest, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00", digest)
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFileSHA256 copies the file at src to dst, creating any parent
+// directories, and returns the SHA-256 checksum and size of the file.
+func copyFileSHA256(dst, src string) (string, int64, error) {
+	fin, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fin.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", 0, err
+	}
+	fout, err := os.Create(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fout.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(fout, h), fin)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := fout.Close(); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
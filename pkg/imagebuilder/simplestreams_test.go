@@ -0,0 +1,103 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSimplestreamsOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := filepath.Join(dir, "image.tar.gz")
+	if err := ioutil.WriteFile(tarball, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	streams := filepath.Join(dir, "streams")
+	r := retention{now: time.Now()}
+	for _, test := range []struct {
+		alias   string
+		info    *OSRelease
+		os      string
+		release string
+	}{
+		{"juju/rocky8/amd64", &OSRelease{ID: "rocky", VersionID: "8.6"}, "Rocky", "8"},
+		{"juju/centos7/amd64", &OSRelease{ID: "centos", VersionID: "7"}, "CentOS", "7"},
+		{"centos/stream", &OSRelease{ID: "centos", VersionID: "9"}, "CentOS", "9"},
+		{"juju/almalinux9/arm64", &OSRelease{ID: "almalinux", VersionID: "9.1"}, "AlmaLinux", "9"},
+		{"juju/navy8/amd64", &OSRelease{ID: "navy", VersionID: "8"}, "Navy", "8"},
+	} {
+		if _, _, err := writeSimplestreams(
+			context.Background(), streams, test.alias, "20200102.1", tarball, test.info, nil, nil, r,
+		); err != nil {
+			t.Fatal(err)
+		}
+		products, err := readStreamsProducts(streams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		product := products.Products[strings.Replace(test.alias, "/", ":", -1)]
+		if product.OS != test.os || product.Release != test.release {
+			t.Errorf("%s: got os %q release %q, expected %q and %q",
+				test.alias, product.OS, product.Release, test.os, test.release)
+		}
+	}
+}
+
+func TestWriteSimplestreamsRefreshesOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := filepath.Join(dir, "image.tar.gz")
+	if err := ioutil.WriteFile(tarball, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A product written by an older release, which
+	// assumed every image was of CentOS.
+	products := &streamsProducts{Products: map[string]streamsProduct{
+		"juju:rocky8:amd64": {
+			Aliases: "juju/rocky8/amd64",
+			OS:      "CentOS",
+			Release: "rocky8",
+			Versions: map[string]streamsVersion{
+				"20200101.1": {Items: map[string]streamsItem{}},
+			},
+		},
+	}}
+	if err := writeStreams(dir, products); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeSimplestreams(
+		context.Background(), dir, "juju/rocky8/amd64", "20200102.1", tarball,
+		&OSRelease{ID: "rocky", VersionID: "8.6"}, nil, nil, retention{now: time.Now()},
+	); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(streamsImagesPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written streamsProducts
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	product := written.Products["juju:rocky8:amd64"]
+	if product.OS != "Rocky" || product.Release != "8" {
+		t.Errorf("got os %q release %q, expected Rocky 8", product.OS, product.Release)
+	}
+	for _, serial := range []string{"20200101.1", "20200102.1"} {
+		if _, ok := product.Versions[serial]; !ok {
+			t.Errorf("version %s missing", serial)
+		}
+	}
+}
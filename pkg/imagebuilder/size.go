@@ -0,0 +1,77 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits holds the multipliers of the size suffixes accepted by
+// ParseSize. Suffixes are binary, whether or not they include the "i".
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// ParseSize parses a size in bytes, as accepted on the command line:
+// a non-negative number, optionally followed by K, M, G or T (with an
+// optional "iB" or "B"), e.g. "512M" or "2GiB".
+func ParseSize(s string) (int64, error) {
+	upper := strings.ToUpper(s)
+	number := strings.TrimSuffix(upper, "B")
+	binary := number != upper && strings.HasSuffix(number, "I")
+	if binary {
+		number = strings.TrimSuffix(number, "I")
+	}
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier || binary && multiplier == 1 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes, optionally suffixed with K, M, G or T", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats a size in bytes for logging, e.g. "1.5GiB".
+func formatSize(n int64) string {
+	for _, unit := range sizeUnits {
+		if n >= unit.n {
+			return strconv.FormatFloat(float64(n)/float64(unit.n), 'f', 1, 64) + unit.suffix + "iB"
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// checkImageSize records the size of the image tarballs, and the
+// unpacked size of its rootfs, in the result, failing with
+// ErrTooLarge if the tarballs exceed maxSize (if positive).
+func checkImageSize(ctx context.Context, result *Result, maxSize, unpacked int64, tarballs ...string) error {
+	var size int64
+	for _, name := range tarballs {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+	}
+	result.Size = size
+	result.UnpackedSize = unpacked
+	logf(ctx, "Image is %s (%s unpacked)", formatSize(size), formatSize(unpacked))
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w: %d bytes (%s), maximum %d", ErrTooLarge, size, formatSize(size), maxSize)
+	}
+	return nil
+}
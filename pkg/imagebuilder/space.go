@@ -0,0 +1,73 @@
+package imagebuilder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// spaceFactor is the space a build needs in its build directory,
+	// as a multiple of the size of the base image: the exported image,
+	// and the rewritten tarball, with room for the provisioned rootfs
+	// to have grown.
+	spaceFactor = 3
+
+	// splitSpaceFactor is spaceFactor for split images, whose
+	// export of the build container is uncompressed.
+	splitSpaceFactor = 4
+)
+
+// imageSize returns the size in bytes of the image with the
+// fingerprint, on the remote of image.
+func imageSize(ctx context.Context, image, fingerprint string) (int64, error) {
+	remote, _ := splitImage(image)
+	out, err := runOutput(ctx, "lxc", "image", "list", qualify(remote, fingerprint), "--format=json")
+	if err != nil {
+		return 0, err
+	}
+	var images []ImageInfo
+	if err := json.Unmarshal(out, &images); err != nil {
+		return 0, err
+	}
+	for _, info := range images {
+		if strings.HasPrefix(info.Fingerprint, fingerprint) {
+			return info.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot find size of image %q", image)
+}
+
+// checkSpace checks that the build directory has enough free space
+// for a build from a base image of the given size, failing with
+// ErrInsufficientSpace if not, rather than part way through writing
+// the image. If the free space cannot be determined, the check is
+// skipped.
+func checkSpace(ctx context.Context, dir string, baseSize int64, format string) error {
+	factor := int64(spaceFactor)
+	if format == ImageFormatSplit {
+		factor = splitSpaceFactor
+	}
+	required := baseSize * factor
+	available, ok, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logf(ctx, "Cannot determine the free space in %s; not checking it", dir)
+		return nil
+	}
+	logf(ctx,
+		"Build needs about %s in %s (%dx the %s base image); %s available",
+		formatSize(required), dir, factor, formatSize(baseSize), formatSize(available),
+	)
+	if available < required {
+		return fmt.Errorf(
+			"%w in %s: need about %s (%d bytes), %s (%d bytes) available",
+			ErrInsufficientSpace, dir,
+			formatSize(required), required, formatSize(available), available,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package imagebuilder
+
+import "syscall"
+
+// freeSpace returns the space available to unprivileged
+// users on the filesystem holding dir, in bytes.
+func freeSpace(dir string) (int64, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true, nil
+}
@@ -0,0 +1,194 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ImageFormatUnified, the default Options.ImageFormat, publishes
+	// the image as a single tarball holding its metadata and rootfs.
+	ImageFormatUnified = "unified"
+
+	// ImageFormatSplit publishes the image as separate metadata and
+	// rootfs tarballs, generated from an export of the build container.
+	ImageFormatSplit = "split"
+)
+
+// backupDir is the directory in "lxc export" tarballs that holds
+// the instance's metadata.yaml, templates and rootfs.
+const backupDir = "backup/container"
+
+// exportContainer exports the stopped container, without its
+// snapshots, to an uncompressed backup tarball in dir, returning
+// its path.
+func exportContainer(ctx context.Context, container, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	backup := filepath.Join(dir, "backup.tar")
+	if err := lxcTransfer(
+		ctx, "export", container, backup,
+		"--instance-only", "--compression=none",
+	); err != nil {
+		return "", err
+	}
+	// Older LXD servers may compress the backup regardless.
+	return decompressTarball(ctx, backup)
+}
+
+// createSplitImage writes the metadata and rootfs tarballs of a split
+// image from the container's backup tarball, returning their paths
+// and the total size of the regular files in the rootfs.
+// The metadata tarball is generated from the container's metadata,
+// as for unified images (see updateImageTemplates), and the rootfs
+// tarball holds the container's rootfs, with its ownership remapped
+// and checked according to ids, and the files added. If sourceDate
+// is non-zero, both are written reproducibly; see createFinalTarball.
+func createSplitImage(
+	ctx context.Context,
+	backup string,
+	dir string,
+	properties map[string]string,
+	sourceDate time.Time,
+	format TarballFormat,
+	ids *idMapping,
+	templates map[string]template,
+	files []ImageFile,
+) (string, string, int64, error) {
+	metadataBytes, err := readTarFile(backup, path.Join(backupDir, "metadata.yaml"))
+	if err != nil {
+		return "", "", 0, err
+	}
+	metadata, err := mergeMetadata(metadataBytes, templates, properties, sourceDate)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if err := ids.resolveShift(ctx, backup, path.Join(backupDir, "rootfs")); err != nil {
+		return "", "", 0, err
+	}
+
+	fin, err := os.Open(backup)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer fin.Close()
+
+	logf(ctx, "Writing rootfs tarball")
+	rootfsTarball := filepath.Join(dir, "rootfs.tar.gz")
+	templateFiles := make(map[string][]byte)
+	var unpacked int64
+	setFiles := make(map[string]bool)
+	for _, t := range templates {
+		setFiles[t.Template] = true
+	}
+	imageFiles, err := newImageFileWriter("", files, func(rel string) ([]byte, error) {
+		return readTarFile(backup, path.Join(backupDir, "rootfs", rel))
+	})
+	if err != nil {
+		return "", "", 0, err
+	}
+	if err := writeGzipTarball(rootfsTarball, gzip.DefaultCompression, format, func(out *tarWriter) error {
+		err := walkTarball(fin, !sourceDate.IsZero(), func(h *tar.Header, r io.Reader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			name := path.Clean(h.Name)
+			if rel := strings.TrimPrefix(name, backupDir+"/templates/"); rel != name {
+				// The base image's templates, such as /etc/hosts,
+				// are carried over to the metadata tarball.
+				if h.Typeflag == tar.TypeReg && !setFiles[rel] {
+					content, err := ioutil.ReadAll(r)
+					templateFiles[rel] = content
+					return err
+				}
+				return nil
+			}
+			rel, ok := rootfsPath(name)
+			if !ok || imageFiles.skip(rel, h) {
+				return nil
+			}
+			h.Name = rel
+			if h.Typeflag == tar.TypeDir && rel != "./" {
+				h.Name += "/"
+			}
+			if h.Typeflag == tar.TypeLink {
+				if h.Linkname, ok = rootfsPath(path.Clean(h.Linkname)); !ok {
+					return nil
+				}
+			}
+			if err := ids.remapRootfs(h); err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeReg {
+				unpacked += h.Size
+			}
+			if !sourceDate.IsZero() {
+				normaliseHeader(h, sourceDate)
+			}
+			if err := out.WriteHeader(h); err != nil {
+				return err
+			}
+			_, err := io.Copy(out, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		size, err := imageFiles.write(ctx, out, sourceDate)
+		unpacked += size
+		return err
+	}); err != nil {
+		return "", "", 0, err
+	}
+
+	logf(ctx, "Writing metadata tarball")
+	metadataTarball := filepath.Join(dir, "metadata.tar.gz")
+	if err := writeGzipTarball(metadataTarball, gzip.DefaultCompression, format, func(out *tarWriter) error {
+		return writeMetadataFiles(out, metadata, templateFiles, templates, sourceDate)
+	}); err != nil {
+		return "", "", 0, err
+	}
+	return metadataTarball, rootfsTarball, unpacked, nil
+}
+
+// rootfsPath returns the path, relative to the rootfs, of the
+// named entry in a backup tarball, or false if it is not in the
+// rootfs. The rootfs directory itself is "./".
+func rootfsPath(name string) (string, bool) {
+	rootfs := path.Join(backupDir, "rootfs")
+	if name == rootfs {
+		return "./", true
+	}
+	rel := strings.TrimPrefix(name, rootfs+"/")
+	return rel, rel != name
+}
+
+// splitFingerprint returns the fingerprint LXD gives a split
+// image: the SHA-256 of the metadata and rootfs tarballs,
+// concatenated.
+func splitFingerprint(metadata, rootfs string) (string, error) {
+	h := sha256.New()
+	for _, name := range []string{metadata, rootfs} {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
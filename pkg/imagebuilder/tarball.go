@@ -0,0 +1,467 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// updateImageTemplates exports the intermediate image, and writes
+// a copy of it with the templates and properties added to tmpdir,
+// for the caller to import. The path to the final image
+// tarball is returned, along with the unpacked size of its rootfs
+// (see createFinalTarball).
+//
+// If sourceDate is non-zero, the tarball is rewritten reproducibly:
+// see createFinalTarball. The ownership of rootfs entries is remapped
+// and checked according to ids. The templates are those of the
+// build's template set (see resolveTemplates). The files are added
+// to the rootfs (see Options.ImageFiles).
+func updateImageTemplates(
+	ctx context.Context,
+	remote string,
+	intermediate string,
+	tmpdir string,
+	properties map[string]string,
+	sourceDate time.Time,
+	format TarballFormat,
+	ids idMapping,
+	templates map[string]template,
+	files []ImageFile,
+) (string, int64, error) {
+	if err := lxcTransfer(ctx, "image", "export", qualify(remote, intermediate), tmpdir); err != nil {
+		return "", 0, err
+	}
+
+	// Images can have one of two formats: a single tarball with
+	// both rootfs and metadata in it, or separate rootfs and
+	// metadata tarballs.
+	//
+	// We currently assume that the centos/7 image uses a single
+	// tarball only. Directories in tmpdir, such as the build's
+	// logs, are ignored.
+	infos, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		return "", 0, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	if len(names) != 1 {
+		return "", 0, fmt.Errorf(
+			"expected a single tarball, found %v (%s)",
+			len(names), names,
+		)
+	}
+	return rewriteImageTarball(
+		ctx, filepath.Join(tmpdir, names[0]), tmpdir,
+		properties, sourceDate, format, ids, templates, files,
+	)
+}
+
+// rewriteImageTarball writes a copy of the unified image tarball to
+// tmpdir with the templates and properties added, as for
+// updateImageTemplates, returning its path and the unpacked size of
+// its rootfs.
+func rewriteImageTarball(
+	ctx context.Context,
+	tarball string,
+	tmpdir string,
+	properties map[string]string,
+	sourceDate time.Time,
+	format TarballFormat,
+	ids idMapping,
+	templates map[string]template,
+	files []ImageFile,
+) (string, int64, error) {
+	// Decompress the tarball, so we can update its contents. We do it
+	// like this rather than extracting the whole tarball with "tar xf"
+	// to avoid having to run as root, since the tarball contains root-
+	// owned special files.
+	tarballName, err := decompressTarball(ctx, tarball)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Extract metadata.yaml, and update it with the
+	// template references. Also write the templates to disk in
+	// the temp dir, and then update the tarball.
+	metadataBytes, err := readTarFile(tarballName, "metadata.yaml")
+	if err != nil {
+		return "", 0, err
+	}
+	metadata, err := mergeMetadata(metadataBytes, templates, properties, sourceDate)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := ids.resolveShift(ctx, tarballName, "rootfs"); err != nil {
+		return "", 0, err
+	}
+
+	logf(ctx, "Updating metadata/templates in tarball")
+	outTarballName := filepath.Join(tmpdir, "output.tar.gz")
+	unpacked, err := createFinalTarball(
+		ctx,
+		outTarballName,
+		tarballName,
+		metadata,
+		gzip.DefaultCompression,
+		sourceDate,
+		format,
+		&ids,
+		templates,
+		files,
+	)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := ids.check(ctx); err != nil {
+		return "", 0, err
+	}
+	return outTarballName, unpacked, nil
+}
+
+// importImage verifies the image tarball, or metadata and rootfs
+// tarballs, and that the image has the templates (see verifyImage),
+// imports it into the remote, and then moves the aliases to it from
+// any existing images, returning its fingerprint. The aliases are
+// only moved once the image has been imported, so that if the
+// tarballs are corrupt, or the import fails, they still refer to
+// the images they did.
+func importImage(
+	ctx context.Context,
+	remote string,
+	aliases []string,
+	templates map[string]template,
+	tarballs ...string,
+) (string, error) {
+	if err := verifyImage(ctx, templates, tarballs...); err != nil {
+		return "", err
+	}
+	var fingerprint string
+	var err error
+	if len(tarballs) == 2 {
+		fingerprint, err = splitFingerprint(tarballs[0], tarballs[1])
+	} else {
+		fingerprint, err = fileSHA256(tarballs[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	importArgs := append([]string{"image", "import"}, tarballs...)
+	if remote != "" {
+		importArgs = append(importArgs, remote+":")
+	}
+	if err := lxcTransfer(ctx, importArgs...); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrImportFailed, err)
+	}
+	for _, alias := range aliases {
+		if imageExists(ctx, qualify(remote, alias)) {
+			if err := lxc(ctx, "image", "alias", "delete", qualify(remote, alias)); err != nil {
+				return "", err
+			}
+		}
+		if err := lxc(ctx, "image", "alias", "create", qualify(remote, alias), fingerprint); err != nil {
+			return "", err
+		}
+	}
+	return fingerprint, nil
+}
+
+// mergeMetadata updates the image metadata (metadata.yaml) with
+// the template references and the given properties,
+// returning the updated metadata. If sourceDate is non-zero, it
+// replaces the image's creation date.
+func mergeMetadata(
+	data []byte,
+	templates map[string]template,
+	properties map[string]string,
+	sourceDate time.Time,
+) ([]byte, error) {
+	metadata := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	if !sourceDate.IsZero() {
+		metadata["creation_date"] = sourceDate.Unix()
+	}
+	metadataTemplates, _ := metadata["templates"].(map[interface{}]interface{})
+	if metadataTemplates == nil {
+		metadataTemplates = make(map[interface{}]interface{})
+		metadata["templates"] = metadataTemplates
+	}
+	for name, template := range templates {
+		metadataTemplates[name] = template
+	}
+	metadataProperties, _ := metadata["properties"].(map[interface{}]interface{})
+	if metadataProperties == nil {
+		metadataProperties = make(map[interface{}]interface{})
+		metadata["properties"] = metadataProperties
+	}
+	for k, v := range properties {
+		metadataProperties[k] = v
+	}
+	return yaml.Marshal(metadata)
+}
+
+// contextReader is an io.Reader that fails once
+// the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// readTarFile returns the contents of the named
+// entry in an uncompressed tarball.
+func readTarFile(tarball, name string) ([]byte, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in %s", name, filepath.Base(tarball))
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(h.Name) == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// walkTarball calls fn for each entry of the uncompressed tarball,
+// in the order they appear or, if sorted is true, sorted by name.
+func walkTarball(f *os.File, sorted bool, fn func(h *tar.Header, r io.Reader) error) error {
+	if !sorted {
+		tr := tar.NewReader(f)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(h, tr); err != nil {
+				return err
+			}
+		}
+	}
+	entries, err := indexTarball(f)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn(e.header, io.NewSectionReader(f, e.offset, e.header.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMetadataFiles writes metadata.yaml, the given template files
+// (keyed by file name, and excluding the templates of the build's
+// template set) and the templates to the image tarball. If sourceDate
+// is non-zero, they are written reproducibly.
+func writeMetadataFiles(
+	out *tarWriter,
+	metadata []byte,
+	files map[string][]byte,
+	templates map[string]template,
+	sourceDate time.Time,
+) error {
+	writeFile := func(name string, content []byte) error {
+		h := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  sourceDate,
+			Typeflag: tar.TypeReg,
+			// Owned by root, as LXD expects, whatever
+			// the ownership of the rootfs entries.
+			Uid: 0,
+			Gid: 0,
+		}
+		if sourceDate.IsZero() {
+			h.Uname, h.Gname = "root", "root"
+		}
+		if err := out.WriteHeader(h); err != nil {
+			return err
+		}
+		_, err := out.Write(content)
+		return err
+	}
+	if err := writeFile("metadata.yaml", metadata); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeFile(path.Join("templates", name), files[name]); err != nil {
+			return err
+		}
+	}
+	for _, t := range sortedTemplates(templates) {
+		if err := writeFile(path.Join("templates", t.Template), []byte(t.content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createFinalTarball writes a gzip-compressed copy of the tarball
+// at inpath to outpath, replacing metadata.yaml and adding the
+// templates and the files to the rootfs. It returns the total size of the regular
+// files in the rootfs, which approximates the space an instance
+// of the image needs.
+//
+// If sourceDate is non-zero, the tarball is written reproducibly,
+// so that identical inputs give byte-identical output: entries are
+// sorted by name, and their headers normalised with normaliseHeader.
+// The gzip header and the format of the tar headers are controlled
+// by format either way.
+//
+// The ownership of rootfs entries is remapped with ids. The
+// metadata entries added are owned by root, and the files, and
+// any parent directories created for them, as ImageFile describes.
+// Extended attributes, including SELinux labels (security.selinux),
+// are preserved.
+func createFinalTarball(
+	ctx context.Context,
+	outpath, inpath string,
+	metadata []byte,
+	compressionLevel int,
+	sourceDate time.Time,
+	format TarballFormat,
+	ids *idMapping,
+	templates map[string]template,
+	files []ImageFile,
+) (int64, error) {
+	fin, err := os.Open(inpath)
+	if err != nil {
+		return 0, err
+	}
+	defer fin.Close()
+
+	templateFiles := make(map[string]bool)
+	for _, t := range templates {
+		templateFiles[path.Join("templates", t.Template)] = true
+	}
+	imageFiles, err := newImageFileWriter("rootfs/", files, func(rel string) ([]byte, error) {
+		return readTarFile(inpath, path.Join("rootfs", rel))
+	})
+	if err != nil {
+		return 0, err
+	}
+	var unpacked int64
+	err = writeGzipTarball(outpath, compressionLevel, format, func(out *tarWriter) error {
+		copyEntry := func(h *tar.Header, r io.Reader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if h.Name == "metadata.yaml" {
+				// Ignore metadata.yaml, we'll write a new one below.
+				return nil
+			}
+			if templateFiles[path.Clean(h.Name)] {
+				// Images derived from images built by this package
+				// already have the templates; they are replaced below.
+				return nil
+			}
+			name := path.Clean(h.Name)
+			if rel := strings.TrimPrefix(name, "rootfs/"); rel != name && imageFiles.skip(rel, h) {
+				// Replaced by an image file, written below.
+				return nil
+			}
+			if err := ids.remap(h); err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeReg && strings.HasPrefix(name, "rootfs/") {
+				unpacked += h.Size
+			}
+			if !sourceDate.IsZero() {
+				normaliseHeader(h, sourceDate)
+			}
+			if err := out.WriteHeader(h); err != nil {
+				return err
+			}
+			_, err := io.Copy(out, r)
+			return err
+		}
+		if err := walkTarball(fin, !sourceDate.IsZero(), copyEntry); err != nil {
+			return err
+		}
+		size, err := imageFiles.write(ctx, out, sourceDate)
+		if err != nil {
+			return err
+		}
+		unpacked += size
+		return writeMetadataFiles(out, metadata, nil, templates, sourceDate)
+	})
+	return unpacked, err
+}
+
+// writeGzipTarball writes a tarball to the named file, compressed
+// with gzip at the given level, with the entries written by fn. The
+// gzip header and tar headers are written as format specifies; the
+// gzip header never records a name.
+func writeGzipTarball(
+	name string,
+	level int,
+	format TarballFormat,
+	fn func(*tarWriter) error,
+) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw, err := gzip.NewWriterLevel(f, level)
+	if err != nil {
+		return err
+	}
+	format.gzipHeader(&zw.Header)
+	tarFormat, err := format.tarFormat()
+	if err != nil {
+		return err
+	}
+	tw := &tarWriter{Writer: tar.NewWriter(zw), format: tarFormat}
+	if err := fn(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
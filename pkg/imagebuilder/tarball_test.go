@@ -0,0 +1,140 @@
+package imagebuilder_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder/lxdfake"
+)
+
+func TestMergeMetadata(t *testing.T) {
+	sourceDate := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	data, err := imagebuilder.MergeMetadata(
+		[]byte(lxdfake.BaseMetadata),
+		map[string]string{"user.team": "juju", "release": "7.8"},
+		sourceDate,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata struct {
+		Architecture string                            `yaml:"architecture"`
+		CreationDate int64                             `yaml:"creation_date"`
+		Properties   map[string]string                 `yaml:"properties"`
+		Templates    map[string]map[string]interface{} `yaml:"templates"`
+	}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Architecture != "x86_64" {
+		t.Errorf("got architecture %q", metadata.Architecture)
+	}
+	if metadata.CreationDate != sourceDate.Unix() {
+		t.Errorf("got creation date %d, expected %d", metadata.CreationDate, sourceDate.Unix())
+	}
+	for k, v := range map[string]string{
+		"os":        "centos",
+		"release":   "7.8",
+		"user.team": "juju",
+	} {
+		if metadata.Properties[k] != v {
+			t.Errorf("property %s: got %q, expected %q", k, metadata.Properties[k], v)
+		}
+	}
+	// The base image's templates are kept alongside ours.
+	for target, name := range map[string]string{
+		"/etc/hostname": "hostname.tpl",
+		"/var/lib/cloud/seed/nocloud-net/user-data": "cloud-init-user.tpl",
+	} {
+		if got := metadata.Templates[target]["template"]; got != name {
+			t.Errorf("template for %s: got %v, expected %q", target, got, name)
+		}
+	}
+}
+
+func TestMergeMetadataKeepsCreationDate(t *testing.T) {
+	data, err := imagebuilder.MergeMetadata([]byte(lxdfake.BaseMetadata), nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata struct {
+		CreationDate int64 `yaml:"creation_date"`
+	}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.CreationDate != 1577836800 {
+		t.Errorf("got creation date %d, expected the base image's", metadata.CreationDate)
+	}
+}
+
+func TestRewriteImageTarball(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarball := filepath.Join(dir, "image.tar.gz")
+	if err := ioutil.WriteFile(tarball, lxdfake.BaseImage(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	motd := filepath.Join(dir, "motd")
+	if err := ioutil.WriteFile(motd, []byte("Built for Juju\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, unpacked, err := imagebuilder.RewriteImageTarball(
+		context.Background(), tarball, dir,
+		map[string]string{"user.team": "juju"},
+		time.Time{},
+		[]imagebuilder.ImageFile{{Source: motd, Destination: "/etc/motd"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked <= 0 {
+		t.Errorf("got unpacked size %d", unpacked)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := lxdfake.ReadTarball(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"rootfs/etc/motd":           "Built for Juju\n",
+		"rootfs/etc/centos-release": "CentOS Linux release 7.7.1908 (Core)\n",
+		"templates/hostname.tpl":    "{{ container.name }}\n",
+	} {
+		if got := string(files[name]); got != content {
+			t.Errorf("%s: got %q, expected %q", name, got, content)
+		}
+	}
+	for _, name := range []string{
+		"templates/cloud-init-meta.tpl",
+		"templates/cloud-init-network.tpl",
+		"templates/cloud-init-user.tpl",
+		"templates/cloud-init-vendor.tpl",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not in image", name)
+		}
+	}
+	metadata, err := lxdfake.Metadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties, _ := metadata["properties"].(map[interface{}]interface{})
+	if properties["user.team"] != "juju" {
+		t.Errorf("got properties %v", properties)
+	}
+}
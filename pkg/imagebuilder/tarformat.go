@@ -0,0 +1,123 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// TarFormatUSTAR writes tar headers in the USTAR format,
+	// failing for entries it cannot represent, such as files
+	// with long names or extended attributes.
+	TarFormatUSTAR = "ustar"
+
+	// TarFormatPAX writes tar headers in the PAX format.
+	TarFormatPAX = "pax"
+
+	// TarFormatGNU writes tar headers in the GNU format,
+	// failing for entries with extended attributes.
+	TarFormatGNU = "gnu"
+)
+
+// gzipOSNames maps the names accepted for TarballFormat.GzipOS
+// to the OS byte of the gzip header (RFC 1952).
+var gzipOSNames = map[string]byte{
+	"fat":     0,
+	"unix":    3,
+	"ntfs":    11,
+	"unknown": 255,
+}
+
+// TarballFormat controls the encoding of the image tarballs a build
+// writes, for consumers that key caches on the tarballs' hashes. The
+// zero value records no name or modification time in the gzip header,
+// and an unknown OS (255), as Go's compress/gzip does, and leaves
+// archive/tar to choose the format of each tar header.
+type TarballFormat struct {
+	// GzipModTime, if non-zero, is the modification time to record
+	// in the gzip header, in seconds since the Unix epoch.
+	GzipModTime int64 `yaml:"gzip-mtime,omitempty" json:"gzip-mtime,omitempty"`
+
+	// GzipOS, if non-empty, is the OS to record in the gzip header:
+	// "unix", "fat", "ntfs", "unknown" or a number from 0 to 255.
+	GzipOS string `yaml:"gzip-os,omitempty" json:"gzip-os,omitempty"`
+
+	// TarFormat, if non-empty, is the format to write every tar
+	// header in: TarFormatUSTAR, TarFormatPAX or TarFormatGNU.
+	// Entries that cannot be represented in it fail the build.
+	TarFormat string `yaml:"tar-format,omitempty" json:"tar-format,omitempty"`
+}
+
+// check checks that the format is valid.
+func (f TarballFormat) check() error {
+	if f.GzipModTime < 0 || f.GzipModTime > 1<<32-1 {
+		return fmt.Errorf("invalid gzip modification time %d", f.GzipModTime)
+	}
+	if _, err := f.gzipOS(); err != nil {
+		return err
+	}
+	if _, err := f.tarFormat(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// gzipOS returns the OS byte of the gzip header.
+func (f TarballFormat) gzipOS() (byte, error) {
+	if f.GzipOS == "" {
+		return gzipOSNames["unknown"], nil
+	}
+	if os, ok := gzipOSNames[f.GzipOS]; ok {
+		return os, nil
+	}
+	os, err := strconv.ParseUint(f.GzipOS, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid gzip OS %q (expected unix, fat, ntfs, unknown or 0-255)", f.GzipOS)
+	}
+	return byte(os), nil
+}
+
+// tarFormat returns the format of the tar headers,
+// or tar.FormatUnknown to leave it to archive/tar.
+func (f TarballFormat) tarFormat() (tar.Format, error) {
+	switch f.TarFormat {
+	case "":
+		return tar.FormatUnknown, nil
+	case TarFormatUSTAR:
+		return tar.FormatUSTAR, nil
+	case TarFormatPAX:
+		return tar.FormatPAX, nil
+	case TarFormatGNU:
+		return tar.FormatGNU, nil
+	}
+	return tar.FormatUnknown, fmt.Errorf("invalid tar format %q (expected ustar, pax or gnu)", f.TarFormat)
+}
+
+// gzipHeader sets the fields of the gzip header. The format
+// must have been checked.
+func (f TarballFormat) gzipHeader(h *gzip.Header) {
+	h.Name = ""
+	h.ModTime = time.Time{}
+	if f.GzipModTime != 0 {
+		h.ModTime = time.Unix(f.GzipModTime, 0)
+	}
+	h.OS, _ = f.gzipOS()
+}
+
+// tarWriter is a tar.Writer that writes every
+// header in a given format, if one is set.
+type tarWriter struct {
+	*tar.Writer
+	format tar.Format
+}
+
+// WriteHeader writes the header in the writer's format.
+func (w *tarWriter) WriteHeader(h *tar.Header) error {
+	if w.format != tar.FormatUnknown {
+		h.Format = w.format
+	}
+	return w.Writer.WriteHeader(h)
+}
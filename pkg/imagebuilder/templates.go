@@ -0,0 +1,363 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// TemplateSetNoCloudClassic, the default Options.TemplateSet,
+	// renders a cloud-init NoCloud seed (meta-data, network-config,
+	// user-data and vendor-data) in /var/lib/cloud/seed/nocloud-net
+	// from the instance's user.* config.
+	TemplateSetNoCloudClassic = "nocloud-classic"
+
+	// TemplateSetLXDDatasource configures cloud-init to read the
+	// instance's config from LXD itself, over /dev/lxd, with its
+	// LXD datasource, falling back to NoCloud. It needs cloud-init
+	// 21.3 or later, which is newer than CentOS 7 ships.
+	TemplateSetLXDDatasource = "lxd-datasource"
+
+	// TemplateSetStaticNetwork is TemplateSetNoCloudClassic, but
+	// with a network config that gives eth0 the static address in
+	// user.static-network.address (in CIDR notation), with the
+	// optional user.static-network.gateway and comma-separated
+	// user.static-network.nameservers, if set. Instances without
+	// an address use DHCP, and user.network-config still overrides
+	// the network config.
+	TemplateSetStaticNetwork = "static-network"
+)
+
+const (
+	cloudInitMetaTemplate = `#cloud-config
+instance-id: {{ container.name }}
+local-hostname: {{ container.name }}
+{{ config_get("user.meta-data", "") }}`
+
+	cloudInitNetworkTemplate = `{% if config_get("user.network-config", "") == "" %}version: 1
+config:
+    - type: physical
+      name: eth0
+      subnets:
+          - type: {% if config_get("user.network_mode", "") == "link-local" %}manual{% else %}dhcp{% endif %}
+            control: auto{% else %}{{ config_get("user.network-config", "") }}{% endif %}`
+
+	cloudInitStaticNetworkTemplate = `{% if config_get("user.network-config", "") == "" %}version: 1
+config:
+    - type: physical
+      name: eth0
+      subnets:
+{% if config_get("user.static-network.address", "") == "" %}          - type: dhcp
+            control: auto{% else %}          - type: static
+            control: auto
+            address: {{ config_get("user.static-network.address", "") }}{% if config_get("user.static-network.gateway", "") != "" %}
+            gateway: {{ config_get("user.static-network.gateway", "") }}{% endif %}{% if config_get("user.static-network.nameservers", "") != "" %}
+            dns_nameservers: [{{ config_get("user.static-network.nameservers", "") }}]{% endif %}{% endif %}{% else %}{{ config_get("user.network-config", "") }}{% endif %}`
+
+	cloudInitUserTemplate = `{{ config_get("user.user-data", properties.default) }}`
+
+	cloudInitVendorTemplate = `{{ config_get("user.vendor-data", properties.default) }}`
+
+	lxdDatasourceTemplate = `# Written by ` + BuilderName + `: read the instance's config from LXD.
+datasource_list: [ LXD, NoCloud, None ]
+`
+)
+
+var cloudInitTemplates = map[string]template{
+	"/var/lib/cloud/seed/nocloud-net/meta-data": template{
+		Template: "cloud-init-meta.tpl",
+		When:     []string{"create", "copy"},
+		content:  cloudInitMetaTemplate,
+	},
+	"/var/lib/cloud/seed/nocloud-net/network-config": template{
+		Template: "cloud-init-network.tpl",
+		When:     []string{"create", "copy"},
+		content:  cloudInitNetworkTemplate,
+	},
+	"/var/lib/cloud/seed/nocloud-net/user-data": template{
+		Properties: map[string]string{
+			"default": "#cloud-config\n{}",
+		},
+		Template: "cloud-init-user.tpl",
+		When:     []string{"create", "copy"},
+		content:  cloudInitUserTemplate,
+	},
+	"/var/lib/cloud/seed/nocloud-net/vendor-data": template{
+		Properties: map[string]string{
+			"default": "#cloud-config\n{}",
+		},
+		Template: "cloud-init-vendor.tpl",
+		When:     []string{"create", "copy"},
+		content:  cloudInitVendorTemplate,
+	},
+}
+
+// templateSets holds the built-in template sets, keyed by name.
+var templateSets = map[string]map[string]template{
+	TemplateSetNoCloudClassic: cloudInitTemplates,
+	TemplateSetLXDDatasource: {
+		"/etc/cloud/cloud.cfg.d/90_lxd_datasource.cfg": template{
+			Template: "lxd-datasource.cfg.tpl",
+			When:     []string{"create", "copy"},
+			content:  lxdDatasourceTemplate,
+		},
+	},
+	TemplateSetStaticNetwork: staticNetworkTemplates(),
+}
+
+// staticNetworkTemplates returns the templates of
+// TemplateSetStaticNetwork.
+func staticNetworkTemplates() map[string]template {
+	templates := make(map[string]template, len(cloudInitTemplates))
+	for target, t := range cloudInitTemplates {
+		templates[target] = t
+	}
+	// The template keeps its file name, so that it replaces
+	// that of images built with the classic set.
+	t := templates["/var/lib/cloud/seed/nocloud-net/network-config"]
+	t.content = cloudInitStaticNetworkTemplate
+	templates["/var/lib/cloud/seed/nocloud-net/network-config"] = t
+	return templates
+}
+
+// TemplateSet is a set of templates for LXD to render into
+// instances of the image, keyed by the absolute path of the
+// file each renders.
+type TemplateSet map[string]TemplateFile
+
+// TemplateFile is a template in a TemplateSet, in LXD's template
+// syntax (see the LXD image documentation).
+type TemplateFile struct {
+	// Source is the path of the template on the host.
+	// Either Source or Content must be specified.
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+
+	// Content is the template itself.
+	Content string `yaml:"content,omitempty" json:"content,omitempty"`
+
+	// Name is the file name of the template in the image. If
+	// empty, it is the base name of the file rendered, with
+	// ".tpl" appended.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+
+	// When holds the events on which LXD renders the template:
+	// "create", "copy" and "start". By default, it is rendered
+	// on create and copy only.
+	When []string `yaml:"when,omitempty" json:"when,omitempty"`
+
+	// Properties holds values for the template to refer
+	// to as properties.<key>.
+	Properties map[string]string `yaml:"properties,omitempty" json:"properties,omitempty"`
+}
+
+type template struct {
+	Properties map[string]string `yaml:"properties,omitempty"`
+	Template   string            `yaml:"template"`
+	When       []string          `yaml:"when,omitempty"`
+
+	// content is the contents of the template file to create
+	// in the image metadata.
+	content string `yaml:"-"`
+}
+
+// templateEvents holds the events on which LXD can render
+// templates: when an instance is created from the image, when
+// it is copied, and on every start.
+var templateEvents = []string{"create", "copy", "start"}
+
+// checkTemplateEvents checks that events is a
+// non-empty list of template events.
+func checkTemplateEvents(events []string) error {
+	if len(events) == 0 {
+		return fmt.Errorf("no events specified")
+	}
+events:
+	for _, event := range events {
+		for _, known := range templateEvents {
+			if event == known {
+				continue events
+			}
+		}
+		return fmt.Errorf(
+			"invalid event %q (expected %s)",
+			event, strings.Join(templateEvents, ", "),
+		)
+	}
+	return nil
+}
+
+// resolveTemplates returns the templates of the named template set
+// (see Options.TemplateSet and Options.TemplateSets), keyed by the
+// file each renders, with the events on which they are rendered
+// overridden by triggers (see Options.TemplateTriggers). The
+// templates of sets defined in sets are read from their sources.
+func resolveTemplates(name string, sets map[string]TemplateSet, triggers map[string][]string) (map[string]template, error) {
+	for setName := range sets {
+		if _, ok := templateSets[setName]; ok {
+			return nil, fmt.Errorf("template set %q is built in, and cannot be redefined", setName)
+		}
+	}
+	if name == "" {
+		name = TemplateSetNoCloudClassic
+	}
+	var templates map[string]template
+	if builtin, ok := templateSets[name]; ok {
+		templates = make(map[string]template, len(builtin))
+		for target, t := range builtin {
+			templates[target] = t
+		}
+	} else if set, ok := sets[name]; ok {
+		var err error
+		if templates, err = set.templates(); err != nil {
+			return nil, fmt.Errorf("template set %q: %v", name, err)
+		}
+	} else {
+		var known []string
+		for name := range templateSets {
+			known = append(known, name)
+		}
+		for name := range sets {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf(
+			"unknown template set %q (expected one of %s)",
+			name, strings.Join(known, ", "),
+		)
+	}
+	if err := checkTemplateTriggers(templates, triggers); err != nil {
+		return nil, err
+	}
+	for target, t := range templates {
+		if when, ok := triggers[path.Base(target)]; ok {
+			t.When = when
+			templates[target] = t
+		}
+	}
+	return templates, nil
+}
+
+// templates checks the set, and returns its templates,
+// read from their sources.
+func (s TemplateSet) templates() (map[string]template, error) {
+	if len(s) == 0 {
+		return nil, fmt.Errorf("no templates")
+	}
+	templates := make(map[string]template, len(s))
+	names := make(map[string]string)
+	targets := make([]string, 0, len(s))
+	for target := range s {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		f := s[target]
+		if !path.IsAbs(target) || path.Clean(target) == "/" {
+			return nil, fmt.Errorf("template target %q is not an absolute file path", target)
+		}
+		name := f.Name
+		if name == "" {
+			name = path.Base(target) + ".tpl"
+		}
+		if strings.ContainsRune(name, '/') || name == "." || name == ".." {
+			return nil, fmt.Errorf("invalid template name %q", name)
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("templates for %s and %s are both named %q", other, target, name)
+		}
+		names[name] = target
+		when := f.When
+		if when == nil {
+			when = []string{"create", "copy"}
+		}
+		if err := checkTemplateEvents(when); err != nil {
+			return nil, fmt.Errorf("template for %s: %v", target, err)
+		}
+		content := f.Content
+		switch {
+		case f.Source != "" && f.Content != "":
+			return nil, fmt.Errorf("template for %s has both source and content", target)
+		case f.Source != "":
+			data, err := ioutil.ReadFile(f.Source)
+			if err != nil {
+				return nil, err
+			}
+			content = string(data)
+		case f.Content == "":
+			return nil, fmt.Errorf("template for %s has no source or content", target)
+		}
+		templates[target] = template{
+			Properties: f.Properties,
+			Template:   name,
+			When:       when,
+			content:    content,
+		}
+	}
+	return templates, nil
+}
+
+// checkTemplateTriggers checks that the keys of triggers (see
+// Options.TemplateTriggers) name templates, and that their
+// values are lists of template events.
+func checkTemplateTriggers(templates map[string]template, triggers map[string][]string) error {
+	names := make([]string, 0, len(triggers))
+	for name := range triggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if templateTarget(templates, name) == "" {
+			var known []string
+			for target := range templates {
+				known = append(known, path.Base(target))
+			}
+			sort.Strings(known)
+			return fmt.Errorf(
+				"unknown template %q (expected one of %s)",
+				name, strings.Join(known, ", "),
+			)
+		}
+		if err := checkTemplateEvents(triggers[name]); err != nil {
+			return fmt.Errorf("template %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// templateTarget returns the file that the named template
+// renders, or "" if there is no such template.
+func templateTarget(templates map[string]template, name string) string {
+	for target := range templates {
+		if path.Base(target) == name {
+			return target
+		}
+	}
+	return ""
+}
+
+// templateTargets returns the files that the
+// templates render, sorted.
+func templateTargets(templates map[string]template) []string {
+	targets := make([]string, 0, len(templates))
+	for target := range templates {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// sortedTemplates returns the templates,
+// sorted by template file name.
+func sortedTemplates(templates map[string]template) []template {
+	sorted := make([]template, 0, len(templates))
+	for _, t := range templates {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Template < sorted[j].Template
+	})
+	return sorted
+}
@@ -0,0 +1,95 @@
+package imagebuilder
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/ratelimit"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/s3"
+)
+
+// uploader uploads simplestreams trees to S3-compatible
+// object storage.
+type uploader struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// newUploader returns an uploader for the given "s3://bucket/prefix"
+// URL, with credentials taken from the environment.
+func newUploader(target string, limiter *ratelimit.Limiter) (*uploader, error) {
+	bucket, prefix, err := s3.ParseURL(target)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	client.Limiter = limiter
+	return &uploader{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (u *uploader) key(p string) string {
+	return path.Join(u.prefix, p)
+}
+
+// fetchMetadata downloads the simplestreams metadata from the bucket
+// into dir, if dir has none, so that the uploaded metadata continues
+// to list previously uploaded images.
+func (u *uploader) fetchMetadata(ctx context.Context, dir string) error {
+	local := filepath.Join(dir, filepath.FromSlash(streamsImagesPath))
+	if _, err := os.Stat(local); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	err := u.client.GetFile(ctx, u.bucket, u.key(streamsImagesPath), local)
+	if err == s3.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// upload uploads the files with the given slash-separated paths,
+// relative to dir, in order, returning the URLs of the uploaded
+// objects.
+func (u *uploader) upload(ctx context.Context, dir string, paths []string) ([]string, error) {
+	var urls []string
+	for _, p := range paths {
+		key := u.key(p)
+		logf(ctx, "Uploading %s to s3://%s/%s", p, u.bucket, key)
+		contentType := "application/octet-stream"
+		switch {
+		case path.Ext(p) == ".json":
+			contentType = "application/json"
+		case p == checksumsPath:
+			contentType = "text/plain"
+		case p == checksumsSignaturePath:
+			contentType = "application/pgp-signature"
+		}
+		if err := u.client.PutFile(ctx, u.bucket, key, filepath.Join(dir, filepath.FromSlash(p)), contentType); err != nil {
+			return urls, err
+		}
+		url := "s3://" + u.bucket + "/" + key
+		urls = append(urls, url)
+		emit(ctx, Event{Type: EventArtifact, Artifact: url})
+	}
+	return urls, nil
+}
+
+// remove deletes the objects with the given slash-separated paths.
+func (u *uploader) remove(ctx context.Context, paths []string) error {
+	for _, p := range paths {
+		key := u.key(p)
+		logf(ctx, "Deleting s3://%s/%s", u.bucket, key)
+		if err := u.client.Delete(ctx, u.bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
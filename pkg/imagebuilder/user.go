@@ -0,0 +1,102 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// execUser is a user, other than root, to run commands
+// in the container as.
+type execUser struct {
+	name string
+	uid  string
+	gid  string
+	home string
+}
+
+// lookupExecUser looks up the user and group, either of which may be
+// a name or a numeric ID, in the container. If group is empty, the
+// user's primary group is used; if user is empty, the command runs as
+// root with the given group. If both are empty, lookupExecUser returns
+// nil.
+func lookupExecUser(ctx context.Context, container, user, group string) (*execUser, error) {
+	if user == "" && group == "" {
+		return nil, nil
+	}
+	u := &execUser{name: "root", uid: "0", gid: "0", home: "/root"}
+	if user != "" {
+		fields, err := getent(ctx, container, "passwd", user)
+		if err != nil {
+			return nil, err
+		}
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("unexpected passwd entry for user %q: %q", user, strings.Join(fields, ":"))
+		}
+		u.name, u.uid, u.gid, u.home = fields[0], fields[2], fields[3], fields[5]
+	}
+	if group != "" {
+		fields, err := getent(ctx, container, "group", group)
+		if err != nil {
+			return nil, err
+		}
+		// name:password:gid:members
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected group entry for group %q: %q", group, strings.Join(fields, ":"))
+		}
+		u.gid = fields[2]
+	}
+	return u, nil
+}
+
+// getent returns the fields of the entry for key in the container's
+// database (passwd or group).
+func getent(ctx context.Context, container, database, key string) ([]string, error) {
+	out, err := runOutput(ctx, "lxc", "exec", container, "--", "getent", database, key)
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s entry for %q: %w", database, key, err)
+	}
+	line := strings.TrimSpace(string(out))
+	if i := strings.IndexRune(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	return strings.Split(line, ":"), nil
+}
+
+// execArgs returns the arguments for "lxc exec" to run a command in
+// the container as the user, with HOME and USER set accordingly, in
+// the given working directory if non-empty.
+func (u *execUser) execArgs(container, dir string) []string {
+	args := []string{"exec", container}
+	if u != nil {
+		args = append(args,
+			"--user", u.uid, "--group", u.gid,
+			"--env", "HOME="+u.home, "--env", "USER="+u.name,
+		)
+	}
+	if dir != "" {
+		args = append(args, "--cwd", dir)
+	}
+	return append(args, "--")
+}
+
+// loadBuildArgs returns the shell commands to prepend to a command
+// run as the user to load the build arguments, or "" if there are
+// none. Build arguments are readable only by root, so a copy is
+// made for other users.
+func (u *execUser) loadBuildArgs(ctx context.Context, container string) (string, error) {
+	if contextBuildArgs(ctx) == nil {
+		return "", nil
+	}
+	if u == nil || u.uid == "0" {
+		return loadBuildArgsShell(buildArgsPath), nil
+	}
+	path := buildArgsPath + "." + u.uid
+	if err := lxc(ctx, "exec", container, "--",
+		"/usr/bin/install", "-m", "0400", "-o", u.uid, "-g", u.gid, buildArgsPath, path,
+	); err != nil {
+		return "", err
+	}
+	return loadBuildArgsShell(path), nil
+}
@@ -0,0 +1,44 @@
+package imagebuilder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// readUserData reads the cloud-init user-data file, checking that it
+// is in one of the formats cloud-init recognises by its first line:
+// cloud-config, a script, an include file, or a jinja template.
+func readUserData(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s := string(data)
+	for _, prefix := range []string{"#cloud-config", "#!", "#include", "## template: jinja", "Content-Type: multipart/"} {
+		if strings.HasPrefix(s, prefix) {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not cloud-init user-data: expected it to start with #cloud-config", path)
+}
+
+// waitCloudInit waits for cloud-init to finish in the build container,
+// returning an error if it fails, e.g. because the user-data could not
+// be applied, or if the container has no cloud-init.
+func waitCloudInit(ctx context.Context, container string) error {
+	logf(ctx, "Waiting for cloud-init to apply user-data")
+	err := lxc(ctx, "exec", container, "--", "cloud-init", "status", "--wait", "--long")
+	if err == nil {
+		return nil
+	}
+	if _, verr := containerCloudInitVersion(ctx, container); verr != nil {
+		return fmt.Errorf(
+			"base image has no cloud-init to apply user-data; "+
+				"use a cloud variant such as images:centos/7/cloud: %v",
+			verr,
+		)
+	}
+	return fmt.Errorf("applying user-data with cloud-init: %w", err)
+}
@@ -0,0 +1,140 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// imageMetadata holds the fields of an image's metadata.yaml
+// that LXD requires to import and launch it.
+type imageMetadata struct {
+	Architecture string              `yaml:"architecture"`
+	CreationDate int64               `yaml:"creation_date"`
+	Templates    map[string]template `yaml:"templates"`
+}
+
+// verifyImage checks that the gzip-compressed image tarball, or
+// metadata and rootfs tarballs, written by the builder can be
+// loaded: that they decompress with valid checksums, that every
+// tar entry can be read, that metadata.yaml parses and has an
+// architecture, and that the templates it refers to, including
+// those given, are present. It fails with ErrImportFailed if not,
+// before anything is imported. The qcow2 root disk of VM images
+// is taken as is.
+func verifyImage(ctx context.Context, templates map[string]template, tarballs ...string) error {
+	logf(ctx, "Verifying image tarball")
+	var metadata []byte
+	present := make(map[string]bool)
+	var rootfs int
+	for i, name := range tarballs {
+		// The metadata tarball of a split image holds no rootfs.
+		split := len(tarballs) == 2
+		if split && i == 1 {
+			// The root disk of VM images is taken as is.
+			vm, err := isQCOW2(name)
+			if err != nil {
+				return err
+			}
+			if vm {
+				rootfs++
+				continue
+			}
+		}
+		err := walkGzipTarball(ctx, name, func(h *tar.Header, r io.Reader) error {
+			entry := path.Clean(h.Name)
+			switch {
+			case split && i == 1:
+				rootfs++
+			case entry == "metadata.yaml":
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				metadata = data
+			case strings.HasPrefix(entry, "templates/"):
+				present[strings.TrimPrefix(entry, "templates/")] = true
+			case entry == "rootfs" || strings.HasPrefix(entry, "rootfs/"):
+				rootfs++
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %s is not a valid image tarball: %v", ErrImportFailed, filepath.Base(name), err)
+		}
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: invalid image: %s", ErrImportFailed, fmt.Sprintf(format, args...))
+	}
+	if metadata == nil {
+		return invalid("no metadata.yaml")
+	}
+	var m imageMetadata
+	if err := yaml.Unmarshal(metadata, &m); err != nil {
+		return invalid("cannot parse metadata.yaml: %v", err)
+	}
+	if m.Architecture == "" {
+		return invalid("metadata.yaml has no architecture")
+	}
+	for target, t := range templates {
+		if _, ok := m.Templates[target]; !ok {
+			return invalid("metadata.yaml has no template for %s", target)
+		}
+		if !present[t.Template] {
+			return invalid("template %s is missing", t.Template)
+		}
+	}
+	for target, t := range m.Templates {
+		if !present[t.Template] {
+			return invalid("template %s for %s is missing", t.Template, target)
+		}
+	}
+	if rootfs == 0 {
+		return invalid("empty rootfs")
+	}
+	return nil
+}
+
+// walkGzipTarball calls fn for each entry of the gzip-compressed
+// tarball, reading each entry, and the rest of the gzip stream, in
+// full, so that truncation and corruption are detected.
+func walkGzipTarball(ctx context.Context, name string, fn func(h *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(contextReader{ctx, f})
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := fn(h, tr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+	// Reading to the end of the gzip stream checks its checksum.
+	if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return err
+	}
+	return zr.Close()
+}
@@ -0,0 +1,379 @@
+package imagebuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// vmAgentDevice is the name of the disk device through which
+	// the LXD agent is installed in VMs built from qcow2 images.
+	vmAgentDevice = "juju-lxd-centos-agent"
+
+	// vmCloudInitDevice is the name of the disk device that
+	// holds the cloud-init seed of VMs built from qcow2 images.
+	vmCloudInitDevice = "juju-lxd-centos-cloud-init"
+
+	// vmAgentTimeout is how long to wait for the LXD
+	// agent to start in a build VM.
+	vmAgentTimeout = 5 * time.Minute
+
+	// vmDisk is the name LXD gives the root disk of a VM image.
+	vmDisk = "rootfs.img"
+)
+
+// qcow2Magic is the magic number at the start of qcow2 disk images.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// vmAgentDevices holds the devices added to VMs built from qcow2
+// images, which, unlike the VM images on the "images:" remote, have
+// neither the LXD agent, which "lxc exec" and "lxc file" need, nor
+// LXD's cloud-init datasource. The agent's drive holds the agent and
+// its installer, and the cloud-init drive a NoCloud seed holding the
+// instance's user-data and vendor-data.
+var vmAgentDevices = map[string]map[string]string{
+	vmAgentDevice:     {"type": "disk", "source": "agent:config"},
+	vmCloudInitDevice: {"type": "disk", "source": "cloud-init:config"},
+}
+
+// vmAgentVendorData is the cloud-init vendor-data of VMs built from
+// qcow2 images, which installs the LXD agent from its drive, mounted
+// by label or, on older LXD servers, as the 9p "config" share.
+const vmAgentVendorData = `#cloud-config
+runcmd:
+- mkdir -p /run/lxd-agent-install
+- mount -o ro /dev/disk/by-label/lxd-agent /run/lxd-agent-install || mount -t 9p config /run/lxd-agent-install
+- cd /run/lxd-agent-install && ./install.sh
+- umount /run/lxd-agent-install
+- systemctl start lxd-agent
+`
+
+// checkVMOptions checks that the options of a VM build
+// (see Options.VM) do not ask for what VM builds cannot do.
+func checkVMOptions(opts Options) error {
+	switch {
+	case opts.BaseQCOW2 == "" && opts.Base == "":
+		return fmt.Errorf("VM builds require a qcow2 base image, or a base image built as a VM")
+	case opts.ImageFormat == ImageFormatSplit:
+		return fmt.Errorf("VM images cannot be written from an export of the build instance (image format %q)", opts.ImageFormat)
+	case len(opts.ImageFiles) > 0 || opts.BakeSeed:
+		return fmt.Errorf("image files and baked seeds cannot be added to VM images")
+	case opts.Reproducible:
+		return fmt.Errorf("VM images cannot be written reproducibly")
+	case opts.IDShift != 0 || opts.StrictIDs:
+		return fmt.Errorf("ID shifts and strict IDs do not apply to VM images")
+	case opts.Cache:
+		return fmt.Errorf("VM builds cannot be cached")
+	case opts.Privileged:
+		return fmt.Errorf("VM builds cannot be privileged")
+	case opts.OutputDir != "" || opts.Upload != "":
+		return fmt.Errorf("VM images cannot be written to a simplestreams tree")
+	case len(opts.TestScenarios) > 0 || opts.JujuTest:
+		return fmt.Errorf("VM images cannot be tested with test scenarios or Juju, which launch containers")
+	}
+	return nil
+}
+
+// checkQCOW2Options checks the options of a build from
+// a qcow2 cloud image (see Options.BaseQCOW2).
+func checkQCOW2Options(opts Options) error {
+	switch {
+	case !opts.VM:
+		return fmt.Errorf("qcow2 base images require a VM build")
+	case opts.Base != "":
+		return fmt.Errorf("base image and qcow2 base image cannot both be specified")
+	case opts.ImageServer != "" || len(opts.ImageFallbacks) > 0:
+		return fmt.Errorf("image server and image fallbacks cannot be specified with a qcow2 base image")
+	case opts.BaseKeyring != "":
+		return fmt.Errorf("qcow2 base images cannot be verified with a keyring")
+	}
+	if _, ok := opts.ContainerConfig["user.vendor-data"]; ok {
+		return fmt.Errorf("build container config key %q cannot be set with a qcow2 base image", "user.vendor-data")
+	}
+	return checkQCOW2(opts.BaseQCOW2)
+}
+
+// isQCOW2 reports whether the named file is a qcow2 disk image.
+func isQCOW2(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, qcow2Magic), nil
+}
+
+// checkQCOW2 checks that the named file is a qcow2 disk image.
+func checkQCOW2(name string) error {
+	ok, err := isQCOW2(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not a qcow2 disk image", name)
+	}
+	return nil
+}
+
+// qcow2VirtualSize returns the size in bytes of the disk held
+// by the qcow2 image, as recorded in its header.
+func qcow2VirtualSize(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("reading qcow2 header of %s: %w", filepath.Base(name), err)
+	}
+	return int64(binary.BigEndian.Uint64(header[24:])), nil
+}
+
+// serverArchitecture returns the kernel architecture of
+// the remote's LXD server, e.g. "x86_64".
+func serverArchitecture(ctx context.Context, remote string) (string, error) {
+	out, err := runOutput(ctx, "lxc", "info", qualify(remote, ""))
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Environment struct {
+			KernelArchitecture string `yaml:"kernel_architecture"`
+		} `yaml:"environment"`
+	}
+	if err := yaml.Unmarshal(out, &info); err != nil {
+		return "", err
+	}
+	if info.Environment.KernelArchitecture == "" {
+		return "", fmt.Errorf("cannot determine the architecture of the LXD server")
+	}
+	return info.Environment.KernelArchitecture, nil
+}
+
+// importQCOW2Base imports the qcow2 cloud image into the remote's
+// image store as a VM image, unless it is already there, returning
+// its fingerprint and a function that deletes it if it was imported.
+//
+// The image's metadata tarball is generated in dir, for the LXD
+// server's architecture, as VMs run natively. It is written
+// reproducibly, dated by the qcow2 image's modification time, so
+// that the image is only imported again if the qcow2 image changes.
+func importQCOW2Base(ctx context.Context, remote, disk, dir string) (string, func(), error) {
+	noop := func() {}
+	info, err := os.Stat(disk)
+	if err != nil {
+		return "", noop, err
+	}
+	arch, err := serverArchitecture(ctx, remote)
+	if err != nil {
+		return "", noop, err
+	}
+	date := time.Unix(info.ModTime().Unix(), 0).UTC()
+	metadata, err := yaml.Marshal(map[string]interface{}{
+		"architecture":  arch,
+		"creation_date": date.Unix(),
+		"properties": map[string]string{
+			"architecture": arch,
+			"description":  filepath.Base(disk),
+		},
+	})
+	if err != nil {
+		return "", noop, err
+	}
+	dir = filepath.Join(dir, "base")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", noop, err
+	}
+	metadataTarball := filepath.Join(dir, "metadata.tar.gz")
+	if err := writeGzipTarball(metadataTarball, gzip.DefaultCompression, TarballFormat{}, func(out *tarWriter) error {
+		return writeMetadataFiles(out, metadata, nil, nil, date)
+	}); err != nil {
+		return "", noop, err
+	}
+	// lxc takes a rootfs named rootfs.img as a VM's root
+	// disk. Link to the qcow2 image or, failing that, copy it.
+	rootfs := filepath.Join(dir, vmDisk)
+	if err := os.Link(disk, rootfs); err != nil {
+		if _, _, err := copyFileSHA256(rootfs, disk); err != nil {
+			return "", noop, err
+		}
+	}
+	fingerprint, err := splitFingerprint(metadataTarball, rootfs)
+	if err != nil {
+		return "", noop, err
+	}
+	image := qualify(remote, fingerprint)
+	if imageExists(ctx, image) {
+		return fingerprint, noop, nil
+	}
+	logf(ctx, "Importing %s as a VM image", disk)
+	importArgs := []string{"image", "import", metadataTarball, rootfs}
+	if remote != "" {
+		importArgs = append(importArgs, remote+":")
+	}
+	if err := lxcTransfer(ctx, importArgs...); err != nil {
+		return "", noop, fmt.Errorf("%w: %v", ErrImportFailed, err)
+	}
+	return fingerprint, func() {
+		if err := lxc(detach(ctx), "image", "delete", image); err != nil {
+			logf(ctx, "Deleting base image: %v", err)
+		}
+	}, nil
+}
+
+// waitVMAgent waits for the LXD agent to start in the build VM,
+// which "lxc exec" and "lxc file" need, as it boots, and for VMs
+// built from qcow2 images, as cloud-init installs the agent.
+func waitVMAgent(ctx context.Context, vm string) error {
+	logf(ctx, "Waiting for the VM agent to start")
+	interval := 5 * time.Second
+	deadline := time.Now().Add(vmAgentTimeout)
+	for {
+		err := lxc(ctx, "exec", vm, "--", "true")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("VM agent did not start within %v: %w", vmAgentTimeout, err)
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// createVMImage exports the intermediate VM image to dir, and writes
+// the metadata tarball of the final image there, with the templates
+// and properties added, as for updateImageTemplates. The paths of the
+// metadata tarball and the image's root disk are returned, along with
+// the size of the disk, which approximates the space an instance of
+// the image needs. The disk is taken as is, so files cannot be added
+// to it.
+func createVMImage(
+	ctx context.Context,
+	remote string,
+	intermediate string,
+	dir string,
+	properties map[string]string,
+	format TarballFormat,
+	templates map[string]template,
+) (string, string, int64, error) {
+	exportDir := filepath.Join(dir, "export")
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return "", "", 0, err
+	}
+	if err := lxcTransfer(ctx, "image", "export", qualify(remote, intermediate), exportDir); err != nil {
+		return "", "", 0, err
+	}
+	// VM images are exported as a metadata tarball,
+	// named "meta-<fingerprint>...", and the root disk.
+	infos, err := ioutil.ReadDir(exportDir)
+	if err != nil {
+		return "", "", 0, err
+	}
+	var metadataTarball, disk string
+	for _, info := range infos {
+		name := filepath.Join(exportDir, info.Name())
+		if strings.HasPrefix(info.Name(), "meta-") {
+			metadataTarball = name
+		} else {
+			disk = name
+		}
+	}
+	if len(infos) != 2 || metadataTarball == "" || disk == "" {
+		return "", "", 0, fmt.Errorf("expected a metadata tarball and a disk image, found %d files", len(infos))
+	}
+	if err := checkQCOW2(disk); err != nil {
+		return "", "", 0, err
+	}
+	unpacked, err := qcow2VirtualSize(disk)
+	if err != nil {
+		return "", "", 0, err
+	}
+	rootfs := filepath.Join(dir, vmDisk)
+	if err := os.Rename(disk, rootfs); err != nil {
+		return "", "", 0, err
+	}
+
+	metadataTarball, err = decompressTarball(ctx, metadataTarball)
+	if err != nil {
+		return "", "", 0, err
+	}
+	metadataBytes, err := readTarFile(metadataTarball, "metadata.yaml")
+	if err != nil {
+		return "", "", 0, err
+	}
+	metadata, err := mergeMetadata(metadataBytes, templates, properties, time.Time{})
+	if err != nil {
+		return "", "", 0, err
+	}
+	// The templates of the intermediate image, other than those
+	// replaced, are carried over.
+	setFiles := make(map[string]bool)
+	for _, t := range templates {
+		setFiles[t.Template] = true
+	}
+	templateFiles := make(map[string][]byte)
+	f, err := os.Open(metadataTarball)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer f.Close()
+	if err := walkTarball(f, false, func(h *tar.Header, r io.Reader) error {
+		name := path.Clean(h.Name)
+		if rel := strings.TrimPrefix(name, "templates/"); rel != name && h.Typeflag == tar.TypeReg && !setFiles[rel] {
+			content, err := ioutil.ReadAll(r)
+			templateFiles[rel] = content
+			return err
+		}
+		return nil
+	}); err != nil {
+		return "", "", 0, err
+	}
+
+	logf(ctx, "Writing metadata tarball")
+	out := filepath.Join(dir, "metadata.tar.gz")
+	if err := writeGzipTarball(out, gzip.DefaultCompression, format, func(out *tarWriter) error {
+		return writeMetadataFiles(out, metadata, templateFiles, templates, time.Time{})
+	}); err != nil {
+		return "", "", 0, err
+	}
+	return out, rootfs, unpacked, nil
+}
+
+type vmKey struct{}
+
+// withVM returns a context marking the build
+// as one whose build instance is a VM.
+func withVM(ctx context.Context) context.Context {
+	return context.WithValue(ctx, vmKey{}, true)
+}
+
+// instanceType returns the type of the build instance,
+// "container" or "virtual-machine".
+func instanceType(ctx context.Context) string {
+	if vm, _ := ctx.Value(vmKey{}).(bool); vm {
+		return "virtual-machine"
+	}
+	return "container"
+}
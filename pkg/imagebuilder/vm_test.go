@@ -0,0 +1,223 @@
+package imagebuilder_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder/lxdfake"
+)
+
+// writeCloudImage writes lxdfake.CloudImage to a file in
+// a temporary directory, returning the directory and file.
+func writeCloudImage(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "imagebuilder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := filepath.Join(dir, "Rocky-9-GenericCloud.latest.x86_64.qcow2")
+	if err := ioutil.WriteFile(disk, lxdfake.CloudImage(), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, disk
+}
+
+func TestBuildVMFromQCOW2(t *testing.T) {
+	dir, disk := writeCloudImage(t)
+	defer os.RemoveAll(dir)
+
+	fake := lxdfake.New()
+	result, err := build(t, imagebuilder.Options{
+		Runner:    fake,
+		VM:        true,
+		BaseQCOW2: disk,
+		Alias:     "juju/rocky9/amd64",
+		Serial:    "20200102.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BaseImage != disk {
+		t.Errorf("got base image %q, expected %q", result.BaseImage, disk)
+	}
+
+	image := fake.Image("juju/rocky9/amd64")
+	if image == nil {
+		t.Fatal("image not published")
+	}
+	if image.Type != "virtual-machine" {
+		t.Errorf("got image type %q, expected virtual-machine", image.Type)
+	}
+	if image.Fingerprint != result.Fingerprint {
+		t.Errorf("got fingerprint %s, expected %s", image.Fingerprint, result.Fingerprint)
+	}
+	for k, v := range map[string]string{
+		"architecture":      "x86_64",
+		"user.build.serial": "20200102.1",
+	} {
+		if image.Properties[k] != v {
+			t.Errorf("property %s: got %q, expected %q", k, image.Properties[k], v)
+		}
+	}
+	metadata, err := lxdfake.Metadata(image.Tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := metadata["templates"].(map[interface{}]interface{})
+	if _, ok := templates["/var/lib/cloud/seed/nocloud-net/user-data"]; !ok {
+		t.Errorf("no cloud-init templates in metadata")
+	}
+	files, err := lxdfake.ReadQCOW2(image.Rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["etc/rocky-release"]; !ok {
+		t.Errorf("cloud image's files not on the image's disk")
+	}
+
+	// The VM is created from the imported cloud image, with the
+	// agent's drives and the vendor-data that installs it, and
+	// cloud-init is reset before publishing.
+	var created, cleaned bool
+	for _, c := range fake.Commands() {
+		cmd := strings.Join(c, " ")
+		switch {
+		case strings.HasPrefix(cmd, "lxc init "):
+			created = true
+			if !strings.Contains(cmd, " --vm") {
+				t.Errorf("VM created without --vm: %s", cmd)
+			}
+			if !strings.Contains(cmd, "--config=user.vendor-data=#cloud-config") {
+				t.Errorf("VM created without vendor-data: %s", cmd)
+			}
+		case strings.HasPrefix(cmd, "lxc launch "):
+			t.Errorf("VM launched before the agent's drives were added: %s", cmd)
+		case strings.Contains(cmd, "cloud-init clean"):
+			cleaned = true
+		}
+	}
+	if !created {
+		t.Errorf("VM not created with lxc init")
+	}
+	if !cleaned {
+		t.Errorf("cloud-init not reset")
+	}
+
+	// The build VM, the intermediate image and
+	// the imported cloud image are removed.
+	if containers := fake.Containers(); len(containers) != 0 {
+		t.Errorf("containers left behind: %v", containers[0].Name)
+	}
+	if images := fake.Images(""); len(images) != 1 {
+		t.Errorf("got %d local images, expected 1", len(images))
+	}
+}
+
+func TestBuildVMFromVMBase(t *testing.T) {
+	dir, disk := writeCloudImage(t)
+	defer os.RemoveAll(dir)
+	fake := lxdfake.New()
+	if _, err := build(t, imagebuilder.Options{
+		Runner:    fake,
+		VM:        true,
+		BaseQCOW2: disk,
+		Alias:     "juju/rocky9/amd64",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent installed in the first build is kept, so a VM
+	// launched from its image can be built on without the
+	// agent's drives.
+	result, err := build(t, imagebuilder.Options{
+		Runner: fake,
+		VM:     true,
+		Base:   "juju/rocky9/amd64",
+		Alias:  "juju/rocky9-layered/amd64",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := fake.Image("juju/rocky9-layered/amd64")
+	if image == nil || image.Fingerprint != result.Fingerprint {
+		t.Fatal("layered image not published")
+	}
+	if image.Type != "virtual-machine" {
+		t.Errorf("got image type %q, expected virtual-machine", image.Type)
+	}
+
+	// VM images cannot be launched as containers.
+	_, err = build(t, imagebuilder.Options{
+		Runner: fake,
+		Base:   "juju/rocky9/amd64",
+		Alias:  "juju/rocky9-container/amd64",
+	})
+	if err == nil || !strings.Contains(err.Error(), "doesn't match instance type") {
+		t.Errorf("got error %v from a container build from a VM image", err)
+	}
+}
+
+func TestVMOptions(t *testing.T) {
+	dir, disk := writeCloudImage(t)
+	defer os.RemoveAll(dir)
+	notQCOW2 := filepath.Join(dir, "centos.tar.gz")
+	if err := ioutil.WriteFile(notQCOW2, lxdfake.BaseImage(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		about  string
+		opts   imagebuilder.Options
+		expect string
+	}{{
+		about:  "VM without a base",
+		opts:   imagebuilder.Options{VM: true},
+		expect: "VM builds require a qcow2 base image",
+	}, {
+		about:  "qcow2 base without VM",
+		opts:   imagebuilder.Options{BaseQCOW2: disk},
+		expect: "qcow2 base images require a VM build",
+	}, {
+		about:  "qcow2 base and base",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, Base: "juju/centos7/amd64", Alias: "juju/rocky9/amd64"},
+		expect: "cannot both be specified",
+	}, {
+		about:  "not a qcow2 disk",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: notQCOW2},
+		expect: "is not a qcow2 disk image",
+	}, {
+		about:  "vendor-data",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, ContainerConfig: map[string]string{"user.vendor-data": ""}},
+		expect: `"user.vendor-data" cannot be set`,
+	}, {
+		about:  "split format",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, ImageFormat: imagebuilder.ImageFormatSplit},
+		expect: "VM images cannot be written from an export",
+	}, {
+		about:  "image files",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, ImageFiles: []imagebuilder.ImageFile{{Source: disk, Destination: "/disk"}}},
+		expect: "image files and baked seeds cannot be added",
+	}, {
+		about:  "reproducible",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, Reproducible: true},
+		expect: "cannot be written reproducibly",
+	}, {
+		about:  "cache",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, Cache: true},
+		expect: "VM builds cannot be cached",
+	}, {
+		about:  "output directory",
+		opts:   imagebuilder.Options{VM: true, BaseQCOW2: disk, OutputDir: dir},
+		expect: "cannot be written to a simplestreams tree",
+	}} {
+		test.opts.Runner = lxdfake.New()
+		_, err := imagebuilder.New(test.opts)
+		if err == nil || !strings.Contains(err.Error(), test.expect) {
+			t.Errorf("%s: got error %v, expected %q", test.about, err, test.expect)
+		}
+	}
+}
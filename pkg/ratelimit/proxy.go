@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Proxy is an HTTP proxy, listening on the loopback interface, that
+// tunnels CONNECT requests (as made for HTTPS) through a Limiter.
+// Programs that honour $HTTPS_PROXY, such as the lxc client, can
+// then be limited by running them with the environment returned
+// by Env.
+type Proxy struct {
+	l      *Limiter
+	ln     net.Listener
+	server *http.Server
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ListenProxy starts a proxy that limits the connections it
+// tunnels with l. It must be closed when no longer needed.
+func ListenProxy(l *Limiter) (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{l: l, ln: ln, ctx: ctx, cancel: cancel}
+	p.server = &http.Server{Handler: http.HandlerFunc(p.serveHTTP)}
+	go p.server.Serve(ln)
+	return p, nil
+}
+
+// URL returns the proxy's URL.
+func (p *Proxy) URL() string {
+	return "http://" + p.ln.Addr().String()
+}
+
+// Env returns the environment variables (key=value) that direct
+// HTTPS connections through the proxy, including to hosts that
+// $NO_PROXY would otherwise exempt.
+func (p *Proxy) Env() []string {
+	return []string{
+		"HTTPS_PROXY=" + p.URL(),
+		"https_proxy=" + p.URL(),
+		"NO_PROXY=",
+		"no_proxy=",
+	}
+}
+
+// Close stops the proxy, closing any tunnelled connections.
+func (p *Proxy) Close() error {
+	p.cancel()
+	return p.server.Close()
+}
+
+func (p *Proxy) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot tunnel", http.StatusInternalServerError)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", req.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// Either direction finishing ends the tunnel.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, p.l.Reader(p.ctx, buf))
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, p.l.Reader(p.ctx, upstream))
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-p.ctx.Done():
+	}
+}
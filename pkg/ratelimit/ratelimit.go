@@ -0,0 +1,98 @@
+// Package ratelimit limits the bandwidth of transfers: those made
+// in-process, by reading through a Limiter, and those made by
+// other programs, by tunnelling their HTTPS connections through
+// a Proxy.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize is the largest number of bytes passed through
+// a Limiter at once, so that transfers are smooth rather
+// than bursty.
+const chunkSize = 32 << 10
+
+// Limiter limits the rate at which bytes pass through it, across
+// all the readers and connections that share it.
+type Limiter struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewLimiter returns a Limiter that passes rate bytes per second.
+// If rate is not positive, it returns nil, which passes bytes
+// without limit.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: rate}
+}
+
+// Rate returns the limit in bytes per second,
+// or zero if l is nil.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate
+}
+
+// WaitN waits until n more bytes may pass, returning early with
+// the context's error if the context is done first.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Reader returns a reader that reads from r no faster than the
+// limit. If l is nil, r is returned.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := r.r.Read(p)
+	if waitErr := r.l.WaitN(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,235 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const (
+	// DefaultPartSize is the default size of the parts
+	// that large files are uploaded in.
+	DefaultPartSize = 64 << 20
+
+	// minPartSize is the smallest part size S3 allows,
+	// other than for the last part.
+	minPartSize = 5 << 20
+
+	// maxParts is the largest number of parts S3 allows.
+	maxParts = 10000
+)
+
+func (c *Client) partSize() int64 {
+	if c.PartSize > 0 {
+		return c.PartSize
+	}
+	return DefaultPartSize
+}
+
+// putMultipart uploads the file with a multipart upload. If there
+// is already an incomplete multipart upload of the key, it is
+// resumed: parts that have already been uploaded with the same
+// content are not uploaded again. If the upload fails, it is left
+// incomplete so that a later call may resume it, so buckets should
+// have a lifecycle rule to abort incomplete multipart uploads.
+func (c *Client) putMultipart(ctx context.Context, bucket, key string, f *os.File, size int64, contentType string) error {
+	partSize := c.partSize()
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	for (size+partSize-1)/partSize > maxParts {
+		partSize *= 2
+	}
+
+	uploadID, uploaded, err := c.findUpload(ctx, bucket, key)
+	if err != nil {
+		return fmt.Errorf("resuming upload of s3://%s/%s: %w", bucket, key, err)
+	}
+	if uploadID == "" {
+		if uploadID, err = c.createUpload(ctx, bucket, key, contentType); err != nil {
+			return fmt.Errorf("uploading s3://%s/%s: %w", bucket, key, err)
+		}
+	}
+
+	var complete completeMultipartUpload
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		section := io.NewSectionReader(f, offset, n)
+		md5sum, sha256sum, err := partHashes(section)
+		if err != nil {
+			return err
+		}
+		etag := `"` + md5sum + `"`
+		if p, ok := uploaded[number]; !ok || p.ETag != etag || p.Size != n {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(number)},
+				"uploadId":   {uploadID},
+			}
+			resp, err := c.do(ctx, "PUT", bucket, key, query, nil, section, sha256sum)
+			if err != nil {
+				return fmt.Errorf("uploading part %d of s3://%s/%s: %w", number, bucket, key, err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("ETag"); got != "" {
+				etag = got
+			}
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: number, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	resp, err := c.do(
+		ctx, "POST", bucket, key, url.Values{"uploadId": {uploadID}},
+		nil, bytes.NewReader(body), hex.EncodeToString(hash[:]),
+	)
+	if err != nil {
+		return fmt.Errorf("completing upload of s3://%s/%s: %w", bucket, key, err)
+	}
+	defer resp.Body.Close()
+	// S3 may report a failure to complete the upload
+	// after responding with a successful status.
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("completing upload of s3://%s/%s: %v", bucket, key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("completing upload of s3://%s/%s: %s: %s", bucket, key, result.Code, result.Message)
+	}
+	return nil
+}
+
+// partHashes returns the hex-encoded MD5 and SHA-256 hashes of the
+// contents of r, and rewinds it.
+func partHashes(r io.ReadSeeker) (md5sum, sha256sum string, err error) {
+	md5hash := md5.New()
+	sha256hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5hash, sha256hash), r); err != nil {
+		return "", "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5hash.Sum(nil)), hex.EncodeToString(sha256hash.Sum(nil)), nil
+}
+
+// createUpload starts a multipart upload of the key,
+// returning its upload ID.
+func (c *Client) createUpload(ctx context.Context, bucket, key, contentType string) (string, error) {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(ctx, "POST", bucket, key, url.Values{"uploads": {""}}, header, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// findUpload returns the ID of the most recently started incomplete
+// multipart upload of the key, along with the parts already uploaded,
+// keyed by part number. If there is no such upload, the returned ID
+// is empty.
+func (c *Client) findUpload(ctx context.Context, bucket, key string) (string, map[int]uploadedPart, error) {
+	var uploads struct {
+		Uploads []struct {
+			Key       string
+			UploadID  string `xml:"UploadId"`
+			Initiated string
+		} `xml:"Upload"`
+	}
+	query := url.Values{"uploads": {""}, "prefix": {key}}
+	if err := c.doXML(ctx, "GET", bucket, "", query, nil, &uploads); err != nil {
+		return "", nil, err
+	}
+	var uploadID, initiated string
+	for _, u := range uploads.Uploads {
+		// Initiated times are in ISO 8601 format,
+		// so compare in lexical order.
+		if u.Key == key && u.Initiated >= initiated {
+			uploadID, initiated = u.UploadID, u.Initiated
+		}
+	}
+	if uploadID == "" {
+		return "", nil, nil
+	}
+
+	parts := make(map[int]uploadedPart)
+	query = url.Values{"uploadId": {uploadID}}
+	for {
+		var result struct {
+			Parts                []uploadedPart `xml:"Part"`
+			IsTruncated          bool
+			NextPartNumberMarker string
+		}
+		if err := c.doXML(ctx, "GET", bucket, key, query, nil, &result); err != nil {
+			return "", nil, err
+		}
+		for _, p := range result.Parts {
+			parts[p.PartNumber] = p
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			break
+		}
+		query.Set("part-number-marker", result.NextPartNumberMarker)
+	}
+	return uploadID, parts, nil
+}
+
+// doXML sends a request with an empty body, decoding
+// the XML response into v.
+func (c *Client) doXML(
+	ctx context.Context,
+	method, bucket, key string,
+	query url.Values,
+	header http.Header,
+	v interface{},
+) error {
+	resp, err := c.do(ctx, method, bucket, key, query, header, nil, emptySHA256)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response: %v", err)
+	}
+	return nil
+}
+
+type uploadedPart struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
@@ -0,0 +1,427 @@
+// Package s3 is a minimal client for uploading objects to Amazon S3
+// and S3-compatible object stores (such as MinIO), signing requests
+// with AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/ratelimit"
+)
+
+// Client uploads, downloads and deletes objects in an
+// S3-compatible object store.
+type Client struct {
+	// Endpoint, if non-empty, is the URL of an S3-compatible
+	// service (e.g. "https://minio.example.com:9000"), which is
+	// addressed with path-style requests. If empty, AWS S3 in
+	// Region is used, with virtual-hosted-style requests.
+	Endpoint string
+
+	// Region is the region to sign requests for.
+	Region string
+
+	// AccessKeyID, SecretAccessKey and SessionToken are
+	// the credentials to sign requests with. SessionToken
+	// is only required for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// HTTPClient is the client to make requests with.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// PartSize is the size of the parts that large files are
+	// uploaded in. If zero, DefaultPartSize is used.
+	PartSize int64
+
+	// Limiter, if non-nil, limits the rate at which
+	// request bodies are sent.
+	Limiter *ratelimit.Limiter
+}
+
+// FromEnv returns a Client configured from the standard AWS
+// environment variables: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION (or AWS_DEFAULT_REGION), and
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) for S3-compatible
+// services.
+func FromEnv() (*Client, error) {
+	c := &Client{
+		Endpoint:        firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		Region:          firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ParseURL parses a URL of the form "s3://bucket[/prefix]",
+// returning the bucket and key prefix.
+func ParseURL(s string) (bucket, prefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket[/prefix]", s)
+	}
+	return u.Host, strings.Trim(u.Path, "/"), nil
+}
+
+// PutFile uploads the named file to the bucket with the given key.
+// Files larger than the client's part size are uploaded in parts,
+// resuming any incomplete upload of the same key left by an earlier
+// call; see putMultipart.
+func (c *Client) PutFile(ctx context.Context, bucket, key, path, contentType string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > c.partSize() {
+		return c.putMultipart(ctx, bucket, key, f, info.Size(), contentType)
+	}
+	payloadHash, err := readerSHA256(f)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do(ctx, "PUT", bucket, key, nil, header, f, payloadHash)
+	if err != nil {
+		return fmt.Errorf("uploading s3://%s/%s: %w", bucket, key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ErrNotFound is returned by GetFile if the object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// GetFile downloads the object with the given key in the bucket to
+// the named file. If the object does not exist, ErrNotFound is
+// returned.
+func (c *Client) GetFile(ctx context.Context, bucket, key, path string) error {
+	resp, err := c.do(ctx, "GET", bucket, key, nil, nil, nil, emptySHA256)
+	if err, ok := err.(*statusError); ok && err.code == http.StatusNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("downloading s3://%s/%s: %w", bucket, key, err)
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Delete deletes the object with the given key in the bucket.
+// Deleting an object that does not exist is not an error.
+func (c *Client) Delete(ctx context.Context, bucket, key string) error {
+	resp, err := c.do(ctx, "DELETE", bucket, key, nil, nil, nil, emptySHA256)
+	if err, ok := err.(*statusError); ok && err.code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("deleting s3://%s/%s: %w", bucket, key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// emptySHA256 is the hex-encoded SHA-256 hash of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// maxAttempts is the number of times a request is attempted
+// before giving up, if it fails with a network error or a
+// server error.
+const maxAttempts = 5
+
+// retryDelay is the delay before the first retry of a request,
+// doubling with each subsequent retry.
+var retryDelay = time.Second
+
+// statusError is returned by do if the server
+// responds with an unsuccessful status.
+type statusError struct {
+	code   int
+	status string
+	msg    []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.msg)
+}
+
+// temporary reports whether the request may succeed if retried.
+func (e *statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusTooManyRequests
+}
+
+// do signs and sends a request for the object with the given key,
+// retrying on network errors and server errors. If body is non-nil,
+// it is rewound before each attempt. If the server responds with an
+// unsuccessful status, a *statusError is returned; otherwise the
+// caller must close the response body.
+func (c *Client) do(
+	ctx context.Context,
+	method, bucket, key string,
+	query url.Values,
+	header http.Header,
+	body io.ReadSeeker,
+	payloadHash string,
+) (*http.Response, error) {
+	u, err := c.objectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = canonicalQuery(query)
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := c.try(ctx, method, u, header, body, payloadHash)
+		if err == nil {
+			return resp, nil
+		}
+		if err, ok := err.(*statusError); ok && !err.temporary() {
+			return nil, err
+		}
+		if attempt == maxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) try(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	header http.Header,
+	body io.ReadSeeker,
+	payloadHash string,
+) (*http.Response, error) {
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = body.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Body = ioutil.NopCloser(c.Limiter.Reader(ctx, body))
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, payloadHash, time.Now())
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{resp.StatusCode, resp.Status, bytes.TrimSpace(msg)}
+	}
+	return resp, nil
+}
+
+// readerSHA256 returns the hex-encoded SHA-256 hash of
+// the contents of r, and rewinds it.
+func readerSHA256(r io.ReadSeeker) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) objectURL(bucket, key string) (*url.URL, error) {
+	if c.Endpoint == "" {
+		return &url.URL{
+			Scheme:  "https",
+			Host:    fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, c.Region),
+			Path:    "/" + key,
+			RawPath: "/" + uriEncode(key),
+		}, nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing S3 endpoint: %v", err)
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + "/" + bucket + "/" + key
+	u.RawPath = uriEncode(base+"/"+bucket) + "/" + uriEncode(key)
+	return u, nil
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query parameters as required
+// by Signature Version 4, sorted by name.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, queryEncode(name)+"="+queryEncode(value))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes the path as required by Signature Version 4,
+// escaping everything other than unreserved characters and "/".
+func uriEncode(path string) string {
+	return encode(path, true)
+}
+
+// queryEncode encodes a query parameter name or value as required
+// by Signature Version 4, escaping everything other than unreserved
+// characters.
+func queryEncode(s string) string {
+	return encode(s, false)
+}
+
+func encode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
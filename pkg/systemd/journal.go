@@ -0,0 +1,159 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// JournalSocket is the socket of the journal's native protocol.
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Journal fields recorded on the entries written by Journal, in
+// addition to the standard MESSAGE, PRIORITY and SYSLOG_IDENTIFIER.
+const (
+	FieldAlias       = "IMAGE_ALIAS"
+	FieldBuildID     = "IMAGE_BUILD_ID"
+	FieldPhase       = "IMAGE_PHASE"
+	FieldFingerprint = "IMAGE_FINGERPRINT"
+	FieldEvent       = "IMAGE_EVENT"
+	FieldArtifact    = "IMAGE_ARTIFACT"
+	FieldResult      = "IMAGE_RESULT"
+)
+
+// Syslog priorities of journal entries.
+const (
+	priorityErr  = "3"
+	priorityInfo = "6"
+)
+
+// Journal writes the progress of a single build to the journal: an
+// entry when each phase starts and finishes, for each artifact, and
+// for the outcome of the build. Messages logged by the build are not
+// written, as they reach the journal through the process's output.
+type Journal struct {
+	conn   *net.UnixConn
+	fields map[string]string
+
+	mu          sync.Mutex
+	phase       string
+	fingerprint string
+}
+
+// NewJournal returns a Journal that records the fields (e.g.
+// FieldAlias) on each entry, if the process's output is connected to
+// the journal, as it is for services run by systemd. Otherwise it
+// returns nil.
+func NewJournal(fields map[string]string) (*Journal, error) {
+	if os.Getenv(EnvJournalStream) == "" {
+		return nil, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the journal: %v", err)
+	}
+	return &Journal{conn: conn, fields: fields}, nil
+}
+
+// OnEvent records the build event. It is suitable for
+// use as imagebuilder.Options.OnEvent.
+func (j *Journal) OnEvent(e imagebuilder.Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fields := map[string]string{FieldEvent: string(e.Type)}
+	switch e.Type {
+	case imagebuilder.EventPhaseStarted:
+		j.phase = e.Phase
+		fields["MESSAGE"] = fmt.Sprintf("Phase %s started", e.Phase)
+	case imagebuilder.EventPhaseFinished:
+		fields["MESSAGE"] = fmt.Sprintf("Phase %s finished in %s", e.Phase, e.Duration.Round(time.Millisecond))
+		if e.Error != "" {
+			fields["MESSAGE"] = fmt.Sprintf("Phase %s failed after %s: %s", e.Phase, e.Duration.Round(time.Millisecond), e.Error)
+			fields["PRIORITY"] = priorityErr
+		}
+		fields[FieldPhase] = e.Phase
+		j.phase = ""
+	case imagebuilder.EventArtifact:
+		if strings.HasPrefix(e.Artifact, "image:") {
+			j.fingerprint = strings.TrimPrefix(e.Artifact, "image:")
+		}
+		fields[FieldArtifact] = e.Artifact
+		fields["MESSAGE"] = "Produced " + e.Artifact
+	default:
+		return
+	}
+	j.write(fields)
+}
+
+// Finish records the outcome of the build, which failed
+// if buildErr is non-nil, and closes the connection to
+// the journal.
+func (j *Journal) Finish(buildErr error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	alias := j.fields[FieldAlias]
+	fields := map[string]string{
+		FieldResult: "succeeded",
+		"MESSAGE":   fmt.Sprintf("Build of %s succeeded", alias),
+	}
+	if buildErr != nil {
+		fields[FieldResult] = "failed"
+		fields["MESSAGE"] = fmt.Sprintf("Build of %s failed: %v", alias, buildErr)
+		fields["PRIORITY"] = priorityErr
+	}
+	j.write(fields)
+	return j.conn.Close()
+}
+
+// write writes an entry with the fields, along with the Journal's
+// own fields and those of the build's progress. Entries that cannot
+// be written are dropped, as the journal may be rate limiting.
+func (j *Journal) write(fields map[string]string) {
+	entry := map[string]string{
+		"SYSLOG_IDENTIFIER": imagebuilder.BuilderName,
+		"PRIORITY":          priorityInfo,
+	}
+	for k, v := range j.fields {
+		entry[k] = v
+	}
+	if j.phase != "" {
+		entry[FieldPhase] = j.phase
+	}
+	if j.fingerprint != "" {
+		entry[FieldFingerprint] = j.fingerprint
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	j.conn.Write(encodeEntry(entry))
+}
+
+// encodeEntry encodes the fields of a journal entry in the journal's
+// native protocol. Values with newlines are length-prefixed.
+func encodeEntry(fields map[string]string) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		v := fields[k]
+		if !strings.ContainsRune(v, '\n') {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+			continue
+		}
+		buf.WriteString(k + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(v)))
+		buf.WriteString(v + "\n")
+	}
+	return buf.Bytes()
+}
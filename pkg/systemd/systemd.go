@@ -0,0 +1,130 @@
+// Package systemd integrates builds with systemd, for when the builder
+// or build server runs as a service. It reports readiness, status and
+// watchdog keep-alives to the service manager with the sd_notify
+// protocol, and writes build events to the journal with structured
+// fields, so that builds can be queried with journalctl, e.g.
+//
+//	journalctl IMAGE_ALIAS=juju/centos7/amd64 IMAGE_PHASE=provision
+//
+// Both are no-ops unless the process is run by systemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// Environment variables set by systemd for the services it runs.
+const (
+	EnvNotifySocket  = "NOTIFY_SOCKET"
+	EnvWatchdogUSec  = "WATCHDOG_USEC"
+	EnvWatchdogPID   = "WATCHDOG_PID"
+	EnvJournalStream = "JOURNAL_STREAM"
+)
+
+// States sent to the service manager with Notify.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state that sets the service's status text,
+// as shown by "systemctl status".
+func Status(text string) string {
+	return "STATUS=" + strings.Replace(text, "\n", " ", -1)
+}
+
+// Notify sends the states (e.g. Ready) to the service manager, if
+// the process was started by one that expects notifications. It
+// returns false, and does nothing, if not.
+func Notify(states ...string) (bool, error) {
+	name := os.Getenv(EnvNotifySocket)
+	if name == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		// An abstract socket.
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval at which the process must
+// send Watchdog keep-alives to the service manager, which is half of
+// the service's WatchdogSec=, or zero if the watchdog is not enabled
+// for the process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(EnvWatchdogUSec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(EnvWatchdogPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// RunWatchdog sends Watchdog keep-alives to the service manager at
+// WatchdogInterval until ctx is done, if the watchdog is enabled.
+// It is suitable for long-running processes, such as the build
+// server, whose liveness does not depend on the progress of a build.
+func RunWatchdog(ctx context.Context) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Notify(Watchdog)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Progress returns an event callback, suitable for use as
+// imagebuilder.Options.OnEvent, that reports the build's phase in the
+// service's status. If the watchdog is enabled, it also sends a
+// keep-alive with each event, so that the service manager kills a
+// build that makes no progress for longer than WatchdogSec=; set it
+// longer than the quietest provisioning step.
+func Progress(alias string) func(imagebuilder.Event) {
+	var mu sync.Mutex
+	var lastKeepAlive time.Time
+	watchdog := WatchdogInterval() > 0
+	return func(e imagebuilder.Event) {
+		var states []string
+		if e.Type == imagebuilder.EventPhaseStarted {
+			states = append(states, Status(fmt.Sprintf("Building %s: %s", alias, e.Phase)))
+		}
+		mu.Lock()
+		if watchdog && time.Since(lastKeepAlive) >= time.Second {
+			lastKeepAlive = time.Now()
+			states = append(states, Watchdog)
+		}
+		mu.Unlock()
+		if len(states) > 0 {
+			Notify(states...)
+		}
+	}
+}
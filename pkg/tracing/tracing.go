@@ -0,0 +1,303 @@
+// Package tracing converts build events into OpenTelemetry spans,
+// and exports them to an OTLP/HTTP collector.
+//
+// Each build is a trace, with a root span for the build as a whole,
+// a child span for each build phase, and a child span of the phase
+// for each external command run during it.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// ServiceName is the service.name resource attribute
+// of exported spans.
+const ServiceName = "juju-lxd-centos-image-builder"
+
+// EnvEndpoint and EnvHeaders are the standard OpenTelemetry
+// environment variables for configuring the OTLP exporter.
+const (
+	EnvEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvHeaders  = "OTEL_EXPORTER_OTLP_HEADERS"
+)
+
+// Tracer records the spans of a single build. Events should be
+// passed to its OnEvent method, and the spans exported with Export
+// once the build completes.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+
+	mu       sync.Mutex
+	traceID  string
+	root     *span
+	phase    *span
+	commands []*span
+	spans    []*span
+}
+
+type span struct {
+	id         string
+	parent     string
+	name       string
+	start, end time.Time
+	attributes map[string]string
+	err        string
+}
+
+// New returns a new Tracer that exports to the OTLP/HTTP collector
+// at the given endpoint (e.g. "http://localhost:4318"). Spans are
+// posted to the endpoint's /v1/traces path. Headers to send with
+// the export request are taken from $OTEL_EXPORTER_OTLP_HEADERS.
+//
+// The attributes are recorded on the build's root span.
+func New(endpoint string, attributes map[string]string) *Tracer {
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		headers:  parseHeaders(os.Getenv(EnvHeaders)),
+		traceID:  randomID(16),
+	}
+	t.root = t.newSpan("build", "", time.Now())
+	for k, v := range attributes {
+		t.root.attributes[k] = v
+	}
+	return t
+}
+
+// TraceID returns the ID of the build's trace.
+func (t *Tracer) TraceID() string {
+	return t.traceID
+}
+
+// OnEvent records the build event. It is suitable for
+// use as imagebuilder.Options.OnEvent.
+func (t *Tracer) OnEvent(e imagebuilder.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e.Type {
+	case imagebuilder.EventPhaseStarted:
+		t.phase = t.newSpan(e.Phase, t.root.id, e.Time)
+		t.phase.attributes["build.phase"] = e.Phase
+	case imagebuilder.EventPhaseFinished:
+		if t.phase != nil {
+			t.phase.end = e.Time
+			t.phase.err = e.Error
+			t.phase = nil
+		}
+	case imagebuilder.EventCommandStarted:
+		parent := t.root.id
+		if t.phase != nil {
+			parent = t.phase.id
+		}
+		s := t.newSpan(e.Command, parent, e.Time)
+		s.attributes["process.executable.name"] = e.Command
+		s.attributes["process.command_line"] = strings.Join(append([]string{e.Command}, e.Args...), " ")
+		t.commands = append(t.commands, s)
+	case imagebuilder.EventCommandFinished:
+		// Commands are not nested, so the most recently
+		// started command with the same name is the one
+		// that has finished.
+		for i := len(t.commands) - 1; i >= 0; i-- {
+			s := t.commands[i]
+			if s.name != e.Command {
+				continue
+			}
+			s.end = e.Time
+			s.err = e.Error
+			t.commands = append(t.commands[:i], t.commands[i+1:]...)
+			break
+		}
+	case imagebuilder.EventArtifact:
+		t.root.attributes["build.artifact"] = e.Artifact
+	}
+}
+
+func (t *Tracer) newSpan(name, parent string, start time.Time) *span {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	s := &span{
+		id:         randomID(8),
+		parent:     parent,
+		name:       name,
+		start:      start,
+		attributes: make(map[string]string),
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// Export ends the build's root span, recording buildErr as the
+// build's error if non-nil, and exports all recorded spans.
+func (t *Tracer) Export(ctx context.Context, buildErr error) error {
+	t.mu.Lock()
+	now := time.Now()
+	if buildErr != nil {
+		t.root.err = buildErr.Error()
+	}
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			// Spans may be left open if the build
+			// failed or was cancelled.
+			s.end = now
+		}
+	}
+	body, err := json.Marshal(t.request())
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("POST", t.endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting spans: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("exporting spans: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The following types are the OTLP/HTTP JSON encoding of
+// an ExportTraceServiceRequest.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanJSON struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+func (t *Tracer) request() exportRequest {
+	spans := make([]spanJSON, len(t.spans))
+	for i, s := range t.spans {
+		spans[i] = spanJSON{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes(s.attributes),
+			Status:            status{Code: statusCodeOK},
+		}
+		if s.err != "" {
+			spans[i].Status = status{Code: statusCodeError, Message: s.err}
+		}
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: attributes(map[string]string{
+			"service.name": ServiceName,
+		})},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "github.com/axw/juju-lxd-centos-image-builder/pkg/tracing"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func attributes(m map[string]string) []keyValue {
+	kvs := make([]keyValue, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, keyValue{k, anyValue{v}})
+	}
+	return kvs
+}
+
+// parseHeaders parses headers in the OTEL_EXPORTER_OTLP_HEADERS
+// format: comma-separated key=value pairs.
+func parseHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			continue
+		}
+		headers[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return headers
+}
+
+func randomID(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
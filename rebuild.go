@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+)
+
+// rebuildImage implements the "rebuild" subcommand, which repeats the
+// build described by a manifest, for reproducing and bisecting image
+// regressions.
+func rebuildImage(args []string) error {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	manifestFile := fs.String("manifest", "", "Manifest of the build to repeat")
+	historyFile := fs.String("history-file", imagebuilder.DefaultHistoryFile(), "File to find the build's options in if the manifest does not record them, and to record the rebuild in")
+	alias := fs.String("alias", "", "Alias to publish the rebuilt image under (default: that of the original build)")
+	remote := fs.String("remote", "", "lxc remote on which to rebuild the image (default: that of the original build)")
+	output := fs.String("output", "", "Directory in which to write the image and simplestreams metadata")
+	newManifest := fs.String("manifest-out", "", "File to write the rebuild's manifest to")
+	force := fs.Bool("force", false, "Rebuild even if the build's inputs have changed or it was built by another version")
+	var buildArgs stringsFlag
+	fs.Var(&buildArgs, "build-arg", "Build argument (KEY=VALUE) given to the original build, whose values are not recorded; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s rebuild -manifest file [-build-arg KEY=VALUE]... [-force]\n", imagebuilder.BuilderName)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *manifestFile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(*manifestFile)
+	if err != nil {
+		return err
+	}
+	var manifest imagebuilder.Result
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("reading manifest %s: %v", *manifestFile, err)
+	}
+	opts, err := imagebuilder.OptionsForRebuild(imagebuilder.RebuildOptions{
+		Manifest:    &manifest,
+		HistoryFile: *historyFile,
+		BuildArgs:   buildArgs,
+		Force:       *force,
+	})
+	if err != nil {
+		return err
+	}
+	if *alias != "" {
+		opts.Alias = *alias
+	}
+	if *remote != "" {
+		opts.Remote = strings.TrimSuffix(*remote, ":")
+	}
+	opts.OutputDir = *output
+	opts.HistoryFile = *historyFile
+	opts.DiagnosticsDir = os.TempDir()
+	finish := superviseBuild(&opts)
+
+	b, err := imagebuilder.New(opts)
+	if err != nil {
+		finish(err)
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	result, err := b.Build(ctx)
+	finish(err)
+	if err != nil {
+		return err
+	}
+	if *newManifest != "" {
+		if err := writeManifest(*newManifest, result); err != nil {
+			return err
+		}
+	}
+	log.Printf("Rebuilt %s (serial %s, fingerprint %.12s; originally %.12s)",
+		result.Alias, result.Serial, result.Fingerprint, manifest.Fingerprint)
+	return nil
+}
+
+// writeManifest writes the build result to the named file,
+// in the format of GET /builds/{id}/manifest.
+func writeManifest(path string, result *imagebuilder.Result) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
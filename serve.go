@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/buildserver"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/systemd"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/tracing"
+)
+
+// serve implements the "serve" subcommand, which runs the build
+// server until interrupted.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8080", "Address to listen on")
+	concurrency := fs.Int("concurrency", 1, "Maximum number of concurrent builds per LXD remote")
+	otlpEndpoint := fs.String("otlp-endpoint", os.Getenv(tracing.EnvEndpoint), "OTLP/HTTP collector to export build traces to (e.g. http://localhost:4318)")
+	pending := fs.Int("max-pending", buildserver.DefaultPending, "Maximum number of builds to queue or run at once; further builds are refused")
+	finished := fs.Int("keep-finished", buildserver.DefaultFinished, "Maximum number of finished builds to remember")
+	expiry := fs.Duration("keep-for", buildserver.DefaultExpiry, "How long to remember finished builds for")
+	tokenFile := fs.String("token-file", "", "File holding the bearer token that clients must present (required)")
+	specDir := fs.String("spec-dir", "", "Directory that relative host paths in build specs are interpreted relative to (required with -allow-host-field)")
+	var remoteConcurrency, allowHostFields stringsFlag
+	fs.Var(&remoteConcurrency, "remote-concurrency", "Maximum number of concurrent builds (remote=N) for a specific LXD remote; may be repeated")
+	fs.Var(&allowHostFields, "allow-host-field", "Spec field giving access to the host (e.g. output, or provisioner:file) to allow specs to set; may be repeated")
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if *tokenFile == "" {
+		return fmt.Errorf("-token-file must be specified")
+	}
+	data, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("%s: empty token", *tokenFile)
+	}
+	if len(allowHostFields) > 0 && *specDir == "" {
+		return fmt.Errorf("-allow-host-field requires -spec-dir")
+	}
+
+	limits := buildserver.Limits{
+		Concurrency: *concurrency,
+		Remotes:     make(map[string]int),
+		Pending:     *pending,
+		Finished:    *finished,
+		Expiry:      *expiry,
+	}
+	for _, kv := range remoteConcurrency {
+		i := strings.IndexRune(kv, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid -remote-concurrency %q, expected remote=N", kv)
+		}
+		n, err := strconv.Atoi(kv[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid -remote-concurrency %q: %v", kv, err)
+		}
+		limits.Remotes[kv[:i]] = n
+	}
+
+	// Builds run in the context of the signal handler, so
+	// that they are cancelled (and cleaned up) on shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	builds := buildserver.New(ctx, limits)
+	builds.OTLPEndpoint = *otlpEndpoint
+	builds.Journal = true
+	builds.Token = token
+	builds.AllowHostFields = allowHostFields
+	builds.SpecDir = *specDir
+	srv := &http.Server{
+		Addr:    *listen,
+		Handler: builds,
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		log.Println("Listening on", *listen)
+		errc <- srv.Serve(l)
+	}()
+	// Tell systemd, if it runs the server as a Type=notify
+	// service, that it is ready to accept builds.
+	if _, err := systemd.Notify(systemd.Ready, systemd.Status("Listening on "+*listen)); err != nil {
+		log.Println("Notifying systemd:", err)
+	}
+	go systemd.RunWatchdog(ctx)
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	systemd.Notify(systemd.Stopping, systemd.Status("Waiting for builds to finish"))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	builds.Wait()
+	return err
+}
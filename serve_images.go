@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// serveImages implements the "serve-images" subcommand, which serves
+// a simplestreams tree written with -output over HTTP(S), for use as
+// an lxc remote.
+func serveImages(args []string) error {
+	fs := flag.NewFlagSet("serve-images", flag.ExitOnError)
+	dir := fs.String("dir", "", "Simplestreams directory to serve, as written with -output (required)")
+	listen := fs.String("listen", ":8443", "Address to listen on")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file; if specified with -tls-key, images are served over HTTPS")
+	tlsKey := fs.String("tls-key", "", "TLS private key file")
+	authFile := fs.String("basic-auth-file", "", "File containing user:password to require with HTTP basic authentication")
+	fs.Parse(args)
+	if err := setFlagsFromEnv(fs); err != nil {
+		return err
+	}
+	if *dir == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be specified together")
+	}
+	if _, err := os.Stat(*dir); err != nil {
+		return err
+	}
+
+	handler := streamsHandler(http.FileServer(http.Dir(*dir)))
+	if *authFile != "" {
+		data, err := ioutil.ReadFile(*authFile)
+		if err != nil {
+			return err
+		}
+		credentials := strings.TrimSpace(string(data))
+		i := strings.IndexRune(credentials, ':')
+		if i == -1 {
+			return fmt.Errorf("%s: expected user:password", *authFile)
+		}
+		handler = basicAuth(handler, credentials[:i], credentials[i+1:])
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{
+		Addr:    *listen,
+		Handler: handler,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" {
+			log.Printf("Serving %s on https://%s", *dir, *listen)
+			errc <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			log.Printf("Serving %s on http://%s", *dir, *listen)
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// streamsHandler wraps a file server for a simplestreams tree,
+// refusing directory listings and setting the content type of
+// the streams metadata.
+func streamsHandler(files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".json") {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// basicAuth wraps h, requiring HTTP basic authentication
+// with the given credentials.
+func basicAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="images"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/imagebuilder"
+	"github.com/axw/juju-lxd-centos-image-builder/pkg/systemd"
+)
+
+// superviseBuild reports the build's progress to systemd, if the
+// builder is run as a service (e.g. by a timer), by chaining callbacks
+// onto opts.OnEvent. The returned function must be called with the
+// build's error when the build finishes.
+func superviseBuild(opts *imagebuilder.Options) func(error) {
+	journal, err := systemd.NewJournal(map[string]string{systemd.FieldAlias: opts.Alias})
+	if err != nil {
+		log.Println("Writing to the journal:", err)
+	} else if journal != nil {
+		opts.OnEvent = chainEvents(opts.OnEvent, journal.OnEvent)
+	}
+	notified, err := systemd.Notify(systemd.Ready, systemd.Status("Building "+opts.Alias))
+	if err != nil {
+		log.Println("Notifying systemd:", err)
+	}
+	if notified {
+		opts.OnEvent = chainEvents(opts.OnEvent, systemd.Progress(opts.Alias))
+	}
+	return func(buildErr error) {
+		if journal != nil {
+			journal.Finish(buildErr)
+		}
+		if notified {
+			status := "Built " + opts.Alias
+			if buildErr != nil {
+				status = "Failed to build " + opts.Alias + ": " + buildErr.Error()
+			}
+			systemd.Notify(systemd.Status(status))
+		}
+	}
+}